@@ -36,9 +36,24 @@ func main() {
 	if err := db.AutoMigrate(
 		&models.User{},
 		&models.Friend{},
+		&models.Block{},
+		&models.TwoFactor{},
+		&models.RecoveryCode{},
+		&models.UserIdentity{},
+		&models.Bot{},
+		&models.APIToken{},
+		&models.Webhook{},
+		&models.WebhookDelivery{},
+		&models.IncomingWebhook{},
+		&models.FriendRemark{},
+		&models.FriendTag{},
 		&models.Group{},
 		&models.GroupMember{},
+		&models.GroupAnnouncement{},
+		&models.GroupTag{},
+		&models.GroupJoinRequest{},
 		&models.Message{},
+		&models.AuditLog{},
 	); err != nil {
 		log.Fatalf("Failed to auto migrate: %v", err)
 	}
@@ -49,7 +64,10 @@ func main() {
 		log.Fatalf("Failed to connect to Redis: %v", err)
 	}
 
-	s := server.NewServer(db, redisClient, appConfig)
+	s, err := server.NewServer(db, redisClient, appConfig)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
 	if err := s.Run(); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
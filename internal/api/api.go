@@ -2,12 +2,15 @@ package api
 
 import (
 	"fmt"
+	"time"
 
+	"simple_im/internal/auth"
 	"simple_im/internal/conf"
 	"simple_im/internal/middleware"
 	"simple_im/internal/storage"
 	"simple_im/internal/ws"
 	"simple_im/pkg/common/jwt"
+	"simple_im/pkg/common/oidc"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,17 +22,28 @@ type ApiServer struct {
 	app        *gin.Engine
 	rpcHandler *RpcHandler
 	jwtManager *jwt.JWTManager
+	oidcClient *oidc.Client // nil unless single sign-on is configured
+	authn      auth.Authenticator
+	webhooks   *botWebhooks
+	dispatcher *webhookDispatcher
 }
 
-func NewApiServer(storage *storage.Storage, hub *ws.Hub, config conf.Config) *ApiServer {
-	jwtManager := jwt.NewJWTManager(config.JWTConfiguration.Secret, config.JWTConfiguration.Expire)
+func NewApiServer(storage *storage.Storage, hub *ws.Hub, config conf.Config) (*ApiServer, error) {
+	jwtManager, err := jwt.NewJWTManagerFromConfig(config.JWTConfiguration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load jwt keys: %v", err)
+	}
 
 	return &ApiServer{
 		storage:    storage,
 		hub:        hub,
 		conf:       config,
 		jwtManager: jwtManager,
-	}
+		oidcClient: oidc.NewClient(config.OIDCConfiguration),
+		authn:      auth.New(storage.GetDB(), config.LDAPConfiguration),
+		webhooks:   newBotWebhooks(time.Duration(config.BotConfiguration.WebhookTimeout)*time.Second, config.WebhookConfiguration.AllowPrivateNetworks),
+		dispatcher: newWebhookDispatcher(storage.GetDB(), config.WebhookConfiguration),
+	}, nil
 }
 
 func (a *ApiServer) Run() error {
@@ -44,6 +58,18 @@ func (a *ApiServer) Run() error {
 	a.app.Use(gin.Logger())
 	a.app.Use(middleware.Cors())
 
+	if err := a.webhooks.load(a.storage.GetDB()); err != nil {
+		return fmt.Errorf("failed to load bot webhooks: %v", err)
+	}
+	a.webhooks.run()
+	a.hub.OnDeliver(a.webhooks.deliver)
+
+	if err := a.dispatcher.reload(); err != nil {
+		return fmt.Errorf("failed to load webhooks: %v", err)
+	}
+	a.dispatcher.run()
+	a.hub.OnBroadcast(a.dispatcher.observe)
+
 	a.rpcHandler = NewRpcHandler(a.storage, a.hub, a.jwtManager)
 	a.registerRpcMethods()
 	a.Router()
@@ -57,10 +83,18 @@ func (a *ApiServer) Router() {
 	a.app.GET("/health", a.HealthCheck)
 	a.app.POST("/api/rpc", a.Rpc)
 	a.app.GET("/ws", a.WebSocket)
+	a.app.GET("/.well-known/jwks.json", a.JWKS)
 
 	// File upload/download
-	a.app.POST("/api/upload", middleware.JWTAuth(a.jwtManager), a.Upload)
+	a.app.POST("/api/upload", middleware.JWTAuth(a.rpcHandler.ParseToken), a.Upload)
 	a.app.Static("/files", a.conf.UploadConfiguration.SavePath)
+	a.app.GET("/api/export/:id", middleware.JWTAuth(a.rpcHandler.ParseToken), a.DownloadExport)
+
+	// Audit log export
+	a.app.GET("/api/admin/audit_log.jsonl", middleware.JWTAuth(a.rpcHandler.ParseToken), a.ExportAuditLog)
+
+	// Incoming webhooks, the token in the URL is the credential
+	a.app.POST(incomingWebhookPath+":token", a.IncomingWebhook)
 }
 
 func (a *ApiServer) HealthCheck(ctx *gin.Context) {
@@ -69,28 +103,100 @@ func (a *ApiServer) HealthCheck(ctx *gin.Context) {
 	})
 }
 
+// JWKS publishes the public keys so other services can verify our tokens
+func (a *ApiServer) JWKS(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(200, a.jwtManager.JWKS())
+}
+
 func (a *ApiServer) registerRpcMethods() {
 	// Basic methods
 	a.rpcHandler.RegisterMethod(&PingMethod{})
 
 	// User methods
-	a.rpcHandler.RegisterMethod(NewUserRegisterMethod(a.storage, a.jwtManager))
-	a.rpcHandler.RegisterMethod(NewUserLoginMethod(a.storage, a.jwtManager))
+	a.rpcHandler.RegisterMethod(NewUserRegisterMethod(a.storage, a.jwtManager, a.conf.RateLimitConfiguration))
+	a.rpcHandler.RegisterMethod(NewUserLoginMethod(a.storage, a.jwtManager, a.conf.RateLimitConfiguration, a.authn))
+	a.rpcHandler.RegisterMethod(NewUserLoginTwoFactorMethod(a.storage, a.jwtManager, a.conf.RateLimitConfiguration))
+	a.rpcHandler.RegisterMethod(NewUserOIDCAuthURLMethod(a.storage, a.oidcClient))
+	a.rpcHandler.RegisterMethod(NewUserLoginOIDCMethod(a.storage, a.jwtManager, a.oidcClient, a.conf.OIDCConfiguration))
+	a.rpcHandler.RegisterMethod(NewUserRefreshMethod(a.storage, a.hub, a.jwtManager))
 	a.rpcHandler.RegisterMethod(NewUserInfoMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewUserUpdateProfileMethod(a.storage, a.conf.UploadConfiguration))
+	a.rpcHandler.RegisterMethod(NewUserChangePasswordMethod(a.storage, a.hub, a.jwtManager))
+	a.rpcHandler.RegisterMethod(NewUserLogoutMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewUserSessionsMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewUserTerminateSessionMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewUserTwoFactorEnrollMethod(a.storage, a.conf.TwoFactorConfiguration))
+	a.rpcHandler.RegisterMethod(NewUserTwoFactorVerifyMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewUserTwoFactorDisableMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewUserTwoFactorRecoveryCodesMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewUserDeleteAccountMethod(a.storage, a.hub, a.webhooks, a.dispatcher, a.conf.ExportConfiguration))
+	a.rpcHandler.RegisterMethod(NewUserExportDataMethod(a.storage, a.conf.ExportConfiguration))
+	a.rpcHandler.RegisterMethod(NewUserBlockMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewUserUnblockMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewUserBlocklistMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewUserSearchMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewUserUpdatePrivacyMethod(a.storage))
 
 	// Friend methods
 	a.rpcHandler.RegisterMethod(NewFriendListMethod(a.storage))
-	a.rpcHandler.RegisterMethod(NewFriendAddMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewFriendAddMethod(a.storage, a.hub, a.conf.FriendConfiguration))
 	a.rpcHandler.RegisterMethod(NewFriendAcceptMethod(a.storage, a.hub))
 	a.rpcHandler.RegisterMethod(NewFriendPendingMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewFriendRemoveMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewFriendCancelMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewFriendOutgoingMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewFriendUpdateMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewFriendTagsMethod(a.storage))
 
 	// Group methods
-	a.rpcHandler.RegisterMethod(NewGroupCreateMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewGroupCreateMethod(a.storage, a.hub, a.conf.GroupConfiguration))
 	a.rpcHandler.RegisterMethod(NewGroupListMethod(a.storage))
 	a.rpcHandler.RegisterMethod(NewGroupInfoMethod(a.storage))
-	a.rpcHandler.RegisterMethod(NewGroupJoinMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewGroupJoinMethod(a.storage, a.hub, a.conf.GroupConfiguration))
+	a.rpcHandler.RegisterMethod(NewGroupUpdateMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewGroupAnnouncementsMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewGroupInviteMethod(a.storage, a.hub, a.conf.GroupConfiguration))
+	a.rpcHandler.RegisterMethod(NewGroupMembersMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewGroupSetNicknameMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewGroupLeaveMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewGroupKickMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewGroupJoinRequestsMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewGroupReviewJoinRequestMethod(a.storage, a.hub, a.conf.GroupConfiguration))
+	a.rpcHandler.RegisterMethod(NewGroupSearchMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewGroupCreateWebhookMethod(a.storage, a.hub, a.conf.GroupConfiguration))
+	a.rpcHandler.RegisterMethod(NewGroupWebhooksMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewGroupDeleteWebhookMethod(a.storage))
 
 	// Message methods
 	a.rpcHandler.RegisterMethod(NewMessageSendMethod(a.storage, a.hub))
 	a.rpcHandler.RegisterMethod(NewMessageHistoryMethod(a.storage))
+
+	// Bot methods
+	a.rpcHandler.RegisterMethod(NewBotCreateMethod(a.storage, a.conf.BotConfiguration))
+	a.rpcHandler.RegisterMethod(NewBotListMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewBotSetWebhookMethod(a.storage, a.webhooks))
+	a.rpcHandler.RegisterMethod(NewBotDeleteMethod(a.storage, a.hub, a.webhooks))
+	a.rpcHandler.RegisterMethod(NewBotCreateTokenMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewBotTokensMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewBotRevokeTokenMethod(a.storage, a.hub))
+
+	// Webhook methods
+	a.rpcHandler.RegisterMethod(NewWebhookCreateMethod(a.storage, a.dispatcher, a.conf.WebhookConfiguration))
+	a.rpcHandler.RegisterMethod(NewWebhookListMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewWebhookUpdateMethod(a.storage, a.dispatcher))
+	a.rpcHandler.RegisterMethod(NewWebhookDeleteMethod(a.storage, a.dispatcher))
+	a.rpcHandler.RegisterMethod(NewWebhookDeliveriesMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewWebhookReplayMethod(a.storage, a.dispatcher))
+
+	// Admin methods
+	a.rpcHandler.RegisterMethod(NewAdminListUsersMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewAdminDisableUserMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewAdminEnableUserMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewAdminResetPasswordMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewAdminResetTwoFactorMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewAdminSetRoleMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewAdminGroupInfoMethod(a.storage))
+	a.rpcHandler.RegisterMethod(NewAdminDeleteMessageMethod(a.storage, a.hub))
+	a.rpcHandler.RegisterMethod(NewAdminAuditLogsMethod(a.storage))
 }
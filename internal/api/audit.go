@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"simple_im/internal/middleware"
+	"simple_im/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	maxAuditParamsLength = 1000
+	auditExportBatch     = 500
+)
+
+// auditRedactedKeys are never written to the audit log
+var auditRedactedKeys = map[string]bool{
+	"password":        true,
+	"old_password":    true,
+	"new_password":    true,
+	"code":            true,
+	"token":           true,
+	"refresh_token":   true,
+	"challenge_token": true,
+}
+
+// newAuditEntry starts the entry of an audited call, RpcHandler writes it
+// once the outcome is known
+func newAuditEntry(ctx context.Context, action string, method AuditedMethod, params json.RawMessage) *models.AuditLog {
+	ip, _ := ctx.Value("client_ip").(string)
+	userAgent, _ := ctx.Value("user_agent").(string)
+	targetType, targetID := method.AuditTarget(params)
+
+	return &models.AuditLog{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         ip,
+		UserAgent:  truncateRunes(userAgent, 255),
+		Params:     summarizeParams(params),
+	}
+}
+
+// setAuditActor records who acted, unauthenticated methods such as
+// user.login call it once they know the user
+func setAuditActor(ctx context.Context, userID int64) {
+	if entry, ok := ctx.Value("audit").(*models.AuditLog); ok {
+		entry.ActorID = &userID
+	}
+}
+
+// writeAudit stores the entry, a failing audit write is logged but does not
+// change the response the call already produced
+func (h *RpcHandler) writeAudit(entry *models.AuditLog, err error) {
+	if entry == nil {
+		return
+	}
+
+	entry.Success = err == nil
+	if err != nil {
+		entry.Error = truncateRunes(err.Error(), 255)
+	}
+	entry.CreatedAt = time.Now()
+
+	if err := h.storage.GetDB().Create(entry).Error; err != nil {
+		log.Error().Err(err).Str("action", entry.Action).Msg("failed to write audit log")
+	}
+}
+
+// auditTarget reads the id of the target from a top level params field
+func auditTarget(params json.RawMessage, targetType, key string) (string, string) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(params, &fields); err != nil || fields[key] == nil {
+		return targetType, ""
+	}
+	return targetType, strings.Trim(string(fields[key]), `"`)
+}
+
+// summarizeParams returns the params as JSON with secrets redacted
+func summarizeParams(params json.RawMessage) string {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(params, &fields); err != nil || len(fields) == 0 {
+		return ""
+	}
+
+	for key := range fields {
+		if auditRedactedKeys[key] {
+			fields[key] = "[redacted]"
+		}
+	}
+
+	summary, err := json.Marshal(fields)
+	if err != nil {
+		return ""
+	}
+	return truncateRunes(string(summary), maxAuditParamsLength)
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// AuditLogFilter narrows audit log queries, zero values match everything
+type AuditLogFilter struct {
+	ActorID    int64      `json:"actor_id" form:"actor_id"`
+	Action     string     `json:"action" form:"action"` // Exact method name, or a namespace prefix like "admin."
+	TargetType string     `json:"target_type" form:"target_type"`
+	TargetID   string     `json:"target_id" form:"target_id"`
+	Success    *bool      `json:"success" form:"success"`
+	Since      *time.Time `json:"since" form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until      *time.Time `json:"until" form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+func (f *AuditLogFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.ActorID > 0 {
+		query = query.Where("actor_id = ?", f.ActorID)
+	}
+	if strings.HasSuffix(f.Action, ".") {
+		query = query.Where("action LIKE ? ESCAPE '\\'", likePrefix(f.Action))
+	} else if f.Action != "" {
+		query = query.Where("action = ?", f.Action)
+	}
+	if f.TargetType != "" {
+		query = query.Where("target_type = ?", f.TargetType)
+	}
+	if f.TargetID != "" {
+		query = query.Where("target_id = ?", f.TargetID)
+	}
+	if f.Success != nil {
+		query = query.Where("success = ?", *f.Success)
+	}
+	if f.Since != nil {
+		query = query.Where("created_at >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		query = query.Where("created_at < ?", *f.Until)
+	}
+	return query
+}
+
+// ExportAuditLog streams the matching audit log entries as JSON lines,
+// oldest first. The filters are passed as query parameters.
+func (a *ApiServer) ExportAuditLog(ctx *gin.Context) {
+	userID := middleware.GetUserID(ctx)
+	rpcCtx := context.WithValue(context.Background(), "user_id", userID)
+	if err := a.rpcHandler.checkPermissions(rpcCtx, []models.Permission{models.PermissionAuditView}); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "permission denied"})
+		return
+	}
+
+	var filter AuditLogFilter
+	if err := ctx.ShouldBindQuery(&filter); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.Header("Content-Type", "application/x-ndjson")
+	ctx.Header("Content-Disposition", `attachment; filename="audit_log.jsonl"`)
+	ctx.Status(http.StatusOK)
+
+	enc := json.NewEncoder(ctx.Writer)
+	var entries []models.AuditLog
+	err := filter.apply(a.storage.GetDB().Model(&models.AuditLog{})).
+		Order("id ASC").
+		FindInBatches(&entries, auditExportBatch, func(tx *gorm.DB, batch int) error {
+			for i := range entries {
+				if err := enc.Encode(&entries[i]); err != nil {
+					return err
+				}
+			}
+			ctx.Writer.Flush()
+			return nil
+		}).Error
+	if err != nil {
+		log.Error().Err(err).Msg("failed to export audit log")
+	}
+}
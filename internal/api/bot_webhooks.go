@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"simple_im/internal/models"
+	"simple_im/internal/ws"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	botWebhookWorkers        = 4
+	botWebhookQueueSize      = 1024
+	defaultBotWebhookTimeout = 10 * time.Second
+
+	// Headers of webhook requests, the signature is the hex HMAC-SHA256 of
+	// "<timestamp>.<body>" with the webhook secret
+	webhookSignatureHeader = "X-SimpleIM-Signature"
+	webhookTimestampHeader = "X-SimpleIM-Timestamp"
+)
+
+// signWebhook returns the signature header value of a webhook body
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var errWebhookAddressForbidden = errors.New("webhook address is not public")
+
+// publicAddress reports whether a webhook may connect to the ip
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// newWebhookClient returns the client webhook requests are made with. Unless
+// private networks are allowed it refuses to connect to internal addresses,
+// the check runs on the resolved address of every connection so neither DNS
+// rebinding nor redirects get around it.
+func newWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	if allowPrivate {
+		return &http.Client{Timeout: timeout}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+				return errWebhookAddressForbidden
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // A proxy would connect on our behalf, unchecked
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+type botWebhook struct {
+	url    string
+	secret string
+}
+
+type botDelivery struct {
+	botID int64
+	hook  botWebhook
+	msg   *ws.Message
+}
+
+// botWebhooks posts the events of bots with a webhook URL. It is called from
+// the hub for every recipient, so the webhooks are kept in memory and the
+// requests are made by workers. Events are dropped when the queue is full or
+// the endpoint fails, bots that need every message read message.history.
+type botWebhooks struct {
+	client *http.Client
+	queue  chan botDelivery
+
+	mu    sync.RWMutex
+	hooks map[int64]botWebhook // bot user id -> webhook
+}
+
+func newBotWebhooks(timeout time.Duration, allowPrivate bool) *botWebhooks {
+	if timeout <= 0 {
+		timeout = defaultBotWebhookTimeout
+	}
+	return &botWebhooks{
+		client: newWebhookClient(timeout, allowPrivate),
+		queue:  make(chan botDelivery, botWebhookQueueSize),
+		hooks:  make(map[int64]botWebhook),
+	}
+}
+
+// load reads the webhooks of all bots
+func (w *botWebhooks) load(db *gorm.DB) error {
+	var bots []models.Bot
+	if err := db.Where("webhook_url <> ''").Find(&bots).Error; err != nil {
+		return err
+	}
+	for _, bot := range bots {
+		w.set(bot.UserID, bot.WebhookURL, bot.WebhookSecret)
+	}
+	return nil
+}
+
+// set updates the webhook of a bot, an empty url removes it
+func (w *botWebhooks) set(botID int64, url, secret string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if url == "" {
+		delete(w.hooks, botID)
+		return
+	}
+	w.hooks[botID] = botWebhook{url: url, secret: secret}
+}
+
+// deliver is the hub's OnDeliver hook
+func (w *botWebhooks) deliver(userID int64, msg *ws.Message) {
+	w.mu.RLock()
+	hook, ok := w.hooks[userID]
+	w.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case w.queue <- botDelivery{botID: userID, hook: hook, msg: msg}:
+	default:
+		log.Warn().Int64("bot_id", userID).Msg("bot webhook queue full, event dropped")
+	}
+}
+
+func (w *botWebhooks) run() {
+	for i := 0; i < botWebhookWorkers; i++ {
+		go func() {
+			for d := range w.queue {
+				if err := w.post(d); err != nil {
+					log.Warn().Err(err).Int64("bot_id", d.botID).Str("url", d.hook.url).Msg("bot webhook failed")
+				}
+			}
+		}()
+	}
+}
+
+func (w *botWebhooks) post(d botDelivery) error {
+	body, err := json.Marshal(d.msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(d.hook.secret, timestamp, body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -96,6 +96,30 @@ func (a *ApiServer) Upload(ctx *gin.Context) {
 	})
 }
 
+// DownloadExport serves a user.export_data archive to the user who requested it
+func (a *ApiServer) DownloadExport(ctx *gin.Context) {
+	userID := middleware.GetUserID(ctx)
+	if userID == 0 {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	exportID := ctx.Param("id")
+	ownerID, err := a.storage.GetExportOwner(ctx.Request.Context(), exportID)
+	if err != nil || ownerID != userID {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "export not found"})
+		return
+	}
+
+	path := exportArchivePath(a.conf.ExportConfiguration, userID, exportID)
+	if _, err := os.Stat(path); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "export not found"})
+		return
+	}
+
+	ctx.FileAttachment(path, fmt.Sprintf("simple_im_export_%s.zip", time.Now().Format("20060102")))
+}
+
 // GetFileType returns the message type based on content type
 func GetFileType(contentType string) models.MessageType {
 	if strings.HasPrefix(contentType, "image/") {
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"simple_im/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	incomingWebhookPath         = "/api/hooks/"
+	incomingWebhookPrefixLen    = 8
+	maxIncomingWebhookBody      = 64 << 10 // bytes
+	maxIncomingWebhookText      = 4000     // runes, longer messages are cut
+	incomingWebhookRatePerMin   = 60
+	maxIncomingWebhooksPerGroup = 10
+)
+
+// newIncomingWebhookToken returns the secret of a webhook URL and its hash
+func newIncomingWebhookToken() (string, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(secret)
+	return token, hashAPIToken(token), nil
+}
+
+// incomingWebhookPayload is the body of an incoming webhook, the simple
+// {"text", "title", "attachments"} shape and Slack's incoming webhook
+// payload are both accepted
+type incomingWebhookPayload struct {
+	Text        string              `json:"text"`
+	Title       string              `json:"title"`
+	Attachments []webhookAttachment `json:"attachments"`
+	Blocks      []slackBlock        `json:"blocks"` // Slack, replaces text when present
+}
+
+// webhookAttachment is a Slack attachment, or a plain string
+type webhookAttachment struct {
+	Fallback  string `json:"fallback"`
+	Pretext   string `json:"pretext"`
+	Title     string `json:"title"`
+	TitleLink string `json:"title_link"`
+	Text      string `json:"text"`
+	Fields    []struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+	} `json:"fields"`
+	Footer string `json:"footer"`
+}
+
+func (a *webhookAttachment) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*a = webhookAttachment{Text: text}
+		return nil
+	}
+	type plain webhookAttachment
+	return json.Unmarshal(data, (*plain)(a))
+}
+
+type slackText struct {
+	Type string `json:"type"` // plain_text or mrkdwn
+	Text string `json:"text"`
+}
+
+// slackBlock covers the text of section, header and context blocks, other
+// block types are skipped
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text"`
+	Fields   []slackText `json:"fields"`
+	Elements []slackText `json:"elements"`
+}
+
+// slackLink matches <url|label> and <url> links of Slack's mrkdwn
+var slackLink = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]+))?>`)
+
+// slackToPlain turns Slack links into "label (url)" and unescapes the
+// entities Slack requires for &, < and >
+func slackToPlain(s string) string {
+	s = slackLink.ReplaceAllStringFunc(s, func(m string) string {
+		parts := slackLink.FindStringSubmatch(m)
+		if parts[2] == "" || parts[2] == parts[1] {
+			return parts[1]
+		}
+		return parts[2] + " (" + parts[1] + ")"
+	})
+	return html.UnescapeString(s)
+}
+
+// render flattens the payload into the content of a text message
+func (p *incomingWebhookPayload) render() string {
+	var parts []string
+	add := func(s string) {
+		if s = strings.TrimSpace(slackToPlain(s)); s != "" {
+			parts = append(parts, s)
+		}
+	}
+
+	add(p.Title)
+	if len(p.Blocks) > 0 {
+		for _, b := range p.Blocks {
+			if b.Text != nil {
+				add(b.Text.Text)
+			}
+			for _, t := range b.Fields {
+				add(t.Text)
+			}
+			for _, t := range b.Elements {
+				add(t.Text)
+			}
+		}
+	}
+	if len(parts) == 0 || len(p.Blocks) == 0 {
+		add(p.Text)
+	}
+
+	for _, a := range p.Attachments {
+		before := len(parts)
+		add(a.Pretext)
+		if a.TitleLink != "" && a.Title != "" {
+			add(a.Title + " (" + a.TitleLink + ")")
+		} else {
+			add(a.Title)
+		}
+		add(a.Text)
+		for _, f := range a.Fields {
+			add(f.Title + ": " + f.Value)
+		}
+		add(a.Footer)
+		if len(parts) == before {
+			add(a.Fallback)
+		}
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+// readIncomingWebhookPayload parses a JSON body, or the payload field of a
+// form post as Slack clients send it
+func readIncomingWebhookPayload(ctx *gin.Context) (*incomingWebhookPayload, error) {
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxIncomingWebhookBody)
+
+	var raw []byte
+	if ctx.ContentType() == "application/x-www-form-urlencoded" {
+		raw = []byte(ctx.PostForm("payload"))
+	} else {
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		raw = body
+	}
+
+	var p incomingWebhookPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, errors.New("invalid payload")
+	}
+	return &p, nil
+}
+
+// IncomingWebhook posts the payload into the webhook's group as its bot.
+// Responses are plain text like Slack's, so scripts checking for "ok" work.
+func (a *ApiServer) IncomingWebhook(ctx *gin.Context) {
+	db := a.storage.GetDB()
+
+	var hook models.IncomingWebhook
+	if err := db.Where("token_hash = ?", hashAPIToken(ctx.Param("token"))).First(&hook).Error; err != nil {
+		ctx.String(http.StatusNotFound, "no_service")
+		return
+	}
+
+	key := "incoming_webhook:" + strconv.FormatInt(hook.ID, 10)
+	if wait, err := a.storage.HitRateLimit(ctx, key, incomingWebhookRatePerMin, time.Minute); err == nil && wait > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(int(wait.Seconds()+0.999)))
+		ctx.String(http.StatusTooManyRequests, "rate_limited")
+		return
+	}
+
+	payload, err := readIncomingWebhookPayload(ctx)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid_payload")
+		return
+	}
+	text := truncateRunes(payload.render(), maxIncomingWebhookText)
+	if text == "" {
+		ctx.String(http.StatusBadRequest, "no_text")
+		return
+	}
+
+	var bot models.User
+	if err := db.First(&bot, hook.BotID).Error; err != nil {
+		ctx.String(http.StatusNotFound, "no_service")
+		return
+	}
+
+	// Sent like any other group message, the bot has to be a member
+	rpcCtx := context.WithValue(context.Background(), "user_id", bot.ID)
+	rpcCtx = context.WithValue(rpcCtx, "username", bot.Username)
+	params, _ := json.Marshal(MessageSendParams{GroupID: hook.GroupID, MsgType: models.MsgTypeText, Content: text})
+	if _, err := NewMessageSendMethod(a.storage, a.hub).Execute(rpcCtx, params); err != nil {
+		log.Warn().Err(err).Int64("webhook_id", hook.ID).Msg("incoming webhook could not post")
+		ctx.String(http.StatusNotFound, "channel_not_found")
+		return
+	}
+
+	db.Model(&hook).Update("last_used_at", time.Now())
+	ctx.String(http.StatusOK, "ok")
+}
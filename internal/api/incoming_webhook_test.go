@@ -0,0 +1,218 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"simple_im/internal/models"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIncomingWebhookPayload_Render(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"text", `{"text": "deploy finished"}`, "deploy finished"},
+		{"title and text", `{"title": "CI", "text": "build #12 passed"}`, "CI\nbuild #12 passed"},
+		{"plain attachments", `{"text": "report", "attachments": ["https://example.com/r.pdf"]}`, "report\nhttps://example.com/r.pdf"},
+		{"slack links and escapes", `{"text": "<https://example.com|Build> failed &amp; <https://example.com/log>"}`, "Build (https://example.com) failed & https://example.com/log"},
+		{
+			"slack attachment",
+			`{"attachments": [{"fallback": "fb", "pretext": "New alert", "title": "CPU", "title_link": "https://example.com/cpu", "fields": [{"title": "Host", "value": "web-1"}]}]}`,
+			"New alert\nCPU (https://example.com/cpu)\nHost: web-1",
+		},
+		{"slack attachment fallback", `{"attachments": [{"fallback": "only fallback"}]}`, "only fallback"},
+		{
+			"slack blocks replace text",
+			`{"text": "fallback", "blocks": [{"type": "header", "text": {"type": "plain_text", "text": "Release"}}, {"type": "section", "text": {"type": "mrkdwn", "text": "v1.2 is out"}}, {"type": "divider"}]}`,
+			"Release\nv1.2 is out",
+		},
+		{"empty", `{"text": "  "}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p incomingWebhookPayload
+			if err := json.Unmarshal([]byte(tt.body), &p); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if got := p.render(); got != tt.want {
+				t.Errorf("render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupCreateWebhookMethod_Access(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("hookgroupowner", "password123")
+	member, _ := env.CreateTestUser("hookgroupmember", "password123")
+	group, _ := env.CreateTestGroup("Incoming Group", owner.ID)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: member.ID, Role: models.GroupRoleMember})
+
+	method := NewGroupCreateWebhookMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+	params, _ := json.Marshal(GroupCreateWebhookParams{GroupID: group.ID, Name: "CI"})
+
+	memberCtx := context.WithValue(context.WithValue(context.Background(), "user_id", member.ID), "username", member.Username)
+	if _, err := method.Execute(memberCtx, params); err == nil {
+		t.Error("Members should not create webhooks")
+	}
+
+	ownerCtx := context.WithValue(context.WithValue(context.Background(), "user_id", owner.ID), "username", owner.Username)
+	result, err := method.Execute(ownerCtx, params)
+	if err != nil {
+		t.Fatalf("Create webhook failed: %v", err)
+	}
+	hook := result.(map[string]interface{})["webhook"].(*models.IncomingWebhook)
+
+	var bot models.User
+	env.DB.First(&bot, hook.BotID)
+	if !bot.IsBot || bot.Nickname != "CI" {
+		t.Errorf("Expected a bot named CI, got %+v", bot)
+	}
+
+	listParams, _ := json.Marshal(GroupWebhooksParams{GroupID: group.ID})
+	if _, err := NewGroupWebhooksMethod(env.Storage).Execute(memberCtx, listParams); err == nil {
+		t.Error("Members should not list webhooks")
+	}
+
+	// Deleting removes the bot from the group
+	deleteParams, _ := json.Marshal(GroupDeleteWebhookParams{WebhookID: hook.ID})
+	if _, err := NewGroupDeleteWebhookMethod(env.Storage).Execute(memberCtx, deleteParams); err == nil {
+		t.Error("Members should not delete webhooks")
+	}
+	if _, err := NewGroupDeleteWebhookMethod(env.Storage).Execute(ownerCtx, deleteParams); err != nil {
+		t.Fatalf("Delete webhook failed: %v", err)
+	}
+	var count int64
+	env.DB.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", group.ID, hook.BotID).Count(&count)
+	if count != 0 {
+		t.Error("Bot should no longer be a member")
+	}
+}
+
+func TestIncomingWebhook_Post(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("postowner", "password123")
+	group, _ := env.CreateTestGroup("Post Group", owner.ID)
+	ownerCtx := context.WithValue(context.WithValue(context.Background(), "user_id", owner.ID), "username", owner.Username)
+
+	params, _ := json.Marshal(GroupCreateWebhookParams{GroupID: group.ID, Name: "Alerts"})
+	result, err := NewGroupCreateWebhookMethod(env.Storage, env.Hub, env.Config.GroupConfiguration).Execute(ownerCtx, params)
+	if err != nil {
+		t.Fatalf("Create webhook failed: %v", err)
+	}
+	hook := result.(map[string]interface{})["webhook"].(*models.IncomingWebhook)
+	token := result.(map[string]interface{})["token"].(string)
+
+	server := &ApiServer{storage: env.Storage, hub: env.Hub, conf: env.Config}
+	post := func(token, contentType, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, incomingWebhookPath+token, strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", contentType)
+		c.Params = gin.Params{{Key: "token", Value: token}}
+		server.IncomingWebhook(c)
+		return w
+	}
+
+	if w := post("unknown", "application/json", `{"text": "hi"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Unknown token should be rejected, got %d", w.Code)
+	}
+	if w := post(token, "application/json", `{"attachments": []}`); w.Code != http.StatusBadRequest || w.Body.String() != "no_text" {
+		t.Errorf("Empty payload should be rejected, got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := post(token, "application/json", `{"title": "Disk", "text": "90% full"}`); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("Post failed with %d %s", w.Code, w.Body.String())
+	}
+
+	// Slack clients may send the JSON as a form field
+	form := url.Values{"payload": {`{"text": "from <https://example.com|slack>"}`}}.Encode()
+	if w := post(token, "application/x-www-form-urlencoded", form); w.Code != http.StatusOK {
+		t.Fatalf("Form post failed with %d %s", w.Code, w.Body.String())
+	}
+
+	var messages []models.Message
+	env.DB.Where("group_id = ? AND sender_id = ?", group.ID, hook.BotID).Order("id").Find(&messages)
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages from the bot, got %d", len(messages))
+	}
+	if messages[0].Content != "Disk\n90% full" || messages[1].Content != "from slack (https://example.com)" {
+		t.Errorf("Unexpected contents: %q, %q", messages[0].Content, messages[1].Content)
+	}
+
+	var used models.IncomingWebhook
+	env.DB.First(&used, hook.ID)
+	if used.LastUsedAt == nil {
+		t.Error("Expected last_used_at to be set")
+	}
+
+	// A removed bot can no longer post
+	env.DB.Where("group_id = ? AND user_id = ?", group.ID, hook.BotID).Delete(&models.GroupMember{})
+	env.Storage.InvalidateGroupMembers(context.Background(), group.ID)
+	if w := post(token, "application/json", `{"text": "hi"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Removed bot should not post, got %d", w.Code)
+	}
+}
+
+func TestUserDeleteAccountMethod_BotsNotSuccessors(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.ExportConfiguration.SavePath = t.TempDir()
+
+	owner, _ := env.CreateTestUser("successorowner", "password123")
+	member, _ := env.CreateTestUser("successormember", "password123")
+	shared, _ := env.CreateTestGroup("Shared Hooks", owner.ID)
+	hooked, _ := env.CreateTestGroup("Only Hooks", owner.ID)
+	ownerCtx := context.WithValue(context.WithValue(context.Background(), "user_id", owner.ID), "username", owner.Username)
+
+	create := NewGroupCreateWebhookMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+	for _, groupID := range []int64{shared.ID, hooked.ID} {
+		params, _ := json.Marshal(GroupCreateWebhookParams{GroupID: groupID})
+		if _, err := create.Execute(ownerCtx, params); err != nil {
+			t.Fatalf("Create webhook failed: %v", err)
+		}
+	}
+	// Outranks the bot, which joined first
+	env.DB.Create(&models.GroupMember{GroupID: shared.ID, UserID: member.ID, Role: models.GroupRoleMember})
+	env.DB.Model(&models.GroupMember{}).Where("group_id = ? AND user_id <> ?", shared.ID, member.ID).Update("role", models.GroupRoleAdmin)
+	env.DB.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", shared.ID, owner.ID).Update("role", models.GroupRoleOwner)
+
+	params, _ := json.Marshal(UserDeleteAccountParams{Password: "password123"})
+	if _, err := NewUserDeleteAccountMethod(env.Storage, env.Hub, nil, nil, env.Config.ExportConfiguration).Execute(ownerCtx, params); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	var group models.Group
+	env.DB.First(&group, shared.ID)
+	if group.OwnerID != member.ID {
+		t.Errorf("Expected the human member to own the group, owner is %d", group.OwnerID)
+	}
+
+	var count int64
+	env.DB.Model(&models.Group{}).Where("id = ?", hooked.ID).Count(&count)
+	if count != 0 {
+		t.Error("Group with only a webhook bot left should be dissolved")
+	}
+	env.DB.Model(&models.IncomingWebhook{}).Where("group_id = ?", hooked.ID).Count(&count)
+	if count != 0 {
+		t.Error("Webhooks of the dissolved group should be deleted")
+	}
+}
@@ -0,0 +1,577 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"simple_im/internal/models"
+	"simple_im/internal/storage"
+	"simple_im/internal/ws"
+
+	"gorm.io/gorm"
+)
+
+// Admin methods are only reachable for roles granting RequiredPermissions,
+// RpcHandler checks them before Execute runs.
+
+// ============ admin.list_users ============
+
+type AdminListUsersMethod struct {
+	storage *storage.Storage
+}
+
+func NewAdminListUsersMethod(s *storage.Storage) *AdminListUsersMethod {
+	return &AdminListUsersMethod{storage: s}
+}
+
+func (m *AdminListUsersMethod) Name() string { return "admin.list_users" }
+
+func (m *AdminListUsersMethod) RequireAuth() bool { return true }
+
+func (m *AdminListUsersMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+func (m *AdminListUsersMethod) RequiredPermissions() []models.Permission {
+	return []models.Permission{models.PermissionUsersView}
+}
+
+type AdminListUsersParams struct {
+	Keyword string           `json:"keyword"` // Matches username or nickname, empty lists everyone
+	Status  *int             `json:"status"`
+	Role    *models.UserRole `json:"role"`
+	Offset  int              `json:"offset"`
+	Limit   int              `json:"limit"`
+}
+
+// Execute lists accounts regardless of their privacy settings, newest first
+func (m *AdminListUsersMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p AdminListUsersParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
+	if p.Limit <= 0 || p.Limit > 100 {
+		p.Limit = 20
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+
+	query := m.storage.GetDB().Model(&models.User{})
+	if keyword := strings.ToLower(strings.TrimSpace(p.Keyword)); keyword != "" {
+		like := likePattern(keyword)
+		query = query.Where("LOWER(username) LIKE ? ESCAPE '\\' OR LOWER(nickname) LIKE ? ESCAPE '\\'", like, like)
+	}
+	if p.Status != nil {
+		query = query.Where("status = ?", *p.Status)
+	}
+	if p.Role != nil {
+		query = query.Where("role = ?", *p.Role)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, fmt.Errorf("failed to count users: %v", err)
+	}
+
+	var users []models.User
+	if err := query.Order("id DESC").Offset(p.Offset).Limit(p.Limit).Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to list users: %v", err)
+	}
+
+	result := make([]*fullProfile, 0, len(users))
+	for i := range users {
+		result = append(result, newFullProfile(&users[i]))
+	}
+
+	return map[string]interface{}{
+		"total": total,
+		"users": result,
+	}, nil
+}
+
+// ============ admin.disable_user ============
+
+type AdminDisableUserMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewAdminDisableUserMethod(s *storage.Storage, h *ws.Hub) *AdminDisableUserMethod {
+	return &AdminDisableUserMethod{storage: s, hub: h}
+}
+
+func (m *AdminDisableUserMethod) Name() string { return "admin.disable_user" }
+
+func (m *AdminDisableUserMethod) RequireAuth() bool { return true }
+
+func (m *AdminDisableUserMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "user", "user_id")
+}
+
+func (m *AdminDisableUserMethod) RequiredPermissions() []models.Permission {
+	return []models.Permission{models.PermissionUsersManage}
+}
+
+type AdminUserParams struct {
+	UserID int64 `json:"user_id"`
+}
+
+// Execute blocks the account from logging in and ends all of its sessions
+func (m *AdminDisableUserMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	user, err := loadAdminTarget(ctx, m.storage.GetDB(), params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.storage.GetDB().Model(user).Update("status", 0).Error; err != nil {
+		return nil, fmt.Errorf("failed to disable user: %v", err)
+	}
+
+	if _, err := m.storage.DeleteUserSessions(ctx, user.ID); err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %v", err)
+	}
+	m.hub.DisconnectSession(user.ID, "")
+
+	return map[string]interface{}{
+		"message": "user disabled",
+	}, nil
+}
+
+// ============ admin.enable_user ============
+
+type AdminEnableUserMethod struct {
+	storage *storage.Storage
+}
+
+func NewAdminEnableUserMethod(s *storage.Storage) *AdminEnableUserMethod {
+	return &AdminEnableUserMethod{storage: s}
+}
+
+func (m *AdminEnableUserMethod) Name() string { return "admin.enable_user" }
+
+func (m *AdminEnableUserMethod) RequireAuth() bool { return true }
+
+func (m *AdminEnableUserMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "user", "user_id")
+}
+
+func (m *AdminEnableUserMethod) RequiredPermissions() []models.Permission {
+	return []models.Permission{models.PermissionUsersManage}
+}
+
+func (m *AdminEnableUserMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	user, err := loadAdminTarget(ctx, m.storage.GetDB(), params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.storage.GetDB().Model(user).Update("status", 1).Error; err != nil {
+		return nil, fmt.Errorf("failed to enable user: %v", err)
+	}
+
+	return map[string]interface{}{
+		"message": "user enabled",
+	}, nil
+}
+
+// ============ admin.reset_password ============
+
+type AdminResetPasswordMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewAdminResetPasswordMethod(s *storage.Storage, h *ws.Hub) *AdminResetPasswordMethod {
+	return &AdminResetPasswordMethod{storage: s, hub: h}
+}
+
+func (m *AdminResetPasswordMethod) Name() string { return "admin.reset_password" }
+
+func (m *AdminResetPasswordMethod) RequireAuth() bool { return true }
+
+func (m *AdminResetPasswordMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "user", "user_id")
+}
+
+func (m *AdminResetPasswordMethod) RequiredPermissions() []models.Permission {
+	return []models.Permission{models.PermissionUsersManage}
+}
+
+type AdminResetPasswordParams struct {
+	UserID      int64  `json:"user_id"`
+	NewPassword string `json:"new_password"` // Generated and returned when empty
+}
+
+// Execute sets a new password and logs the user out everywhere
+func (m *AdminResetPasswordMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p AdminResetPasswordParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	db := m.storage.GetDB()
+	user, err := loadAdminTarget(ctx, db, params)
+	if err != nil {
+		return nil, err
+	}
+
+	generated := p.NewPassword == ""
+	if generated {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate password: %v", err)
+		}
+		p.NewPassword = strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw))
+	} else if len(p.NewPassword) < 6 {
+		return nil, errors.New("password must be at least 6 characters")
+	}
+
+	if err := user.SetPassword(p.NewPassword); err != nil {
+		return nil, fmt.Errorf("failed to set password: %v", err)
+	}
+	if err := db.Model(user).Update("password", user.Password).Error; err != nil {
+		return nil, fmt.Errorf("failed to update password: %v", err)
+	}
+
+	if _, err := m.storage.DeleteUserSessions(ctx, user.ID); err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %v", err)
+	}
+	m.hub.DisconnectSession(user.ID, "")
+	m.storage.ClearLoginFailures(ctx, loginName(user.Username))
+
+	result := map[string]interface{}{
+		"message": "password reset",
+	}
+	if generated {
+		result["password"] = p.NewPassword
+	}
+	return result, nil
+}
+
+// ============ admin.reset_2fa ============
+
+type AdminResetTwoFactorMethod struct {
+	storage *storage.Storage
+}
+
+func NewAdminResetTwoFactorMethod(s *storage.Storage) *AdminResetTwoFactorMethod {
+	return &AdminResetTwoFactorMethod{storage: s}
+}
+
+func (m *AdminResetTwoFactorMethod) Name() string { return "admin.reset_2fa" }
+
+func (m *AdminResetTwoFactorMethod) RequireAuth() bool { return true }
+
+func (m *AdminResetTwoFactorMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "user", "user_id")
+}
+
+func (m *AdminResetTwoFactorMethod) RequiredPermissions() []models.Permission {
+	return []models.Permission{models.PermissionUsersManage}
+}
+
+// Execute turns 2FA off for a user who lost both the authenticator and the
+// recovery codes, the password alone logs them in again afterwards
+func (m *AdminResetTwoFactorMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	db := m.storage.GetDB()
+	user, err := loadAdminTarget(ctx, db, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return clearTwoFactor(tx, user.ID)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to reset two-factor authentication: %v", err)
+	}
+
+	return map[string]interface{}{
+		"message": "two-factor authentication reset",
+	}, nil
+}
+
+// ============ admin.set_role ============
+
+type AdminSetRoleMethod struct {
+	storage *storage.Storage
+}
+
+func NewAdminSetRoleMethod(s *storage.Storage) *AdminSetRoleMethod {
+	return &AdminSetRoleMethod{storage: s}
+}
+
+func (m *AdminSetRoleMethod) Name() string { return "admin.set_role" }
+
+func (m *AdminSetRoleMethod) RequireAuth() bool { return true }
+
+func (m *AdminSetRoleMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "user", "user_id")
+}
+
+func (m *AdminSetRoleMethod) RequiredPermissions() []models.Permission {
+	return []models.Permission{models.PermissionRolesManage}
+}
+
+type AdminSetRoleParams struct {
+	UserID int64           `json:"user_id"`
+	Role   models.UserRole `json:"role"`
+}
+
+func (m *AdminSetRoleMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p AdminSetRoleParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if !p.Role.Valid() {
+		return nil, errors.New("invalid role")
+	}
+
+	db := m.storage.GetDB()
+	user, err := loadAdminTarget(ctx, db, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(user).Update("role", p.Role).Error; err != nil {
+		return nil, fmt.Errorf("failed to set role: %v", err)
+	}
+
+	return map[string]interface{}{
+		"message": "role updated",
+	}, nil
+}
+
+// ============ admin.group_info ============
+
+type AdminGroupInfoMethod struct {
+	storage *storage.Storage
+}
+
+func NewAdminGroupInfoMethod(s *storage.Storage) *AdminGroupInfoMethod {
+	return &AdminGroupInfoMethod{storage: s}
+}
+
+func (m *AdminGroupInfoMethod) Name() string { return "admin.group_info" }
+
+func (m *AdminGroupInfoMethod) RequireAuth() bool { return true }
+
+func (m *AdminGroupInfoMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "group", "group_id")
+}
+
+func (m *AdminGroupInfoMethod) RequiredPermissions() []models.Permission {
+	return []models.Permission{models.PermissionGroupsView}
+}
+
+type AdminGroupInfoParams struct {
+	GroupID int64 `json:"group_id"`
+}
+
+// Execute returns a group with all members, also to admins outside the group
+func (m *AdminGroupInfoMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p AdminGroupInfoParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	db := m.storage.GetDB()
+
+	var group models.Group
+	if err := db.Preload("Owner").First(&group, p.GroupID).Error; err != nil {
+		return nil, errors.New("group not found")
+	}
+
+	var members []models.GroupMember
+	db.Preload("User").Where("group_id = ?", p.GroupID).Order("role DESC, joined_at ASC").Find(&members)
+
+	var tags []string
+	db.Model(&models.GroupTag{}).Where("group_id = ?", p.GroupID).Order("tag ASC").Pluck("tag", &tags)
+
+	var messageCount, pendingRequests int64
+	db.Model(&models.Message{}).Where("group_id = ?", p.GroupID).Count(&messageCount)
+	db.Model(&models.GroupJoinRequest{}).
+		Where("group_id = ? AND status = ?", p.GroupID, models.GroupJoinRequestPending).
+		Count(&pendingRequests)
+
+	return map[string]interface{}{
+		"group":            group,
+		"members":          members,
+		"member_count":     len(members),
+		"tags":             tags,
+		"message_count":    messageCount,
+		"pending_requests": pendingRequests,
+	}, nil
+}
+
+// ============ admin.delete_message ============
+
+type AdminDeleteMessageMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewAdminDeleteMessageMethod(s *storage.Storage, h *ws.Hub) *AdminDeleteMessageMethod {
+	return &AdminDeleteMessageMethod{storage: s, hub: h}
+}
+
+func (m *AdminDeleteMessageMethod) Name() string { return "admin.delete_message" }
+
+func (m *AdminDeleteMessageMethod) RequireAuth() bool { return true }
+
+func (m *AdminDeleteMessageMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "message", "message_id")
+}
+
+func (m *AdminDeleteMessageMethod) RequiredPermissions() []models.Permission {
+	return []models.Permission{models.PermissionMessagesDelete}
+}
+
+type AdminDeleteMessageParams struct {
+	MessageID int64 `json:"message_id"`
+}
+
+// Execute removes a message and tells the online participants to drop it
+func (m *AdminDeleteMessageMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p AdminDeleteMessageParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.MessageID == 0 {
+		return nil, errors.New("message_id is required")
+	}
+
+	db := m.storage.GetDB()
+
+	var msg models.Message
+	if err := db.First(&msg, p.MessageID).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+
+	if err := db.Delete(&msg).Error; err != nil {
+		return nil, fmt.Errorf("failed to delete message: %v", err)
+	}
+
+	event := &ws.Message{
+		ID:        msg.ID,
+		Type:      "message_deleted",
+		CreatedAt: msg.CreatedAt,
+	}
+	if msg.GroupID != nil {
+		members, err := m.storage.GetGroupMemberIDs(ctx, *msg.GroupID)
+		if err == nil {
+			event.GroupID = *msg.GroupID
+			event.GroupMembers = members
+			m.hub.Broadcast(event)
+		}
+	} else if msg.ReceiverID != nil {
+		for _, userID := range []int64{msg.SenderID, *msg.ReceiverID} {
+			e := *event
+			e.ReceiverID = userID
+			m.hub.Broadcast(&e)
+		}
+	}
+
+	return map[string]interface{}{
+		"message": "message deleted",
+	}, nil
+}
+
+// ============ admin.audit_logs ============
+
+type AdminAuditLogsMethod struct {
+	storage *storage.Storage
+}
+
+func NewAdminAuditLogsMethod(s *storage.Storage) *AdminAuditLogsMethod {
+	return &AdminAuditLogsMethod{storage: s}
+}
+
+func (m *AdminAuditLogsMethod) Name() string { return "admin.audit_logs" }
+
+func (m *AdminAuditLogsMethod) RequireAuth() bool { return true }
+
+func (m *AdminAuditLogsMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+func (m *AdminAuditLogsMethod) RequiredPermissions() []models.Permission {
+	return []models.Permission{models.PermissionAuditView}
+}
+
+type AdminAuditLogsParams struct {
+	AuditLogFilter
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// Execute pages through the audit log, newest first
+func (m *AdminAuditLogsMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p AdminAuditLogsParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
+	if p.Limit <= 0 || p.Limit > 100 {
+		p.Limit = 50
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+
+	query := p.AuditLogFilter.apply(m.storage.GetDB().Model(&models.AuditLog{}))
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, fmt.Errorf("failed to count audit logs: %v", err)
+	}
+
+	var logs []models.AuditLog
+	if err := query.Order("id DESC").Offset(p.Offset).Limit(p.Limit).Find(&logs).Error; err != nil {
+		return nil, fmt.Errorf("failed to list audit logs: %v", err)
+	}
+
+	return map[string]interface{}{
+		"total": total,
+		"logs":  logs,
+	}, nil
+}
+
+// loadAdminTarget returns the user named by params.user_id. Admins cannot
+// target themselves, so they cannot lock themselves out by accident.
+func loadAdminTarget(ctx context.Context, db *gorm.DB, params json.RawMessage) (*models.User, error) {
+	var p AdminUserParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.UserID == 0 {
+		return nil, errors.New("user_id is required")
+	}
+
+	if p.UserID == ctx.Value("user_id").(int64) {
+		return nil, errors.New("cannot apply this to your own account")
+	}
+
+	var user models.User
+	if err := db.First(&user, p.UserID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	return &user, nil
+}
@@ -0,0 +1,469 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"simple_im/internal/auth"
+	"simple_im/internal/models"
+	"simple_im/pkg/common/resp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// callRpc sends a request through the handler like a client would
+func callRpc(handler *RpcHandler, token, method string, params interface{}) resp.RpcResponse {
+	raw, _ := json.Marshal(params)
+	body, _ := json.Marshal(resp.RpcRequest{JsonRPC: "2.0", Method: method, Params: raw, Id: "1"})
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/api/rpc", bytes.NewReader(body))
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+	handler.HandleRpcRequest(ctx)
+
+	var response resp.RpcResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response
+}
+
+func TestRpcHandler_RequiredPermissions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+	handler.RegisterMethod(NewAdminListUsersMethod(env.Storage))
+	handler.RegisterMethod(NewAdminDisableUserMethod(env.Storage, env.Hub))
+
+	user, _ := env.CreateTestUser("regular", "password123")
+	moderator, _ := env.CreateTestUser("moderator", "password123")
+	env.DB.Model(moderator).Update("role", models.UserRoleModerator)
+
+	userToken, _ := env.CreateTestToken(user)
+	modToken, _ := env.CreateTestToken(moderator)
+
+	response := callRpc(handler, userToken, "admin.list_users", nil)
+	if response.Error == nil || response.Error.Code != resp.PermissionDeniedCode {
+		t.Errorf("Expected permission denied for regular user, got %+v", response.Error)
+	}
+
+	response = callRpc(handler, modToken, "admin.list_users", nil)
+	if response.Error != nil {
+		t.Errorf("Moderator should list users: %v", response.Error)
+	}
+
+	response = callRpc(handler, modToken, "admin.disable_user", AdminUserParams{UserID: user.ID})
+	if response.Error == nil || response.Error.Code != resp.PermissionDeniedCode {
+		t.Errorf("Moderator should not disable users, got %+v", response.Error)
+	}
+
+	// Demotion applies to tokens issued before it
+	env.DB.Model(moderator).Update("role", models.UserRoleUser)
+	response = callRpc(handler, modToken, "admin.list_users", nil)
+	if response.Error == nil || response.Error.Code != resp.PermissionDeniedCode {
+		t.Errorf("Expected permission denied after demotion, got %+v", response.Error)
+	}
+}
+
+func TestAdminListUsersMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	admin, _ := env.CreateTestUser("admin", "password123")
+	env.CreateTestUser("alice", "password123")
+	hidden, _ := env.CreateTestUser("alicia", "password123")
+	env.DB.Model(hidden).Updates(map[string]interface{}{"discoverable": false, "status": 0})
+
+	method := NewAdminListUsersMethod(env.Storage)
+	ctx := context.WithValue(context.Background(), "user_id", admin.ID)
+
+	// Admins also find users hidden from user.search
+	params, _ := json.Marshal(AdminListUsersParams{Keyword: "ALI"})
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if total := result.(map[string]interface{})["total"].(int64); total != 2 {
+		t.Errorf("Expected 2 users, got %d", total)
+	}
+
+	disabled := 0
+	params, _ = json.Marshal(AdminListUsersParams{Status: &disabled})
+	result, _ = method.Execute(ctx, params)
+	users := result.(map[string]interface{})["users"].([]*fullProfile)
+	if len(users) != 1 || users[0].ID != hidden.ID {
+		t.Errorf("Expected only the disabled user, got %+v", users)
+	}
+}
+
+func TestAdminDisableUserMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	admin, _ := env.CreateTestUser("admin", "password123")
+	user, _ := env.CreateTestUser("troll", "password123")
+	token, _ := env.CreateTestToken(user)
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+
+	ctx := context.WithValue(context.Background(), "user_id", admin.ID)
+	params, _ := json.Marshal(AdminUserParams{UserID: user.ID})
+
+	if _, err := NewAdminDisableUserMethod(env.Storage, env.Hub).Execute(ctx, params); err != nil {
+		t.Fatalf("Disable failed: %v", err)
+	}
+
+	if _, err := handler.ParseToken(token); err == nil {
+		t.Error("Sessions of a disabled user should be revoked")
+	}
+
+	login := NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB))
+	loginParams, _ := json.Marshal(UserLoginParams{Username: "troll", Password: "password123"})
+	if _, err := login.Execute(context.Background(), loginParams); err == nil {
+		t.Error("Disabled user should not log in")
+	}
+
+	if _, err := NewAdminEnableUserMethod(env.Storage).Execute(ctx, params); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+	if _, err := login.Execute(context.Background(), loginParams); err != nil {
+		t.Errorf("Enabled user should log in: %v", err)
+	}
+
+	params, _ = json.Marshal(AdminUserParams{UserID: admin.ID})
+	if _, err := NewAdminDisableUserMethod(env.Storage, env.Hub).Execute(ctx, params); err == nil {
+		t.Error("Admins should not disable themselves")
+	}
+}
+
+func TestAdminResetPasswordMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	admin, _ := env.CreateTestUser("admin", "password123")
+	user, _ := env.CreateTestUser("forgetful", "password123")
+	token, _ := env.CreateTestToken(user)
+
+	ctx := context.WithValue(context.Background(), "user_id", admin.ID)
+	params, _ := json.Marshal(AdminResetPasswordParams{UserID: user.ID})
+	result, err := NewAdminResetPasswordMethod(env.Storage, env.Hub).Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	password, _ := result.(map[string]interface{})["password"].(string)
+	if len(password) < 6 {
+		t.Fatalf("Expected a generated password, got %q", password)
+	}
+
+	var updated models.User
+	env.DB.First(&updated, user.ID)
+	if !updated.CheckPassword(password) || updated.CheckPassword("password123") {
+		t.Error("Password should be replaced by the generated one")
+	}
+
+	if _, err := NewRpcHandler(env.Storage, env.Hub, env.JWTManager).ParseToken(token); err == nil {
+		t.Error("Sessions should be revoked after a reset")
+	}
+
+	params, _ = json.Marshal(AdminResetPasswordParams{UserID: user.ID, NewPassword: "short"})
+	if _, err := NewAdminResetPasswordMethod(env.Storage, env.Hub).Execute(ctx, params); err == nil {
+		t.Error("Short password should be rejected")
+	}
+}
+
+func TestAdminResetTwoFactorMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	admin, _ := env.CreateTestUser("admin", "password123")
+	user, _ := env.CreateTestUser("locked", "password123")
+
+	env.DB.Create(&models.TwoFactor{UserID: user.ID, Secret: "JBSWY3DPEHPK3PXP", Enabled: true})
+	env.DB.Create(&models.RecoveryCode{UserID: user.ID, CodeHash: hashRecoveryCode("ABCDEFGH")})
+
+	method := NewAdminResetTwoFactorMethod(env.Storage)
+	params, _ := json.Marshal(AdminUserParams{UserID: user.ID})
+
+	adminCtx := context.WithValue(context.Background(), "user_id", admin.ID)
+	if _, err := method.Execute(adminCtx, params); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+
+	var count int64
+	env.DB.Model(&models.TwoFactor{}).Where("user_id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Error("2FA should be removed")
+	}
+	env.DB.Model(&models.RecoveryCode{}).Where("user_id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Error("Recovery codes should be removed")
+	}
+
+	params, _ = json.Marshal(AdminUserParams{UserID: 9999})
+	if _, err := method.Execute(adminCtx, params); err == nil {
+		t.Error("Expected error for unknown user")
+	}
+}
+
+func TestAdminSetRoleMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	admin, _ := env.CreateTestUser("admin", "password123")
+	user, _ := env.CreateTestUser("promoted", "password123")
+
+	method := NewAdminSetRoleMethod(env.Storage)
+	ctx := context.WithValue(context.Background(), "user_id", admin.ID)
+
+	params, _ := json.Marshal(AdminSetRoleParams{UserID: user.ID, Role: 7})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Unknown role should be rejected")
+	}
+
+	params, _ = json.Marshal(AdminSetRoleParams{UserID: user.ID, Role: models.UserRoleModerator})
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Fatalf("Set role failed: %v", err)
+	}
+
+	var updated models.User
+	env.DB.First(&updated, user.ID)
+	if updated.Role != models.UserRoleModerator {
+		t.Errorf("Expected moderator role, got %d", updated.Role)
+	}
+}
+
+func TestAdminGroupInfoMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	admin, _ := env.CreateTestUser("admin", "password123")
+	owner, _ := env.CreateTestUser("owner", "password123")
+	group, _ := env.CreateTestGroup("private", owner.ID)
+	env.DB.Create(&models.Message{SenderID: owner.ID, GroupID: &group.ID, MsgType: models.MsgTypeText, Content: "hi"})
+
+	// The admin is not a member
+	ctx := context.WithValue(context.Background(), "user_id", admin.ID)
+	params, _ := json.Marshal(AdminGroupInfoParams{GroupID: group.ID})
+	result, err := NewAdminGroupInfoMethod(env.Storage).Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Group info failed: %v", err)
+	}
+
+	info := result.(map[string]interface{})
+	if info["member_count"] != 1 || info["message_count"] != int64(1) {
+		t.Errorf("Unexpected group info: %v", info)
+	}
+
+	params, _ = json.Marshal(AdminGroupInfoParams{GroupID: 9999})
+	if _, err := NewAdminGroupInfoMethod(env.Storage).Execute(ctx, params); err == nil {
+		t.Error("Expected error for unknown group")
+	}
+}
+
+func TestAdminDeleteMessageMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	moderator, _ := env.CreateTestUser("moderator", "password123")
+	owner, _ := env.CreateTestUser("owner", "password123")
+	group, _ := env.CreateTestGroup("noisy", owner.ID)
+
+	msg := &models.Message{SenderID: owner.ID, GroupID: &group.ID, MsgType: models.MsgTypeText, Content: "spam"}
+	env.DB.Create(msg)
+
+	method := NewAdminDeleteMessageMethod(env.Storage, env.Hub)
+	ctx := context.WithValue(context.Background(), "user_id", moderator.ID)
+	params, _ := json.Marshal(AdminDeleteMessageParams{MessageID: msg.ID})
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	var count int64
+	env.DB.Model(&models.Message{}).Where("id = ?", msg.ID).Count(&count)
+	if count != 0 {
+		t.Error("Message should be deleted")
+	}
+
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Deleting a missing message should fail")
+	}
+}
+
+func TestRpcHandler_AuditLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+	handler.RegisterMethod(&PingMethod{})
+	handler.RegisterMethod(NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB)))
+	handler.RegisterMethod(NewAdminDisableUserMethod(env.Storage, env.Hub))
+
+	user, _ := env.CreateTestUser("audited", "password123")
+	token, _ := env.CreateTestToken(user)
+
+	callRpc(handler, "", "user.login", UserLoginParams{Username: "audited", Password: "wrong"})
+	callRpc(handler, "", "user.login", UserLoginParams{Username: "audited", Password: "password123"})
+	callRpc(handler, token, "admin.disable_user", AdminUserParams{UserID: 42})
+	callRpc(handler, "", "ping", nil)
+
+	var logs []models.AuditLog
+	env.DB.Order("id ASC").Find(&logs)
+	if len(logs) != 3 {
+		t.Fatalf("Expected 3 audit entries, got %d", len(logs))
+	}
+
+	failed, login, denied := logs[0], logs[1], logs[2]
+	if failed.Success || failed.Error != "invalid username or password" {
+		t.Errorf("Failed login should be recorded as failure: %+v", failed)
+	}
+	if failed.ActorID == nil || *failed.ActorID != user.ID {
+		t.Errorf("Failed login should name the account, got %v", failed.ActorID)
+	}
+	if !login.Success || login.Action != "user.login" || login.IP == "" {
+		t.Errorf("Unexpected login entry: %+v", login)
+	}
+	if strings.Contains(login.Params, "password123") || !strings.Contains(login.Params, `"password":"[redacted]"`) {
+		t.Errorf("Password should be redacted, got %s", login.Params)
+	}
+
+	if denied.Success || denied.Action != "admin.disable_user" {
+		t.Errorf("Permission denial should be recorded as failure: %+v", denied)
+	}
+	if denied.TargetType != "user" || denied.TargetID != "42" {
+		t.Errorf("Expected target user 42, got %s %s", denied.TargetType, denied.TargetID)
+	}
+
+	// Entries are append-only
+	if err := env.DB.Model(&login).Update("success", false).Error; err == nil {
+		t.Error("Audit entries should not be updatable")
+	}
+	if err := env.DB.Delete(&login).Error; err == nil {
+		t.Error("Audit entries should not be deletable")
+	}
+}
+
+func TestAdminAuditLogsMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	admin, _ := env.CreateTestUser("admin", "password123")
+	now := time.Now()
+	env.DB.Create(&[]models.AuditLog{
+		{ActorID: &admin.ID, Action: "admin.disable_user", TargetType: "user", TargetID: "7", Success: true, CreatedAt: now.Add(-2 * time.Hour)},
+		{ActorID: &admin.ID, Action: "admin.enable_user", TargetType: "user", TargetID: "7", Success: true, CreatedAt: now.Add(-time.Hour)},
+		{Action: "user.login", Success: false, CreatedAt: now},
+	})
+
+	method := NewAdminAuditLogsMethod(env.Storage)
+	ctx := context.WithValue(context.Background(), "user_id", admin.ID)
+
+	list := func(p AdminAuditLogsParams) (int64, []models.AuditLog) {
+		params, _ := json.Marshal(p)
+		result, err := method.Execute(ctx, params)
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		data := result.(map[string]interface{})
+		return data["total"].(int64), data["logs"].([]models.AuditLog)
+	}
+
+	total, logs := list(AdminAuditLogsParams{})
+	if total != 3 || logs[0].Action != "user.login" {
+		t.Errorf("Expected 3 entries newest first, got %d", total)
+	}
+
+	if total, _ = list(AdminAuditLogsParams{AuditLogFilter: AuditLogFilter{Action: "admin."}}); total != 2 {
+		t.Errorf("Expected 2 admin entries, got %d", total)
+	}
+
+	failed := false
+	if total, _ = list(AdminAuditLogsParams{AuditLogFilter: AuditLogFilter{Success: &failed}}); total != 1 {
+		t.Errorf("Expected 1 failed entry, got %d", total)
+	}
+
+	since := now.Add(-90 * time.Minute)
+	total, logs = list(AdminAuditLogsParams{AuditLogFilter: AuditLogFilter{ActorID: admin.ID, Since: &since}})
+	if total != 1 || logs[0].Action != "admin.enable_user" {
+		t.Errorf("Expected only the enable entry, got %d", total)
+	}
+}
+
+func TestApiServer_ExportAuditLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user, _ := env.CreateTestUser("regular", "password123")
+	admin, _ := env.CreateTestUser("admin", "password123")
+	env.DB.Model(admin).Update("role", models.UserRoleAdmin)
+
+	for _, action := range []string{"user.login", "admin.set_role", "user.logout"} {
+		env.DB.Create(&models.AuditLog{ActorID: &user.ID, Action: action, Success: true, CreatedAt: time.Now()})
+	}
+
+	server := &ApiServer{
+		storage:    env.Storage,
+		conf:       env.Config,
+		rpcHandler: NewRpcHandler(env.Storage, env.Hub, env.JWTManager),
+	}
+	export := func(userID int64, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/admin/audit_log.jsonl?"+query, nil)
+		c.Set("user_id", userID)
+		server.ExportAuditLog(c)
+		return w
+	}
+
+	if w := export(user.ID, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Regular users should not export, got status %d", w.Code)
+	}
+
+	w := export(admin.ID, "action=user.&since=2000-01-01T00:00:00Z")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Export failed with status %d", w.Code)
+	}
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d: %s", len(lines), w.Body.String())
+	}
+	var first models.AuditLog
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first.Action != "user.login" {
+		t.Errorf("Expected oldest entry first, got %s", lines[0])
+	}
+}
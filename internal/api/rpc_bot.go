@@ -0,0 +1,529 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"simple_im/internal/models"
+	"simple_im/internal/storage"
+	"simple_im/internal/ws"
+	"simple_im/pkg/common/config"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultMaxBotsPerOwner = 10
+	maxTokensPerBot        = 20
+	apiTokenPrefixLength   = 12 // Characters of the token kept to tell tokens apart
+)
+
+// newAPIToken returns a new bot token and the hash stored for it
+func newAPIToken() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := models.APITokenPrefix + hex.EncodeToString(secret)
+	return token, hashAPIToken(token), nil
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenSessionID is the hub session of connections opened with an API
+// token, revoking the token closes them
+func apiTokenSessionID(tokenID int64) string {
+	return "api:" + strconv.FormatInt(tokenID, 10)
+}
+
+// createBotUser saves a bot account. Bots never log in with a password,
+// they get one nobody knows, and they are hidden from user.search.
+func createBotUser(tx *gorm.DB, username, nickname string) (*models.User, error) {
+	user := &models.User{Username: username, Nickname: nickname, IsBot: true}
+	if user.Nickname == "" {
+		user.Nickname = username
+	}
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		return nil, err
+	}
+	if err := user.SetPassword(hex.EncodeToString(password)); err != nil {
+		return nil, fmt.Errorf("failed to set password: %v", err)
+	}
+	if err := tx.Create(user).Error; err != nil {
+		return nil, err
+	}
+	// Written separately, a false zero value is replaced by the column default on insert
+	if err := tx.Model(user).Update("discoverable", false).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// loadOwnedBot returns the bot when the caller owns it, other bots look
+// like they don't exist
+func loadOwnedBot(ctx context.Context, db *gorm.DB, botID int64) (*models.Bot, error) {
+	if botID == 0 {
+		return nil, errors.New("bot_id is required")
+	}
+	userID := ctx.Value("user_id").(int64)
+
+	var bot models.Bot
+	if err := db.Preload("User").Where("user_id = ? AND owner_id = ?", botID, userID).First(&bot).Error; err != nil || bot.User == nil {
+		return nil, errors.New("bot not found")
+	}
+	return &bot, nil
+}
+
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// deleteBot revokes the tokens of a bot, removes it from its groups and
+// deletes its account. Callers drop its webhook and sessions after the commit.
+func deleteBot(tx *gorm.DB, botID int64) error {
+	if err := tx.Where("user_id = ?", botID).Delete(&models.GroupMember{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.APIToken{}).Where("user_id = ? AND revoked_at IS NULL", botID).Update("revoked_at", time.Now()).Error; err != nil {
+		return err
+	}
+	if err := tx.Delete(&models.Bot{}, "user_id = ?", botID).Error; err != nil {
+		return err
+	}
+	return tx.Delete(&models.User{}, botID).Error
+}
+
+// ============ bot.create ============
+
+type BotCreateMethod struct {
+	storage *storage.Storage
+	conf    config.BotConfiguration
+}
+
+func NewBotCreateMethod(s *storage.Storage, c config.BotConfiguration) *BotCreateMethod {
+	return &BotCreateMethod{storage: s, conf: c}
+}
+
+func (m *BotCreateMethod) Name() string { return "bot.create" }
+
+func (m *BotCreateMethod) RequireAuth() bool { return true }
+
+func (m *BotCreateMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "bot", "username")
+}
+
+type BotCreateParams struct {
+	Username    string `json:"username"`
+	Nickname    string `json:"nickname"`
+	Description string `json:"description"`
+}
+
+func (m *BotCreateMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p BotCreateParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if len(p.Username) < 3 || len(p.Username) > 50 {
+		return nil, errors.New("username must be 3-50 characters")
+	}
+	if len([]rune(p.Nickname)) > 100 {
+		return nil, errors.New("nickname must be at most 100 characters")
+	}
+	if len([]rune(p.Description)) > 255 {
+		return nil, errors.New("description must be at most 255 characters")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var owner models.User
+	if err := db.First(&owner, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if owner.IsBot {
+		return nil, errors.New("bots cannot create bots")
+	}
+
+	limit := m.conf.MaxPerOwner
+	if limit <= 0 {
+		limit = defaultMaxBotsPerOwner
+	}
+	var owned int64
+	db.Model(&models.Bot{}).Where("owner_id = ?", userID).Count(&owned)
+	if owned >= int64(limit) {
+		return nil, fmt.Errorf("cannot own more than %d bots", limit)
+	}
+
+	var count int64
+	db.Model(&models.User{}).Where("username = ?", p.Username).Count(&count)
+	if count > 0 {
+		return nil, errors.New("username already exists")
+	}
+
+	var user *models.User
+	bot := &models.Bot{OwnerID: userID, Description: p.Description}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = createBotUser(tx, p.Username, p.Nickname); err != nil {
+			return fmt.Errorf("failed to create user: %v", err)
+		}
+		bot.UserID = user.ID
+		if err := tx.Create(bot).Error; err != nil {
+			return fmt.Errorf("failed to create bot: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bot.User = user
+
+	return bot, nil
+}
+
+// ============ bot.list ============
+
+type BotListMethod struct {
+	storage *storage.Storage
+}
+
+func NewBotListMethod(s *storage.Storage) *BotListMethod {
+	return &BotListMethod{storage: s}
+}
+
+func (m *BotListMethod) Name() string { return "bot.list" }
+
+func (m *BotListMethod) RequireAuth() bool { return true }
+
+func (m *BotListMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	userID := ctx.Value("user_id").(int64)
+
+	var bots []models.Bot
+	if err := m.storage.GetDB().Preload("User").Where("owner_id = ?", userID).Order("user_id").Find(&bots).Error; err != nil {
+		return nil, fmt.Errorf("failed to get bots: %v", err)
+	}
+
+	return bots, nil
+}
+
+// ============ bot.set_webhook ============
+
+type BotSetWebhookMethod struct {
+	storage  *storage.Storage
+	webhooks *botWebhooks
+}
+
+func NewBotSetWebhookMethod(s *storage.Storage, w *botWebhooks) *BotSetWebhookMethod {
+	return &BotSetWebhookMethod{storage: s, webhooks: w}
+}
+
+func (m *BotSetWebhookMethod) Name() string { return "bot.set_webhook" }
+
+func (m *BotSetWebhookMethod) RequireAuth() bool { return true }
+
+func (m *BotSetWebhookMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "bot", "bot_id")
+}
+
+type BotSetWebhookParams struct {
+	BotID int64  `json:"bot_id"`
+	URL   string `json:"url"` // Empty removes the webhook
+}
+
+// Execute stores the URL with a new secret, the secret is only returned here
+func (m *BotSetWebhookMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p BotSetWebhookParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	p.URL = strings.TrimSpace(p.URL)
+	if p.URL != "" && (len(p.URL) > 500 || !validWebhookURL(p.URL)) {
+		return nil, errors.New("url must be an http or https URL")
+	}
+
+	db := m.storage.GetDB()
+	bot, err := loadOwnedBot(ctx, db, p.BotID)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret string
+	if p.URL != "" {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(raw)
+	}
+
+	err = db.Model(bot).Updates(map[string]interface{}{"webhook_url": p.URL, "webhook_secret": secret}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to update bot: %v", err)
+	}
+	m.webhooks.set(bot.UserID, p.URL, secret)
+
+	return map[string]interface{}{
+		"webhook_url":    p.URL,
+		"webhook_secret": secret,
+	}, nil
+}
+
+// ============ bot.delete ============
+
+type BotDeleteMethod struct {
+	storage  *storage.Storage
+	hub      *ws.Hub
+	webhooks *botWebhooks
+}
+
+func NewBotDeleteMethod(s *storage.Storage, h *ws.Hub, w *botWebhooks) *BotDeleteMethod {
+	return &BotDeleteMethod{storage: s, hub: h, webhooks: w}
+}
+
+func (m *BotDeleteMethod) Name() string { return "bot.delete" }
+
+func (m *BotDeleteMethod) RequireAuth() bool { return true }
+
+func (m *BotDeleteMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "bot", "bot_id")
+}
+
+type BotDeleteParams struct {
+	BotID int64 `json:"bot_id"`
+}
+
+// Execute removes the bot from its groups and deletes its account, the
+// messages it sent stay in the history
+func (m *BotDeleteMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p BotDeleteParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	db := m.storage.GetDB()
+	bot, err := loadOwnedBot(ctx, db, p.BotID)
+	if err != nil {
+		return nil, err
+	}
+
+	var groupIDs []int64
+	db.Model(&models.GroupMember{}).Where("user_id = ?", bot.UserID).Pluck("group_id", &groupIDs)
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return deleteBot(tx, bot.UserID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete bot: %v", err)
+	}
+
+	for _, groupID := range groupIDs {
+		m.storage.InvalidateGroupMembers(ctx, groupID)
+	}
+	m.webhooks.set(bot.UserID, "", "")
+	m.hub.DisconnectSession(bot.UserID, "")
+
+	return map[string]interface{}{
+		"success": true,
+	}, nil
+}
+
+// ============ bot.create_token ============
+
+type BotCreateTokenMethod struct {
+	storage *storage.Storage
+}
+
+func NewBotCreateTokenMethod(s *storage.Storage) *BotCreateTokenMethod {
+	return &BotCreateTokenMethod{storage: s}
+}
+
+func (m *BotCreateTokenMethod) Name() string { return "bot.create_token" }
+
+func (m *BotCreateTokenMethod) RequireAuth() bool { return true }
+
+func (m *BotCreateTokenMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "bot", "bot_id")
+}
+
+type BotCreateTokenParams struct {
+	BotID     int64    `json:"bot_id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expires_in"` // Seconds, 0 never expires
+}
+
+// Execute returns the token once, only its hash is kept
+func (m *BotCreateTokenMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p BotCreateTokenParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if len(p.Scopes) == 0 {
+		return nil, errors.New("scopes is required")
+	}
+	seen := make(map[string]bool, len(p.Scopes))
+	scopes := make([]string, 0, len(p.Scopes))
+	for _, s := range p.Scopes {
+		if !models.TokenScope(s).Valid() {
+			return nil, fmt.Errorf("unknown scope: %s", s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	if len([]rune(p.Name)) > 100 {
+		return nil, errors.New("name must be at most 100 characters")
+	}
+	if p.ExpiresIn < 0 {
+		return nil, errors.New("expires_in must not be negative")
+	}
+
+	db := m.storage.GetDB()
+	bot, err := loadOwnedBot(ctx, db, p.BotID)
+	if err != nil {
+		return nil, err
+	}
+
+	var active int64
+	db.Model(&models.APIToken{}).Where("user_id = ? AND revoked_at IS NULL", bot.UserID).Count(&active)
+	if active >= maxTokensPerBot {
+		return nil, fmt.Errorf("a bot can have at most %d tokens", maxTokensPerBot)
+	}
+
+	raw, hash, err := newAPIToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+
+	token := &models.APIToken{
+		UserID:    bot.UserID,
+		Name:      p.Name,
+		TokenHash: hash,
+		Prefix:    raw[:apiTokenPrefixLength],
+		Scopes:    strings.Join(scopes, " "),
+	}
+	if p.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(time.Duration(p.ExpiresIn) * time.Second)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := db.Create(token).Error; err != nil {
+		return nil, fmt.Errorf("failed to create token: %v", err)
+	}
+
+	return map[string]interface{}{
+		"token":     raw,
+		"api_token": token,
+	}, nil
+}
+
+// ============ bot.tokens ============
+
+type BotTokensMethod struct {
+	storage *storage.Storage
+}
+
+func NewBotTokensMethod(s *storage.Storage) *BotTokensMethod {
+	return &BotTokensMethod{storage: s}
+}
+
+func (m *BotTokensMethod) Name() string { return "bot.tokens" }
+
+func (m *BotTokensMethod) RequireAuth() bool { return true }
+
+type BotTokensParams struct {
+	BotID int64 `json:"bot_id"`
+}
+
+func (m *BotTokensMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p BotTokensParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	db := m.storage.GetDB()
+	bot, err := loadOwnedBot(ctx, db, p.BotID)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []models.APIToken
+	if err := db.Where("user_id = ?", bot.UserID).Order("id DESC").Find(&tokens).Error; err != nil {
+		return nil, fmt.Errorf("failed to get tokens: %v", err)
+	}
+
+	return tokens, nil
+}
+
+// ============ bot.revoke_token ============
+
+type BotRevokeTokenMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewBotRevokeTokenMethod(s *storage.Storage, h *ws.Hub) *BotRevokeTokenMethod {
+	return &BotRevokeTokenMethod{storage: s, hub: h}
+}
+
+func (m *BotRevokeTokenMethod) Name() string { return "bot.revoke_token" }
+
+func (m *BotRevokeTokenMethod) RequireAuth() bool { return true }
+
+func (m *BotRevokeTokenMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "api_token", "token_id")
+}
+
+type BotRevokeTokenParams struct {
+	TokenID int64 `json:"token_id"`
+}
+
+func (m *BotRevokeTokenMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p BotRevokeTokenParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.TokenID == 0 {
+		return nil, errors.New("token_id is required")
+	}
+
+	db := m.storage.GetDB()
+
+	var token models.APIToken
+	if err := db.First(&token, p.TokenID).Error; err != nil {
+		return nil, errors.New("token not found")
+	}
+	if _, err := loadOwnedBot(ctx, db, token.UserID); err != nil {
+		return nil, errors.New("token not found")
+	}
+
+	if token.RevokedAt == nil {
+		now := time.Now()
+		if err := db.Model(&token).Update("revoked_at", now).Error; err != nil {
+			return nil, fmt.Errorf("failed to revoke token: %v", err)
+		}
+	}
+	m.hub.DisconnectSession(token.UserID, apiTokenSessionID(token.ID))
+
+	return map[string]interface{}{
+		"success": true,
+	}, nil
+}
@@ -0,0 +1,332 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"simple_im/internal/models"
+	"simple_im/internal/ws"
+	"simple_im/pkg/common/resp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createTestBot creates a bot of the owner and a token with the given scopes
+func createTestBot(t *testing.T, env *TestEnv, owner *models.User, username string, scopes ...string) (*models.Bot, string) {
+	ctx := context.WithValue(context.Background(), "user_id", owner.ID)
+
+	params, _ := json.Marshal(BotCreateParams{Username: username})
+	result, err := NewBotCreateMethod(env.Storage, env.Config.BotConfiguration).Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Create bot failed: %v", err)
+	}
+	bot := result.(*models.Bot)
+
+	params, _ = json.Marshal(BotCreateTokenParams{BotID: bot.UserID, Name: "test", Scopes: scopes})
+	result, err = NewBotCreateTokenMethod(env.Storage).Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Create token failed: %v", err)
+	}
+	return bot, result.(map[string]interface{})["token"].(string)
+}
+
+func TestBotCreateMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("botowner", "password123")
+	env.CreateTestUser("taken", "password123")
+	method := NewBotCreateMethod(env.Storage, env.Config.BotConfiguration)
+	method.conf.MaxPerOwner = 1
+	ctx := context.WithValue(context.Background(), "user_id", owner.ID)
+
+	params, _ := json.Marshal(BotCreateParams{Username: "taken"})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Expected error for existing username")
+	}
+
+	params, _ = json.Marshal(BotCreateParams{Username: "helper", Description: "Answers questions"})
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Create bot failed: %v", err)
+	}
+	bot := result.(*models.Bot)
+	if bot.OwnerID != owner.ID || !bot.User.IsBot {
+		t.Errorf("Unexpected bot: %+v", bot)
+	}
+
+	// user.info marks the account as a bot
+	info, err := NewUserInfoMethod(env.Storage).Execute(ctx, json.RawMessage(`{"user_id":`+strconv.FormatInt(bot.UserID, 10)+`}`))
+	if err != nil || !info.(*userProfile).IsBot {
+		t.Errorf("Expected is_bot in user.info, got %+v, %v", info, err)
+	}
+
+	params, _ = json.Marshal(BotCreateParams{Username: "helper2"})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Expected error past the bot limit")
+	}
+}
+
+func TestBotCreateTokenMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("tokenowner", "password123")
+	other, _ := env.CreateTestUser("stranger", "password123")
+	bot, _ := createTestBot(t, env, owner, "tokenbot", "messages:send")
+	method := NewBotCreateTokenMethod(env.Storage)
+
+	ctx := context.WithValue(context.Background(), "user_id", owner.ID)
+	params, _ := json.Marshal(BotCreateTokenParams{BotID: bot.UserID, Scopes: []string{"admin"}})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Expected error for unknown scope")
+	}
+
+	otherCtx := context.WithValue(context.Background(), "user_id", other.ID)
+	params, _ = json.Marshal(BotCreateTokenParams{BotID: bot.UserID, Scopes: []string{"events"}})
+	if _, err := method.Execute(otherCtx, params); err == nil {
+		t.Error("Only the owner should create tokens")
+	}
+
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Create token failed: %v", err)
+	}
+	token := result.(map[string]interface{})["api_token"].(*models.APIToken)
+	raw := result.(map[string]interface{})["token"].(string)
+	if token.TokenHash != hashAPIToken(raw) || token.Prefix != raw[:apiTokenPrefixLength] {
+		t.Error("Expected the hash and prefix of the returned token")
+	}
+
+	// Neither the token nor its hash is serialized
+	encoded, _ := json.Marshal(token)
+	if strings.Contains(string(encoded), raw) || strings.Contains(string(encoded), token.TokenHash) {
+		t.Error("Token secret should not be serialized")
+	}
+}
+
+func TestRpcHandler_APITokenScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+	handler.RegisterMethod(NewMessageSendMethod(env.Storage, env.Hub))
+	handler.RegisterMethod(NewMessageHistoryMethod(env.Storage))
+	handler.RegisterMethod(NewGroupInviteMethod(env.Storage, env.Hub, env.Config.GroupConfiguration))
+	handler.RegisterMethod(NewBotListMethod(env.Storage))
+	handler.RegisterMethod(NewBotRevokeTokenMethod(env.Storage, env.Hub))
+
+	owner, _ := env.CreateTestUser("scopeowner", "password123")
+	friend, _ := env.CreateTestUser("scopefriend", "password123")
+	group, _ := env.CreateTestGroup("Bot Group", owner.ID)
+	bot, botToken := createTestBot(t, env, owner, "scopebot", "messages:send")
+	ownerToken, _ := env.CreateTestToken(owner)
+
+	response := callRpc(handler, botToken, "message.send", MessageSendParams{GroupID: group.ID, Content: "hi"})
+	if response.Error == nil {
+		t.Error("Bot should not send to groups it was not added to")
+	}
+
+	response = callRpc(handler, ownerToken, "group.invite", GroupInviteParams{GroupID: group.ID, UserIDs: []int64{bot.UserID}})
+	if response.Error != nil {
+		t.Fatalf("Owner should add the bot: %v", response.Error)
+	}
+
+	response = callRpc(handler, botToken, "message.send", MessageSendParams{GroupID: group.ID, Content: "hi"})
+	if response.Error != nil {
+		t.Errorf("Bot should send to its group: %v", response.Error)
+	}
+
+	response = callRpc(handler, botToken, "message.send", MessageSendParams{ReceiverID: friend.ID, Content: "hi"})
+	if response.Error == nil {
+		t.Error("Bot should not send private messages")
+	}
+
+	response = callRpc(handler, botToken, "message.history", MessageHistoryParams{GroupID: group.ID})
+	if response.Error == nil || response.Error.Code != resp.PermissionDeniedCode {
+		t.Errorf("Expected permission denied without messages:read, got %+v", response.Error)
+	}
+
+	response = callRpc(handler, botToken, "bot.list", nil)
+	if response.Error == nil || response.Error.Code != resp.PermissionDeniedCode {
+		t.Errorf("Expected permission denied for unscoped method, got %+v", response.Error)
+	}
+
+	var token models.APIToken
+	env.DB.Where("user_id = ?", bot.UserID).First(&token)
+	if token.LastUsedAt == nil {
+		t.Error("Expected last_used_at to be recorded")
+	}
+
+	response = callRpc(handler, ownerToken, "bot.revoke_token", BotRevokeTokenParams{TokenID: token.ID})
+	if response.Error != nil {
+		t.Fatalf("Revoke failed: %v", response.Error)
+	}
+	response = callRpc(handler, botToken, "message.send", MessageSendParams{GroupID: group.ID, Content: "hi"})
+	if response.Error == nil {
+		t.Error("Revoked token should be refused")
+	}
+}
+
+func TestGroupInviteMethod_Bots(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("inviteowner", "password123")
+	member, _ := env.CreateTestUser("invitemember", "password123")
+	group, _ := env.CreateTestGroup("Invite Group", member.ID)
+	bot, _ := createTestBot(t, env, owner, "invitebot", "events")
+
+	ctx := context.WithValue(context.Background(), "user_id", member.ID)
+	params, _ := json.Marshal(GroupInviteParams{GroupID: group.ID, UserIDs: []int64{bot.UserID}})
+	if _, err := NewGroupInviteMethod(env.Storage, env.Hub, env.Config.GroupConfiguration).Execute(ctx, params); err == nil {
+		t.Error("Only the owner should add a bot to groups")
+	}
+}
+
+func TestBotUsers_Hidden(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("hiddenowner", "password123")
+	stranger, _ := env.CreateTestUser("hiddenstranger", "password123")
+	bot, _ := createTestBot(t, env, owner, "hiddenbot", "events")
+
+	var user models.User
+	env.DB.First(&user, bot.UserID)
+	if user.Discoverable {
+		t.Error("Bots should not be discoverable")
+	}
+
+	ctx := context.WithValue(context.WithValue(context.Background(), "user_id", stranger.ID), "username", stranger.Username)
+	params, _ := json.Marshal(FriendAddParams{FriendID: bot.UserID})
+	if _, err := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration).Execute(ctx, params); err == nil {
+		t.Error("Bots should not receive friend requests")
+	}
+}
+
+func TestBotDeleteMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("deleteowner", "password123")
+	group, _ := env.CreateTestGroup("Delete Group", owner.ID)
+	bot, raw := createTestBot(t, env, owner, "deletebot", "messages:send")
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: bot.UserID, Role: models.GroupRoleMember})
+
+	ctx := context.WithValue(context.Background(), "user_id", owner.ID)
+	params, _ := json.Marshal(BotDeleteParams{BotID: bot.UserID})
+	if _, err := NewBotDeleteMethod(env.Storage, env.Hub, nil).Execute(ctx, params); err != nil {
+		t.Fatalf("Delete bot failed: %v", err)
+	}
+
+	var count int64
+	env.DB.Model(&models.GroupMember{}).Where("user_id = ?", bot.UserID).Count(&count)
+	if count != 0 {
+		t.Error("Bot should leave its groups")
+	}
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+	if _, err := handler.ParseAPIToken(raw); err == nil {
+		t.Error("Tokens of a deleted bot should be refused")
+	}
+}
+
+func TestUserDeleteAccountMethod_Bots(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.ExportConfiguration.SavePath = t.TempDir()
+
+	owner, _ := env.CreateTestUser("leavingowner", "password123")
+	bot, raw := createTestBot(t, env, owner, "orphanbot", "messages:send")
+	group, _ := env.CreateTestGroup("Bot Group", owner.ID)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: bot.UserID, Role: models.GroupRoleMember})
+
+	webhooks := newBotWebhooks(time.Second, true)
+	webhooks.set(bot.UserID, "https://example.com/bot", "secret")
+
+	ctx := context.WithValue(context.Background(), "user_id", owner.ID)
+	params, _ := json.Marshal(UserDeleteAccountParams{Password: "password123"})
+	if _, err := NewUserDeleteAccountMethod(env.Storage, env.Hub, webhooks, nil, env.Config.ExportConfiguration).Execute(ctx, params); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+	if _, err := handler.ParseAPIToken(raw); err == nil {
+		t.Error("Tokens of the owner's bots should be refused")
+	}
+	var count int64
+	env.DB.Model(&models.Bot{}).Where("owner_id = ?", owner.ID).Count(&count)
+	if count != 0 {
+		t.Error("Owner's bots should be deleted")
+	}
+	if _, ok := webhooks.hooks[bot.UserID]; ok {
+		t.Error("Bot webhook should be dropped")
+	}
+
+	// The bot is gone before a successor is picked, so the group is dissolved
+	env.DB.Model(&models.Group{}).Where("id = ?", group.ID).Count(&count)
+	if count != 0 {
+		t.Error("Group with only the bot left should be dissolved")
+	}
+}
+
+func TestBotWebhooks_Deliver(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	webhooks := newBotWebhooks(time.Second, true)
+	webhooks.run()
+	webhooks.set(42, server.URL, "secret")
+
+	webhooks.deliver(7, &ws.Message{Type: "message", Content: "not a bot"})
+	webhooks.deliver(42, &ws.Message{Type: "message", Content: "hello"})
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhookTimestampHeader), 10, 64)
+		if r.Header.Get(webhookSignatureHeader) != signWebhook("secret", timestamp, body) {
+			t.Error("Signature does not match the body")
+		}
+		var msg ws.Message
+		if json.Unmarshal(body, &msg) != nil || msg.Content != "hello" {
+			t.Errorf("Unexpected body: %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not called")
+	}
+
+	select {
+	case <-received:
+		t.Error("Only bots with a webhook should be called")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -5,11 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"simple_im/internal/models"
 	"simple_im/internal/storage"
 	"simple_im/internal/ws"
+	"simple_im/pkg/common/config"
+
+	"gorm.io/gorm"
 )
 
 // ============ friend.list ============
@@ -26,19 +31,45 @@ func (m *FriendListMethod) Name() string { return "friend.list" }
 
 func (m *FriendListMethod) RequireAuth() bool { return true }
 
+type FriendListParams struct {
+	Tag string `json:"tag"` // Optional, only friends with this tag
+}
+
 func (m *FriendListMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p FriendListParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
 	userID := ctx.Value("user_id").(int64)
 	db := m.storage.GetDB()
 
+	query := db.Where("(user_id = ? OR friend_id = ?) AND status = ?", userID, userID, models.FriendStatusAccepted)
+
+	if tag := strings.ToLower(strings.TrimSpace(p.Tag)); tag != "" {
+		var taggedIDs []int64
+		if err := db.Model(&models.FriendTag{}).Where("user_id = ? AND tag = ?", userID, tag).
+			Pluck("friend_id", &taggedIDs).Error; err != nil {
+			return nil, fmt.Errorf("failed to get friends: %v", err)
+		}
+		if len(taggedIDs) == 0 {
+			return []map[string]interface{}{}, nil
+		}
+		query = query.Where("(user_id IN ? OR friend_id IN ?)", taggedIDs, taggedIDs)
+	}
+
 	var friends []models.Friend
-	err := db.Where("(user_id = ? OR friend_id = ?) AND status = ?", userID, userID, models.FriendStatusAccepted).
-		Preload("User").
+	err := query.Preload("User").
 		Preload("Friend").
 		Find(&friends).Error
 	if err != nil {
 		return nil, fmt.Errorf("failed to get friends: %v", err)
 	}
 
+	remarks, tags := loadFriendLabels(db, userID)
+
 	// Build friend list with user info
 	result := make([]map[string]interface{}, 0, len(friends))
 	for _, f := range friends {
@@ -49,12 +80,18 @@ func (m *FriendListMethod) Execute(ctx context.Context, params json.RawMessage)
 			friendUser = f.User
 		}
 		if friendUser != nil {
+			friendTags := tags[friendUser.ID]
+			if friendTags == nil {
+				friendTags = []string{}
+			}
 			result = append(result, map[string]interface{}{
 				"id":         f.ID,
 				"user_id":    friendUser.ID,
 				"username":   friendUser.Username,
 				"nickname":   friendUser.Nickname,
-				"avatar":     friendUser.Avatar,
+				"avatar":     visibleAvatar(friendUser, userID, true),
+				"remark":     remarks[friendUser.ID],
+				"tags":       friendTags,
 				"created_at": f.CreatedAt,
 			})
 		}
@@ -63,15 +100,44 @@ func (m *FriendListMethod) Execute(ctx context.Context, params json.RawMessage)
 	return result, nil
 }
 
+// loadFriendLabels returns the remarks and sorted tags userID gave to friends, keyed by friend id
+func loadFriendLabels(db *gorm.DB, userID int64) (map[int64]string, map[int64][]string) {
+	var remarkRows []models.FriendRemark
+	db.Where("user_id = ?", userID).Find(&remarkRows)
+	remarks := make(map[int64]string, len(remarkRows))
+	for _, r := range remarkRows {
+		remarks[r.FriendID] = r.Remark
+	}
+
+	var tagRows []models.FriendTag
+	db.Where("user_id = ?", userID).Order("tag ASC").Find(&tagRows)
+	tags := make(map[int64][]string)
+	for _, t := range tagRows {
+		tags[t.FriendID] = append(tags[t.FriendID], t.Tag)
+	}
+
+	return remarks, tags
+}
+
+// clearFriendLabels drops the remarks and tags both users gave each other
+func clearFriendLabels(tx *gorm.DB, a, b int64) error {
+	where := "(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)"
+	if err := tx.Where(where, a, b, b, a).Delete(&models.FriendRemark{}).Error; err != nil {
+		return err
+	}
+	return tx.Where(where, a, b, b, a).Delete(&models.FriendTag{}).Error
+}
+
 // ============ friend.add ============
 
 type FriendAddMethod struct {
 	storage *storage.Storage
 	hub     *ws.Hub
+	conf    config.FriendConfiguration
 }
 
-func NewFriendAddMethod(s *storage.Storage, h *ws.Hub) *FriendAddMethod {
-	return &FriendAddMethod{storage: s, hub: h}
+func NewFriendAddMethod(s *storage.Storage, h *ws.Hub, c config.FriendConfiguration) *FriendAddMethod {
+	return &FriendAddMethod{storage: s, hub: h, conf: c}
 }
 
 func (m *FriendAddMethod) Name() string { return "friend.add" }
@@ -81,6 +147,7 @@ func (m *FriendAddMethod) RequireAuth() bool { return true }
 type FriendAddParams struct {
 	FriendID int64  `json:"friend_id"`
 	Username string `json:"username"`
+	Message  string `json:"message"` // Optional greeting shown to the recipient
 }
 
 func (m *FriendAddMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
@@ -89,6 +156,11 @@ func (m *FriendAddMethod) Execute(ctx context.Context, params json.RawMessage) (
 		return nil, fmt.Errorf("invalid params: %v", err)
 	}
 
+	message := strings.TrimSpace(p.Message)
+	if utf8.RuneCountInString(message) > 255 {
+		return nil, errors.New("message must be at most 255 characters")
+	}
+
 	userID := ctx.Value("user_id").(int64)
 	username := ctx.Value("username").(string)
 	db := m.storage.GetDB()
@@ -112,38 +184,85 @@ func (m *FriendAddMethod) Execute(ctx context.Context, params json.RawMessage) (
 		return nil, errors.New("cannot add yourself as friend")
 	}
 
-	// Check if already friends or pending
-	var existing models.Friend
+	if isBlocked(db, userID, friendID) {
+		return nil, errors.New("unblock this user before adding them as friend")
+	}
+
+	var target models.User
+	if err := db.First(&target, friendID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if target.IsBot {
+		return nil, errors.New("bots cannot be added as friends")
+	}
+
+	// There is at most one row per pair, reuse it for a new request
+	friend := &models.Friend{}
 	err := db.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
-		userID, friendID, friendID, userID).First(&existing).Error
+		userID, friendID, friendID, userID).First(friend).Error
 	if err == nil {
-		if existing.Status == models.FriendStatusAccepted {
+		switch friend.Status {
+		case models.FriendStatusAccepted:
 			return nil, errors.New("already friends")
+		case models.FriendStatusPending:
+			if friend.UserID == userID {
+				return nil, errors.New("friend request already pending")
+			}
+			return nil, errors.New("this user already sent you a friend request")
 		}
-		if existing.Status == models.FriendStatusPending {
-			return nil, errors.New("friend request already pending")
+
+		if err := checkFriendRequestPolicy(db, &target, userID); err != nil {
+			return nil, err
 		}
-	}
 
-	friend := &models.Friend{
-		UserID:   userID,
-		FriendID: friendID,
-		Status:   models.FriendStatusPending,
-	}
+		// Only the previous requester has to wait, the other side may ask right away
+		cooldown := time.Duration(m.conf.RequestCooldown) * time.Second
+		if friend.UserID == userID && time.Since(friend.UpdatedAt) < cooldown {
+			return nil, errors.New("please wait before sending another friend request")
+		}
+
+		friend.UserID = userID
+		friend.FriendID = friendID
+		friend.Status = models.FriendStatusPending
+		friend.Message = message
+		friend.CreatedAt = time.Now()
+		if err := db.Save(friend).Error; err != nil {
+			return nil, fmt.Errorf("failed to create friend request: %v", err)
+		}
+	} else {
+		if err := checkFriendRequestPolicy(db, &target, userID); err != nil {
+			return nil, err
+		}
 
-	if err := db.Create(friend).Error; err != nil {
-		return nil, fmt.Errorf("failed to create friend request: %v", err)
+		friend = &models.Friend{
+			UserID:   userID,
+			FriendID: friendID,
+			Status:   models.FriendStatusPending,
+			Message:  message,
+		}
+
+		if err := db.Create(friend).Error; err != nil {
+			return nil, fmt.Errorf("failed to create friend request: %v", err)
+		}
 	}
 
-	// Send notification via WebSocket
-	m.hub.Broadcast(&ws.Message{
-		Type:       "friend_request",
-		SenderID:   userID,
-		SenderName: username,
-		ReceiverID: friendID,
-		Content:    "sent you a friend request",
-		CreatedAt:  time.Now(),
-	})
+	// Requests from blocked users are kept but never shown to the recipient,
+	// so the requester can't tell they have been blocked
+	if !isBlocked(db, friendID, userID) {
+		content := message
+		if content == "" {
+			content = "sent you a friend request"
+		}
+		m.hub.Broadcast(&ws.Message{
+			ID:         friend.ID,
+			Type:       "friend_request",
+			SenderID:   userID,
+			SenderName: username,
+			ReceiverID: friendID,
+			Content:    content,
+			CreatedAt:  time.Now(),
+		})
+	}
 
 	return map[string]interface{}{
 		"id":      friend.ID,
@@ -151,6 +270,19 @@ func (m *FriendAddMethod) Execute(ctx context.Context, params json.RawMessage) (
 	}, nil
 }
 
+// checkFriendRequestPolicy enforces who the target accepts friend requests from
+func checkFriendRequestPolicy(db *gorm.DB, target *models.User, requesterID int64) error {
+	switch target.FriendRequestPolicy {
+	case models.FriendRequestNobody:
+		return errors.New("this user does not accept friend requests")
+	case models.FriendRequestGroupMembers:
+		if !shareGroup(db, target.ID, requesterID) {
+			return errors.New("this user only accepts friend requests from group members")
+		}
+	}
+	return nil
+}
+
 // ============ friend.accept ============
 
 type FriendAcceptMethod struct {
@@ -230,6 +362,73 @@ func (m *FriendAcceptMethod) Execute(ctx context.Context, params json.RawMessage
 	}, nil
 }
 
+// ============ friend.cancel ============
+
+type FriendCancelMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewFriendCancelMethod(s *storage.Storage, h *ws.Hub) *FriendCancelMethod {
+	return &FriendCancelMethod{storage: s, hub: h}
+}
+
+func (m *FriendCancelMethod) Name() string { return "friend.cancel" }
+
+func (m *FriendCancelMethod) RequireAuth() bool { return true }
+
+type FriendCancelParams struct {
+	RequestID int64 `json:"request_id"`
+}
+
+func (m *FriendCancelMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p FriendCancelParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.RequestID == 0 {
+		return nil, errors.New("request_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	username := ctx.Value("username").(string)
+	db := m.storage.GetDB()
+
+	var friend models.Friend
+	if err := db.First(&friend, p.RequestID).Error; err != nil {
+		return nil, errors.New("friend request not found")
+	}
+
+	if friend.UserID != userID {
+		return nil, errors.New("not authorized to cancel this request")
+	}
+
+	if friend.Status != models.FriendStatusPending {
+		return nil, errors.New("request already processed")
+	}
+
+	friend.Status = models.FriendStatusCancelled
+	if err := db.Save(&friend).Error; err != nil {
+		return nil, fmt.Errorf("failed to cancel friend request: %v", err)
+	}
+
+	if !isBlocked(db, friend.FriendID, userID) {
+		m.hub.Broadcast(&ws.Message{
+			ID:         friend.ID,
+			Type:       "friend_request_cancelled",
+			SenderID:   userID,
+			SenderName: username,
+			ReceiverID: friend.FriendID,
+			CreatedAt:  time.Now(),
+		})
+	}
+
+	return map[string]interface{}{
+		"message": "friend request cancelled",
+	}, nil
+}
+
 // ============ friend.pending ============
 
 type FriendPendingMethod struct {
@@ -250,6 +449,7 @@ func (m *FriendPendingMethod) Execute(ctx context.Context, params json.RawMessag
 
 	var requests []models.Friend
 	err := db.Where("friend_id = ? AND status = ?", userID, models.FriendStatusPending).
+		Where("user_id NOT IN (SELECT blocked_id FROM blocks WHERE user_id = ?)", userID).
 		Preload("User").
 		Find(&requests).Error
 	if err != nil {
@@ -263,10 +463,280 @@ func (m *FriendPendingMethod) Execute(ctx context.Context, params json.RawMessag
 			"user_id":    r.UserID,
 			"username":   r.User.Username,
 			"nickname":   r.User.Nickname,
-			"avatar":     r.User.Avatar,
+			"avatar":     visibleAvatar(r.User, userID, false),
+			"message":    r.Message,
+			"created_at": r.CreatedAt,
+		})
+	}
+
+	return result, nil
+}
+
+// ============ friend.outgoing ============
+
+type FriendOutgoingMethod struct {
+	storage *storage.Storage
+}
+
+func NewFriendOutgoingMethod(s *storage.Storage) *FriendOutgoingMethod {
+	return &FriendOutgoingMethod{storage: s}
+}
+
+func (m *FriendOutgoingMethod) Name() string { return "friend.outgoing" }
+
+func (m *FriendOutgoingMethod) RequireAuth() bool { return true }
+
+type FriendOutgoingParams struct {
+	Status *models.FriendStatus `json:"status"` // Optional filter
+}
+
+func (m *FriendOutgoingMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p FriendOutgoingParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	query := db.Where("user_id = ?", userID).Preload("Friend").Order("updated_at DESC")
+	if p.Status != nil {
+		query = query.Where("status = ?", *p.Status)
+	}
+
+	var requests []models.Friend
+	if err := query.Find(&requests).Error; err != nil {
+		return nil, fmt.Errorf("failed to get outgoing requests: %v", err)
+	}
+
+	result := make([]map[string]interface{}, 0, len(requests))
+	for _, r := range requests {
+		if r.Friend == nil {
+			continue
+		}
+		result = append(result, map[string]interface{}{
+			"id":         r.ID,
+			"user_id":    r.FriendID,
+			"username":   r.Friend.Username,
+			"nickname":   r.Friend.Nickname,
+			"avatar":     visibleAvatar(r.Friend, userID, r.Status == models.FriendStatusAccepted),
+			"message":    r.Message,
+			"status":     r.Status,
 			"created_at": r.CreatedAt,
+			"updated_at": r.UpdatedAt,
 		})
 	}
 
 	return result, nil
 }
+
+// ============ friend.remove ============
+
+type FriendRemoveMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewFriendRemoveMethod(s *storage.Storage, h *ws.Hub) *FriendRemoveMethod {
+	return &FriendRemoveMethod{storage: s, hub: h}
+}
+
+func (m *FriendRemoveMethod) Name() string { return "friend.remove" }
+
+func (m *FriendRemoveMethod) RequireAuth() bool { return true }
+
+type FriendRemoveParams struct {
+	FriendID int64 `json:"friend_id"`
+}
+
+func (m *FriendRemoveMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p FriendRemoveParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.FriendID == 0 {
+		return nil, errors.New("friend_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	username := ctx.Value("username").(string)
+	db := m.storage.GetDB()
+
+	tx := db.Begin()
+
+	result := tx.Where("((user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)) AND status = ?",
+		userID, p.FriendID, p.FriendID, userID, models.FriendStatusAccepted).Delete(&models.Friend{})
+	if result.Error != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to remove friend: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return nil, errors.New("not friends")
+	}
+
+	if err := clearFriendLabels(tx, userID, p.FriendID); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to remove friend: %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to remove friend: %v", err)
+	}
+
+	m.hub.Broadcast(&ws.Message{
+		Type:       "friend_removed",
+		SenderID:   userID,
+		SenderName: username,
+		ReceiverID: p.FriendID,
+		CreatedAt:  time.Now(),
+	})
+
+	return map[string]interface{}{
+		"message": "friend removed",
+	}, nil
+}
+
+// ============ friend.update ============
+
+type FriendUpdateMethod struct {
+	storage *storage.Storage
+}
+
+func NewFriendUpdateMethod(s *storage.Storage) *FriendUpdateMethod {
+	return &FriendUpdateMethod{storage: s}
+}
+
+func (m *FriendUpdateMethod) Name() string { return "friend.update" }
+
+func (m *FriendUpdateMethod) RequireAuth() bool { return true }
+
+// FriendUpdateParams only changes the fields that are set, an empty remark
+// or tag list clears them
+type FriendUpdateParams struct {
+	FriendID int64     `json:"friend_id"`
+	Remark   *string   `json:"remark"`
+	Tags     *[]string `json:"tags"`
+}
+
+func (m *FriendUpdateMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p FriendUpdateParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.FriendID == 0 {
+		return nil, errors.New("friend_id is required")
+	}
+
+	var remark string
+	if p.Remark != nil {
+		remark = strings.TrimSpace(*p.Remark)
+		if utf8.RuneCountInString(remark) > 100 {
+			return nil, errors.New("remark must be at most 100 characters")
+		}
+	}
+
+	var tags []string
+	if p.Tags != nil {
+		var err error
+		if tags, err = normalizeTags(*p.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var count int64
+	db.Model(&models.Friend{}).
+		Where("((user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)) AND status = ?",
+			userID, p.FriendID, p.FriendID, userID, models.FriendStatusAccepted).
+		Count(&count)
+	if count == 0 {
+		return nil, errors.New("not friends")
+	}
+
+	tx := db.Begin()
+
+	if p.Remark != nil {
+		err := tx.Where("user_id = ? AND friend_id = ?", userID, p.FriendID).Delete(&models.FriendRemark{}).Error
+		if err == nil && remark != "" {
+			err = tx.Create(&models.FriendRemark{UserID: userID, FriendID: p.FriendID, Remark: remark}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update remark: %v", err)
+		}
+	}
+
+	if p.Tags != nil {
+		err := tx.Where("user_id = ? AND friend_id = ?", userID, p.FriendID).Delete(&models.FriendTag{}).Error
+		for _, tag := range tags {
+			if err != nil {
+				break
+			}
+			err = tx.Create(&models.FriendTag{UserID: userID, FriendID: p.FriendID, Tag: tag}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update tags: %v", err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update friend: %v", err)
+	}
+
+	remarks, allTags := loadFriendLabels(db, userID)
+	friendTags := allTags[p.FriendID]
+	if friendTags == nil {
+		friendTags = []string{}
+	}
+
+	return map[string]interface{}{
+		"friend_id": p.FriendID,
+		"remark":    remarks[p.FriendID],
+		"tags":      friendTags,
+	}, nil
+}
+
+// ============ friend.tags ============
+
+type FriendTagsMethod struct {
+	storage *storage.Storage
+}
+
+func NewFriendTagsMethod(s *storage.Storage) *FriendTagsMethod {
+	return &FriendTagsMethod{storage: s}
+}
+
+func (m *FriendTagsMethod) Name() string { return "friend.tags" }
+
+func (m *FriendTagsMethod) RequireAuth() bool { return true }
+
+func (m *FriendTagsMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	type tagCount struct {
+		Tag   string `json:"tag"`
+		Count int64  `json:"count"`
+	}
+
+	result := []tagCount{}
+	err := db.Model(&models.FriendTag{}).
+		Select("tag, COUNT(*) AS count").
+		Where("user_id = ?", userID).
+		Group("tag").
+		Order("tag ASC").
+		Scan(&result).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags: %v", err)
+	}
+
+	return result, nil
+}
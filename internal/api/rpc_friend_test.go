@@ -3,8 +3,11 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"simple_im/internal/models"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFriendAddMethod_Execute(t *testing.T) {
@@ -16,7 +19,7 @@ func TestFriendAddMethod_Execute(t *testing.T) {
 	user1, _ := env.CreateTestUser("user1", "password")
 	user2, _ := env.CreateTestUser("user2", "password")
 
-	method := NewFriendAddMethod(env.Storage, env.Hub)
+	method := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
 
 	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
 	ctx = context.WithValue(ctx, "username", user1.Username)
@@ -50,7 +53,7 @@ func TestFriendAddMethod_AddByUsername(t *testing.T) {
 	user1, _ := env.CreateTestUser("adder", "password")
 	user2, _ := env.CreateTestUser("addee", "password")
 
-	method := NewFriendAddMethod(env.Storage, env.Hub)
+	method := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
 
 	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
 	ctx = context.WithValue(ctx, "username", user1.Username)
@@ -69,7 +72,7 @@ func TestFriendAddMethod_CannotAddSelf(t *testing.T) {
 	}
 
 	user, _ := env.CreateTestUser("selfadder", "password")
-	method := NewFriendAddMethod(env.Storage, env.Hub)
+	method := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
 
 	ctx := context.WithValue(context.Background(), "user_id", user.ID)
 	ctx = context.WithValue(ctx, "username", user.Username)
@@ -213,11 +216,425 @@ func TestFriendPendingMethod_Execute(t *testing.T) {
 	}
 }
 
+func TestFriendRemoveMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("remover", "password")
+	user2, _ := env.CreateTestUser("removed", "password")
+	env.CreateTestFriendship(user2.ID, user1.ID, models.FriendStatusAccepted)
+
+	method := NewFriendRemoveMethod(env.Storage, env.Hub)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+	ctx = context.WithValue(ctx, "username", user1.Username)
+
+	params, _ := json.Marshal(FriendRemoveParams{FriendID: user2.ID})
+	_, err = method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Remove friend failed: %v", err)
+	}
+
+	var count int64
+	env.DB.Model(&models.Friend{}).Count(&count)
+	if count != 0 {
+		t.Error("Friendship should be removed")
+	}
+
+	// Removing again fails
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Should fail when not friends")
+	}
+}
+
+func TestFriendRemoveMethod_PendingNotRemoved(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("pendremover", "password")
+	user2, _ := env.CreateTestUser("pendremoved", "password")
+	env.CreateTestFriendship(user1.ID, user2.ID, models.FriendStatusPending)
+
+	method := NewFriendRemoveMethod(env.Storage, env.Hub)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+	ctx = context.WithValue(ctx, "username", user1.Username)
+
+	params, _ := json.Marshal(FriendRemoveParams{FriendID: user2.ID})
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Should not remove a pending request")
+	}
+}
+
+func TestFriendAddMethod_ResendAfterRejection(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.FriendConfiguration.RequestCooldown = 3600
+
+	user1, _ := env.CreateTestUser("persistent", "password")
+	user2, _ := env.CreateTestUser("reluctant", "password")
+	env.CreateTestFriendship(user1.ID, user2.ID, models.FriendStatusRejected)
+
+	method := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
+
+	ctx1 := context.WithValue(context.Background(), "user_id", user1.ID)
+	ctx1 = context.WithValue(ctx1, "username", user1.Username)
+
+	// The rejected requester has to wait for the cooldown
+	params, _ := json.Marshal(FriendAddParams{FriendID: user2.ID})
+	_, err = method.Execute(ctx1, params)
+	if err == nil {
+		t.Error("Should not be able to re-send during cooldown")
+	}
+
+	// The other side can send a request right away, reusing the same row
+	ctx2 := context.WithValue(context.Background(), "user_id", user2.ID)
+	ctx2 = context.WithValue(ctx2, "username", user2.Username)
+
+	params, _ = json.Marshal(FriendAddParams{FriendID: user1.ID})
+	_, err = method.Execute(ctx2, params)
+	if err != nil {
+		t.Fatalf("Reverse request failed: %v", err)
+	}
+
+	var friends []models.Friend
+	env.DB.Find(&friends)
+	if len(friends) != 1 {
+		t.Fatalf("Expected 1 canonical row, got %d", len(friends))
+	}
+	if friends[0].UserID != user2.ID || friends[0].Status != models.FriendStatusPending {
+		t.Errorf("Expected pending request from %d, got %+v", user2.ID, friends[0])
+	}
+}
+
+func TestFriendAddMethod_ResendAfterCooldown(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.FriendConfiguration.RequestCooldown = 3600
+
+	user1, _ := env.CreateTestUser("patient", "password")
+	user2, _ := env.CreateTestUser("busy", "password")
+	env.CreateTestFriendship(user1.ID, user2.ID, models.FriendStatusRejected)
+
+	// Pretend the rejection happened two hours ago
+	env.DB.Model(&models.Friend{}).Where("user_id = ?", user1.ID).
+		UpdateColumn("updated_at", time.Now().Add(-2*time.Hour))
+
+	method := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+	ctx = context.WithValue(ctx, "username", user1.Username)
+
+	params, _ := json.Marshal(FriendAddParams{FriendID: user2.ID})
+	_, err = method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Re-send after cooldown failed: %v", err)
+	}
+
+	var count int64
+	env.DB.Model(&models.Friend{}).Where("status = ?", models.FriendStatusPending).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 pending request, got %d", count)
+	}
+}
+
+func TestFriendAddMethod_ReverseDuplicate(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("first", "password")
+	user2, _ := env.CreateTestUser("second", "password")
+	env.CreateTestFriendship(user1.ID, user2.ID, models.FriendStatusPending)
+
+	method := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
+
+	ctx := context.WithValue(context.Background(), "user_id", user2.ID)
+	ctx = context.WithValue(ctx, "username", user2.Username)
+
+	params, _ := json.Marshal(FriendAddParams{FriendID: user1.ID})
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Should not create a second request in the reverse direction")
+	}
+
+	// The database refuses a second row for the same pair as well
+	err = env.CreateTestFriendship(user2.ID, user1.ID, models.FriendStatusPending)
+	if err == nil {
+		t.Error("Database should reject a duplicate pair")
+	}
+}
+
+func TestFriendCancelMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("canceller", "password")
+	user2, _ := env.CreateTestUser("cancelee", "password")
+
+	addMethod := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
+
+	ctx1 := context.WithValue(context.Background(), "user_id", user1.ID)
+	ctx1 = context.WithValue(ctx1, "username", user1.Username)
+
+	params, _ := json.Marshal(FriendAddParams{FriendID: user2.ID})
+	result, err := addMethod.Execute(ctx1, params)
+	if err != nil {
+		t.Fatalf("Add friend failed: %v", err)
+	}
+	requestID := result.(map[string]interface{})["id"].(int64)
+
+	method := NewFriendCancelMethod(env.Storage, env.Hub)
+
+	// Recipient cannot cancel
+	ctx2 := context.WithValue(context.Background(), "user_id", user2.ID)
+	ctx2 = context.WithValue(ctx2, "username", user2.Username)
+	params, _ = json.Marshal(FriendCancelParams{RequestID: requestID})
+	if _, err := method.Execute(ctx2, params); err == nil {
+		t.Error("Recipient should not be able to cancel the request")
+	}
+
+	if _, err := method.Execute(ctx1, params); err != nil {
+		t.Fatalf("Cancel request failed: %v", err)
+	}
+
+	var friend models.Friend
+	env.DB.First(&friend, requestID)
+	if friend.Status != models.FriendStatusCancelled {
+		t.Errorf("Expected cancelled status, got %d", friend.Status)
+	}
+
+	// With no cooldown configured the request can be sent again
+	params, _ = json.Marshal(FriendAddParams{FriendID: user2.ID})
+	result, err = addMethod.Execute(ctx1, params)
+	if err != nil {
+		t.Fatalf("Re-send after cancel failed: %v", err)
+	}
+	if result.(map[string]interface{})["id"].(int64) != requestID {
+		t.Error("Re-sent request should reuse the existing row")
+	}
+}
+
+func TestFriendAddMethod_Greeting(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("greeter", "password")
+	user2, _ := env.CreateTestUser("greeted", "password")
+
+	method := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+	ctx = context.WithValue(ctx, "username", user1.Username)
+
+	params, _ := json.Marshal(FriendAddParams{FriendID: user2.ID, Message: "Hi, we met at the conference"})
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Fatalf("Add friend failed: %v", err)
+	}
+
+	pendingMethod := NewFriendPendingMethod(env.Storage)
+	result, err := pendingMethod.Execute(context.WithValue(context.Background(), "user_id", user2.ID), nil)
+	if err != nil {
+		t.Fatalf("Get pending failed: %v", err)
+	}
+
+	pending := result.([]map[string]interface{})
+	if len(pending) != 1 || pending[0]["message"] != "Hi, we met at the conference" {
+		t.Errorf("Expected greeting in pending request, got %v", pending)
+	}
+}
+
+func TestFriendOutgoingMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("outgoer", "password")
+	user2, _ := env.CreateTestUser("outtarget1", "password")
+	user3, _ := env.CreateTestUser("outtarget2", "password")
+	env.CreateTestFriendship(user1.ID, user2.ID, models.FriendStatusPending)
+	env.CreateTestFriendship(user1.ID, user3.ID, models.FriendStatusRejected)
+	env.CreateTestFriendship(user3.ID, user2.ID, models.FriendStatusPending)
+
+	method := NewFriendOutgoingMethod(env.Storage)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+
+	result, err := method.Execute(ctx, nil)
+	if err != nil {
+		t.Fatalf("Get outgoing failed: %v", err)
+	}
+	if len(result.([]map[string]interface{})) != 2 {
+		t.Errorf("Expected 2 outgoing requests, got %d", len(result.([]map[string]interface{})))
+	}
+
+	status := models.FriendStatusRejected
+	params, _ := json.Marshal(FriendOutgoingParams{Status: &status})
+	result, err = method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Get outgoing failed: %v", err)
+	}
+
+	requests := result.([]map[string]interface{})
+	if len(requests) != 1 || requests[0]["user_id"] != user3.ID {
+		t.Errorf("Expected rejected request to %d, got %v", user3.ID, requests)
+	}
+}
+
+func TestFriendUpdateMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("labeler", "password")
+	user2, _ := env.CreateTestUser("bob", "password")
+	user3, _ := env.CreateTestUser("carol", "password")
+	env.CreateTestFriendship(user1.ID, user2.ID, models.FriendStatusAccepted)
+	env.CreateTestFriendship(user3.ID, user1.ID, models.FriendStatusAccepted)
+
+	method := NewFriendUpdateMethod(env.Storage)
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+
+	remark := "Bob from Finance"
+	tags := []string{"Work", "finance", "work"}
+	params, _ := json.Marshal(FriendUpdateParams{FriendID: user2.ID, Remark: &remark, Tags: &tags})
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Update friend failed: %v", err)
+	}
+
+	resultMap := result.(map[string]interface{})
+	if resultMap["remark"] != remark {
+		t.Errorf("Expected remark '%s', got '%v'", remark, resultMap["remark"])
+	}
+	if len(resultMap["tags"].([]string)) != 2 {
+		t.Errorf("Expected 2 normalized tags, got %v", resultMap["tags"])
+	}
+
+	tags = []string{"work"}
+	params, _ = json.Marshal(FriendUpdateParams{FriendID: user3.ID, Tags: &tags})
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Fatalf("Update friend failed: %v", err)
+	}
+
+	// Remarks are private to the user who set them
+	listMethod := NewFriendListMethod(env.Storage)
+	ctx2 := context.WithValue(context.Background(), "user_id", user2.ID)
+	result, _ = listMethod.Execute(ctx2, nil)
+	friends := result.([]map[string]interface{})
+	if len(friends) != 1 || friends[0]["remark"] != "" {
+		t.Errorf("Remark should not be visible to the friend, got %v", friends)
+	}
+
+	params, _ = json.Marshal(FriendListParams{Tag: "finance"})
+	result, err = listMethod.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Get friends by tag failed: %v", err)
+	}
+	friends = result.([]map[string]interface{})
+	if len(friends) != 1 || friends[0]["user_id"] != user2.ID || friends[0]["remark"] != remark {
+		t.Errorf("Expected only bob with remark, got %v", friends)
+	}
+
+	params, _ = json.Marshal(FriendListParams{Tag: "Work"})
+	result, _ = listMethod.Execute(ctx, params)
+	if len(result.([]map[string]interface{})) != 2 {
+		t.Errorf("Expected 2 friends tagged work, got %v", result)
+	}
+
+	params, _ = json.Marshal(FriendListParams{Tag: "family"})
+	result, _ = listMethod.Execute(ctx, params)
+	if len(result.([]map[string]interface{})) != 0 {
+		t.Errorf("Expected no friends tagged family, got %v", result)
+	}
+
+	tagsMethod := NewFriendTagsMethod(env.Storage)
+	result, err = tagsMethod.Execute(ctx, nil)
+	if err != nil {
+		t.Fatalf("Get friend tags failed: %v", err)
+	}
+	data, _ := json.Marshal(result)
+	if string(data) != `[{"tag":"finance","count":1},{"tag":"work","count":2}]` {
+		t.Errorf("Unexpected tag counts: %s", data)
+	}
+
+	// Removing the friend drops the labels
+	removeMethod := NewFriendRemoveMethod(env.Storage, env.Hub)
+	removeCtx := context.WithValue(ctx, "username", user1.Username)
+	params, _ = json.Marshal(FriendRemoveParams{FriendID: user2.ID})
+	if _, err := removeMethod.Execute(removeCtx, params); err != nil {
+		t.Fatalf("Remove friend failed: %v", err)
+	}
+
+	var count int64
+	env.DB.Model(&models.FriendRemark{}).Count(&count)
+	if count != 0 {
+		t.Error("Remark should be removed with the friendship")
+	}
+	env.DB.Model(&models.FriendTag{}).Where("friend_id = ?", user2.ID).Count(&count)
+	if count != 0 {
+		t.Error("Tags should be removed with the friendship")
+	}
+}
+
+func TestFriendUpdateMethod_Validation(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("validator", "password")
+	user2, _ := env.CreateTestUser("stranger", "password")
+
+	method := NewFriendUpdateMethod(env.Storage)
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+
+	remark := "Stranger"
+	params, _ := json.Marshal(FriendUpdateParams{FriendID: user2.ID, Remark: &remark})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Should fail when not friends")
+	}
+
+	env.CreateTestFriendship(user1.ID, user2.ID, models.FriendStatusAccepted)
+
+	remark = strings.Repeat("a", 101)
+	params, _ = json.Marshal(FriendUpdateParams{FriendID: user2.ID, Remark: &remark})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Should fail for a remark longer than 100 characters")
+	}
+
+	tags := make([]string, maxTags+1)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("tag%d", i)
+	}
+	params, _ = json.Marshal(FriendUpdateParams{FriendID: user2.ID, Tags: &tags})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Should fail for too many tags")
+	}
+}
+
 func TestFriendMethods_RequireAuth(t *testing.T) {
 	env, _ := SetupTestEnv()
 
 	listMethod := NewFriendListMethod(env.Storage)
-	addMethod := NewFriendAddMethod(env.Storage, env.Hub)
+	addMethod := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
 	acceptMethod := NewFriendAcceptMethod(env.Storage, env.Hub)
 	pendingMethod := NewFriendPendingMethod(env.Storage)
 
@@ -234,3 +651,41 @@ func TestFriendMethods_RequireAuth(t *testing.T) {
 		t.Error("Pending should require auth")
 	}
 }
+
+func TestFriendAddMethod_RequestPolicy(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	target, _ := env.CreateTestUser("picky", "password")
+	requester, _ := env.CreateTestUser("eager", "password")
+
+	targetCtx := context.WithValue(context.Background(), "user_id", target.ID)
+	ctx := context.WithValue(context.Background(), "user_id", requester.ID)
+	ctx = context.WithValue(ctx, "username", requester.Username)
+
+	privacyMethod := NewUserUpdatePrivacyMethod(env.Storage)
+	method := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
+	params, _ := json.Marshal(FriendAddParams{FriendID: target.ID})
+
+	policy := models.FriendRequestNobody
+	privacyParams, _ := json.Marshal(UserUpdatePrivacyParams{FriendRequestPolicy: &policy})
+	privacyMethod.Execute(targetCtx, privacyParams)
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Should fail when the user accepts no friend requests")
+	}
+
+	policy = models.FriendRequestGroupMembers
+	privacyParams, _ = json.Marshal(UserUpdatePrivacyParams{FriendRequestPolicy: &policy})
+	privacyMethod.Execute(targetCtx, privacyParams)
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Should fail without a shared group")
+	}
+
+	group, _ := env.CreateTestGroup("Shared", target.ID)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: requester.ID, Role: models.GroupRoleMember})
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Errorf("Group members should be able to send requests: %v", err)
+	}
+}
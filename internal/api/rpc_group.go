@@ -2,23 +2,122 @@ package api
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"simple_im/internal/models"
 	"simple_im/internal/storage"
+	"simple_im/internal/ws"
+	"simple_im/pkg/common/config"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultGroupMaxMembers = 500
+	groupInfoMemberPreview = 50
+	maxTags                = 10
+	maxTagLength           = 30
 )
 
+// groupMaxMembers returns the configured member limit of a group
+func groupMaxMembers(c config.GroupConfiguration) int {
+	if c.MaxMembers <= 0 {
+		return defaultGroupMaxMembers
+	}
+	return c.MaxMembers
+}
+
+// checkGroupCapacity fails when adding n members would exceed the group size
+// limit. It locks the group row, so call it in the transaction adding the
+// members to keep concurrent joins from all passing the check.
+func checkGroupCapacity(tx *gorm.DB, c config.GroupConfiguration, groupID int64, n int) error {
+	var group models.Group
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&group, groupID).Error; err != nil {
+		return errors.New("group not found")
+	}
+
+	var memberCount int64
+	tx.Model(&models.GroupMember{}).Where("group_id = ?", groupID).Count(&memberCount)
+	if maxMembers := groupMaxMembers(c); memberCount+int64(n) > int64(maxMembers) {
+		return fmt.Errorf("group cannot have more than %d members", maxMembers)
+	}
+	return nil
+}
+
+// normalizeTags lower-cases, trims and de-duplicates group or friend tags, the result is sorted
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag must be at most %d characters", maxTagLength)
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	if len(result) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// saveGroupTags replaces the tags of a group
+func saveGroupTags(tx *gorm.DB, groupID int64, tags []string) error {
+	if err := tx.Where("group_id = ?", groupID).Delete(&models.GroupTag{}).Error; err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := tx.Create(&models.GroupTag{GroupID: groupID, Tag: tag}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadGroupTags returns the sorted tags of the given groups keyed by group id
+func loadGroupTags(db *gorm.DB, groupIDs []int64) map[int64][]string {
+	result := make(map[int64][]string, len(groupIDs))
+	if len(groupIDs) == 0 {
+		return result
+	}
+
+	var tags []models.GroupTag
+	db.Where("group_id IN ?", groupIDs).Order("tag ASC").Find(&tags)
+	for _, t := range tags {
+		result[t.GroupID] = append(result[t.GroupID], t.Tag)
+	}
+	return result
+}
+
+func validGroupJoinPolicy(policy models.GroupJoinPolicy) bool {
+	return policy >= models.GroupJoinOpen && policy <= models.GroupJoinInviteOnly
+}
+
 // ============ group.create ============
 
 type GroupCreateMethod struct {
 	storage *storage.Storage
+	hub     *ws.Hub
+	conf    config.GroupConfiguration
 }
 
-func NewGroupCreateMethod(s *storage.Storage) *GroupCreateMethod {
-	return &GroupCreateMethod{storage: s}
+func NewGroupCreateMethod(s *storage.Storage, h *ws.Hub, c config.GroupConfiguration) *GroupCreateMethod {
+	return &GroupCreateMethod{storage: s, hub: h, conf: c}
 }
 
 func (m *GroupCreateMethod) Name() string { return "group.create" }
@@ -26,9 +125,13 @@ func (m *GroupCreateMethod) Name() string { return "group.create" }
 func (m *GroupCreateMethod) RequireAuth() bool { return true }
 
 type GroupCreateParams struct {
-	Name      string  `json:"name"`
-	Avatar    string  `json:"avatar"`
-	MemberIDs []int64 `json:"member_ids"`
+	Name        string                 `json:"name"`
+	Avatar      string                 `json:"avatar"`
+	Description string                 `json:"description"`
+	IsPublic    bool                   `json:"is_public"`
+	JoinPolicy  models.GroupJoinPolicy `json:"join_policy"` // 0:open 1:approval 2:invite only
+	Tags        []string               `json:"tags"`
+	MemberIDs   []int64                `json:"member_ids"`
 }
 
 func (m *GroupCreateMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
@@ -41,14 +144,47 @@ func (m *GroupCreateMethod) Execute(ctx context.Context, params json.RawMessage)
 		return nil, errors.New("group name is required")
 	}
 
+	if utf8.RuneCountInString(p.Description) > 500 {
+		return nil, errors.New("description must be at most 500 characters")
+	}
+
+	if !validGroupJoinPolicy(p.JoinPolicy) {
+		return nil, errors.New("invalid join_policy")
+	}
+
+	tags, err := normalizeTags(p.Tags)
+	if err != nil {
+		return nil, err
+	}
+
 	userID := ctx.Value("user_id").(int64)
 	db := m.storage.GetDB()
 
+	// De-duplicate members so the size limit counts real people
+	candidates := make([]int64, 0, len(p.MemberIDs))
+	seen := map[int64]bool{userID: true}
+	for _, memberID := range p.MemberIDs {
+		if seen[memberID] {
+			continue
+		}
+		seen[memberID] = true
+		candidates = append(candidates, memberID)
+	}
+	// Users who wouldn't accept an invite are left out and reported as refused
+	memberIDs, refused := filterInvitees(db, userID, candidates)
+
+	if maxMembers := groupMaxMembers(m.conf); len(memberIDs)+1 > maxMembers {
+		return nil, fmt.Errorf("group cannot have more than %d members", maxMembers)
+	}
+
 	// Create group
 	group := &models.Group{
-		Name:    p.Name,
-		OwnerID: userID,
-		Avatar:  p.Avatar,
+		Name:        p.Name,
+		OwnerID:     userID,
+		Avatar:      p.Avatar,
+		Description: p.Description,
+		IsPublic:    p.IsPublic,
+		JoinPolicy:  p.JoinPolicy,
 	}
 
 	tx := db.Begin()
@@ -58,6 +194,11 @@ func (m *GroupCreateMethod) Execute(ctx context.Context, params json.RawMessage)
 		return nil, fmt.Errorf("failed to create group: %v", err)
 	}
 
+	if err := saveGroupTags(tx, group.ID, tags); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to save tags: %v", err)
+	}
+
 	// Add owner as member
 	ownerMember := &models.GroupMember{
 		GroupID:  group.ID,
@@ -71,10 +212,7 @@ func (m *GroupCreateMethod) Execute(ctx context.Context, params json.RawMessage)
 	}
 
 	// Add other members
-	for _, memberID := range p.MemberIDs {
-		if memberID == userID {
-			continue
-		}
+	for _, memberID := range memberIDs {
 		member := &models.GroupMember{
 			GroupID:  group.ID,
 			UserID:   memberID,
@@ -87,9 +225,53 @@ func (m *GroupCreateMethod) Execute(ctx context.Context, params json.RawMessage)
 		}
 	}
 
-	tx.Commit()
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to create group: %v", err)
+	}
 
-	return group, nil
+	sendGroupSystemMessage(ctx, m.storage, m.hub, group, userID, models.SystemPayload{
+		Event:   models.SystemEventGroupCreated,
+		Targets: systemTargets(memberIDs),
+	})
+
+	return &createdGroup{Group: group, Refused: refused}, nil
+}
+
+// createdGroup is the new group and the requested members left out of it
+type createdGroup struct {
+	*models.Group
+	Refused []int64 `json:"refused"`
+}
+
+// filterInvitees splits users into those the inviter may add to a group and
+// those who refuse. Being added makes users share a group, so unless they are
+// friends it is held to the invitee's friend request policy and blocks. Bots
+// can only be added by their owner, unknown users are refused as well.
+func filterInvitees(db *gorm.DB, inviterID int64, userIDs []int64) ([]int64, []int64) {
+	allowed := make([]int64, 0, len(userIDs))
+	refused := make([]int64, 0)
+	if len(userIDs) == 0 {
+		return allowed, refused
+	}
+
+	var users []models.User
+	ownBots := db.Model(&models.Bot{}).Select("user_id").Where("owner_id = ?", inviterID)
+	db.Where("id IN ?", userIDs).Where("is_bot = ? OR id IN (?)", false, ownBots).Find(&users)
+	found := make(map[int64]*models.User, len(users))
+	for i := range users {
+		found[users[i].ID] = &users[i]
+	}
+
+	for _, id := range userIDs {
+		target := found[id]
+		if target == nil || (!target.IsBot && (isBlocked(db, target.ID, inviterID) ||
+			(!areFriends(db, inviterID, target.ID) && checkFriendRequestPolicy(db, target, inviterID) != nil))) {
+			refused = append(refused, id)
+			continue
+		}
+		allowed = append(allowed, id)
+	}
+	return allowed, refused
 }
 
 // ============ group.list ============
@@ -106,6 +288,8 @@ func (m *GroupListMethod) Name() string { return "group.list" }
 
 func (m *GroupListMethod) RequireAuth() bool { return true }
 
+func (m *GroupListMethod) RequiredScope() models.TokenScope { return models.ScopeGroupsRead }
+
 func (m *GroupListMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
 	userID := ctx.Value("user_id").(int64)
 	db := m.storage.GetDB()
@@ -123,13 +307,14 @@ func (m *GroupListMethod) Execute(ctx context.Context, params json.RawMessage) (
 	for _, m := range members {
 		if m.Group != nil {
 			result = append(result, map[string]interface{}{
-				"id":         m.Group.ID,
-				"name":       m.Group.Name,
-				"avatar":     m.Group.Avatar,
-				"owner_id":   m.Group.OwnerID,
-				"owner_name": m.Group.Owner.Nickname,
-				"role":       m.Role,
-				"joined_at":  m.JoinedAt,
+				"id":          m.Group.ID,
+				"name":        m.Group.Name,
+				"avatar":      m.Group.Avatar,
+				"description": m.Group.Description,
+				"owner_id":    m.Group.OwnerID,
+				"owner_name":  m.Group.Owner.Nickname,
+				"role":        m.Role,
+				"joined_at":   m.JoinedAt,
 			})
 		}
 	}
@@ -151,6 +336,8 @@ func (m *GroupInfoMethod) Name() string { return "group.info" }
 
 func (m *GroupInfoMethod) RequireAuth() bool { return true }
 
+func (m *GroupInfoMethod) RequiredScope() models.TokenScope { return models.ScopeGroupsRead }
+
 type GroupInfoParams struct {
 	GroupID int64 `json:"group_id"`
 }
@@ -176,34 +363,42 @@ func (m *GroupInfoMethod) Execute(ctx context.Context, params json.RawMessage) (
 	}
 
 	var group models.Group
-	err = db.Preload("Owner").Preload("Members").Preload("Members.User").First(&group, p.GroupID).Error
+	err = db.Preload("Owner").First(&group, p.GroupID).Error
 	if err != nil {
 		return nil, errors.New("group not found")
 	}
 
-	// Build member list
-	members := make([]map[string]interface{}, 0, len(group.Members))
-	for _, m := range group.Members {
-		if m.User != nil {
-			members = append(members, map[string]interface{}{
-				"user_id":   m.UserID,
-				"username":  m.User.Username,
-				"nickname":  m.User.Nickname,
-				"avatar":    m.User.Avatar,
-				"role":      m.Role,
-				"joined_at": m.JoinedAt,
-			})
-		}
+	var memberCount int64
+	db.Model(&models.GroupMember{}).Where("group_id = ?", p.GroupID).Count(&memberCount)
+
+	// Only a preview of the member list, use group.members to page through all of them
+	var preview []models.GroupMember
+	err = db.Where("group_id = ?", p.GroupID).
+		Preload("User").
+		Order("role DESC, joined_at ASC, id ASC").
+		Limit(groupInfoMemberPreview).
+		Find(&preview).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get members: %v", err)
 	}
 
+	members := buildGroupMemberList(db, userID, preview)
+
 	return map[string]interface{}{
-		"id":         group.ID,
-		"name":       group.Name,
-		"avatar":     group.Avatar,
-		"owner_id":   group.OwnerID,
-		"owner_name": group.Owner.Nickname,
-		"created_at": group.CreatedAt,
-		"members":    members,
+		"id":           group.ID,
+		"name":         group.Name,
+		"avatar":       group.Avatar,
+		"description":  group.Description,
+		"announcement": group.Announcement,
+		"is_public":    group.IsPublic,
+		"join_policy":  group.JoinPolicy,
+		"tags":         loadGroupTags(db, []int64{group.ID})[group.ID],
+		"owner_id":     group.OwnerID,
+		"owner_name":   group.Owner.Nickname,
+		"created_at":   group.CreatedAt,
+		"updated_at":   group.UpdatedAt,
+		"member_count": memberCount,
+		"members":      members,
 	}, nil
 }
 
@@ -211,10 +406,12 @@ func (m *GroupInfoMethod) Execute(ctx context.Context, params json.RawMessage) (
 
 type GroupJoinMethod struct {
 	storage *storage.Storage
+	hub     *ws.Hub
+	conf    config.GroupConfiguration
 }
 
-func NewGroupJoinMethod(s *storage.Storage) *GroupJoinMethod {
-	return &GroupJoinMethod{storage: s}
+func NewGroupJoinMethod(s *storage.Storage, h *ws.Hub, c config.GroupConfiguration) *GroupJoinMethod {
+	return &GroupJoinMethod{storage: s, hub: h, conf: c}
 }
 
 func (m *GroupJoinMethod) Name() string { return "group.join" }
@@ -222,7 +419,8 @@ func (m *GroupJoinMethod) Name() string { return "group.join" }
 func (m *GroupJoinMethod) RequireAuth() bool { return true }
 
 type GroupJoinParams struct {
-	GroupID int64 `json:"group_id"`
+	GroupID int64  `json:"group_id"`
+	Message string `json:"message"` // Shown to admins when the group requires approval
 }
 
 func (m *GroupJoinMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
@@ -251,18 +449,1419 @@ func (m *GroupJoinMethod) Execute(ctx context.Context, params json.RawMessage) (
 		return nil, errors.New("already a member of this group")
 	}
 
+	switch group.JoinPolicy {
+	case models.GroupJoinInviteOnly:
+		return nil, errors.New("this group is invite only")
+	case models.GroupJoinApproval:
+		return m.requestJoin(ctx, &group, userID, p.Message)
+	}
+
 	member := &models.GroupMember{
 		GroupID:  p.GroupID,
 		UserID:   userID,
 		Role:     models.GroupRoleMember,
 		JoinedAt: time.Now(),
 	}
-
-	if err := db.Create(member).Error; err != nil {
-		return nil, fmt.Errorf("failed to join group: %v", err)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := checkGroupCapacity(tx, m.conf, p.GroupID, 1); err != nil {
+			return err
+		}
+		if err := tx.Create(member).Error; err != nil {
+			return fmt.Errorf("failed to join group: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	m.storage.InvalidateGroupMembers(ctx, p.GroupID)
+
+	sendGroupSystemMessage(ctx, m.storage, m.hub, &group, userID, models.SystemPayload{
+		Event: models.SystemEventMemberJoined,
+	})
+
 	return map[string]interface{}{
 		"message": "joined group successfully",
 	}, nil
 }
+
+// requestJoin files a join request for admins to review
+func (m *GroupJoinMethod) requestJoin(ctx context.Context, group *models.Group, userID int64, message string) (interface{}, error) {
+	if utf8.RuneCountInString(message) > 255 {
+		return nil, errors.New("message must be at most 255 characters")
+	}
+
+	username := ctx.Value("username").(string)
+	db := m.storage.GetDB()
+
+	var pending models.GroupJoinRequest
+	err := db.Where("group_id = ? AND user_id = ? AND status = ?", group.ID, userID, models.GroupJoinRequestPending).
+		First(&pending).Error
+	if err == nil {
+		return nil, errors.New("join request already pending")
+	}
+
+	request := &models.GroupJoinRequest{
+		GroupID: group.ID,
+		UserID:  userID,
+		Message: message,
+		Status:  models.GroupJoinRequestPending,
+	}
+	if err := db.Create(request).Error; err != nil {
+		return nil, fmt.Errorf("failed to create join request: %v", err)
+	}
+
+	var adminIDs []int64
+	db.Model(&models.GroupMember{}).Where("group_id = ? AND role >= ?", group.ID, models.GroupRoleAdmin).Pluck("user_id", &adminIDs)
+
+	m.hub.Broadcast(&ws.Message{
+		ID:           request.ID,
+		Type:         "group_join_request",
+		SenderID:     userID,
+		SenderName:   username,
+		GroupID:      group.ID,
+		GroupName:    group.Name,
+		Content:      message,
+		CreatedAt:    request.CreatedAt,
+		GroupMembers: adminIDs,
+	})
+
+	return map[string]interface{}{
+		"id":      request.ID,
+		"pending": true,
+		"message": "join request sent",
+	}, nil
+}
+
+// ============ group.update ============
+
+type GroupUpdateMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewGroupUpdateMethod(s *storage.Storage, h *ws.Hub) *GroupUpdateMethod {
+	return &GroupUpdateMethod{storage: s, hub: h}
+}
+
+func (m *GroupUpdateMethod) Name() string { return "group.update" }
+
+func (m *GroupUpdateMethod) RequireAuth() bool { return true }
+
+func (m *GroupUpdateMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "group", "group_id")
+}
+
+// GroupUpdateParams uses pointers so that omitted fields are left untouched
+// while an empty string can still be used to clear a field.
+type GroupUpdateParams struct {
+	GroupID      int64                   `json:"group_id"`
+	Name         *string                 `json:"name"`
+	Avatar       *string                 `json:"avatar"`
+	Description  *string                 `json:"description"`
+	Announcement *string                 `json:"announcement"`
+	IsPublic     *bool                   `json:"is_public"`
+	JoinPolicy   *models.GroupJoinPolicy `json:"join_policy"`
+	Tags         *[]string               `json:"tags"`
+}
+
+func (m *GroupUpdateMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupUpdateParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var membership models.GroupMember
+	err := db.Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+	if err != nil {
+		return nil, errors.New("not a member of this group")
+	}
+
+	if membership.Role < models.GroupRoleAdmin {
+		return nil, errors.New("only group owner or admin can update the group")
+	}
+
+	var group models.Group
+	if err := db.First(&group, p.GroupID).Error; err != nil {
+		return nil, errors.New("group not found")
+	}
+
+	updates := make(map[string]interface{})
+
+	if p.Name != nil {
+		name := strings.TrimSpace(*p.Name)
+		if name == "" {
+			return nil, errors.New("group name is required")
+		}
+		if utf8.RuneCountInString(name) > 100 {
+			return nil, errors.New("group name must be at most 100 characters")
+		}
+		if name != group.Name {
+			updates["name"] = name
+		}
+	}
+
+	if p.Avatar != nil && *p.Avatar != group.Avatar {
+		if len(*p.Avatar) > 500 {
+			return nil, errors.New("avatar url is too long")
+		}
+		updates["avatar"] = *p.Avatar
+	}
+
+	if p.Description != nil && *p.Description != group.Description {
+		if utf8.RuneCountInString(*p.Description) > 500 {
+			return nil, errors.New("description must be at most 500 characters")
+		}
+		updates["description"] = *p.Description
+	}
+
+	if p.Announcement != nil && *p.Announcement != group.Announcement {
+		if utf8.RuneCountInString(*p.Announcement) > 2000 {
+			return nil, errors.New("announcement must be at most 2000 characters")
+		}
+		updates["announcement"] = *p.Announcement
+	}
+
+	if p.IsPublic != nil && *p.IsPublic != group.IsPublic {
+		updates["is_public"] = *p.IsPublic
+	}
+
+	if p.JoinPolicy != nil && *p.JoinPolicy != group.JoinPolicy {
+		if !validGroupJoinPolicy(*p.JoinPolicy) {
+			return nil, errors.New("invalid join_policy")
+		}
+		updates["join_policy"] = *p.JoinPolicy
+	}
+
+	// Fields reported in the timeline event, tags live in their own table
+	changed := make(map[string]interface{}, len(updates)+1)
+	for k, v := range updates {
+		changed[k] = v
+	}
+
+	var tags []string
+	if p.Tags != nil {
+		tags, err = normalizeTags(*p.Tags)
+		if err != nil {
+			return nil, err
+		}
+		current := loadGroupTags(db, []int64{group.ID})[group.ID]
+		if strings.Join(tags, ",") != strings.Join(current, ",") {
+			changed["tags"] = tags
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil, errors.New("nothing to update")
+	}
+
+	tx := db.Begin()
+
+	if len(updates) > 0 {
+		if err := tx.Model(&group).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update group: %v", err)
+		}
+	}
+
+	if _, ok := changed["tags"]; ok {
+		if err := saveGroupTags(tx, group.ID, tags); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to save tags: %v", err)
+		}
+	}
+
+	// Keep announcement history, clearing the announcement is not recorded
+	if content, ok := updates["announcement"].(string); ok && content != "" {
+		announcement := &models.GroupAnnouncement{
+			GroupID:  group.ID,
+			AuthorID: userID,
+			Content:  content,
+		}
+		if err := tx.Create(announcement).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to save announcement: %v", err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update group: %v", err)
+	}
+
+	sendGroupSystemMessage(ctx, m.storage, m.hub, &group, userID, models.SystemPayload{
+		Event:  models.SystemEventGroupUpdated,
+		Fields: changed,
+	})
+
+	return group, nil
+}
+
+// ============ group.announcements ============
+
+type GroupAnnouncementsMethod struct {
+	storage *storage.Storage
+}
+
+func NewGroupAnnouncementsMethod(s *storage.Storage) *GroupAnnouncementsMethod {
+	return &GroupAnnouncementsMethod{storage: s}
+}
+
+func (m *GroupAnnouncementsMethod) Name() string { return "group.announcements" }
+
+func (m *GroupAnnouncementsMethod) RequireAuth() bool { return true }
+
+type GroupAnnouncementsParams struct {
+	GroupID  int64 `json:"group_id"`
+	BeforeID int64 `json:"before_id"` // For pagination
+	Limit    int   `json:"limit"`
+}
+
+func (m *GroupAnnouncementsMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupAnnouncementsParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	if p.Limit <= 0 || p.Limit > 100 {
+		p.Limit = 20
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var membership models.GroupMember
+	err := db.Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+	if err != nil {
+		return nil, errors.New("not a member of this group")
+	}
+
+	query := db.Preload("Author").Where("group_id = ?", p.GroupID).Order("id DESC").Limit(p.Limit)
+	if p.BeforeID > 0 {
+		query = query.Where("id < ?", p.BeforeID)
+	}
+
+	var announcements []models.GroupAnnouncement
+	if err := query.Find(&announcements).Error; err != nil {
+		return nil, fmt.Errorf("failed to get announcements: %v", err)
+	}
+
+	authorIDs := make([]int64, 0, len(announcements))
+	for _, a := range announcements {
+		authorIDs = append(authorIDs, a.AuthorID)
+	}
+	friends := friendsAmong(db, userID, authorIDs)
+
+	result := make([]groupAnnouncement, 0, len(announcements))
+	for _, a := range announcements {
+		item := groupAnnouncement{GroupAnnouncement: a}
+		if a.Author != nil {
+			item.Author = newUserProfile(a.Author, userID, friends[a.AuthorID])
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+// groupAnnouncement shows the author through their public profile
+type groupAnnouncement struct {
+	models.GroupAnnouncement
+	Author *userProfile `json:"author,omitempty"`
+}
+
+// ============ group.invite ============
+
+type GroupInviteMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+	conf    config.GroupConfiguration
+}
+
+func NewGroupInviteMethod(s *storage.Storage, h *ws.Hub, c config.GroupConfiguration) *GroupInviteMethod {
+	return &GroupInviteMethod{storage: s, hub: h, conf: c}
+}
+
+func (m *GroupInviteMethod) Name() string { return "group.invite" }
+
+func (m *GroupInviteMethod) RequireAuth() bool { return true }
+
+type GroupInviteParams struct {
+	GroupID int64   `json:"group_id"`
+	UserIDs []int64 `json:"user_ids"`
+}
+
+func (m *GroupInviteMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupInviteParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	if len(p.UserIDs) == 0 {
+		return nil, errors.New("user_ids is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var membership models.GroupMember
+	err := db.Preload("Group").Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+	if err != nil || membership.Group == nil {
+		return nil, errors.New("not a member of this group")
+	}
+
+	// Members inviting others would get around the review of join requests
+	if membership.Group.JoinPolicy != models.GroupJoinOpen && membership.Role < models.GroupRoleAdmin {
+		return nil, errors.New("only group admins can invite to this group")
+	}
+
+	// Skip users that are already members and users that don't exist
+	var existing []int64
+	db.Model(&models.GroupMember{}).Where("group_id = ? AND user_id IN ?", p.GroupID, p.UserIDs).Pluck("user_id", &existing)
+	skip := make(map[int64]bool, len(existing))
+	for _, id := range existing {
+		skip[id] = true
+	}
+
+	candidates := make([]int64, 0, len(p.UserIDs))
+	for _, id := range p.UserIDs {
+		if !skip[id] {
+			skip[id] = true
+			candidates = append(candidates, id)
+		}
+	}
+	inviteIDs, refused := filterInvitees(db, userID, candidates)
+
+	if len(inviteIDs) == 0 {
+		if len(refused) > 0 {
+			return nil, errors.New("these users don't accept invites from you")
+		}
+		return nil, errors.New("no users to invite")
+	}
+
+	tx := db.Begin()
+	if err := checkGroupCapacity(tx, m.conf, p.GroupID, len(inviteIDs)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, id := range inviteIDs {
+		member := &models.GroupMember{
+			GroupID:  p.GroupID,
+			UserID:   id,
+			Role:     models.GroupRoleMember,
+			JoinedAt: time.Now(),
+		}
+		if err := tx.Create(member).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to add member: %v", err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to add member: %v", err)
+	}
+
+	m.storage.InvalidateGroupMembers(ctx, p.GroupID)
+
+	sendGroupSystemMessage(ctx, m.storage, m.hub, membership.Group, userID, models.SystemPayload{
+		Event:   models.SystemEventMemberInvited,
+		Targets: systemTargets(inviteIDs),
+	})
+
+	return map[string]interface{}{
+		"invited": inviteIDs,
+		"refused": refused,
+	}, nil
+}
+
+// ============ group.members ============
+
+type GroupMembersMethod struct {
+	storage *storage.Storage
+}
+
+func NewGroupMembersMethod(s *storage.Storage) *GroupMembersMethod {
+	return &GroupMembersMethod{storage: s}
+}
+
+func (m *GroupMembersMethod) Name() string { return "group.members" }
+
+func (m *GroupMembersMethod) RequireAuth() bool { return true }
+
+func (m *GroupMembersMethod) RequiredScope() models.TokenScope { return models.ScopeGroupsRead }
+
+type GroupMembersParams struct {
+	GroupID int64  `json:"group_id"`
+	Keyword string `json:"keyword"` // Matches username, nickname or group nickname
+	Offset  int    `json:"offset"`
+	Limit   int    `json:"limit"`
+}
+
+func (m *GroupMembersMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupMembersParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	if p.Limit <= 0 || p.Limit > 100 {
+		p.Limit = 50
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var membership models.GroupMember
+	err := db.Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+	if err != nil {
+		return nil, errors.New("not a member of this group")
+	}
+
+	query := db.Model(&models.GroupMember{}).Where("group_members.group_id = ?", p.GroupID)
+	if keyword := strings.TrimSpace(p.Keyword); keyword != "" {
+		like := likePattern(strings.ToLower(keyword))
+		query = query.Joins("JOIN users ON users.id = group_members.user_id").
+			Where("LOWER(users.username) LIKE ? ESCAPE '\\' OR LOWER(users.nickname) LIKE ? ESCAPE '\\' "+
+				"OR LOWER(group_members.nickname) LIKE ? ESCAPE '\\'", like, like, like)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, fmt.Errorf("failed to count members: %v", err)
+	}
+
+	var members []models.GroupMember
+	err = query.Preload("User").
+		Order("group_members.role DESC, group_members.joined_at ASC, group_members.id ASC").
+		Offset(p.Offset).
+		Limit(p.Limit).
+		Find(&members).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get members: %v", err)
+	}
+
+	return map[string]interface{}{
+		"total":   total,
+		"members": buildGroupMemberList(db, userID, members),
+	}, nil
+}
+
+// ============ group.set_nickname ============
+
+type GroupSetNicknameMethod struct {
+	storage *storage.Storage
+}
+
+func NewGroupSetNicknameMethod(s *storage.Storage) *GroupSetNicknameMethod {
+	return &GroupSetNicknameMethod{storage: s}
+}
+
+func (m *GroupSetNicknameMethod) Name() string { return "group.set_nickname" }
+
+func (m *GroupSetNicknameMethod) RequireAuth() bool { return true }
+
+type GroupSetNicknameParams struct {
+	GroupID  int64  `json:"group_id"`
+	Nickname string `json:"nickname"` // Empty to clear
+}
+
+func (m *GroupSetNicknameMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupSetNicknameParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	nickname := strings.TrimSpace(p.Nickname)
+	if utf8.RuneCountInString(nickname) > 100 {
+		return nil, errors.New("nickname must be at most 100 characters")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var membership models.GroupMember
+	err := db.Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+	if err != nil {
+		return nil, errors.New("not a member of this group")
+	}
+
+	if err := db.Model(&membership).Update("nickname", nickname).Error; err != nil {
+		return nil, fmt.Errorf("failed to set nickname: %v", err)
+	}
+
+	return map[string]interface{}{
+		"group_id": p.GroupID,
+		"nickname": nickname,
+	}, nil
+}
+
+// ============ group.leave ============
+
+type GroupLeaveMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewGroupLeaveMethod(s *storage.Storage, h *ws.Hub) *GroupLeaveMethod {
+	return &GroupLeaveMethod{storage: s, hub: h}
+}
+
+func (m *GroupLeaveMethod) Name() string { return "group.leave" }
+
+func (m *GroupLeaveMethod) RequireAuth() bool { return true }
+
+type GroupLeaveParams struct {
+	GroupID int64 `json:"group_id"`
+}
+
+func (m *GroupLeaveMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupLeaveParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var membership models.GroupMember
+	err := db.Preload("Group").Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+	if err != nil || membership.Group == nil {
+		return nil, errors.New("not a member of this group")
+	}
+
+	if membership.Role == models.GroupRoleOwner {
+		return nil, errors.New("group owner cannot leave the group")
+	}
+
+	if err := db.Delete(&membership).Error; err != nil {
+		return nil, fmt.Errorf("failed to leave group: %v", err)
+	}
+
+	m.storage.InvalidateGroupMembers(ctx, p.GroupID)
+
+	sendGroupSystemMessage(ctx, m.storage, m.hub, membership.Group, userID, models.SystemPayload{
+		Event: models.SystemEventMemberLeft,
+	})
+
+	return map[string]interface{}{
+		"message": "left group successfully",
+	}, nil
+}
+
+// ============ group.kick ============
+
+type GroupKickMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewGroupKickMethod(s *storage.Storage, h *ws.Hub) *GroupKickMethod {
+	return &GroupKickMethod{storage: s, hub: h}
+}
+
+func (m *GroupKickMethod) Name() string { return "group.kick" }
+
+func (m *GroupKickMethod) RequireAuth() bool { return true }
+
+func (m *GroupKickMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "group", "group_id")
+}
+
+type GroupKickParams struct {
+	GroupID int64 `json:"group_id"`
+	UserID  int64 `json:"user_id"`
+}
+
+func (m *GroupKickMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupKickParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 || p.UserID == 0 {
+		return nil, errors.New("group_id and user_id are required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	username := ctx.Value("username").(string)
+	db := m.storage.GetDB()
+
+	if p.UserID == userID {
+		return nil, errors.New("use group.leave to leave the group")
+	}
+
+	var membership models.GroupMember
+	err := db.Preload("Group").Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+	if err != nil || membership.Group == nil {
+		return nil, errors.New("not a member of this group")
+	}
+
+	var target models.GroupMember
+	if err := db.Where("group_id = ? AND user_id = ?", p.GroupID, p.UserID).First(&target).Error; err != nil {
+		return nil, errors.New("user is not a member of this group")
+	}
+
+	// Admins can remove members, only the owner can remove admins
+	if membership.Role < models.GroupRoleAdmin || target.Role >= membership.Role {
+		return nil, errors.New("not authorized to remove this member")
+	}
+
+	if err := db.Delete(&target).Error; err != nil {
+		return nil, fmt.Errorf("failed to remove member: %v", err)
+	}
+
+	m.storage.InvalidateGroupMembers(ctx, p.GroupID)
+
+	sendGroupSystemMessage(ctx, m.storage, m.hub, membership.Group, userID, models.SystemPayload{
+		Event:   models.SystemEventMemberRemoved,
+		Targets: systemTargets([]int64{p.UserID}),
+	})
+
+	// The removed user no longer receives group pushes, tell them directly
+	m.hub.Broadcast(&ws.Message{
+		Type:       "group_removed",
+		SenderID:   userID,
+		SenderName: username,
+		ReceiverID: p.UserID,
+		GroupID:    p.GroupID,
+		GroupName:  membership.Group.Name,
+		CreatedAt:  time.Now(),
+	})
+
+	return map[string]interface{}{
+		"message": "member removed",
+	}, nil
+}
+
+// ============ group.join_requests ============
+
+type GroupJoinRequestsMethod struct {
+	storage *storage.Storage
+}
+
+func NewGroupJoinRequestsMethod(s *storage.Storage) *GroupJoinRequestsMethod {
+	return &GroupJoinRequestsMethod{storage: s}
+}
+
+func (m *GroupJoinRequestsMethod) Name() string { return "group.join_requests" }
+
+func (m *GroupJoinRequestsMethod) RequireAuth() bool { return true }
+
+type GroupJoinRequestsParams struct {
+	GroupID int64 `json:"group_id"`
+}
+
+func (m *GroupJoinRequestsMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupJoinRequestsParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var membership models.GroupMember
+	err := db.Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+	if err != nil {
+		return nil, errors.New("not a member of this group")
+	}
+
+	if membership.Role < models.GroupRoleAdmin {
+		return nil, errors.New("only group owner or admin can view join requests")
+	}
+
+	var requests []models.GroupJoinRequest
+	err = db.Where("group_id = ? AND status = ?", p.GroupID, models.GroupJoinRequestPending).
+		Preload("User").
+		Order("id ASC").
+		Find(&requests).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get join requests: %v", err)
+	}
+
+	userIDs := make([]int64, 0, len(requests))
+	for _, r := range requests {
+		userIDs = append(userIDs, r.UserID)
+	}
+	friends := friendsAmong(db, userID, userIDs)
+
+	result := make([]map[string]interface{}, 0, len(requests))
+	for _, r := range requests {
+		if r.User == nil {
+			continue
+		}
+		result = append(result, map[string]interface{}{
+			"id":         r.ID,
+			"user_id":    r.UserID,
+			"username":   r.User.Username,
+			"nickname":   r.User.Nickname,
+			"avatar":     visibleAvatar(r.User, userID, friends[r.UserID]),
+			"message":    r.Message,
+			"created_at": r.CreatedAt,
+		})
+	}
+
+	return result, nil
+}
+
+// ============ group.review_join_request ============
+
+type GroupReviewJoinRequestMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+	conf    config.GroupConfiguration
+}
+
+func NewGroupReviewJoinRequestMethod(s *storage.Storage, h *ws.Hub, c config.GroupConfiguration) *GroupReviewJoinRequestMethod {
+	return &GroupReviewJoinRequestMethod{storage: s, hub: h, conf: c}
+}
+
+func (m *GroupReviewJoinRequestMethod) Name() string { return "group.review_join_request" }
+
+func (m *GroupReviewJoinRequestMethod) RequireAuth() bool { return true }
+
+func (m *GroupReviewJoinRequestMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "group_join_request", "request_id")
+}
+
+type GroupReviewJoinRequestParams struct {
+	RequestID int64 `json:"request_id"`
+	Approve   bool  `json:"approve"`
+}
+
+func (m *GroupReviewJoinRequestMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupReviewJoinRequestParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.RequestID == 0 {
+		return nil, errors.New("request_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	username := ctx.Value("username").(string)
+	db := m.storage.GetDB()
+
+	var request models.GroupJoinRequest
+	if err := db.Preload("Group").First(&request, p.RequestID).Error; err != nil || request.Group == nil {
+		return nil, errors.New("join request not found")
+	}
+
+	var membership models.GroupMember
+	err := db.Where("group_id = ? AND user_id = ?", request.GroupID, userID).First(&membership).Error
+	if err != nil || membership.Role < models.GroupRoleAdmin {
+		return nil, errors.New("not authorized to review this request")
+	}
+
+	if request.Status != models.GroupJoinRequestPending {
+		return nil, errors.New("request already processed")
+	}
+
+	status := models.GroupJoinRequestRejected
+	if p.Approve {
+		status = models.GroupJoinRequestApproved
+	}
+
+	tx := db.Begin()
+
+	if p.Approve {
+		// The requester may have been invited in the meantime
+		var existing int64
+		tx.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", request.GroupID, request.UserID).Count(&existing)
+		if existing == 0 {
+			if err := checkGroupCapacity(tx, m.conf, request.GroupID, 1); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			member := &models.GroupMember{
+				GroupID:  request.GroupID,
+				UserID:   request.UserID,
+				Role:     models.GroupRoleMember,
+				JoinedAt: time.Now(),
+			}
+			if err := tx.Create(member).Error; err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("failed to add member: %v", err)
+			}
+		}
+	}
+
+	err = tx.Model(&request).Updates(map[string]interface{}{
+		"status":      status,
+		"reviewer_id": userID,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update join request: %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update join request: %v", err)
+	}
+
+	notifyType := "group_join_rejected"
+	if p.Approve {
+		notifyType = "group_join_approved"
+		m.storage.InvalidateGroupMembers(ctx, request.GroupID)
+
+		sendGroupSystemMessage(ctx, m.storage, m.hub, request.Group, request.UserID, models.SystemPayload{
+			Event:  models.SystemEventMemberJoined,
+			Fields: map[string]interface{}{"approved_by": userID},
+		})
+	}
+
+	m.hub.Broadcast(&ws.Message{
+		ID:         request.ID,
+		Type:       notifyType,
+		SenderID:   userID,
+		SenderName: username,
+		ReceiverID: request.UserID,
+		GroupID:    request.GroupID,
+		GroupName:  request.Group.Name,
+		CreatedAt:  time.Now(),
+	})
+
+	return map[string]interface{}{
+		"message": "join request " + notifyType[len("group_join_"):],
+	}, nil
+}
+
+// ============ group.search ============
+
+type GroupSearchMethod struct {
+	storage *storage.Storage
+}
+
+func NewGroupSearchMethod(s *storage.Storage) *GroupSearchMethod {
+	return &GroupSearchMethod{storage: s}
+}
+
+func (m *GroupSearchMethod) Name() string { return "group.search" }
+
+func (m *GroupSearchMethod) RequireAuth() bool { return true }
+
+type GroupSearchParams struct {
+	Keyword string `json:"keyword"` // Matches name, description or a tag
+	Tag     string `json:"tag"`     // Exact tag filter
+	Offset  int    `json:"offset"`
+	Limit   int    `json:"limit"`
+}
+
+func (m *GroupSearchMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupSearchParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
+	if p.Limit <= 0 || p.Limit > 50 {
+		p.Limit = 20
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	query := db.Model(&models.Group{}).Where("is_public = ?", true)
+
+	if keyword := strings.ToLower(strings.TrimSpace(p.Keyword)); keyword != "" {
+		like := likePattern(keyword)
+		query = query.Where(
+			"LOWER(name) LIKE ? ESCAPE '\\' OR LOWER(description) LIKE ? ESCAPE '\\' OR id IN (SELECT group_id FROM group_tags WHERE tag = ?)",
+			like, like, keyword,
+		)
+	}
+
+	if tag := strings.ToLower(strings.TrimSpace(p.Tag)); tag != "" {
+		query = query.Where("id IN (SELECT group_id FROM group_tags WHERE tag = ?)", tag)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, fmt.Errorf("failed to count groups: %v", err)
+	}
+
+	// Most popular groups first
+	var groups []models.Group
+	err := query.
+		Order("(SELECT COUNT(*) FROM group_members WHERE group_members.group_id = groups.id) DESC, id ASC").
+		Offset(p.Offset).
+		Limit(p.Limit).
+		Find(&groups).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to search groups: %v", err)
+	}
+
+	groupIDs := make([]int64, 0, len(groups))
+	for _, g := range groups {
+		groupIDs = append(groupIDs, g.ID)
+	}
+
+	type groupCount struct {
+		GroupID int64
+		Count   int64
+	}
+	var counts []groupCount
+	memberCounts := make(map[int64]int64, len(groups))
+	joined := make(map[int64]bool, len(groups))
+	if len(groupIDs) > 0 {
+		db.Model(&models.GroupMember{}).
+			Select("group_id, COUNT(*) AS count").
+			Where("group_id IN ?", groupIDs).
+			Group("group_id").
+			Scan(&counts)
+		for _, c := range counts {
+			memberCounts[c.GroupID] = c.Count
+		}
+
+		var joinedIDs []int64
+		db.Model(&models.GroupMember{}).Where("group_id IN ? AND user_id = ?", groupIDs, userID).Pluck("group_id", &joinedIDs)
+		for _, id := range joinedIDs {
+			joined[id] = true
+		}
+	}
+
+	tags := loadGroupTags(db, groupIDs)
+
+	result := make([]map[string]interface{}, 0, len(groups))
+	for _, g := range groups {
+		result = append(result, map[string]interface{}{
+			"id":           g.ID,
+			"name":         g.Name,
+			"avatar":       g.Avatar,
+			"description":  g.Description,
+			"tags":         tags[g.ID],
+			"join_policy":  g.JoinPolicy,
+			"member_count": memberCounts[g.ID],
+			"is_member":    joined[g.ID],
+			"created_at":   g.CreatedAt,
+		})
+	}
+
+	return map[string]interface{}{
+		"total":  total,
+		"groups": result,
+	}, nil
+}
+
+// ============ group.create_webhook ============
+
+type GroupCreateWebhookMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+	conf    config.GroupConfiguration
+}
+
+func NewGroupCreateWebhookMethod(s *storage.Storage, h *ws.Hub, c config.GroupConfiguration) *GroupCreateWebhookMethod {
+	return &GroupCreateWebhookMethod{storage: s, hub: h, conf: c}
+}
+
+func (m *GroupCreateWebhookMethod) Name() string { return "group.create_webhook" }
+
+func (m *GroupCreateWebhookMethod) RequireAuth() bool { return true }
+
+func (m *GroupCreateWebhookMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "group", "group_id")
+}
+
+type GroupCreateWebhookParams struct {
+	GroupID int64  `json:"group_id"`
+	Name    string `json:"name"` // Shown as the sender of the messages
+}
+
+func (m *GroupCreateWebhookMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupCreateWebhookParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	name := strings.TrimSpace(p.Name)
+	if name == "" {
+		name = "Webhook"
+	}
+	if utf8.RuneCountInString(name) > 100 {
+		return nil, errors.New("name too long (max 100 characters)")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var membership models.GroupMember
+	err := db.Preload("Group").Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+	if err != nil || membership.Group == nil {
+		return nil, errors.New("not a member of this group")
+	}
+	if membership.Role < models.GroupRoleAdmin {
+		return nil, errors.New("only group admins can create webhooks")
+	}
+
+	var count int64
+	db.Model(&models.IncomingWebhook{}).Where("group_id = ?", p.GroupID).Count(&count)
+	if count >= maxIncomingWebhooksPerGroup {
+		return nil, fmt.Errorf("a group cannot have more than %d webhooks", maxIncomingWebhooksPerGroup)
+	}
+
+	token, hash, err := newIncomingWebhookToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to generate username: %v", err)
+	}
+	hook := &models.IncomingWebhook{
+		GroupID:   p.GroupID,
+		CreatorID: userID,
+		Name:      name,
+		TokenHash: hash,
+		Prefix:    token[:incomingWebhookPrefixLen],
+	}
+	var bot *models.User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// The webhook's bot takes a member slot like any other bot
+		if err := checkGroupCapacity(tx, m.conf, p.GroupID, 1); err != nil {
+			return err
+		}
+		var err error
+		if bot, err = createBotUser(tx, "webhook_"+hex.EncodeToString(suffix), name); err != nil {
+			return err
+		}
+		member := &models.GroupMember{
+			GroupID:  p.GroupID,
+			UserID:   bot.ID,
+			Role:     models.GroupRoleMember,
+			JoinedAt: time.Now(),
+		}
+		if err := tx.Create(member).Error; err != nil {
+			return err
+		}
+		hook.BotID = bot.ID
+		return tx.Create(hook).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %v", err)
+	}
+
+	m.storage.InvalidateGroupMembers(ctx, p.GroupID)
+
+	sendGroupSystemMessage(ctx, m.storage, m.hub, membership.Group, userID, models.SystemPayload{
+		Event:   models.SystemEventMemberInvited,
+		Targets: systemTargets([]int64{bot.ID}),
+	})
+
+	// The token is only returned here, it can't be read again
+	return map[string]interface{}{
+		"webhook": hook,
+		"token":   token,
+		"url":     incomingWebhookPath + token,
+	}, nil
+}
+
+// ============ group.webhooks ============
+
+type GroupWebhooksMethod struct {
+	storage *storage.Storage
+}
+
+func NewGroupWebhooksMethod(s *storage.Storage) *GroupWebhooksMethod {
+	return &GroupWebhooksMethod{storage: s}
+}
+
+func (m *GroupWebhooksMethod) Name() string { return "group.webhooks" }
+
+func (m *GroupWebhooksMethod) RequireAuth() bool { return true }
+
+type GroupWebhooksParams struct {
+	GroupID int64 `json:"group_id"`
+}
+
+func (m *GroupWebhooksMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupWebhooksParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.GroupID == 0 {
+		return nil, errors.New("group_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var membership models.GroupMember
+	if err := db.Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error; err != nil {
+		return nil, errors.New("not a member of this group")
+	}
+	if membership.Role < models.GroupRoleAdmin {
+		return nil, errors.New("only group admins can view webhooks")
+	}
+
+	var hooks []models.IncomingWebhook
+	if err := db.Where("group_id = ?", p.GroupID).Order("id").Find(&hooks).Error; err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %v", err)
+	}
+
+	return map[string]interface{}{
+		"webhooks": hooks,
+	}, nil
+}
+
+// ============ group.delete_webhook ============
+
+type GroupDeleteWebhookMethod struct {
+	storage *storage.Storage
+}
+
+func NewGroupDeleteWebhookMethod(s *storage.Storage) *GroupDeleteWebhookMethod {
+	return &GroupDeleteWebhookMethod{storage: s}
+}
+
+func (m *GroupDeleteWebhookMethod) Name() string { return "group.delete_webhook" }
+
+func (m *GroupDeleteWebhookMethod) RequireAuth() bool { return true }
+
+func (m *GroupDeleteWebhookMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "incoming_webhook", "webhook_id")
+}
+
+type GroupDeleteWebhookParams struct {
+	WebhookID int64 `json:"webhook_id"`
+}
+
+func (m *GroupDeleteWebhookMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GroupDeleteWebhookParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.WebhookID == 0 {
+		return nil, errors.New("webhook_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var hook models.IncomingWebhook
+	if err := db.First(&hook, p.WebhookID).Error; err != nil {
+		return nil, errors.New("webhook not found")
+	}
+
+	// Webhooks of other groups look like they don't exist
+	var membership models.GroupMember
+	err := db.Where("group_id = ? AND user_id = ?", hook.GroupID, userID).First(&membership).Error
+	if err != nil || membership.Role < models.GroupRoleAdmin {
+		return nil, errors.New("webhook not found")
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ? AND user_id = ?", hook.GroupID, hook.BotID).Delete(&models.GroupMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&models.User{}, hook.BotID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&hook).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete webhook: %v", err)
+	}
+
+	m.storage.InvalidateGroupMembers(ctx, hook.GroupID)
+
+	return map[string]interface{}{
+		"message": "webhook deleted",
+	}, nil
+}
+
+// buildGroupMemberList flattens members with their user profile as viewerID
+// sees it for responses
+func buildGroupMemberList(db *gorm.DB, viewerID int64, members []models.GroupMember) []map[string]interface{} {
+	userIDs := make([]int64, 0, len(members))
+	for _, m := range members {
+		userIDs = append(userIDs, m.UserID)
+	}
+	friends := friendsAmong(db, viewerID, userIDs)
+
+	result := make([]map[string]interface{}, 0, len(members))
+	for _, m := range members {
+		if m.User != nil {
+			result = append(result, map[string]interface{}{
+				"user_id":        m.UserID,
+				"username":       m.User.Username,
+				"nickname":       m.User.Nickname,
+				"group_nickname": m.Nickname,
+				"display_name":   m.DisplayName(),
+				"avatar":         visibleAvatar(m.User, viewerID, friends[m.UserID]),
+				"role":           m.Role,
+				"joined_at":      m.JoinedAt,
+			})
+		}
+	}
+	return result
+}
+
+// userDisplayNames returns the group display name of the given users, falling
+// back to their global profile for users that are not members (anymore).
+func userDisplayNames(db *gorm.DB, groupID int64, userIDs []int64) map[int64]string {
+	names := make(map[int64]string, len(userIDs))
+	if len(userIDs) == 0 {
+		return names
+	}
+
+	// Deleted accounts keep their anonymized name in the timeline
+	var users []models.User
+	db.Unscoped().Where("id IN ?", userIDs).Find(&users)
+	for i := range users {
+		member := models.GroupMember{User: &users[i]}
+		names[users[i].ID] = member.DisplayName()
+	}
+
+	var members []models.GroupMember
+	db.Where("group_id = ? AND user_id IN ? AND nickname <> ''", groupID, userIDs).Find(&members)
+	for _, m := range members {
+		names[m.UserID] = m.Nickname
+	}
+
+	return names
+}
+
+// sendGroupSystemMessage stores a system event in the group timeline and
+// pushes it to the online members. The group change already happened at this
+// point, so failures are only logged.
+func sendGroupSystemMessage(ctx context.Context, st *storage.Storage, hub *ws.Hub, group *models.Group, actorID int64, payload models.SystemPayload) {
+	db := st.GetDB()
+
+	userIDs := []int64{actorID}
+	for _, t := range payload.Targets {
+		userIDs = append(userIDs, t.UserID)
+	}
+	names := userDisplayNames(db, group.ID, userIDs)
+
+	payload.ActorID = actorID
+	payload.ActorName = names[actorID]
+	for i := range payload.Targets {
+		payload.Targets[i].Name = names[payload.Targets[i].UserID]
+	}
+
+	content, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Int64("group_id", group.ID).Msg("failed to encode system message")
+		return
+	}
+
+	msg := &models.Message{
+		SenderID:  actorID,
+		GroupID:   &group.ID,
+		MsgType:   models.MsgTypeSystem,
+		Content:   string(content),
+		CreatedAt: time.Now(),
+	}
+
+	if err := db.Create(msg).Error; err != nil {
+		log.Error().Err(err).Int64("group_id", group.ID).Msg("failed to create system message")
+		return
+	}
+
+	groupMembers, err := st.GetGroupMemberIDs(ctx, group.ID)
+	if err != nil {
+		log.Error().Err(err).Int64("group_id", group.ID).Msg("failed to get group members")
+		return
+	}
+
+	hub.Broadcast(&ws.Message{
+		ID:           msg.ID,
+		Type:         "message",
+		SenderID:     actorID,
+		SenderName:   payload.ActorName,
+		GroupID:      group.ID,
+		GroupName:    group.Name,
+		MsgType:      ws.MsgTypeSystem,
+		Content:      msg.Content,
+		CreatedAt:    msg.CreatedAt,
+		GroupMembers: groupMembers,
+	})
+}
+
+// deleteGroup removes a group with its members, history and requests
+func deleteGroup(tx *gorm.DB, groupID int64) error {
+	// The bots of incoming webhooks only exist for the group
+	var botIDs []int64
+	if err := tx.Model(&models.IncomingWebhook{}).Where("group_id = ?", groupID).Pluck("bot_id", &botIDs).Error; err != nil {
+		return err
+	}
+	if len(botIDs) > 0 {
+		if err := tx.Where("id IN ?", botIDs).Delete(&models.User{}).Error; err != nil {
+			return err
+		}
+	}
+
+	// Group webhooks go with the group, their deliveries with them
+	groupHooks := tx.Model(&models.Webhook{}).Select("id").Where("group_id = ?", groupID)
+	if err := tx.Where("webhook_id IN (?)", groupHooks).Delete(&models.WebhookDelivery{}).Error; err != nil {
+		return err
+	}
+
+	for _, model := range []interface{}{
+		&models.GroupMember{},
+		&models.GroupTag{},
+		&models.GroupAnnouncement{},
+		&models.GroupJoinRequest{},
+		&models.IncomingWebhook{},
+		&models.Webhook{},
+		&models.Message{},
+	} {
+		if err := tx.Where("group_id = ?", groupID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Delete(&models.Group{}, groupID).Error
+}
+
+// systemTargets wraps user ids for a system payload, names are filled in by sendGroupSystemMessage
+func systemTargets(userIDs []int64) []models.SystemTarget {
+	targets := make([]models.SystemTarget, 0, len(userIDs))
+	for _, id := range userIDs {
+		targets = append(targets, models.SystemTarget{UserID: id})
+	}
+	return targets
+}
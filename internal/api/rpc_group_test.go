@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"simple_im/internal/models"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -14,7 +16,7 @@ func TestGroupCreateMethod_Execute(t *testing.T) {
 	}
 
 	user, _ := env.CreateTestUser("groupcreator", "password")
-	method := NewGroupCreateMethod(env.Storage)
+	method := NewGroupCreateMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
 
 	ctx := context.WithValue(context.Background(), "user_id", user.ID)
 
@@ -27,7 +29,7 @@ func TestGroupCreateMethod_Execute(t *testing.T) {
 		t.Fatalf("Create group failed: %v", err)
 	}
 
-	group := result.(*models.Group)
+	group := result.(*createdGroup)
 	if group.Name != "Test Group" {
 		t.Errorf("Expected group name 'Test Group', got '%s'", group.Name)
 	}
@@ -56,7 +58,7 @@ func TestGroupCreateMethod_WithMembers(t *testing.T) {
 	user2, _ := env.CreateTestUser("member1", "password")
 	user3, _ := env.CreateTestUser("member2", "password")
 
-	method := NewGroupCreateMethod(env.Storage)
+	method := NewGroupCreateMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
 
 	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
 
@@ -70,7 +72,7 @@ func TestGroupCreateMethod_WithMembers(t *testing.T) {
 		t.Fatalf("Create group with members failed: %v", err)
 	}
 
-	group := result.(*models.Group)
+	group := result.(*createdGroup)
 
 	// Verify all members were added
 	var count int64
@@ -87,7 +89,7 @@ func TestGroupCreateMethod_EmptyName(t *testing.T) {
 	}
 
 	user, _ := env.CreateTestUser("emptynamer", "password")
-	method := NewGroupCreateMethod(env.Storage)
+	method := NewGroupCreateMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
 
 	ctx := context.WithValue(context.Background(), "user_id", user.ID)
 
@@ -153,6 +155,9 @@ func TestGroupInfoMethod_Execute(t *testing.T) {
 	if len(members) != 1 {
 		t.Errorf("Expected 1 member, got %d", len(members))
 	}
+	if resultMap["member_count"].(int64) != 1 {
+		t.Errorf("Expected member_count 1, got %v", resultMap["member_count"])
+	}
 }
 
 func TestGroupInfoMethod_NotMember(t *testing.T) {
@@ -186,7 +191,7 @@ func TestGroupJoinMethod_Execute(t *testing.T) {
 	user2, _ := env.CreateTestUser("joiner", "password")
 	group, _ := env.CreateTestGroup("Joinable Group", user1.ID)
 
-	method := NewGroupJoinMethod(env.Storage)
+	method := NewGroupJoinMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
 
 	ctx := context.WithValue(context.Background(), "user_id", user2.ID)
 
@@ -216,7 +221,7 @@ func TestGroupJoinMethod_AlreadyMember(t *testing.T) {
 	user, _ := env.CreateTestUser("alreadymember", "password")
 	group, _ := env.CreateTestGroup("Already Joined", user.ID)
 
-	method := NewGroupJoinMethod(env.Storage)
+	method := NewGroupJoinMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
 
 	ctx := context.WithValue(context.Background(), "user_id", user.ID)
 
@@ -230,10 +235,10 @@ func TestGroupJoinMethod_AlreadyMember(t *testing.T) {
 func TestGroupMethods_RequireAuth(t *testing.T) {
 	env, _ := SetupTestEnv()
 
-	createMethod := NewGroupCreateMethod(env.Storage)
+	createMethod := NewGroupCreateMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
 	listMethod := NewGroupListMethod(env.Storage)
 	infoMethod := NewGroupInfoMethod(env.Storage)
-	joinMethod := NewGroupJoinMethod(env.Storage)
+	joinMethod := NewGroupJoinMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
 
 	if !createMethod.RequireAuth() {
 		t.Error("Create should require auth")
@@ -252,10 +257,10 @@ func TestGroupMethods_RequireAuth(t *testing.T) {
 func TestGroupMethods_Name(t *testing.T) {
 	env, _ := SetupTestEnv()
 
-	createMethod := NewGroupCreateMethod(env.Storage)
+	createMethod := NewGroupCreateMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
 	listMethod := NewGroupListMethod(env.Storage)
 	infoMethod := NewGroupInfoMethod(env.Storage)
-	joinMethod := NewGroupJoinMethod(env.Storage)
+	joinMethod := NewGroupJoinMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
 
 	if createMethod.Name() != "group.create" {
 		t.Errorf("Expected 'group.create', got '%s'", createMethod.Name())
@@ -270,3 +275,812 @@ func TestGroupMethods_Name(t *testing.T) {
 		t.Errorf("Expected 'group.join', got '%s'", joinMethod.Name())
 	}
 }
+
+func TestGroupUpdateMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user, _ := env.CreateTestUser("groupupdater", "password")
+	group, _ := env.CreateTestGroup("Old Name", user.ID)
+
+	method := NewGroupUpdateMethod(env.Storage, env.Hub)
+
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+	ctx = context.WithValue(ctx, "username", user.Username)
+
+	name := "New Name"
+	announcement := "Standup moved to 10am"
+	params, _ := json.Marshal(GroupUpdateParams{
+		GroupID:      group.ID,
+		Name:         &name,
+		Announcement: &announcement,
+	})
+
+	_, err = method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Update group failed: %v", err)
+	}
+
+	var updated models.Group
+	env.DB.First(&updated, group.ID)
+	if updated.Name != "New Name" {
+		t.Errorf("Expected group name 'New Name', got '%s'", updated.Name)
+	}
+	if updated.Announcement != announcement {
+		t.Errorf("Expected announcement '%s', got '%s'", announcement, updated.Announcement)
+	}
+
+	// Verify announcement history was kept
+	var count int64
+	env.DB.Model(&models.GroupAnnouncement{}).Where("group_id = ?", group.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 announcement, got %d", count)
+	}
+
+	// Verify the update was recorded in the timeline
+	var msg models.Message
+	err = env.DB.Where("group_id = ? AND msg_type = ?", group.ID, models.MsgTypeSystem).First(&msg).Error
+	if err != nil {
+		t.Error("Update should be recorded as a system message")
+	}
+
+	long := strings.Repeat("a", 2001)
+	params, _ = json.Marshal(GroupUpdateParams{GroupID: group.ID, Announcement: &long})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Should fail for an announcement over 2000 characters")
+	}
+}
+
+func TestGroupUpdateMethod_NotAdmin(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("updateowner", "password")
+	user2, _ := env.CreateTestUser("plainmember", "password")
+	group, _ := env.CreateTestGroup("Admin Only", user1.ID)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: user2.ID, Role: models.GroupRoleMember})
+
+	method := NewGroupUpdateMethod(env.Storage, env.Hub)
+
+	ctx := context.WithValue(context.Background(), "user_id", user2.ID)
+	ctx = context.WithValue(ctx, "username", user2.Username)
+
+	name := "Hijacked"
+	params, _ := json.Marshal(GroupUpdateParams{GroupID: group.ID, Name: &name})
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Plain member should not be able to update the group")
+	}
+}
+
+func TestGroupAnnouncementsMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user, _ := env.CreateTestUser("announcer", "password")
+	group, _ := env.CreateTestGroup("Announcements", user.ID)
+
+	updateMethod := NewGroupUpdateMethod(env.Storage, env.Hub)
+
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+	ctx = context.WithValue(ctx, "username", user.Username)
+
+	for _, content := range []string{"first", "second"} {
+		announcement := content
+		params, _ := json.Marshal(GroupUpdateParams{GroupID: group.ID, Announcement: &announcement})
+		if _, err := updateMethod.Execute(ctx, params); err != nil {
+			t.Fatalf("Update announcement failed: %v", err)
+		}
+	}
+
+	method := NewGroupAnnouncementsMethod(env.Storage)
+
+	params, _ := json.Marshal(GroupAnnouncementsParams{GroupID: group.ID})
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Get announcements failed: %v", err)
+	}
+
+	announcements := result.([]groupAnnouncement)
+	if len(announcements) != 2 {
+		t.Fatalf("Expected 2 announcements, got %d", len(announcements))
+	}
+	if announcements[0].Content != "second" {
+		t.Errorf("Expected newest announcement first, got '%s'", announcements[0].Content)
+	}
+}
+
+func TestGroupCreateMethod_TooManyMembers(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.GroupConfiguration.MaxMembers = 2
+
+	user1, _ := env.CreateTestUser("bigowner", "password")
+	user2, _ := env.CreateTestUser("bigmember1", "password")
+	user3, _ := env.CreateTestUser("bigmember2", "password")
+
+	method := NewGroupCreateMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+
+	params, _ := json.Marshal(GroupCreateParams{
+		Name:      "Too Big",
+		MemberIDs: []int64{user2.ID, user3.ID},
+	})
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Should fail when exceeding max members")
+	}
+}
+
+func TestGroupJoinMethod_GroupFull(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.GroupConfiguration.MaxMembers = 1
+
+	user1, _ := env.CreateTestUser("fullowner", "password")
+	user2, _ := env.CreateTestUser("latecomer", "password")
+	group, _ := env.CreateTestGroup("Full Group", user1.ID)
+
+	method := NewGroupJoinMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+
+	ctx := context.WithValue(context.Background(), "user_id", user2.ID)
+
+	params, _ := json.Marshal(GroupJoinParams{GroupID: group.ID})
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Should fail when group is full")
+	}
+}
+
+func TestGroupInviteMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("inviter", "password")
+	user2, _ := env.CreateTestUser("invitee", "password")
+	group, _ := env.CreateTestGroup("Invite Group", user1.ID)
+
+	// Warm the member cache so the invite has to invalidate it
+	ids, _ := env.Storage.GetGroupMemberIDs(context.Background(), group.ID)
+	if len(ids) != 1 {
+		t.Fatalf("Expected 1 cached member, got %d", len(ids))
+	}
+	if !env.Redis.Exists("group:members:" + strconv.FormatInt(group.ID, 10)) {
+		t.Fatal("Expected the member ids to be cached")
+	}
+
+	method := NewGroupInviteMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+
+	params, _ := json.Marshal(GroupInviteParams{GroupID: group.ID, UserIDs: []int64{user2.ID, user1.ID}})
+	_, err = method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Invite failed: %v", err)
+	}
+
+	ids, _ = env.Storage.GetGroupMemberIDs(context.Background(), group.ID)
+	if len(ids) != 2 {
+		t.Errorf("Expected 2 members after invite, got %d", len(ids))
+	}
+}
+
+func TestGroupInviteMethod_Consent(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	inviter, _ := env.CreateTestUser("consentinviter", "password")
+	private, _ := env.CreateTestUser("consentprivate", "password")
+	blocker, _ := env.CreateTestUser("consentblocker", "password")
+	friend, _ := env.CreateTestUser("consentfriend", "password")
+	open, _ := env.CreateTestUser("consentopen", "password")
+	env.DB.Model(private).Update("friend_request_policy", models.FriendRequestGroupMembers)
+	env.DB.Model(friend).Update("friend_request_policy", models.FriendRequestNobody)
+	env.DB.Create(&models.Block{UserID: blocker.ID, BlockedID: inviter.ID})
+	env.CreateTestFriendship(inviter.ID, friend.ID, models.FriendStatusAccepted)
+	group, _ := env.CreateTestGroup("Consent Group", inviter.ID)
+
+	ctx := context.WithValue(context.Background(), "user_id", inviter.ID)
+	params, _ := json.Marshal(GroupInviteParams{GroupID: group.ID, UserIDs: []int64{private.ID, blocker.ID, friend.ID, open.ID}})
+	result, err := NewGroupInviteMethod(env.Storage, env.Hub, env.Config.GroupConfiguration).Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Invite failed: %v", err)
+	}
+
+	// A new group doesn't count as shared for the group members policy
+	summary := result.(map[string]interface{})
+	invited := summary["invited"].([]int64)
+	refused := summary["refused"].([]int64)
+	if len(invited) != 2 || len(refused) != 2 {
+		t.Errorf("Expected friend and open user invited, got invited %v refused %v", invited, refused)
+	}
+	if shareGroup(env.DB, inviter.ID, private.ID) || shareGroup(env.DB, inviter.ID, blocker.ID) {
+		t.Error("Refused users should not be added")
+	}
+
+	// The same applies to the members of a new group
+	params, _ = json.Marshal(GroupCreateParams{Name: "Consent Created", MemberIDs: []int64{private.ID, open.ID, 999999}})
+	result, err = NewGroupCreateMethod(env.Storage, env.Hub, env.Config.GroupConfiguration).Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if shareGroup(env.DB, inviter.ID, private.ID) {
+		t.Error("Group creation should leave out users who refuse")
+	}
+	// Unknown users are reported along with those who refuse
+	if created := result.(*createdGroup); len(created.Refused) != 2 || created.Refused[0] != private.ID || created.Refused[1] != 999999 {
+		t.Errorf("Expected the private and unknown user refused, got %v", created.Refused)
+	}
+}
+
+func TestGroupInviteMethod_JoinPolicy(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("policyowner", "password")
+	member, _ := env.CreateTestUser("policymember", "password")
+	outsider, _ := env.CreateTestUser("policyoutsider", "password")
+	group, _ := env.CreateTestGroup("Policy Group", owner.ID)
+	env.DB.Model(group).Update("join_policy", models.GroupJoinApproval)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: member.ID, Role: models.GroupRoleMember})
+
+	method := NewGroupInviteMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+	params, _ := json.Marshal(GroupInviteParams{GroupID: group.ID, UserIDs: []int64{outsider.ID}})
+
+	if _, err := method.Execute(context.WithValue(context.Background(), "user_id", member.ID), params); err == nil {
+		t.Error("Members should not invite to a group with reviewed joins")
+	}
+	if _, err := method.Execute(context.WithValue(context.Background(), "user_id", owner.ID), params); err != nil {
+		t.Errorf("Owner invite failed: %v", err)
+	}
+}
+
+func TestGroupInviteMethod_TooManyMembers(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.GroupConfiguration.MaxMembers = 1
+
+	user1, _ := env.CreateTestUser("fullinviter", "password")
+	user2, _ := env.CreateTestUser("fullinvitee", "password")
+	group, _ := env.CreateTestGroup("Full Invite Group", user1.ID)
+
+	method := NewGroupInviteMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+
+	params, _ := json.Marshal(GroupInviteParams{GroupID: group.ID, UserIDs: []int64{user2.ID}})
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Should fail when exceeding max members")
+	}
+}
+
+func TestGroupMembersMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("memberowner", "password")
+	group, _ := env.CreateTestGroup("Paged Group", owner.ID)
+	for _, name := range []string{"alice", "alicia", "bob"} {
+		user, _ := env.CreateTestUser(name, "password")
+		env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: user.ID, Role: models.GroupRoleMember})
+	}
+
+	method := NewGroupMembersMethod(env.Storage)
+
+	ctx := context.WithValue(context.Background(), "user_id", owner.ID)
+
+	// First page
+	params, _ := json.Marshal(GroupMembersParams{GroupID: group.ID, Limit: 2})
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("List members failed: %v", err)
+	}
+
+	resultMap := result.(map[string]interface{})
+	if resultMap["total"].(int64) != 4 {
+		t.Errorf("Expected total 4, got %v", resultMap["total"])
+	}
+	members := resultMap["members"].([]map[string]interface{})
+	if len(members) != 2 {
+		t.Errorf("Expected 2 members on first page, got %d", len(members))
+	}
+	if members[0]["user_id"] != owner.ID {
+		t.Error("Owner should be listed first")
+	}
+
+	// Keyword search
+	params, _ = json.Marshal(GroupMembersParams{GroupID: group.ID, Keyword: "ALI"})
+	result, err = method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Search members failed: %v", err)
+	}
+
+	resultMap = result.(map[string]interface{})
+	if resultMap["total"].(int64) != 2 {
+		t.Errorf("Expected 2 matches, got %v", resultMap["total"])
+	}
+	members = resultMap["members"].([]map[string]interface{})
+	if len(members) != 2 {
+		t.Errorf("Expected 2 members, got %d", len(members))
+	}
+
+	// Wildcards are matched literally
+	for _, keyword := range []string{"%", "_", `\`} {
+		params, _ = json.Marshal(GroupMembersParams{GroupID: group.ID, Keyword: keyword})
+		result, err = method.Execute(ctx, params)
+		if err != nil {
+			t.Fatalf("Search members failed: %v", err)
+		}
+		if total := result.(map[string]interface{})["total"].(int64); total != 0 {
+			t.Errorf("Expected no match for %q, got %d", keyword, total)
+		}
+	}
+}
+
+func TestGroupMembersMethod_AvatarVisibility(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("avatarowner", "password")
+	friend, _ := env.CreateTestUser("avatarfriend", "password")
+	stranger, _ := env.CreateTestUser("avatarstranger", "password")
+	group, _ := env.CreateTestGroup("Avatar Group", owner.ID)
+	for _, u := range []*models.User{friend, stranger} {
+		env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: u.ID, Role: models.GroupRoleMember})
+	}
+	env.CreateTestFriendship(owner.ID, friend.ID, models.FriendStatusAccepted)
+	env.DB.Model(owner).Updates(map[string]interface{}{"avatar": "/files/a.png", "avatar_visibility": models.VisibilityFriends})
+
+	avatarOf := func(viewer *models.User) interface{} {
+		params, _ := json.Marshal(GroupMembersParams{GroupID: group.ID})
+		result, err := NewGroupMembersMethod(env.Storage).Execute(context.WithValue(context.Background(), "user_id", viewer.ID), params)
+		if err != nil {
+			t.Fatalf("List members failed: %v", err)
+		}
+		for _, m := range result.(map[string]interface{})["members"].([]map[string]interface{}) {
+			if m["user_id"] == owner.ID {
+				return m["avatar"]
+			}
+		}
+		t.Fatal("Owner not listed")
+		return nil
+	}
+
+	if avatarOf(owner) != "/files/a.png" || avatarOf(friend) != "/files/a.png" {
+		t.Error("The owner and friends should see the avatar")
+	}
+	if avatarOf(stranger) != "" {
+		t.Error("Other members should not see a friends only avatar")
+	}
+
+	env.DB.Model(owner).Update("avatar_visibility", models.VisibilityNobody)
+	result, _ := NewFriendListMethod(env.Storage).Execute(context.WithValue(context.Background(), "user_id", friend.ID), nil)
+	if friends := result.([]map[string]interface{}); len(friends) != 1 || friends[0]["avatar"] != "" {
+		t.Errorf("Friends should not see a hidden avatar, got %v", friends)
+	}
+}
+
+func TestGroupSetNicknameMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user, _ := env.CreateTestUser("alice_qa", "password")
+	group, _ := env.CreateTestGroup("Work Group", user.ID)
+
+	method := NewGroupSetNicknameMethod(env.Storage)
+
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+
+	params, _ := json.Marshal(GroupSetNicknameParams{GroupID: group.ID, Nickname: "Alice (QA)"})
+	_, err = method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Set nickname failed: %v", err)
+	}
+
+	// Verify nickname shows up in the member listing
+	membersMethod := NewGroupMembersMethod(env.Storage)
+	params, _ = json.Marshal(GroupMembersParams{GroupID: group.ID, Keyword: "(qa)"})
+	result, err := membersMethod.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("List members failed: %v", err)
+	}
+
+	members := result.(map[string]interface{})["members"].([]map[string]interface{})
+	if len(members) != 1 {
+		t.Fatalf("Expected 1 member, got %d", len(members))
+	}
+	if members[0]["display_name"] != "Alice (QA)" {
+		t.Errorf("Expected display name 'Alice (QA)', got '%v'", members[0]["display_name"])
+	}
+}
+
+func TestGroupSetNicknameMethod_NotMember(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("nickowner", "password")
+	user2, _ := env.CreateTestUser("nickoutsider", "password")
+	group, _ := env.CreateTestGroup("Nick Group", user1.ID)
+
+	method := NewGroupSetNicknameMethod(env.Storage)
+
+	ctx := context.WithValue(context.Background(), "user_id", user2.ID)
+
+	params, _ := json.Marshal(GroupSetNicknameParams{GroupID: group.ID, Nickname: "Intruder"})
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Non-member should not be able to set a group nickname")
+	}
+}
+
+func TestGroupJoinMethod_InviteOnly(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("inviteonlyowner", "password")
+	user2, _ := env.CreateTestUser("gatecrasher", "password")
+	group, _ := env.CreateTestGroup("Invite Only", user1.ID)
+	env.DB.Model(group).Update("join_policy", models.GroupJoinInviteOnly)
+
+	method := NewGroupJoinMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+
+	ctx := context.WithValue(context.Background(), "user_id", user2.ID)
+
+	params, _ := json.Marshal(GroupJoinParams{GroupID: group.ID})
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Should not be able to join an invite only group")
+	}
+}
+
+func TestGroupJoinMethod_Approval(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("approvalowner", "password")
+	applicant, _ := env.CreateTestUser("applicant", "password")
+	group, _ := env.CreateTestGroup("Approval Group", owner.ID)
+	env.DB.Model(group).Update("join_policy", models.GroupJoinApproval)
+
+	joinMethod := NewGroupJoinMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+
+	applicantCtx := context.WithValue(context.Background(), "user_id", applicant.ID)
+	applicantCtx = context.WithValue(applicantCtx, "username", applicant.Username)
+
+	params, _ := json.Marshal(GroupJoinParams{GroupID: group.ID, Message: "let me in"})
+	result, err := joinMethod.Execute(applicantCtx, params)
+	if err != nil {
+		t.Fatalf("Join request failed: %v", err)
+	}
+	if result.(map[string]interface{})["pending"] != true {
+		t.Error("Join should be pending approval")
+	}
+
+	// Not a member yet
+	var count int64
+	env.DB.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", group.ID, applicant.ID).Count(&count)
+	if count != 0 {
+		t.Error("Applicant should not be a member before approval")
+	}
+
+	// Duplicate request
+	_, err = joinMethod.Execute(applicantCtx, params)
+	if err == nil {
+		t.Error("Should not be able to file a second pending request")
+	}
+
+	ownerCtx := context.WithValue(context.Background(), "user_id", owner.ID)
+	ownerCtx = context.WithValue(ownerCtx, "username", owner.Username)
+
+	listMethod := NewGroupJoinRequestsMethod(env.Storage)
+	params, _ = json.Marshal(GroupJoinRequestsParams{GroupID: group.ID})
+	result, err = listMethod.Execute(ownerCtx, params)
+	if err != nil {
+		t.Fatalf("List join requests failed: %v", err)
+	}
+	requests := result.([]map[string]interface{})
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 join request, got %d", len(requests))
+	}
+	if requests[0]["message"] != "let me in" {
+		t.Errorf("Expected message 'let me in', got '%v'", requests[0]["message"])
+	}
+
+	reviewMethod := NewGroupReviewJoinRequestMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+	params, _ = json.Marshal(GroupReviewJoinRequestParams{RequestID: requests[0]["id"].(int64), Approve: true})
+	_, err = reviewMethod.Execute(ownerCtx, params)
+	if err != nil {
+		t.Fatalf("Approve join request failed: %v", err)
+	}
+
+	env.DB.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", group.ID, applicant.ID).Count(&count)
+	if count != 1 {
+		t.Error("Applicant should be a member after approval")
+	}
+}
+
+func TestGroupReviewJoinRequestMethod_NotAdmin(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("reviewowner", "password")
+	applicant, _ := env.CreateTestUser("selfapprover", "password")
+	group, _ := env.CreateTestGroup("Review Group", owner.ID)
+
+	request := &models.GroupJoinRequest{GroupID: group.ID, UserID: applicant.ID}
+	env.DB.Create(request)
+
+	method := NewGroupReviewJoinRequestMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+
+	ctx := context.WithValue(context.Background(), "user_id", applicant.ID)
+	ctx = context.WithValue(ctx, "username", applicant.Username)
+
+	params, _ := json.Marshal(GroupReviewJoinRequestParams{RequestID: request.ID, Approve: true})
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Applicant should not be able to approve their own request")
+	}
+}
+
+func TestGroupSearchMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("searchowner", "password")
+	searcher, _ := env.CreateTestUser("searcher", "password")
+
+	createMethod := NewGroupCreateMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+	ownerCtx := context.WithValue(context.Background(), "user_id", owner.ID)
+
+	for _, p := range []GroupCreateParams{
+		{Name: "Gophers", Description: "Talk about Go", IsPublic: true, Tags: []string{"Go", "backend"}},
+		{Name: "Rustaceans", IsPublic: true, Tags: []string{"rust"}, MemberIDs: []int64{searcher.ID}},
+		{Name: "Secret Gophers", IsPublic: false},
+	} {
+		params, _ := json.Marshal(p)
+		if _, err := createMethod.Execute(ownerCtx, params); err != nil {
+			t.Fatalf("Create group failed: %v", err)
+		}
+	}
+
+	method := NewGroupSearchMethod(env.Storage)
+
+	ctx := context.WithValue(context.Background(), "user_id", searcher.ID)
+
+	// All public groups, most members first
+	result, err := method.Execute(ctx, nil)
+	if err != nil {
+		t.Fatalf("Search groups failed: %v", err)
+	}
+	resultMap := result.(map[string]interface{})
+	if resultMap["total"].(int64) != 2 {
+		t.Errorf("Expected 2 public groups, got %v", resultMap["total"])
+	}
+	groups := resultMap["groups"].([]map[string]interface{})
+	if len(groups) != 2 || groups[0]["name"] != "Rustaceans" {
+		t.Fatalf("Expected Rustaceans first, got %v", groups)
+	}
+	if groups[0]["member_count"].(int64) != 2 || groups[0]["is_member"] != true {
+		t.Errorf("Unexpected member info: %v", groups[0])
+	}
+
+	// Keyword search does not leak private groups
+	params, _ := json.Marshal(GroupSearchParams{Keyword: "gopher"})
+	result, err = method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Search groups failed: %v", err)
+	}
+	groups = result.(map[string]interface{})["groups"].([]map[string]interface{})
+	if len(groups) != 1 || groups[0]["name"] != "Gophers" {
+		t.Errorf("Expected only Gophers, got %v", groups)
+	}
+
+	// Tag filter
+	params, _ = json.Marshal(GroupSearchParams{Tag: "GO"})
+	result, err = method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Search groups failed: %v", err)
+	}
+	groups = result.(map[string]interface{})["groups"].([]map[string]interface{})
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 group tagged go, got %d", len(groups))
+	}
+	tags := groups[0]["tags"].([]string)
+	if len(tags) != 2 || tags[0] != "backend" || tags[1] != "go" {
+		t.Errorf("Expected tags [backend go], got %v", tags)
+	}
+}
+
+func TestGroupLeaveMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("leaveowner", "password")
+	member, _ := env.CreateTestUser("leaver", "password")
+	group, _ := env.CreateTestGroup("Leave Group", owner.ID)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: member.ID, Role: models.GroupRoleMember})
+
+	method := NewGroupLeaveMethod(env.Storage, env.Hub)
+
+	ctx := context.WithValue(context.Background(), "user_id", member.ID)
+	params, _ := json.Marshal(GroupLeaveParams{GroupID: group.ID})
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Fatalf("Leave group failed: %v", err)
+	}
+
+	var count int64
+	env.DB.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", group.ID, member.ID).Count(&count)
+	if count != 0 {
+		t.Error("User should no longer be a member")
+	}
+
+	// Owner cannot leave
+	ctx = context.WithValue(context.Background(), "user_id", owner.ID)
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Owner should not be able to leave the group")
+	}
+}
+
+func TestGroupKickMethod_Permissions(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("kickowner", "password")
+	admin, _ := env.CreateTestUser("kickadmin", "password")
+	member, _ := env.CreateTestUser("kickmember", "password")
+	group, _ := env.CreateTestGroup("Kick Group", owner.ID)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: admin.ID, Role: models.GroupRoleAdmin})
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: member.ID, Role: models.GroupRoleMember})
+
+	method := NewGroupKickMethod(env.Storage, env.Hub)
+
+	// Member cannot kick admin
+	ctx := context.WithValue(context.Background(), "user_id", member.ID)
+	ctx = context.WithValue(ctx, "username", member.Username)
+	params, _ := json.Marshal(GroupKickParams{GroupID: group.ID, UserID: admin.ID})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Member should not be able to kick an admin")
+	}
+
+	// Admin cannot kick owner
+	ctx = context.WithValue(context.Background(), "user_id", admin.ID)
+	ctx = context.WithValue(ctx, "username", admin.Username)
+	params, _ = json.Marshal(GroupKickParams{GroupID: group.ID, UserID: owner.ID})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Admin should not be able to kick the owner")
+	}
+
+	// Admin can kick member
+	params, _ = json.Marshal(GroupKickParams{GroupID: group.ID, UserID: member.ID})
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Fatalf("Admin kick failed: %v", err)
+	}
+
+	var count int64
+	env.DB.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", group.ID, member.ID).Count(&count)
+	if count != 0 {
+		t.Error("Kicked user should no longer be a member")
+	}
+}
+
+func TestGroupSystemMessages_History(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("eventowner", "password")
+	alice, _ := env.CreateTestUser("eventalice", "password")
+	bob, _ := env.CreateTestUser("eventbob", "password")
+
+	ownerCtx := context.WithValue(context.Background(), "user_id", owner.ID)
+	ownerCtx = context.WithValue(ownerCtx, "username", owner.Username)
+
+	createMethod := NewGroupCreateMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+	params, _ := json.Marshal(GroupCreateParams{Name: "Events", MemberIDs: []int64{alice.ID}})
+	result, err := createMethod.Execute(ownerCtx, params)
+	if err != nil {
+		t.Fatalf("Create group failed: %v", err)
+	}
+	group := result.(*createdGroup)
+
+	inviteMethod := NewGroupInviteMethod(env.Storage, env.Hub, env.Config.GroupConfiguration)
+	params, _ = json.Marshal(GroupInviteParams{GroupID: group.ID, UserIDs: []int64{bob.ID}})
+	if _, err := inviteMethod.Execute(ownerCtx, params); err != nil {
+		t.Fatalf("Invite failed: %v", err)
+	}
+
+	kickMethod := NewGroupKickMethod(env.Storage, env.Hub)
+	params, _ = json.Marshal(GroupKickParams{GroupID: group.ID, UserID: bob.ID})
+	if _, err := kickMethod.Execute(ownerCtx, params); err != nil {
+		t.Fatalf("Kick failed: %v", err)
+	}
+
+	aliceCtx := context.WithValue(context.Background(), "user_id", alice.ID)
+	leaveMethod := NewGroupLeaveMethod(env.Storage, env.Hub)
+	params, _ = json.Marshal(GroupLeaveParams{GroupID: group.ID})
+	if _, err := leaveMethod.Execute(aliceCtx, params); err != nil {
+		t.Fatalf("Leave failed: %v", err)
+	}
+
+	historyMethod := NewMessageHistoryMethod(env.Storage)
+	params, _ = json.Marshal(MessageHistoryParams{GroupID: group.ID})
+	result, err = historyMethod.Execute(ownerCtx, params)
+	if err != nil {
+		t.Fatalf("Get history failed: %v", err)
+	}
+
+	messages := result.([]historyMessage)
+	expected := []models.SystemEvent{
+		models.SystemEventGroupCreated,
+		models.SystemEventMemberInvited,
+		models.SystemEventMemberRemoved,
+		models.SystemEventMemberLeft,
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d system messages, got %d", len(expected), len(messages))
+	}
+
+	for i, msg := range messages {
+		if msg.MsgType != models.MsgTypeSystem {
+			t.Errorf("Message %d should be a system message", i)
+		}
+		var payload models.SystemPayload
+		if err := json.Unmarshal([]byte(msg.Content), &payload); err != nil {
+			t.Fatalf("Invalid system payload: %v", err)
+		}
+		if payload.Event != expected[i] {
+			t.Errorf("Expected event %s, got %s", expected[i], payload.Event)
+		}
+	}
+
+	// "eventowner invited eventbob"
+	var payload models.SystemPayload
+	json.Unmarshal([]byte(messages[1].Content), &payload)
+	if payload.ActorID != owner.ID || payload.ActorName != "eventowner" {
+		t.Errorf("Unexpected actor: %d %s", payload.ActorID, payload.ActorName)
+	}
+	if len(payload.Targets) != 1 || payload.Targets[0].UserID != bob.ID || payload.Targets[0].Name != "eventbob" {
+		t.Errorf("Unexpected targets: %v", payload.Targets)
+	}
+}
@@ -3,10 +3,13 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
+	"simple_im/internal/models"
 	"simple_im/internal/storage"
 	"simple_im/internal/ws"
 	"simple_im/pkg/common/jwt"
@@ -21,6 +24,31 @@ type RpcMethod interface {
 	RequireAuth() bool
 }
 
+// PermissionedMethod is implemented by methods that need more than a login,
+// the caller's global role must grant every returned permission
+type PermissionedMethod interface {
+	RequiredPermissions() []models.Permission
+}
+
+// AuditedMethod is implemented by methods whose calls are written to the
+// audit log, AuditTarget names the object a call acts on
+type AuditedMethod interface {
+	AuditTarget(params json.RawMessage) (targetType, targetID string)
+}
+
+// ScopedMethod is implemented by methods bots may call, an API token must
+// carry the returned scope. Methods without it only accept user tokens.
+type ScopedMethod interface {
+	RequiredScope() models.TokenScope
+}
+
+// ErrAPITokenInvalid covers unknown, revoked and expired API tokens and
+// tokens of disabled or deleted bots
+var ErrAPITokenInvalid = errors.New("api token is invalid")
+
+// apiTokenTouchInterval limits how often last_used_at is written
+const apiTokenTouchInterval = time.Minute
+
 type RpcHandler struct {
 	methods    map[string]RpcMethod
 	mu         sync.RWMutex
@@ -71,36 +99,139 @@ func (h *RpcHandler) HandleRpcRequest(ctx *gin.Context) {
 
 	// Create context with request info
 	rpcCtx := context.Background()
+	rpcCtx = context.WithValue(rpcCtx, "client_ip", ctx.ClientIP())
+	rpcCtx = context.WithValue(rpcCtx, "user_agent", ctx.Request.UserAgent())
+
+	var entry *models.AuditLog
+	if am, ok := method.(AuditedMethod); ok {
+		entry = newAuditEntry(rpcCtx, req.Method, am, req.Params)
+		rpcCtx = context.WithValue(rpcCtx, "audit", entry)
+	}
+	fail := func(err error) {
+		h.writeAudit(entry, err)
+		resp.ErrorReturn(ctx, req.Id, err)
+	}
 
 	// Check authentication if required
 	if method.RequireAuth() {
 		authHeader := ctx.GetHeader("Authorization")
 		if authHeader == "" {
-			resp.ErrorReturn(ctx, req.Id, fmt.Errorf("authorization required"))
+			fail(fmt.Errorf("authorization required"))
 			return
 		}
 
 		parts := strings.SplitN(authHeader, " ", 2)
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			resp.ErrorReturn(ctx, req.Id, fmt.Errorf("invalid authorization format"))
+			fail(fmt.Errorf("invalid authorization format"))
 			return
 		}
 
-		claims, err := h.jwtManager.ParseToken(parts[1])
-		if err != nil {
-			resp.ErrorReturn(ctx, req.Id, fmt.Errorf("invalid token: %v", err))
-			return
+		if strings.HasPrefix(parts[1], models.APITokenPrefix) {
+			token, err := h.ParseAPIToken(parts[1])
+			if err != nil {
+				fail(fmt.Errorf("invalid token: %v", err))
+				return
+			}
+			rpcCtx = context.WithValue(rpcCtx, "user_id", token.UserID)
+			rpcCtx = context.WithValue(rpcCtx, "username", token.User.Username)
+			rpcCtx = context.WithValue(rpcCtx, "api_token", token)
+			setAuditActor(rpcCtx, token.UserID)
+
+			sm, ok := method.(ScopedMethod)
+			if !ok || !token.HasScope(sm.RequiredScope()) {
+				fail(resp.NewError(resp.PermissionDeniedCode, "api token not allowed to call "+req.Method, nil))
+				return
+			}
+		} else {
+			claims, err := h.ParseToken(parts[1])
+			if err != nil {
+				fail(fmt.Errorf("invalid token: %v", err))
+				return
+			}
+
+			rpcCtx = context.WithValue(rpcCtx, "user_id", claims.UserID)
+			rpcCtx = context.WithValue(rpcCtx, "username", claims.Username)
+			rpcCtx = context.WithValue(rpcCtx, "session_id", claims.ID)
+			setAuditActor(rpcCtx, claims.UserID)
 		}
+	}
 
-		rpcCtx = context.WithValue(rpcCtx, "user_id", claims.UserID)
-		rpcCtx = context.WithValue(rpcCtx, "username", claims.Username)
+	if pm, ok := method.(PermissionedMethod); ok {
+		if err := h.checkPermissions(rpcCtx, pm.RequiredPermissions()); err != nil {
+			fail(err)
+			return
+		}
 	}
 
 	result, err := method.Execute(rpcCtx, req.Params)
 	if err != nil {
-		resp.ErrorReturn(ctx, req.Id, err)
+		fail(err)
 		return
 	}
 
+	h.writeAudit(entry, nil)
 	resp.SuccessReturn(ctx, req.Id, result)
 }
+
+// ParseToken validates a token and checks that its session is still alive
+func (h *RpcHandler) ParseToken(token string) (*jwt.Claims, error) {
+	claims, err := h.jwtManager.ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" {
+		return nil, jwt.ErrTokenInvalid
+	}
+
+	ctx := context.Background()
+	session, err := h.storage.GetSession(ctx, claims.ID)
+	if err != nil || session.UserID != claims.UserID {
+		return nil, jwt.ErrTokenRevoked
+	}
+	h.storage.TouchSession(ctx, session)
+
+	return claims, nil
+}
+
+// ParseAPIToken looks up a bot's API token by its hash
+func (h *RpcHandler) ParseAPIToken(raw string) (*models.APIToken, error) {
+	db := h.storage.GetDB()
+
+	var token models.APIToken
+	if err := db.Preload("User").Where("token_hash = ?", hashAPIToken(raw)).First(&token).Error; err != nil {
+		return nil, ErrAPITokenInvalid
+	}
+
+	now := time.Now()
+	if !token.Active(now) || token.User == nil || token.User.Status != 1 {
+		return nil, ErrAPITokenInvalid
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > apiTokenTouchInterval {
+		db.Model(&token).Update("last_used_at", now)
+	}
+	return &token, nil
+}
+
+// checkPermissions loads the caller's role on every call, so role changes
+// apply to tokens that are already issued
+func (h *RpcHandler) checkPermissions(ctx context.Context, permissions []models.Permission) error {
+	denied := resp.NewError(resp.PermissionDeniedCode, "permission denied", nil)
+
+	userID, ok := ctx.Value("user_id").(int64)
+	if !ok {
+		return denied
+	}
+
+	var user models.User
+	if err := h.storage.GetDB().Select("id", "role").First(&user, userID).Error; err != nil {
+		return denied
+	}
+
+	for _, p := range permissions {
+		if !user.Role.HasPermission(p) {
+			return denied
+		}
+	}
+	return nil
+}
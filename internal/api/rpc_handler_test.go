@@ -2,11 +2,14 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"simple_im/internal/auth"
+	"simple_im/pkg/common/config"
 	"simple_im/pkg/common/resp"
 
 	"github.com/gin-gonic/gin"
@@ -166,7 +169,7 @@ func TestRpcHandler_AuthWithValidToken(t *testing.T) {
 	user, _ := env.CreateTestUser("authuser", "password")
 
 	// Generate token
-	token, _ := env.JWTManager.GenerateToken(user.ID, user.Username)
+	token, _ := env.CreateTestToken(user)
 
 	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
 	handler.RegisterMethod(NewUserInfoMethod(env.Storage))
@@ -267,3 +270,67 @@ func TestPingMethod(t *testing.T) {
 		t.Error("Expected message: pong")
 	}
 }
+
+func TestRpcHandler_ParseToken_Session(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user, _ := env.CreateTestUser("sessionuser", "password")
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+
+	token, _ := env.CreateTestToken(user)
+	claims, err := handler.ParseToken(token)
+	if err != nil {
+		t.Fatalf("Token with a live session should be valid: %v", err)
+	}
+
+	// Tokens without a session are rejected
+	stateless, _ := env.JWTManager.GenerateToken(user.ID, user.Username, "")
+	if _, err := handler.ParseToken(stateless); err == nil {
+		t.Error("Token without session id should be rejected")
+	}
+
+	// Tokens of a deleted session are rejected
+	env.Storage.DeleteSession(context.Background(), user.ID, claims.ID)
+	if _, err := handler.ParseToken(token); err == nil {
+		t.Error("Token of a deleted session should be rejected")
+	}
+}
+
+func TestRpcHandler_RateLimitedErrorCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+	limits := config.RateLimitConfiguration{LoginPerIP: 1}
+	handler.RegisterMethod(NewUserLoginMethod(env.Storage, env.JWTManager, limits, auth.NewLocal(env.DB)))
+
+	params, _ := json.Marshal(UserLoginParams{Username: "nobody", Password: "password123"})
+	body, _ := json.Marshal(resp.RpcRequest{JsonRPC: "2.0", Method: "user.login", Params: params, Id: "1"})
+
+	var response resp.RpcResponse
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/api/rpc", bytes.NewReader(body))
+		ctx.Request.Header.Set("Content-Type", "application/json")
+		handler.HandleRpcRequest(ctx)
+
+		response = resp.RpcResponse{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+	}
+
+	if response.Error == nil || response.Error.Code != resp.RateLimitedCode {
+		t.Fatalf("Expected rate limited error, got %+v", response.Error)
+	}
+	data, _ := response.Error.Data.(map[string]interface{})
+	if data["retry_after"] == nil {
+		t.Error("Rate limited error should carry retry_after")
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"simple_im/internal/models"
 	"simple_im/internal/storage"
 	"simple_im/internal/ws"
+
+	"gorm.io/gorm"
 )
 
 // ============ message.send ============
@@ -27,14 +29,16 @@ func (m *MessageSendMethod) Name() string { return "message.send" }
 
 func (m *MessageSendMethod) RequireAuth() bool { return true }
 
+func (m *MessageSendMethod) RequiredScope() models.TokenScope { return models.ScopeMessagesSend }
+
 type MessageSendParams struct {
-	ReceiverID int64             `json:"receiver_id"` // For private chat
-	GroupID    int64             `json:"group_id"`    // For group chat
+	ReceiverID int64              `json:"receiver_id"` // For private chat
+	GroupID    int64              `json:"group_id"`    // For group chat
 	MsgType    models.MessageType `json:"msg_type"`    // 1:text 2:image 3:file
-	Content    string            `json:"content"`
-	FileURL    string            `json:"file_url"`
-	FileName   string            `json:"file_name"`
-	FileSize   int64             `json:"file_size"`
+	Content    string             `json:"content"`
+	FileURL    string             `json:"file_url"`
+	FileName   string             `json:"file_name"`
+	FileSize   int64              `json:"file_size"`
 }
 
 func (m *MessageSendMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
@@ -51,6 +55,10 @@ func (m *MessageSendMethod) Execute(ctx context.Context, params json.RawMessage)
 		p.MsgType = models.MsgTypeText
 	}
 
+	if p.MsgType != models.MsgTypeText && p.MsgType != models.MsgTypeImage && p.MsgType != models.MsgTypeFile {
+		return nil, errors.New("invalid msg_type")
+	}
+
 	if p.MsgType == models.MsgTypeText && p.Content == "" {
 		return nil, errors.New("content is required for text message")
 	}
@@ -59,34 +67,48 @@ func (m *MessageSendMethod) Execute(ctx context.Context, params json.RawMessage)
 		return nil, errors.New("file_url is required for image/file message")
 	}
 
+	// Bots only talk in the groups they were added to
+	if _, isBot := ctx.Value("api_token").(*models.APIToken); isBot && p.GroupID == 0 {
+		return nil, errors.New("bots can only send to groups")
+	}
+
 	userID := ctx.Value("user_id").(int64)
 	username := ctx.Value("username").(string)
 	db := m.storage.GetDB()
 
 	// Validate receiver or group
 	var groupMembers []int64
+	senderName := username
 	if p.GroupID > 0 {
 		// Check if user is member of group
 		var membership models.GroupMember
-		err := db.Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
+		err := db.Preload("User").Where("group_id = ? AND user_id = ?", p.GroupID, userID).First(&membership).Error
 		if err != nil {
 			return nil, errors.New("not a member of this group")
 		}
+		senderName = membership.DisplayName()
 
 		// Get all group members for broadcasting
-		var members []models.GroupMember
-		db.Where("group_id = ?", p.GroupID).Find(&members)
-		for _, m := range members {
-			groupMembers = append(groupMembers, m.UserID)
+		groupMembers, err = m.storage.GetGroupMemberIDs(ctx, p.GroupID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get group members: %v", err)
 		}
 	} else {
-		// Check if receiver exists and is friend
-		var friend models.Friend
-		err := db.Where("((user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)) AND status = ?",
-			userID, p.ReceiverID, p.ReceiverID, userID, models.FriendStatusAccepted).First(&friend).Error
-		if err != nil {
+		// Blocked senders get the same answer as strangers
+		if isBlocked(db, p.ReceiverID, userID) {
 			return nil, errors.New("can only send messages to friends")
 		}
+
+		// Friends can always chat, strangers only if the receiver allows it and they share a group
+		if !areFriends(db, userID, p.ReceiverID) {
+			var receiver models.User
+			if err := db.First(&receiver, p.ReceiverID).Error; err != nil {
+				return nil, errors.New("can only send messages to friends")
+			}
+			if !receiver.AllowStrangerChat || !shareGroup(db, userID, p.ReceiverID) {
+				return nil, errors.New("can only send messages to friends")
+			}
+		}
 	}
 
 	// Create message
@@ -125,7 +147,7 @@ func (m *MessageSendMethod) Execute(ctx context.Context, params json.RawMessage)
 		ID:           msg.ID,
 		Type:         "message",
 		SenderID:     userID,
-		SenderName:   username,
+		SenderName:   senderName,
 		ReceiverID:   p.ReceiverID,
 		GroupID:      p.GroupID,
 		GroupName:    groupName,
@@ -155,6 +177,8 @@ func (m *MessageHistoryMethod) Name() string { return "message.history" }
 
 func (m *MessageHistoryMethod) RequireAuth() bool { return true }
 
+func (m *MessageHistoryMethod) RequiredScope() models.TokenScope { return models.ScopeMessagesRead }
+
 type MessageHistoryParams struct {
 	ReceiverID int64 `json:"receiver_id"` // For private chat
 	GroupID    int64 `json:"group_id"`    // For group chat
@@ -180,7 +204,9 @@ func (m *MessageHistoryMethod) Execute(ctx context.Context, params json.RawMessa
 	db := m.storage.GetDB()
 
 	var messages []models.Message
-	query := db.Preload("Sender").Order("id DESC").Limit(p.Limit)
+	query := db.Preload("Sender", func(tx *gorm.DB) *gorm.DB {
+		return tx.Unscoped() // Deleted accounts still show as the sender
+	}).Order("id DESC").Limit(p.Limit)
 
 	if p.BeforeID > 0 {
 		query = query.Where("id < ?", p.BeforeID)
@@ -207,10 +233,27 @@ func (m *MessageHistoryMethod) Execute(ctx context.Context, params json.RawMessa
 		return nil, fmt.Errorf("failed to get messages: %v", err)
 	}
 
+	senderIDs := make([]int64, 0, len(messages))
+	for _, msg := range messages {
+		senderIDs = append(senderIDs, msg.SenderID)
+	}
+	friends := friendsAmong(db, userID, senderIDs)
+
 	// Reverse to chronological order
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	result := make([]historyMessage, 0, len(messages))
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := historyMessage{Message: messages[i]}
+		if sender := messages[i].Sender; sender != nil {
+			msg.Sender = newUserProfile(sender, userID, friends[sender.ID])
+		}
+		result = append(result, msg)
 	}
 
-	return messages, nil
+	return result, nil
+}
+
+// historyMessage shows the sender through their public profile
+type historyMessage struct {
+	models.Message
+	Sender *userProfile `json:"sender,omitempty"`
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"simple_im/internal/models"
+	"strings"
 	"testing"
 	"time"
 )
@@ -107,6 +108,51 @@ func TestMessageSendMethod_NotFriend(t *testing.T) {
 	}
 }
 
+func TestMessageSendMethod_StrangerInSharedGroup(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("colleague1", "password")
+	user2, _ := env.CreateTestUser("colleague2", "password")
+	outsider, _ := env.CreateTestUser("outsider", "password")
+
+	group, _ := env.CreateTestGroup("Office", user1.ID)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: user2.ID, Role: models.GroupRoleMember})
+
+	method := NewMessageSendMethod(env.Storage, env.Hub)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+	ctx = context.WithValue(ctx, "username", user1.Username)
+
+	params, _ := json.Marshal(MessageSendParams{
+		ReceiverID: user2.ID,
+		MsgType:    models.MsgTypeText,
+		Content:    "Hello colleague",
+	})
+
+	// Off by default
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Strangers should not be able to chat by default")
+	}
+
+	allow := true
+	privacyParams, _ := json.Marshal(UserUpdatePrivacyParams{AllowStrangerChat: &allow})
+	NewUserUpdatePrivacyMethod(env.Storage).Execute(context.WithValue(context.Background(), "user_id", user2.ID), privacyParams)
+
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Errorf("Group members should be able to chat when allowed: %v", err)
+	}
+
+	// Still limited to people sharing a group
+	outsiderCtx := context.WithValue(context.Background(), "user_id", outsider.ID)
+	outsiderCtx = context.WithValue(outsiderCtx, "username", outsider.Username)
+	if _, err := method.Execute(outsiderCtx, params); err == nil {
+		t.Error("Users without a shared group should not be able to chat")
+	}
+}
+
 func TestMessageSendMethod_NotGroupMember(t *testing.T) {
 	env, err := SetupTestEnv()
 	if err != nil {
@@ -134,6 +180,32 @@ func TestMessageSendMethod_NotGroupMember(t *testing.T) {
 	}
 }
 
+func TestMessageSendMethod_SystemTypeRejected(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("spoofer", "password")
+	group, _ := env.CreateTestGroup("Spoofed Group", user1.ID)
+
+	method := NewMessageSendMethod(env.Storage, env.Hub)
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+	ctx = context.WithValue(ctx, "username", user1.Username)
+
+	params, _ := json.Marshal(MessageSendParams{
+		GroupID: group.ID,
+		MsgType: models.MsgTypeSystem,
+		Content: `{"event":"group_updated"}`,
+	})
+
+	_, err = method.Execute(ctx, params)
+	if err == nil {
+		t.Error("Clients should not be able to send system messages")
+	}
+}
+
 func TestMessageSendMethod_ImageMessage(t *testing.T) {
 	env, err := SetupTestEnv()
 	if err != nil {
@@ -253,7 +325,7 @@ func TestMessageHistoryMethod_PrivateChat(t *testing.T) {
 		t.Fatalf("Get message history failed: %v", err)
 	}
 
-	messages := result.([]models.Message)
+	messages := result.([]historyMessage)
 	if len(messages) != 5 {
 		t.Errorf("Expected 5 messages, got %d", len(messages))
 	}
@@ -295,12 +367,54 @@ func TestMessageHistoryMethod_GroupChat(t *testing.T) {
 		t.Fatalf("Get group message history failed: %v", err)
 	}
 
-	messages := result.([]models.Message)
+	messages := result.([]historyMessage)
 	if len(messages) != 3 {
 		t.Errorf("Expected 3 messages, got %d", len(messages))
 	}
 }
 
+func TestMessageHistoryMethod_SenderPrivacy(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	sender, _ := env.CreateTestUser("privatesender", "password")
+	stranger, _ := env.CreateTestUser("historystranger", "password")
+	group, _ := env.CreateTestGroup("Privacy Group", sender.ID)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: stranger.ID, Role: models.GroupRoleMember})
+	env.DB.Model(sender).Updates(map[string]interface{}{
+		"avatar":               "/files/a.png",
+		"last_seen_at":         time.Now(),
+		"avatar_visibility":    models.VisibilityNobody,
+		"last_seen_visibility": models.VisibilityNobody,
+	})
+
+	groupID := group.ID
+	env.DB.Create(&models.Message{SenderID: sender.ID, GroupID: &groupID, MsgType: models.MsgTypeText, Content: "hi"})
+
+	params, _ := json.Marshal(MessageHistoryParams{GroupID: group.ID})
+	result, err := NewMessageHistoryMethod(env.Storage).Execute(context.WithValue(context.Background(), "user_id", stranger.ID), params)
+	if err != nil {
+		t.Fatalf("Get history failed: %v", err)
+	}
+
+	messages := result.([]historyMessage)
+	if len(messages) != 1 || messages[0].Sender == nil {
+		t.Fatalf("Expected 1 message with its sender, got %+v", messages)
+	}
+	if messages[0].Sender.Avatar != "" || messages[0].Sender.LastSeenAt != nil {
+		t.Errorf("Hidden avatar and last seen should not be shown, got %+v", messages[0].Sender)
+	}
+
+	raw, _ := json.Marshal(messages)
+	for _, key := range []string{"last_seen_at\":\"", "avatar_visibility", "last_seen_visibility", "allow_stranger_chat", "friend_request_policy", "/files/a.png"} {
+		if strings.Contains(string(raw), key) {
+			t.Errorf("History should not contain %s: %s", key, raw)
+		}
+	}
+}
+
 func TestMessageHistoryMethod_Pagination(t *testing.T) {
 	env, err := SetupTestEnv()
 	if err != nil {
@@ -336,7 +450,7 @@ func TestMessageHistoryMethod_Pagination(t *testing.T) {
 	})
 
 	result, _ := method.Execute(ctx, params)
-	messages := result.([]models.Message)
+	messages := result.([]historyMessage)
 	if len(messages) != 5 {
 		t.Errorf("Expected 5 messages, got %d", len(messages))
 	}
@@ -349,7 +463,7 @@ func TestMessageHistoryMethod_Pagination(t *testing.T) {
 	})
 
 	result, _ = method.Execute(ctx, params)
-	messages = result.([]models.Message)
+	messages = result.([]historyMessage)
 	if len(messages) != 5 {
 		t.Errorf("Expected 5 older messages, got %d", len(messages))
 	}
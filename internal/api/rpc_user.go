@@ -2,13 +2,31 @@ package api
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"simple_im/internal/auth"
 	"simple_im/internal/models"
 	"simple_im/internal/storage"
+	"simple_im/internal/ws"
+	"simple_im/pkg/common/config"
 	"simple_im/pkg/common/jwt"
+	"simple_im/pkg/common/oidc"
+	"simple_im/pkg/common/resp"
+	"simple_im/pkg/common/totp"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // ============ user.register ============
@@ -16,20 +34,26 @@ import (
 type UserRegisterMethod struct {
 	storage    *storage.Storage
 	jwtManager *jwt.JWTManager
+	limits     config.RateLimitConfiguration
 }
 
-func NewUserRegisterMethod(s *storage.Storage, j *jwt.JWTManager) *UserRegisterMethod {
-	return &UserRegisterMethod{storage: s, jwtManager: j}
+func NewUserRegisterMethod(s *storage.Storage, j *jwt.JWTManager, c config.RateLimitConfiguration) *UserRegisterMethod {
+	return &UserRegisterMethod{storage: s, jwtManager: j, limits: c}
 }
 
 func (m *UserRegisterMethod) Name() string { return "user.register" }
 
 func (m *UserRegisterMethod) RequireAuth() bool { return false }
 
+func (m *UserRegisterMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
 type UserRegisterParams struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Nickname string `json:"nickname"`
+	Device   string `json:"device"` // Optional device name shown in user.sessions
 }
 
 func (m *UserRegisterMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
@@ -50,6 +74,10 @@ func (m *UserRegisterMethod) Execute(ctx context.Context, params json.RawMessage
 		return nil, errors.New("password must be at least 6 characters")
 	}
 
+	if err := checkRegisterAllowed(ctx, m.storage, m.limits); err != nil {
+		return nil, err
+	}
+
 	db := m.storage.GetDB()
 
 	// Check if username exists
@@ -74,36 +102,46 @@ func (m *UserRegisterMethod) Execute(ctx context.Context, params json.RawMessage
 	if err := db.Create(user).Error; err != nil {
 		return nil, fmt.Errorf("failed to create user: %v", err)
 	}
+	setAuditActor(ctx, user.ID)
 
-	token, err := m.jwtManager.GenerateToken(user.ID, user.Username)
+	tokens, err := issueToken(ctx, m.storage, m.jwtManager, user, p.Device)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate token: %v", err)
+		return nil, err
 	}
 
 	return map[string]interface{}{
-		"user":  user,
-		"token": token,
+		"user":          newFullProfile(user),
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	}, nil
 }
 
 // ============ user.login ============
 
 type UserLoginMethod struct {
-	storage    *storage.Storage
-	jwtManager *jwt.JWTManager
+	storage       *storage.Storage
+	jwtManager    *jwt.JWTManager
+	limits        config.RateLimitConfiguration
+	authenticator auth.Authenticator
 }
 
-func NewUserLoginMethod(s *storage.Storage, j *jwt.JWTManager) *UserLoginMethod {
-	return &UserLoginMethod{storage: s, jwtManager: j}
+func NewUserLoginMethod(s *storage.Storage, j *jwt.JWTManager, c config.RateLimitConfiguration, a auth.Authenticator) *UserLoginMethod {
+	return &UserLoginMethod{storage: s, jwtManager: j, limits: c, authenticator: a}
 }
 
 func (m *UserLoginMethod) Name() string { return "user.login" }
 
 func (m *UserLoginMethod) RequireAuth() bool { return false }
 
+func (m *UserLoginMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
 type UserLoginParams struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Device   string `json:"device"` // Optional device name shown in user.sessions
 }
 
 func (m *UserLoginMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
@@ -116,29 +154,350 @@ func (m *UserLoginMethod) Execute(ctx context.Context, params json.RawMessage) (
 		return nil, errors.New("username and password are required")
 	}
 
+	// Counted per normalized name, directories match usernames case-insensitively
+	name := loginName(p.Username)
+	if err := checkLoginAllowed(ctx, m.storage, m.limits, name); err != nil {
+		return nil, err
+	}
+
+	user, err := m.authenticator.Authenticate(ctx, p.Username, p.Password)
+	if err != nil {
+		// Name the account in the audit log even though the password was wrong
+		var known models.User
+		if m.storage.GetDB().Select("id").Where("username = ?", p.Username).First(&known).Error == nil {
+			setAuditActor(ctx, known.ID)
+		}
+		recordLoginFailure(ctx, m.storage, m.limits, name)
+		return nil, errors.New("invalid username or password")
+	}
+	setAuditActor(ctx, user.ID)
+
+	if user.Status != 1 {
+		return nil, errors.New("user is disabled")
+	}
+
+	// With 2FA enabled the password only earns a challenge, tokens come from user.login_2fa
+	challenge, err := twoFactorChallenge(ctx, m.storage, user, p.Device)
+	if err != nil || challenge != nil {
+		return challenge, err
+	}
+
+	tokens, err := issueToken(ctx, m.storage, m.jwtManager, user, p.Device)
+	if err != nil {
+		return nil, err
+	}
+	m.storage.ClearLoginFailures(ctx, name)
+
+	return map[string]interface{}{
+		"user":          newFullProfile(user),
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	}, nil
+}
+
+// ============ user.login_2fa ============
+
+type UserLoginTwoFactorMethod struct {
+	storage    *storage.Storage
+	jwtManager *jwt.JWTManager
+	limits     config.RateLimitConfiguration
+}
+
+func NewUserLoginTwoFactorMethod(s *storage.Storage, j *jwt.JWTManager, c config.RateLimitConfiguration) *UserLoginTwoFactorMethod {
+	return &UserLoginTwoFactorMethod{storage: s, jwtManager: j, limits: c}
+}
+
+func (m *UserLoginTwoFactorMethod) Name() string { return "user.login_2fa" }
+
+func (m *UserLoginTwoFactorMethod) RequireAuth() bool { return false }
+
+func (m *UserLoginTwoFactorMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+type UserLoginTwoFactorParams struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"` // TOTP code or recovery code
+}
+
+func (m *UserLoginTwoFactorMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserLoginTwoFactorParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.ChallengeToken == "" || p.Code == "" {
+		return nil, errors.New("challenge_token and code are required")
+	}
+
+	challenge, err := m.storage.GetLoginChallenge(ctx, p.ChallengeToken)
+	if err != nil {
+		return nil, errors.New("invalid or expired challenge")
+	}
+	setAuditActor(ctx, challenge.UserID)
+
 	db := m.storage.GetDB()
 
 	var user models.User
-	if err := db.Where("username = ?", p.Username).First(&user).Error; err != nil {
-		return nil, errors.New("invalid username or password")
+	if err := db.First(&user, challenge.UserID).Error; err != nil || user.Status != 1 {
+		m.storage.ConsumeLoginChallenge(ctx, challenge.ID)
+		return nil, errors.New("user is disabled")
 	}
 
-	if !user.CheckPassword(p.Password) {
-		return nil, errors.New("invalid username or password")
+	var tf models.TwoFactor
+	if err := db.Where("user_id = ? AND enabled = ?", user.ID, true).First(&tf).Error; err != nil {
+		// 2FA was reset after the password step, start over
+		m.storage.ConsumeLoginChallenge(ctx, challenge.ID)
+		return nil, errors.New("invalid or expired challenge")
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords, new
+	// challenges would otherwise allow unlimited guesses
+	name := loginName(user.Username)
+	if err := checkLoginLockout(ctx, m.storage, name); err != nil {
+		return nil, err
+	}
+
+	if !verifyTwoFactorCode(db, &tf, p.Code) {
+		m.storage.FailLoginChallenge(ctx, challenge.ID, loginChallengeAttempts)
+		recordLoginFailure(ctx, m.storage, m.limits, name)
+		return nil, errors.New("invalid code")
+	}
+
+	if ok, err := m.storage.ConsumeLoginChallenge(ctx, challenge.ID); err != nil || !ok {
+		return nil, errors.New("invalid or expired challenge")
+	}
+
+	tokens, err := issueToken(ctx, m.storage, m.jwtManager, &user, challenge.Device)
+	if err != nil {
+		return nil, err
 	}
+	m.storage.ClearLoginFailures(ctx, name)
+
+	return map[string]interface{}{
+		"user":          newFullProfile(&user),
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	}, nil
+}
+
+// ============ user.oidc_auth_url ============
+
+type UserOIDCAuthURLMethod struct {
+	storage *storage.Storage
+	client  *oidc.Client
+}
+
+func NewUserOIDCAuthURLMethod(s *storage.Storage, c *oidc.Client) *UserOIDCAuthURLMethod {
+	return &UserOIDCAuthURLMethod{storage: s, client: c}
+}
+
+func (m *UserOIDCAuthURLMethod) Name() string { return "user.oidc_auth_url" }
+
+func (m *UserOIDCAuthURLMethod) RequireAuth() bool { return false }
+
+type UserOIDCAuthURLParams struct {
+	Device string `json:"device"`
+}
+
+// Execute starts a single sign-on login. The client sends the user to url,
+// the provider redirects back to the configured RedirectURL with code and
+// state, which the client passes on to user.login_oidc.
+func (m *UserOIDCAuthURLMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserOIDCAuthURLParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
+	if m.client == nil {
+		return nil, errors.New("single sign-on is not configured")
+	}
+
+	state := &storage.OIDCState{Device: p.Device}
+	for _, v := range []*string{&state.ID, &state.Nonce, &state.Verifier} {
+		random, err := oidc.RandomString()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create state: %v", err)
+		}
+		*v = random
+	}
+
+	url, err := m.client.AuthCodeURL(ctx, state.ID, state.Nonce, oidc.CodeChallenge(state.Verifier))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.storage.CreateOIDCState(ctx, state, oidcStateTTL); err != nil {
+		return nil, fmt.Errorf("failed to create state: %v", err)
+	}
+
+	return map[string]interface{}{
+		"url":        url,
+		"state":      state.ID,
+		"expires_in": int64(oidcStateTTL / time.Second),
+	}, nil
+}
+
+// ============ user.login_oidc ============
+
+type UserLoginOIDCMethod struct {
+	storage    *storage.Storage
+	jwtManager *jwt.JWTManager
+	client     *oidc.Client
+	conf       config.OIDCConfiguration
+}
+
+func NewUserLoginOIDCMethod(s *storage.Storage, j *jwt.JWTManager, o *oidc.Client, c config.OIDCConfiguration) *UserLoginOIDCMethod {
+	return &UserLoginOIDCMethod{storage: s, jwtManager: j, client: o, conf: c}
+}
+
+func (m *UserLoginOIDCMethod) Name() string { return "user.login_oidc" }
+
+func (m *UserLoginOIDCMethod) RequireAuth() bool { return false }
+
+func (m *UserLoginOIDCMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+type UserLoginOIDCParams struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+// Execute finishes a single sign-on login. The first login of an identity
+// creates an account from the mapped claims, or links the local account of
+// the same username when LinkExisting is set. Local 2FA still applies.
+func (m *UserLoginOIDCMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserLoginOIDCParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if m.client == nil {
+		return nil, errors.New("single sign-on is not configured")
+	}
+
+	if p.Code == "" || p.State == "" {
+		return nil, errors.New("code and state are required")
+	}
+
+	state, err := m.storage.TakeOIDCState(ctx, p.State)
+	if err != nil {
+		return nil, errors.New("invalid or expired state")
+	}
+
+	token, err := m.client.Exchange(ctx, p.Code, state.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := m.client.VerifyIDToken(ctx, token.IDToken, state.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := auth.Provision(m.storage.GetDB(), auth.ExternalIdentity{
+		Provider: m.client.Issuer(),
+		Subject:  claims.Subject(),
+		Username: claims.String(orDefaultString(m.conf.UsernameClaim, "preferred_username")),
+		Nickname: claims.String(orDefaultString(m.conf.NicknameClaim, "name")),
+	}, m.conf.LinkExisting)
+	if err != nil {
+		return nil, err
+	}
+	setAuditActor(ctx, user.ID)
 
 	if user.Status != 1 {
 		return nil, errors.New("user is disabled")
 	}
 
-	token, err := m.jwtManager.GenerateToken(user.ID, user.Username)
+	challenge, err := twoFactorChallenge(ctx, m.storage, user, state.Device)
+	if err != nil || challenge != nil {
+		return challenge, err
+	}
+
+	tokens, err := issueToken(ctx, m.storage, m.jwtManager, user, state.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"user":          newFullProfile(user),
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	}, nil
+}
+
+// ============ user.refresh ============
+
+type UserRefreshMethod struct {
+	storage    *storage.Storage
+	hub        *ws.Hub
+	jwtManager *jwt.JWTManager
+}
+
+func NewUserRefreshMethod(s *storage.Storage, h *ws.Hub, j *jwt.JWTManager) *UserRefreshMethod {
+	return &UserRefreshMethod{storage: s, hub: h, jwtManager: j}
+}
+
+func (m *UserRefreshMethod) Name() string { return "user.refresh" }
+
+func (m *UserRefreshMethod) RequireAuth() bool { return false }
+
+type UserRefreshParams struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (m *UserRefreshMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserRefreshParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	sessionID, _, ok := strings.Cut(p.RefreshToken, ".")
+	if !ok || sessionID == "" {
+		return nil, errors.New("invalid refresh token")
+	}
+
+	session, err := m.storage.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, errors.New("invalid refresh token")
+	}
+
+	newToken, newHash, err := newRefreshToken(session.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token: %v", err)
+	}
+
+	err = m.storage.RotateRefreshToken(ctx, session, hashRefreshToken(p.RefreshToken), newHash, m.jwtManager.RefreshExpire())
+	if errors.Is(err, storage.ErrRefreshReused) {
+		// Either the client or an attacker holds a stolen token, end the session for both
+		m.storage.DeleteSession(ctx, session.UserID, session.ID)
+		m.hub.DisconnectSession(session.UserID, session.ID)
+		return nil, errors.New("refresh token reuse detected, session revoked")
+	}
+	if err != nil {
+		return nil, errors.New("invalid refresh token")
+	}
+
+	var user models.User
+	if err := m.storage.GetDB().First(&user, session.UserID).Error; err != nil || user.Status != 1 {
+		m.storage.DeleteSession(ctx, session.UserID, session.ID)
+		return nil, errors.New("user is disabled")
+	}
+
+	token, err := m.jwtManager.GenerateToken(user.ID, user.Username, session.ID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token: %v", err)
 	}
 
 	return map[string]interface{}{
-		"user":  user,
-		"token": token,
+		"token":         token,
+		"refresh_token": newToken,
+		"expires_in":    int64(m.jwtManager.Expire() / time.Second),
 	}, nil
 }
 
@@ -156,6 +515,8 @@ func (m *UserInfoMethod) Name() string { return "user.info" }
 
 func (m *UserInfoMethod) RequireAuth() bool { return true }
 
+func (m *UserInfoMethod) RequiredScope() models.TokenScope { return models.ScopeUsersRead }
+
 type UserInfoParams struct {
 	UserID int64 `json:"user_id"`
 }
@@ -185,5 +546,1530 @@ func (m *UserInfoMethod) Execute(ctx context.Context, params json.RawMessage) (i
 		return nil, errors.New("user not found")
 	}
 
-	return user, nil
+	var viewerID int64
+	if v := ctx.Value("user_id"); v != nil {
+		viewerID = v.(int64)
+	}
+
+	// Users see their own settings, others only the public profile
+	if viewerID == user.ID {
+		return newFullProfile(&user), nil
+	}
+
+	isFriend := viewerID != 0 && areFriends(db, viewerID, user.ID)
+	return newUserProfile(&user, viewerID, isFriend), nil
+}
+
+// ============ user.update_profile ============
+
+type UserUpdateProfileMethod struct {
+	storage *storage.Storage
+	upload  config.UploadConfiguration
+}
+
+func NewUserUpdateProfileMethod(s *storage.Storage, c config.UploadConfiguration) *UserUpdateProfileMethod {
+	return &UserUpdateProfileMethod{storage: s, upload: c}
+}
+
+func (m *UserUpdateProfileMethod) Name() string { return "user.update_profile" }
+
+func (m *UserUpdateProfileMethod) RequireAuth() bool { return true }
+
+// UserUpdateProfileParams only changes the fields that are set, an empty avatar removes it
+type UserUpdateProfileParams struct {
+	Nickname *string `json:"nickname"`
+	Avatar   *string `json:"avatar"`
+}
+
+func (m *UserUpdateProfileMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserUpdateProfileParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	updates := map[string]interface{}{}
+
+	if p.Nickname != nil {
+		nickname := strings.TrimSpace(*p.Nickname)
+		if n := utf8.RuneCountInString(nickname); n == 0 || n > 100 {
+			return nil, errors.New("nickname must be 1-100 characters")
+		}
+		user.Nickname = nickname
+		updates["nickname"] = nickname
+	}
+
+	if p.Avatar != nil {
+		avatar := strings.TrimSpace(*p.Avatar)
+		if avatar != "" && !m.ownUploadedImage(db, userID, avatar) {
+			return nil, errors.New("avatar must be an image you uploaded")
+		}
+		user.Avatar = avatar
+		updates["avatar"] = avatar
+	}
+
+	if len(updates) > 0 {
+		if err := db.Model(&user).Updates(updates).Error; err != nil {
+			return nil, fmt.Errorf("failed to update profile: %v", err)
+		}
+	}
+
+	return newFullProfile(&user), nil
+}
+
+// ownUploadedImage reports whether url points to an image the user uploaded through /api/upload
+func (m *UserUpdateProfileMethod) ownUploadedImage(db *gorm.DB, userID int64, url string) bool {
+	name := strings.TrimPrefix(url, "/files/")
+	if name == url || name == "" || name != filepath.Base(name) {
+		return false
+	}
+
+	var file models.File
+	err := db.Where("user_id = ? AND filepath = ?", userID, filepath.Join(m.upload.SavePath, name)).First(&file).Error
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(file.Mimetype, "image/")
+}
+
+// ============ user.change_password ============
+
+type UserChangePasswordMethod struct {
+	storage    *storage.Storage
+	hub        *ws.Hub
+	jwtManager *jwt.JWTManager
+}
+
+func NewUserChangePasswordMethod(s *storage.Storage, h *ws.Hub, j *jwt.JWTManager) *UserChangePasswordMethod {
+	return &UserChangePasswordMethod{storage: s, hub: h, jwtManager: j}
+}
+
+func (m *UserChangePasswordMethod) Name() string { return "user.change_password" }
+
+func (m *UserChangePasswordMethod) RequireAuth() bool { return true }
+
+func (m *UserChangePasswordMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+type UserChangePasswordParams struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+func (m *UserChangePasswordMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserChangePasswordParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.OldPassword == "" || p.NewPassword == "" {
+		return nil, errors.New("old_password and new_password are required")
+	}
+
+	if len(p.NewPassword) < 6 {
+		return nil, errors.New("password must be at least 6 characters")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	if !user.CheckPassword(p.OldPassword) {
+		return nil, errors.New("old password is incorrect")
+	}
+
+	if err := user.SetPassword(p.NewPassword); err != nil {
+		return nil, fmt.Errorf("failed to set password: %v", err)
+	}
+
+	if err := db.Model(&user).Update("password", user.Password).Error; err != nil {
+		return nil, fmt.Errorf("failed to update password: %v", err)
+	}
+
+	var device string
+	if session, err := m.storage.GetSession(ctx, currentSessionID(ctx)); err == nil {
+		device = session.Device
+	}
+
+	// Log out every device, the caller continues with a new session
+	if _, err := m.storage.DeleteUserSessions(ctx, userID); err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %v", err)
+	}
+	m.hub.DisconnectSession(userID, "")
+
+	tokens, err := issueToken(ctx, m.storage, m.jwtManager, &user, device)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	}, nil
+}
+
+// ============ user.logout ============
+
+type UserLogoutMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewUserLogoutMethod(s *storage.Storage, h *ws.Hub) *UserLogoutMethod {
+	return &UserLogoutMethod{storage: s, hub: h}
+}
+
+func (m *UserLogoutMethod) Name() string { return "user.logout" }
+
+func (m *UserLogoutMethod) RequireAuth() bool { return true }
+
+func (m *UserLogoutMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+func (m *UserLogoutMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	userID := ctx.Value("user_id").(int64)
+	sessionID := currentSessionID(ctx)
+	if sessionID == "" {
+		return nil, errors.New("not logged in with a session")
+	}
+
+	if err := m.storage.DeleteSession(ctx, userID, sessionID); err != nil {
+		return nil, fmt.Errorf("failed to logout: %v", err)
+	}
+	m.hub.DisconnectSession(userID, sessionID)
+
+	return map[string]interface{}{
+		"message": "logged out",
+	}, nil
+}
+
+// ============ user.sessions ============
+
+type UserSessionsMethod struct {
+	storage *storage.Storage
+}
+
+func NewUserSessionsMethod(s *storage.Storage) *UserSessionsMethod {
+	return &UserSessionsMethod{storage: s}
+}
+
+func (m *UserSessionsMethod) Name() string { return "user.sessions" }
+
+func (m *UserSessionsMethod) RequireAuth() bool { return true }
+
+func (m *UserSessionsMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	userID := ctx.Value("user_id").(int64)
+	currentID := currentSessionID(ctx)
+
+	sessions, err := m.storage.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %v", err)
+	}
+
+	result := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, map[string]interface{}{
+			"session_id":     session.ID,
+			"device":         session.Device,
+			"ip":             session.IP,
+			"current":        session.ID == currentID,
+			"created_at":     session.CreatedAt,
+			"last_active_at": session.LastActiveAt,
+		})
+	}
+
+	return result, nil
+}
+
+// ============ user.terminate_session ============
+
+type UserTerminateSessionMethod struct {
+	storage *storage.Storage
+	hub     *ws.Hub
+}
+
+func NewUserTerminateSessionMethod(s *storage.Storage, h *ws.Hub) *UserTerminateSessionMethod {
+	return &UserTerminateSessionMethod{storage: s, hub: h}
+}
+
+func (m *UserTerminateSessionMethod) Name() string { return "user.terminate_session" }
+
+func (m *UserTerminateSessionMethod) RequireAuth() bool { return true }
+
+func (m *UserTerminateSessionMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "session", "session_id")
+}
+
+type UserTerminateSessionParams struct {
+	SessionID string `json:"session_id"`
+}
+
+func (m *UserTerminateSessionMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserTerminateSessionParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.SessionID == "" {
+		return nil, errors.New("session_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+
+	session, err := m.storage.GetSession(ctx, p.SessionID)
+	if err != nil || session.UserID != userID {
+		return nil, errors.New("session not found")
+	}
+
+	if err := m.storage.DeleteSession(ctx, userID, p.SessionID); err != nil {
+		return nil, fmt.Errorf("failed to terminate session: %v", err)
+	}
+	m.hub.DisconnectSession(userID, p.SessionID)
+
+	return map[string]interface{}{
+		"message": "session terminated",
+	}, nil
+}
+
+// ============ user.2fa_enroll ============
+
+type UserTwoFactorEnrollMethod struct {
+	storage *storage.Storage
+	config  config.TwoFactorConfiguration
+}
+
+func NewUserTwoFactorEnrollMethod(s *storage.Storage, c config.TwoFactorConfiguration) *UserTwoFactorEnrollMethod {
+	return &UserTwoFactorEnrollMethod{storage: s, config: c}
+}
+
+func (m *UserTwoFactorEnrollMethod) Name() string { return "user.2fa_enroll" }
+
+func (m *UserTwoFactorEnrollMethod) RequireAuth() bool { return true }
+
+func (m *UserTwoFactorEnrollMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+type UserTwoFactorEnrollParams struct {
+	Password string `json:"password"` // Optional for SSO accounts right after signing in
+}
+
+// Execute creates a new secret, it guards logins once confirmed with user.2fa_verify
+func (m *UserTwoFactorEnrollMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserTwoFactorEnrollParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	if err := confirmUser(ctx, m.storage, &user, p.Password); err != nil {
+		return nil, err
+	}
+
+	var count int64
+	db.Model(&models.TwoFactor{}).Where("user_id = ? AND enabled = ?", userID, true).Count(&count)
+	if count > 0 {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %v", err)
+	}
+
+	// Enrolling again replaces an unconfirmed secret
+	tf := &models.TwoFactor{UserID: userID, Secret: secret}
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret", "last_used_step", "updated_at"}),
+	}).Create(tf).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll: %v", err)
+	}
+
+	issuer := m.config.Issuer
+	if issuer == "" {
+		issuer = defaultTwoFactorIssuer
+	}
+
+	return map[string]interface{}{
+		"secret": secret,
+		"uri":    totp.ProvisioningURI(issuer, user.Username, secret),
+	}, nil
+}
+
+// ============ user.2fa_verify ============
+
+type UserTwoFactorVerifyMethod struct {
+	storage *storage.Storage
+}
+
+func NewUserTwoFactorVerifyMethod(s *storage.Storage) *UserTwoFactorVerifyMethod {
+	return &UserTwoFactorVerifyMethod{storage: s}
+}
+
+func (m *UserTwoFactorVerifyMethod) Name() string { return "user.2fa_verify" }
+
+func (m *UserTwoFactorVerifyMethod) RequireAuth() bool { return true }
+
+func (m *UserTwoFactorVerifyMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+type UserTwoFactorVerifyParams struct {
+	Code string `json:"code"`
+}
+
+// Execute enables 2FA after the authenticator produced a valid code and
+// returns the recovery codes, they are not shown again
+func (m *UserTwoFactorVerifyMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserTwoFactorVerifyParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.Code == "" {
+		return nil, errors.New("code is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var tf models.TwoFactor
+	if err := db.Where("user_id = ?", userID).First(&tf).Error; err != nil {
+		return nil, errors.New("two-factor authentication is not enrolled")
+	}
+
+	if tf.Enabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+
+	if !useTOTPCode(db, &tf, p.Code) {
+		return nil, errors.New("invalid code")
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&tf).Updates(map[string]interface{}{
+			"enabled":    true,
+			"enabled_at": &now,
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		codes, err = generateRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %v", err)
+	}
+
+	return map[string]interface{}{
+		"enabled":        true,
+		"recovery_codes": codes,
+	}, nil
+}
+
+// ============ user.2fa_disable ============
+
+type UserTwoFactorDisableMethod struct {
+	storage *storage.Storage
+}
+
+func NewUserTwoFactorDisableMethod(s *storage.Storage) *UserTwoFactorDisableMethod {
+	return &UserTwoFactorDisableMethod{storage: s}
+}
+
+func (m *UserTwoFactorDisableMethod) Name() string { return "user.2fa_disable" }
+
+func (m *UserTwoFactorDisableMethod) RequireAuth() bool { return true }
+
+func (m *UserTwoFactorDisableMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+type UserTwoFactorDisableParams struct {
+	Password string `json:"password"` // Optional for SSO accounts right after signing in
+	Code     string `json:"code"`     // TOTP code or recovery code
+}
+
+func (m *UserTwoFactorDisableMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserTwoFactorDisableParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.Code == "" {
+		return nil, errors.New("code is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	if err := confirmUser(ctx, m.storage, &user, p.Password); err != nil {
+		return nil, err
+	}
+
+	var tf models.TwoFactor
+	if err := db.Where("user_id = ? AND enabled = ?", userID, true).First(&tf).Error; err != nil {
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+
+	if !verifyTwoFactorCode(db, &tf, p.Code) {
+		return nil, errors.New("invalid code")
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return clearTwoFactor(tx, userID)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to disable two-factor authentication: %v", err)
+	}
+
+	return map[string]interface{}{
+		"message": "two-factor authentication disabled",
+	}, nil
+}
+
+// ============ user.2fa_recovery_codes ============
+
+type UserTwoFactorRecoveryCodesMethod struct {
+	storage *storage.Storage
+}
+
+func NewUserTwoFactorRecoveryCodesMethod(s *storage.Storage) *UserTwoFactorRecoveryCodesMethod {
+	return &UserTwoFactorRecoveryCodesMethod{storage: s}
+}
+
+func (m *UserTwoFactorRecoveryCodesMethod) Name() string { return "user.2fa_recovery_codes" }
+
+func (m *UserTwoFactorRecoveryCodesMethod) RequireAuth() bool { return true }
+
+func (m *UserTwoFactorRecoveryCodesMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+type UserTwoFactorRecoveryCodesParams struct {
+	Code string `json:"code"`
+}
+
+// Execute replaces all recovery codes, used or not, with a fresh set
+func (m *UserTwoFactorRecoveryCodesMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserTwoFactorRecoveryCodesParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.Code == "" {
+		return nil, errors.New("code is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var tf models.TwoFactor
+	if err := db.Where("user_id = ? AND enabled = ?", userID, true).First(&tf).Error; err != nil {
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+
+	if !useTOTPCode(db, &tf, p.Code) {
+		return nil, errors.New("invalid code")
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = generateRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery codes: %v", err)
+	}
+
+	return map[string]interface{}{
+		"recovery_codes": codes,
+	}, nil
+}
+
+// ============ user.delete_account ============
+
+type UserDeleteAccountMethod struct {
+	storage    *storage.Storage
+	hub        *ws.Hub
+	webhooks   *botWebhooks
+	dispatcher *webhookDispatcher
+	exports    config.ExportConfiguration
+}
+
+func NewUserDeleteAccountMethod(s *storage.Storage, h *ws.Hub, w *botWebhooks, d *webhookDispatcher, c config.ExportConfiguration) *UserDeleteAccountMethod {
+	return &UserDeleteAccountMethod{storage: s, hub: h, webhooks: w, dispatcher: d, exports: c}
+}
+
+func (m *UserDeleteAccountMethod) Name() string { return "user.delete_account" }
+
+func (m *UserDeleteAccountMethod) RequireAuth() bool { return true }
+
+func (m *UserDeleteAccountMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+type UserDeleteAccountParams struct {
+	Password string `json:"password"` // Optional for SSO accounts right after signing in
+	Code     string `json:"code"`     // Required when 2FA is enabled
+}
+
+// Execute removes the user's relationships, uploads, memberships and bots and
+// leaves an anonymous soft-deleted row so sent messages keep a sender. Owned
+// groups pass to the highest ranking, longest standing human member, groups
+// without one are dissolved.
+func (m *UserDeleteAccountMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserDeleteAccountParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	if err := confirmUser(ctx, m.storage, &user, p.Password); err != nil {
+		return nil, err
+	}
+
+	var tf models.TwoFactor
+	if err := db.Where("user_id = ? AND enabled = ?", userID, true).First(&tf).Error; err == nil {
+		if p.Code == "" || !verifyTwoFactorCode(db, &tf, p.Code) {
+			return nil, errors.New("invalid code")
+		}
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to delete account: %v", err)
+	}
+
+	var files []models.File
+	var leftGroups, botIDs, botGroups []int64
+	newOwners := make(map[int64]int64) // group id -> new owner
+	var dissolvedGroups []int64
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Nobody would be left to revoke the bots' tokens
+		if err := tx.Model(&models.Bot{}).Where("owner_id = ?", userID).Pluck("user_id", &botIDs).Error; err != nil {
+			return err
+		}
+		if len(botIDs) > 0 {
+			if err := tx.Model(&models.GroupMember{}).Where("user_id IN ?", botIDs).Pluck("group_id", &botGroups).Error; err != nil {
+				return err
+			}
+		}
+		for _, botID := range botIDs {
+			if err := deleteBot(tx, botID); err != nil {
+				return err
+			}
+		}
+
+		var owned []models.Group
+		if err := tx.Where("owner_id = ?", userID).Find(&owned).Error; err != nil {
+			return err
+		}
+		for _, g := range owned {
+			// Bots can't own groups, a group left with only bots is dissolved
+			var successor models.GroupMember
+			err := tx.Joins("JOIN users ON users.id = group_members.user_id AND users.is_bot = ? AND users.deleted_at IS NULL", false).
+				Where("group_members.group_id = ? AND group_members.user_id <> ?", g.ID, userID).
+				Order("group_members.role DESC, group_members.joined_at ASC, group_members.id ASC").
+				First(&successor).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				if err := deleteGroup(tx, g.ID); err != nil {
+					return err
+				}
+				dissolvedGroups = append(dissolvedGroups, g.ID)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&models.Group{}).Where("id = ?", g.ID).Update("owner_id", successor.UserID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&successor).Update("role", models.GroupRoleOwner).Error; err != nil {
+				return err
+			}
+			newOwners[g.ID] = successor.UserID
+		}
+
+		if err := tx.Model(&models.GroupMember{}).Where("user_id = ?", userID).Pluck("group_id", &leftGroups).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.GroupMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.GroupJoinRequest{}).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&models.Friend{}, &models.FriendRemark{}, &models.FriendTag{}} {
+			if err := tx.Where("user_id = ? OR friend_id = ?", userID, userID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ? OR blocked_id = ?", userID, userID).Delete(&models.Block{}).Error; err != nil {
+			return err
+		}
+		if err := clearTwoFactor(tx, userID); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.UserIdentity{}).Error; err != nil {
+			return err
+		}
+		// Group and global webhooks belong to the group or the server and keep running
+		if err := tx.Model(&models.Webhook{}).Where("owner_id = ? AND scope = ?", userID, models.WebhookScopeUser).Update("active", false).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("user_id = ?", userID).Find(&files).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.File{}).Error; err != nil {
+			return err
+		}
+
+		// An empty password hash never matches, the username is freed for new accounts
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"username":     "deleted_" + hex.EncodeToString(suffix),
+			"nickname":     deletedUserNickname,
+			"avatar":       "",
+			"password":     "",
+			"status":       0,
+			"discoverable": false,
+			"last_seen_at": nil,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete account: %v", err)
+	}
+
+	m.storage.DeleteUserSessions(ctx, userID)
+	m.hub.DisconnectSession(userID, "")
+	for _, botID := range botIDs {
+		m.webhooks.set(botID, "", "")
+		m.hub.DisconnectSession(botID, "")
+	}
+	for _, groupID := range append(botGroups, dissolvedGroups...) {
+		m.storage.InvalidateGroupMembers(ctx, groupID)
+	}
+	// Drops the disabled webhooks and those of dissolved groups
+	m.dispatcher.reload()
+
+	for _, f := range files {
+		os.Remove(f.Filepath)
+	}
+	removeExports(m.exports, userID)
+
+	for _, groupID := range leftGroups {
+		m.storage.InvalidateGroupMembers(ctx, groupID)
+
+		var group models.Group
+		if err := db.First(&group, groupID).Error; err != nil {
+			continue
+		}
+		payload := models.SystemPayload{Event: models.SystemEventMemberLeft}
+		if ownerID, ok := newOwners[groupID]; ok {
+			payload.Fields = map[string]interface{}{"owner_id": ownerID}
+		}
+		sendGroupSystemMessage(ctx, m.storage, m.hub, &group, userID, payload)
+	}
+
+	return map[string]interface{}{
+		"message":            "account deleted",
+		"groups_transferred": len(newOwners),
+		"groups_dissolved":   len(dissolvedGroups),
+	}, nil
+}
+
+// ============ user.export_data ============
+
+type UserExportDataMethod struct {
+	storage *storage.Storage
+	conf    config.ExportConfiguration
+}
+
+func NewUserExportDataMethod(s *storage.Storage, c config.ExportConfiguration) *UserExportDataMethod {
+	return &UserExportDataMethod{storage: s, conf: c}
+}
+
+func (m *UserExportDataMethod) Name() string { return "user.export_data" }
+
+func (m *UserExportDataMethod) RequireAuth() bool { return true }
+
+func (m *UserExportDataMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return "", ""
+}
+
+// Execute builds a zip of the user's data and returns a link to download it
+// with the access token, a new export replaces the previous one
+func (m *UserExportDataMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	userID := ctx.Value("user_id").(int64)
+
+	wait, err := m.storage.HitRateLimit(ctx, fmt.Sprintf("export:user:%d", userID), exportsPerHour, time.Hour)
+	if err == nil && wait > 0 {
+		return nil, resp.NewError(resp.RateLimitedCode, "too many exports", retryAfterData(wait))
+	}
+
+	db := m.storage.GetDB()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to export data: %v", err)
+	}
+	exportID := hex.EncodeToString(id)
+
+	removeExports(m.conf, userID)
+	if err := os.MkdirAll(exportDir(m.conf), 0700); err != nil {
+		return nil, fmt.Errorf("failed to export data: %v", err)
+	}
+
+	path := exportArchivePath(m.conf, userID, exportID)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export data: %v", err)
+	}
+	err = writeUserArchive(f, db, &user)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to export data: %v", err)
+	}
+
+	expire := exportExpire(m.conf)
+	if err := m.storage.CreateExport(ctx, exportID, userID, expire); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to export data: %v", err)
+	}
+
+	return map[string]interface{}{
+		"url":        "/api/export/" + exportID,
+		"expires_at": time.Now().Add(expire),
+	}, nil
+}
+
+// ============ user.block ============
+
+type UserBlockMethod struct {
+	storage *storage.Storage
+}
+
+func NewUserBlockMethod(s *storage.Storage) *UserBlockMethod {
+	return &UserBlockMethod{storage: s}
+}
+
+func (m *UserBlockMethod) Name() string { return "user.block" }
+
+func (m *UserBlockMethod) RequireAuth() bool { return true }
+
+type UserBlockParams struct {
+	UserID int64 `json:"user_id"`
+}
+
+func (m *UserBlockMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserBlockParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.UserID == 0 {
+		return nil, errors.New("user_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	if p.UserID == userID {
+		return nil, errors.New("cannot block yourself")
+	}
+
+	var user models.User
+	if err := db.First(&user, p.UserID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	if isBlocked(db, userID, p.UserID) {
+		return nil, errors.New("user already blocked")
+	}
+
+	tx := db.Begin()
+
+	if err := tx.Create(&models.Block{UserID: userID, BlockedID: p.UserID}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to block user: %v", err)
+	}
+
+	// Blocking ends the friendship and drops pending requests both ways
+	err := tx.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
+		userID, p.UserID, p.UserID, userID).Delete(&models.Friend{}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to remove friendship: %v", err)
+	}
+
+	if err := clearFriendLabels(tx, userID, p.UserID); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to remove friendship: %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to block user: %v", err)
+	}
+
+	return map[string]interface{}{
+		"message": "user blocked",
+	}, nil
+}
+
+// ============ user.unblock ============
+
+type UserUnblockMethod struct {
+	storage *storage.Storage
+}
+
+func NewUserUnblockMethod(s *storage.Storage) *UserUnblockMethod {
+	return &UserUnblockMethod{storage: s}
+}
+
+func (m *UserUnblockMethod) Name() string { return "user.unblock" }
+
+func (m *UserUnblockMethod) RequireAuth() bool { return true }
+
+func (m *UserUnblockMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserBlockParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.UserID == 0 {
+		return nil, errors.New("user_id is required")
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	result := db.Where("user_id = ? AND blocked_id = ?", userID, p.UserID).Delete(&models.Block{})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to unblock user: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("user is not blocked")
+	}
+
+	return map[string]interface{}{
+		"message": "user unblocked",
+	}, nil
+}
+
+// ============ user.blocklist ============
+
+type UserBlocklistMethod struct {
+	storage *storage.Storage
+}
+
+func NewUserBlocklistMethod(s *storage.Storage) *UserBlocklistMethod {
+	return &UserBlocklistMethod{storage: s}
+}
+
+func (m *UserBlocklistMethod) Name() string { return "user.blocklist" }
+
+func (m *UserBlocklistMethod) RequireAuth() bool { return true }
+
+func (m *UserBlocklistMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var blocks []models.Block
+	if err := db.Where("user_id = ?", userID).Preload("Blocked").Order("id DESC").Find(&blocks).Error; err != nil {
+		return nil, fmt.Errorf("failed to get blocked users: %v", err)
+	}
+
+	result := make([]map[string]interface{}, 0, len(blocks))
+	for _, b := range blocks {
+		if b.Blocked == nil {
+			continue
+		}
+		result = append(result, map[string]interface{}{
+			"user_id":    b.BlockedID,
+			"username":   b.Blocked.Username,
+			"nickname":   b.Blocked.Nickname,
+			"avatar":     visibleAvatar(b.Blocked, userID, areFriends(db, userID, b.BlockedID)),
+			"created_at": b.CreatedAt,
+		})
+	}
+
+	return result, nil
+}
+
+// ============ user.search ============
+
+type UserSearchMethod struct {
+	storage *storage.Storage
+}
+
+func NewUserSearchMethod(s *storage.Storage) *UserSearchMethod {
+	return &UserSearchMethod{storage: s}
+}
+
+func (m *UserSearchMethod) Name() string { return "user.search" }
+
+func (m *UserSearchMethod) RequireAuth() bool { return true }
+
+type UserSearchParams struct {
+	Keyword string `json:"keyword"` // Matches username or nickname
+	Offset  int    `json:"offset"`
+	Limit   int    `json:"limit"`
+}
+
+func (m *UserSearchMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserSearchParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	keyword := strings.ToLower(strings.TrimSpace(p.Keyword))
+	if keyword == "" {
+		return nil, errors.New("keyword is required")
+	}
+
+	if p.Limit <= 0 || p.Limit > 50 {
+		p.Limit = 20
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	// Soft-deleted users are skipped by gorm, users who blocked the caller are hidden
+	like := likePattern(keyword)
+	query := db.Model(&models.User{}).
+		Where("status = ? AND discoverable = ? AND id <> ?", 1, true, userID).
+		Where("LOWER(username) LIKE ? ESCAPE '\\' OR LOWER(nickname) LIKE ? ESCAPE '\\'", like, like).
+		Where("id NOT IN (SELECT user_id FROM blocks WHERE blocked_id = ?)", userID)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, fmt.Errorf("failed to count users: %v", err)
+	}
+
+	// Exact username first, then prefix matches, then anything containing the keyword
+	prefix := likePrefix(keyword)
+	var users []models.User
+	err := query.
+		Order(clause.Expr{
+			SQL: "CASE WHEN LOWER(username) = ? THEN 0 WHEN LOWER(username) LIKE ? ESCAPE '\\' THEN 1 " +
+				"WHEN LOWER(nickname) LIKE ? ESCAPE '\\' THEN 2 ELSE 3 END, username ASC",
+			Vars:               []interface{}{keyword, prefix, prefix},
+			WithoutParentheses: true,
+		}).
+		Offset(p.Offset).
+		Limit(p.Limit).
+		Find(&users).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %v", err)
+	}
+
+	ids := make([]int64, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+
+	friends := friendsAmong(db, userID, ids)
+
+	result := make([]map[string]interface{}, 0, len(users))
+	for i, u := range users {
+		result = append(result, map[string]interface{}{
+			"user_id":   u.ID,
+			"username":  u.Username,
+			"nickname":  u.Nickname,
+			"avatar":    visibleAvatar(&users[i], userID, friends[u.ID]),
+			"is_friend": friends[u.ID],
+		})
+	}
+
+	return map[string]interface{}{
+		"total": total,
+		"users": result,
+	}, nil
+}
+
+// ============ user.update_privacy ============
+
+type UserUpdatePrivacyMethod struct {
+	storage *storage.Storage
+}
+
+func NewUserUpdatePrivacyMethod(s *storage.Storage) *UserUpdatePrivacyMethod {
+	return &UserUpdatePrivacyMethod{storage: s}
+}
+
+func (m *UserUpdatePrivacyMethod) Name() string { return "user.update_privacy" }
+
+func (m *UserUpdatePrivacyMethod) RequireAuth() bool { return true }
+
+// UserUpdatePrivacyParams only changes the settings that are set
+type UserUpdatePrivacyParams struct {
+	Discoverable        *bool                       `json:"discoverable"`
+	FriendRequestPolicy *models.FriendRequestPolicy `json:"friend_request_policy"`
+	AvatarVisibility    *models.Visibility          `json:"avatar_visibility"`
+	LastSeenVisibility  *models.Visibility          `json:"last_seen_visibility"`
+	AllowStrangerChat   *bool                       `json:"allow_stranger_chat"`
+}
+
+func (m *UserUpdatePrivacyMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p UserUpdatePrivacyParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.FriendRequestPolicy != nil &&
+		(*p.FriendRequestPolicy < models.FriendRequestEveryone || *p.FriendRequestPolicy > models.FriendRequestNobody) {
+		return nil, errors.New("invalid friend_request_policy")
+	}
+	for _, v := range []*models.Visibility{p.AvatarVisibility, p.LastSeenVisibility} {
+		if v != nil && (*v < models.VisibilityEveryone || *v > models.VisibilityNobody) {
+			return nil, errors.New("invalid visibility")
+		}
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	updates := map[string]interface{}{}
+	if p.Discoverable != nil {
+		user.Discoverable = *p.Discoverable
+		updates["discoverable"] = user.Discoverable
+	}
+	if p.FriendRequestPolicy != nil {
+		user.FriendRequestPolicy = *p.FriendRequestPolicy
+		updates["friend_request_policy"] = user.FriendRequestPolicy
+	}
+	if p.AvatarVisibility != nil {
+		user.AvatarVisibility = *p.AvatarVisibility
+		updates["avatar_visibility"] = user.AvatarVisibility
+	}
+	if p.LastSeenVisibility != nil {
+		user.LastSeenVisibility = *p.LastSeenVisibility
+		updates["last_seen_visibility"] = user.LastSeenVisibility
+	}
+	if p.AllowStrangerChat != nil {
+		user.AllowStrangerChat = *p.AllowStrangerChat
+		updates["allow_stranger_chat"] = user.AllowStrangerChat
+	}
+
+	if len(updates) > 0 {
+		if err := db.Model(&user).Updates(updates).Error; err != nil {
+			return nil, fmt.Errorf("failed to update privacy settings: %v", err)
+		}
+	}
+
+	return map[string]interface{}{
+		"discoverable":          user.Discoverable,
+		"friend_request_policy": user.FriendRequestPolicy,
+		"avatar_visibility":     user.AvatarVisibility,
+		"last_seen_visibility":  user.LastSeenVisibility,
+		"allow_stranger_chat":   user.AllowStrangerChat,
+	}, nil
+}
+
+// tokenPair is handed out on login, the access token is renewed with user.refresh
+type tokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int64 // seconds until the access token expires
+}
+
+// twoFactorChallenge starts the second login step for users with 2FA
+// enabled, it returns nil when tokens can be issued right away
+func twoFactorChallenge(ctx context.Context, st *storage.Storage, user *models.User, device string) (map[string]interface{}, error) {
+	var count int64
+	st.GetDB().Model(&models.TwoFactor{}).Where("user_id = ? AND enabled = ?", user.ID, true).Count(&count)
+	if count == 0 {
+		return nil, nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to create login challenge: %v", err)
+	}
+	challenge := &storage.LoginChallenge{
+		ID:     hex.EncodeToString(id),
+		UserID: user.ID,
+		Device: device,
+	}
+	if err := st.CreateLoginChallenge(ctx, challenge, loginChallengeTTL); err != nil {
+		return nil, fmt.Errorf("failed to create login challenge: %v", err)
+	}
+
+	return map[string]interface{}{
+		"two_factor_required": true,
+		"challenge_token":     challenge.ID,
+		"expires_in":          int64(loginChallengeTTL / time.Second),
+	}, nil
+}
+
+// issueToken starts a new session for the user and returns its tokens. The
+// device falls back to the client's user agent.
+func issueToken(ctx context.Context, st *storage.Storage, j *jwt.JWTManager, user *models.User, device string) (*tokenPair, error) {
+	device = strings.TrimSpace(device)
+	if device == "" {
+		device, _ = ctx.Value("user_agent").(string)
+	}
+	if utf8.RuneCountInString(device) > 100 {
+		device = string([]rune(device)[:100])
+	}
+	ip, _ := ctx.Value("client_ip").(string)
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	sessionID := hex.EncodeToString(id)
+
+	refreshToken, refreshHash, err := newRefreshToken(sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+
+	now := time.Now()
+	session := &storage.Session{
+		ID:           sessionID,
+		UserID:       user.ID,
+		Device:       device,
+		IP:           ip,
+		CreatedAt:    now,
+		LastActiveAt: now,
+		RefreshHash:  refreshHash,
+	}
+	if err := st.CreateSession(ctx, session, j.RefreshExpire()); err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+
+	token, err := j.GenerateToken(user.ID, user.Username, session.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+
+	return &tokenPair{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(j.Expire() / time.Second),
+	}, nil
+}
+
+// newRefreshToken returns an opaque refresh token for the session and the
+// hash kept server side. The session id prefix lets user.refresh find it.
+func newRefreshToken(sessionID string) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := sessionID + "." + hex.EncodeToString(secret)
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+const (
+	loginChallengeTTL      = 5 * time.Minute
+	oidcStateTTL           = 10 * time.Minute
+	loginChallengeAttempts = 5
+	recoveryCodeCount      = 10
+	totpSkew               = 1 // Time steps of clock drift accepted either way
+	defaultTwoFactorIssuer = "simple_im"
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// useTOTPCode checks an authenticator code and spends its time step, so the
+// same code cannot be replayed even by concurrent requests
+func useTOTPCode(db *gorm.DB, tf *models.TwoFactor, code string) bool {
+	step, ok := totp.Validate(tf.Secret, code, time.Now(), totpSkew)
+	if !ok {
+		return false
+	}
+	result := db.Model(&models.TwoFactor{}).
+		Where("user_id = ? AND last_used_step < ?", tf.UserID, step).
+		Update("last_used_step", step)
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// useRecoveryCode marks an unused recovery code as used
+func useRecoveryCode(db *gorm.DB, userID int64, code string) bool {
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return false
+	}
+	result := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(normalized)).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// verifyTwoFactorCode accepts either a TOTP code or a recovery code
+func verifyTwoFactorCode(db *gorm.DB, tf *models.TwoFactor, code string) bool {
+	return useTOTPCode(db, tf, code) || useRecoveryCode(db, tf.UserID, code)
+}
+
+// generateRecoveryCodes replaces the user's recovery codes and returns the
+// new ones in plain text, only their hashes are stored
+func generateRecoveryCodes(tx *gorm.DB, userID int64) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]models.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(raw)
+		codes = append(codes, code[:4]+"-"+code[4:])
+		records = append(records, models.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)})
+	}
+
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode drops separators and case so "abcd-efgh" matches ABCDEFGH
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+func hashRecoveryCode(normalized string) string {
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// clearTwoFactor turns 2FA off and removes the secret and recovery codes
+func clearTwoFactor(tx *gorm.DB, userID int64) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("user_id = ?", userID).Delete(&models.TwoFactor{}).Error
+}
+
+const (
+	deletedUserNickname = "Deleted user"
+	exportsPerHour      = 3
+	reauthWindow        = 10 * time.Minute // How recent a login confirms the user without a password
+)
+
+// confirmUser checks the password before sensitive changes. Accounts that
+// sign in through an identity provider have no password they know, for them
+// a login of the current session within reauthWindow counts instead.
+func confirmUser(ctx context.Context, st *storage.Storage, user *models.User, password string) error {
+	if password != "" {
+		if !user.CheckPassword(password) {
+			return errors.New("password is incorrect")
+		}
+		return nil
+	}
+
+	var linked int64
+	st.GetDB().Model(&models.UserIdentity{}).Where("user_id = ?", user.ID).Count(&linked)
+	if linked == 0 {
+		return errors.New("password is required")
+	}
+	sessionID, _ := ctx.Value("session_id").(string)
+	session, err := st.GetSession(ctx, sessionID)
+	if err != nil || session.UserID != user.ID || time.Since(session.CreatedAt) > reauthWindow {
+		return errors.New("password is required, or sign in again to confirm it's you")
+	}
+	return nil
+}
+
+const (
+	defaultLoginPerIP       = 20
+	defaultLoginPerUsername = 10
+	defaultRegisterPerIP    = 5
+	defaultLockoutThreshold = 5
+	defaultLockoutBase      = 60   // seconds
+	defaultLockoutMax       = 3600 // seconds
+)
+
+// orDefault returns v unless it is unset
+func orDefault(v, def int64) int64 {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func orDefaultString(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func retryAfterData(wait time.Duration) map[string]interface{} {
+	return map[string]interface{}{
+		"retry_after": int64((wait + time.Second - 1) / time.Second),
+	}
+}
+
+// checkLoginAllowed runs before the password is compared, so throttled
+// attempts do not cost a bcrypt round
+// loginName is the key of the login rate limit and lockout for a username
+func loginName(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func checkLoginAllowed(ctx context.Context, st *storage.Storage, c config.RateLimitConfiguration, username string) error {
+	if ip, _ := ctx.Value("client_ip").(string); ip != "" {
+		wait, err := st.HitRateLimit(ctx, "login:ip:"+ip, orDefault(c.LoginPerIP, defaultLoginPerIP), time.Minute)
+		if err == nil && wait > 0 {
+			return resp.NewError(resp.RateLimitedCode, "too many login attempts", retryAfterData(wait))
+		}
+	}
+
+	wait, err := st.HitRateLimit(ctx, "login:user:"+username, orDefault(c.LoginPerUsername, defaultLoginPerUsername), time.Minute)
+	if err == nil && wait > 0 {
+		return resp.NewError(resp.RateLimitedCode, "too many login attempts", retryAfterData(wait))
+	}
+
+	return checkLoginLockout(ctx, st, username)
+}
+
+func checkLoginLockout(ctx context.Context, st *storage.Storage, username string) error {
+	if wait, err := st.LoginLockout(ctx, username); err == nil && wait > 0 {
+		return resp.NewError(resp.AccountLockedCode, "account is temporarily locked after failed logins", retryAfterData(wait))
+	}
+	return nil
+}
+
+// recordLoginFailure counts a wrong password or code towards the lockout,
+// usernames that do not exist are counted too so lockouts reveal nothing
+func recordLoginFailure(ctx context.Context, st *storage.Storage, c config.RateLimitConfiguration, username string) {
+	st.RecordLoginFailure(ctx, username,
+		orDefault(c.LockoutThreshold, defaultLockoutThreshold),
+		time.Duration(orDefault(c.LockoutBase, defaultLockoutBase))*time.Second,
+		time.Duration(orDefault(c.LockoutMax, defaultLockoutMax))*time.Second)
+}
+
+func checkRegisterAllowed(ctx context.Context, st *storage.Storage, c config.RateLimitConfiguration) error {
+	ip, _ := ctx.Value("client_ip").(string)
+	if ip == "" {
+		return nil
+	}
+	wait, err := st.HitRateLimit(ctx, "register:ip:"+ip, orDefault(c.RegisterPerIP, defaultRegisterPerIP), time.Hour)
+	if err == nil && wait > 0 {
+		return resp.NewError(resp.RateLimitedCode, "too many registrations", retryAfterData(wait))
+	}
+	return nil
+}
+
+// currentSessionID returns the session of the authenticated request
+func currentSessionID(ctx context.Context) string {
+	sessionID, _ := ctx.Value("session_id").(string)
+	return sessionID
+}
+
+// isBlocked reports whether userID has blocked targetID
+func isBlocked(db *gorm.DB, userID, targetID int64) bool {
+	var count int64
+	db.Model(&models.Block{}).Where("user_id = ? AND blocked_id = ?", userID, targetID).Count(&count)
+	return count > 0
+}
+
+// areFriends reports whether the two users have an accepted friendship
+func areFriends(db *gorm.DB, a, b int64) bool {
+	var count int64
+	db.Model(&models.Friend{}).
+		Where("((user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)) AND status = ?",
+			a, b, b, a, models.FriendStatusAccepted).
+		Count(&count)
+	return count > 0
+}
+
+// shareGroup reports whether the two users are members of at least one common group
+func shareGroup(db *gorm.DB, a, b int64) bool {
+	var count int64
+	db.Model(&models.GroupMember{}).
+		Where("user_id = ? AND group_id IN (SELECT group_id FROM group_members WHERE user_id = ?)", a, b).
+		Count(&count)
+	return count > 0
+}
+
+// likeEscaper escapes the LIKE wildcards, queries add ESCAPE '\' to the
+// patterns built with it
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePattern matches values containing keyword, taken literally
+func likePattern(keyword string) string {
+	return "%" + likePrefix(keyword)
+}
+
+// likePrefix matches values starting with keyword, taken literally
+func likePrefix(keyword string) string {
+	return likeEscaper.Replace(keyword) + "%"
 }
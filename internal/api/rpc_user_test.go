@@ -1,10 +1,28 @@
 package api
 
 import (
+	"archive/zip"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"simple_im/internal/auth"
 	"simple_im/internal/models"
+	"simple_im/internal/storage"
+	"simple_im/pkg/common/config"
+	"simple_im/pkg/common/oidc"
+	"simple_im/pkg/common/oidc/oidctest"
+	"simple_im/pkg/common/resp"
+	"simple_im/pkg/common/totp"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func TestUserRegisterMethod_Execute(t *testing.T) {
@@ -13,7 +31,7 @@ func TestUserRegisterMethod_Execute(t *testing.T) {
 		t.Fatalf("Failed to setup test env: %v", err)
 	}
 
-	method := NewUserRegisterMethod(env.Storage, env.JWTManager)
+	method := NewUserRegisterMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration)
 
 	// Test successful registration
 	params, _ := json.Marshal(UserRegisterParams{
@@ -45,7 +63,7 @@ func TestUserRegisterMethod_Validation(t *testing.T) {
 		t.Fatalf("Failed to setup test env: %v", err)
 	}
 
-	method := NewUserRegisterMethod(env.Storage, env.JWTManager)
+	method := NewUserRegisterMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration)
 
 	tests := []struct {
 		name    string
@@ -102,7 +120,7 @@ func TestUserLoginMethod_Execute(t *testing.T) {
 		t.Fatalf("Failed to create test user: %v", err)
 	}
 
-	method := NewUserLoginMethod(env.Storage, env.JWTManager)
+	method := NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB))
 
 	// Test successful login
 	params, _ := json.Marshal(UserLoginParams{
@@ -164,7 +182,7 @@ func TestUserInfoMethod_Execute(t *testing.T) {
 		t.Fatalf("GetInfo failed: %v", err)
 	}
 
-	userResult := result.(models.User)
+	userResult := result.(*fullProfile)
 	if userResult.Username != "infouser" {
 		t.Errorf("Expected username 'infouser', got '%s'", userResult.Username)
 	}
@@ -180,8 +198,8 @@ func TestUserInfoMethod_Execute(t *testing.T) {
 func TestUserMethods_RequireAuth(t *testing.T) {
 	env, _ := SetupTestEnv()
 
-	registerMethod := NewUserRegisterMethod(env.Storage, env.JWTManager)
-	loginMethod := NewUserLoginMethod(env.Storage, env.JWTManager)
+	registerMethod := NewUserRegisterMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration)
+	loginMethod := NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB))
 	infoMethod := NewUserInfoMethod(env.Storage)
 
 	if registerMethod.RequireAuth() {
@@ -200,8 +218,8 @@ func TestUserMethods_RequireAuth(t *testing.T) {
 func TestUserMethods_Name(t *testing.T) {
 	env, _ := SetupTestEnv()
 
-	registerMethod := NewUserRegisterMethod(env.Storage, env.JWTManager)
-	loginMethod := NewUserLoginMethod(env.Storage, env.JWTManager)
+	registerMethod := NewUserRegisterMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration)
+	loginMethod := NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB))
 	infoMethod := NewUserInfoMethod(env.Storage)
 
 	if registerMethod.Name() != "user.register" {
@@ -216,3 +234,1201 @@ func TestUserMethods_Name(t *testing.T) {
 		t.Errorf("Expected 'user.info', got '%s'", infoMethod.Name())
 	}
 }
+
+func TestUserBlockMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("blocker", "password")
+	user2, _ := env.CreateTestUser("blockee", "password")
+	env.CreateTestFriendship(user1.ID, user2.ID, models.FriendStatusAccepted)
+
+	method := NewUserBlockMethod(env.Storage)
+
+	ctx1 := context.WithValue(context.Background(), "user_id", user1.ID)
+	ctx1 = context.WithValue(ctx1, "username", user1.Username)
+
+	params, _ := json.Marshal(UserBlockParams{UserID: user2.ID})
+	if _, err := method.Execute(ctx1, params); err != nil {
+		t.Fatalf("Block user failed: %v", err)
+	}
+
+	// Blocking ends the friendship
+	var count int64
+	env.DB.Model(&models.Friend{}).Count(&count)
+	if count != 0 {
+		t.Error("Friendship should be removed when blocking")
+	}
+
+	ctx2 := context.WithValue(context.Background(), "user_id", user2.ID)
+	ctx2 = context.WithValue(ctx2, "username", user2.Username)
+
+	// The blocked user's friend request looks sent but is hidden from the blocker
+	addMethod := NewFriendAddMethod(env.Storage, env.Hub, env.Config.FriendConfiguration)
+	params, _ = json.Marshal(FriendAddParams{FriendID: user1.ID})
+	if _, err := addMethod.Execute(ctx2, params); err != nil {
+		t.Fatalf("Friend request from blocked user should not reveal the block: %v", err)
+	}
+
+	pendingMethod := NewFriendPendingMethod(env.Storage)
+	result, err := pendingMethod.Execute(ctx1, nil)
+	if err != nil {
+		t.Fatalf("Get pending failed: %v", err)
+	}
+	if len(result.([]map[string]interface{})) != 0 {
+		t.Error("Requests from blocked users should be hidden")
+	}
+
+	// Private messages are refused like for any stranger
+	sendMethod := NewMessageSendMethod(env.Storage, env.Hub)
+	params, _ = json.Marshal(MessageSendParams{ReceiverID: user1.ID, Content: "hi"})
+	if _, err := sendMethod.Execute(ctx2, params); err == nil {
+		t.Error("Blocked user should not be able to send private messages")
+	}
+
+	// The blocker can't send friend requests to the blocked user either
+	params, _ = json.Marshal(FriendAddParams{FriendID: user2.ID})
+	if _, err := addMethod.Execute(ctx1, params); err == nil {
+		t.Error("Should not be able to add a blocked user")
+	}
+
+	// Unblock reveals the pending request
+	unblockMethod := NewUserUnblockMethod(env.Storage)
+	params, _ = json.Marshal(UserBlockParams{UserID: user2.ID})
+	if _, err := unblockMethod.Execute(ctx1, params); err != nil {
+		t.Fatalf("Unblock user failed: %v", err)
+	}
+
+	result, _ = pendingMethod.Execute(ctx1, nil)
+	if len(result.([]map[string]interface{})) != 1 {
+		t.Error("Pending request should be visible after unblocking")
+	}
+}
+
+func TestUserBlocklistMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user1, _ := env.CreateTestUser("listblocker", "password")
+	user2, _ := env.CreateTestUser("listblockee", "password")
+
+	ctx := context.WithValue(context.Background(), "user_id", user1.ID)
+
+	params, _ := json.Marshal(UserBlockParams{UserID: user2.ID})
+	if _, err := NewUserBlockMethod(env.Storage).Execute(ctx, params); err != nil {
+		t.Fatalf("Block user failed: %v", err)
+	}
+
+	// Blocking twice fails
+	if _, err := NewUserBlockMethod(env.Storage).Execute(ctx, params); err == nil {
+		t.Error("Should fail when user already blocked")
+	}
+
+	result, err := NewUserBlocklistMethod(env.Storage).Execute(ctx, nil)
+	if err != nil {
+		t.Fatalf("Get blocklist failed: %v", err)
+	}
+
+	blocked := result.([]map[string]interface{})
+	if len(blocked) != 1 || blocked[0]["user_id"] != user2.ID {
+		t.Errorf("Expected blocklist with user %d, got %v", user2.ID, blocked)
+	}
+}
+
+func TestUserSearchMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	searcher, _ := env.CreateTestUser("searcher", "password")
+	alice, _ := env.CreateTestUser("alice", "password")
+	alicia, _ := env.CreateTestUser("alicia", "password")
+	bob, _ := env.CreateTestUser("bob", "password")
+	hidden, _ := env.CreateTestUser("alice_hidden", "password")
+	disabled, _ := env.CreateTestUser("alice_disabled", "password")
+	deleted, _ := env.CreateTestUser("alice_deleted", "password")
+
+	env.DB.Model(bob).Update("nickname", "Malice")
+	env.DB.Model(disabled).Update("status", 0)
+	env.DB.Delete(deleted)
+	env.CreateTestFriendship(searcher.ID, alicia.ID, models.FriendStatusAccepted)
+
+	ctx := context.WithValue(context.Background(), "user_id", searcher.ID)
+
+	privacyMethod := NewUserUpdatePrivacyMethod(env.Storage)
+	off := false
+	params, _ := json.Marshal(UserUpdatePrivacyParams{Discoverable: &off})
+	if _, err := privacyMethod.Execute(context.WithValue(context.Background(), "user_id", hidden.ID), params); err != nil {
+		t.Fatalf("Update privacy failed: %v", err)
+	}
+
+	method := NewUserSearchMethod(env.Storage)
+	params, _ = json.Marshal(UserSearchParams{Keyword: "ALIC"})
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Search users failed: %v", err)
+	}
+
+	resultMap := result.(map[string]interface{})
+	users := resultMap["users"].([]map[string]interface{})
+	if resultMap["total"] != int64(3) || len(users) != 3 {
+		t.Fatalf("Expected alice, alicia and bob, got %v", users)
+	}
+
+	// Username prefix matches rank before nickname matches
+	if users[0]["user_id"] != alice.ID || users[1]["user_id"] != alicia.ID || users[2]["user_id"] != bob.ID {
+		t.Errorf("Unexpected order: %v", users)
+	}
+	if users[1]["is_friend"] != true || users[0]["is_friend"] != false {
+		t.Errorf("Unexpected friend flags: %v", users)
+	}
+
+	// An exact username ranks first
+	params, _ = json.Marshal(UserSearchParams{Keyword: "alicia"})
+	result, _ = method.Execute(ctx, params)
+	users = result.(map[string]interface{})["users"].([]map[string]interface{})
+	if len(users) != 1 || users[0]["user_id"] != alicia.ID {
+		t.Errorf("Expected only alicia, got %v", users)
+	}
+
+	// Pagination
+	params, _ = json.Marshal(UserSearchParams{Keyword: "alic", Offset: 1, Limit: 1})
+	result, _ = method.Execute(ctx, params)
+	resultMap = result.(map[string]interface{})
+	users = resultMap["users"].([]map[string]interface{})
+	if resultMap["total"] != int64(3) || len(users) != 1 || users[0]["user_id"] != alicia.ID {
+		t.Errorf("Expected second page with alicia, got %v", resultMap)
+	}
+
+	// Users who blocked the searcher are hidden
+	blockCtx := context.WithValue(context.Background(), "user_id", alice.ID)
+	params, _ = json.Marshal(UserBlockParams{UserID: searcher.ID})
+	NewUserBlockMethod(env.Storage).Execute(blockCtx, params)
+
+	params, _ = json.Marshal(UserSearchParams{Keyword: "alice"})
+	result, _ = method.Execute(ctx, params)
+	users = result.(map[string]interface{})["users"].([]map[string]interface{})
+	if len(users) != 1 || users[0]["user_id"] != bob.ID {
+		t.Errorf("Expected only bob, got %v", users)
+	}
+
+	// Wildcards are matched literally
+	for _, keyword := range []string{"%", "_"} {
+		params, _ = json.Marshal(UserSearchParams{Keyword: keyword})
+		result, _ = method.Execute(ctx, params)
+		if total := result.(map[string]interface{})["total"]; total != int64(0) {
+			t.Errorf("Expected no match for %q, got %v", keyword, total)
+		}
+	}
+
+	params, _ = json.Marshal(UserSearchParams{Keyword: "  "})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Should fail without keyword")
+	}
+}
+
+func TestUserInfoMethod_Privacy(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("private", "password")
+	friend, _ := env.CreateTestUser("close", "password")
+	stranger, _ := env.CreateTestUser("far", "password")
+	env.CreateTestFriendship(owner.ID, friend.ID, models.FriendStatusAccepted)
+	env.DB.Model(owner).Updates(map[string]interface{}{"avatar": "/files/a.png", "last_seen_at": time.Now()})
+
+	ownerCtx := context.WithValue(context.Background(), "user_id", owner.ID)
+	friendsOnly := models.VisibilityFriends
+	nobody := models.VisibilityNobody
+	params, _ := json.Marshal(UserUpdatePrivacyParams{AvatarVisibility: &friendsOnly, LastSeenVisibility: &nobody})
+	if _, err := NewUserUpdatePrivacyMethod(env.Storage).Execute(ownerCtx, params); err != nil {
+		t.Fatalf("Update privacy failed: %v", err)
+	}
+
+	method := NewUserInfoMethod(env.Storage)
+	params, _ = json.Marshal(UserInfoParams{UserID: owner.ID})
+
+	result, _ := method.Execute(ownerCtx, params)
+	self := result.(*fullProfile)
+	if self.Avatar == "" || self.LastSeenAt == nil {
+		t.Error("Users should always see their own profile")
+	}
+
+	result, _ = method.Execute(context.WithValue(context.Background(), "user_id", friend.ID), params)
+	seenByFriend := result.(*userProfile)
+	if seenByFriend.Avatar == "" {
+		t.Error("Friends should see the avatar")
+	}
+	if seenByFriend.LastSeenAt != nil {
+		t.Error("Last seen should be hidden from everyone")
+	}
+	// Settings are private to the user
+	raw, _ := json.Marshal(result)
+	var fields map[string]interface{}
+	json.Unmarshal(raw, &fields)
+	for _, key := range []string{"friend_request_policy", "allow_stranger_chat", "avatar_visibility", "discoverable", "role"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("%s should not be shown to other users", key)
+		}
+	}
+
+	raw, _ = json.Marshal(self)
+	fields = nil
+	json.Unmarshal(raw, &fields)
+	if fields["avatar_visibility"] != float64(models.VisibilityFriends) || fields["last_seen_at"] == nil {
+		t.Errorf("Users should see their own settings, got %v", fields)
+	}
+
+	result, _ = method.Execute(context.WithValue(context.Background(), "user_id", stranger.ID), params)
+	if result.(*userProfile).Avatar != "" {
+		t.Error("Strangers should not see the avatar")
+	}
+
+	invalid := models.Visibility(5)
+	params, _ = json.Marshal(UserUpdatePrivacyParams{AvatarVisibility: &invalid})
+	if _, err := NewUserUpdatePrivacyMethod(env.Storage).Execute(ownerCtx, params); err == nil {
+		t.Error("Should fail for invalid visibility")
+	}
+}
+
+func TestUserUpdateProfileMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user, _ := env.CreateTestUser("profile", "password")
+	other, _ := env.CreateTestUser("otherprofile", "password")
+
+	env.Config.UploadConfiguration.SavePath = "uploads"
+	env.DB.Create(&models.File{UserID: user.ID, Filename: "me.png", Filepath: "uploads/1_1.png", Filesize: 1, Mimetype: "image/png"})
+	env.DB.Create(&models.File{UserID: user.ID, Filename: "doc.pdf", Filepath: "uploads/1_2.pdf", Filesize: 1, Mimetype: "application/pdf"})
+	env.DB.Create(&models.File{UserID: other.ID, Filename: "them.png", Filepath: "uploads/2_1.png", Filesize: 1, Mimetype: "image/png"})
+
+	method := NewUserUpdateProfileMethod(env.Storage, env.Config.UploadConfiguration)
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+
+	nickname := "  New Name  "
+	avatar := "/files/1_1.png"
+	params, _ := json.Marshal(UserUpdateProfileParams{Nickname: &nickname, Avatar: &avatar})
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Update profile failed: %v", err)
+	}
+
+	updated := result.(*fullProfile)
+	if updated.Nickname != "New Name" || updated.Avatar != avatar {
+		t.Errorf("Unexpected profile: %+v", updated)
+	}
+
+	tests := []struct {
+		name   string
+		params UserUpdateProfileParams
+	}{
+		{"Empty nickname", UserUpdateProfileParams{Nickname: strPtr("   ")}},
+		{"Long nickname", UserUpdateProfileParams{Nickname: strPtr(strings.Repeat("a", 101))}},
+		{"External avatar", UserUpdateProfileParams{Avatar: strPtr("https://example.com/a.png")}},
+		{"Other user's upload", UserUpdateProfileParams{Avatar: strPtr("/files/2_1.png")}},
+		{"Not an image", UserUpdateProfileParams{Avatar: strPtr("/files/1_2.pdf")}},
+		{"Path traversal", UserUpdateProfileParams{Avatar: strPtr("/files/../1_1.png")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _ := json.Marshal(tt.params)
+			if _, err := method.Execute(ctx, params); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
+	}
+
+	// An empty avatar removes it
+	params, _ = json.Marshal(UserUpdateProfileParams{Avatar: strPtr("")})
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Fatalf("Clearing avatar failed: %v", err)
+	}
+
+	var stored models.User
+	env.DB.First(&stored, user.ID)
+	if stored.Avatar != "" || stored.Nickname != "New Name" {
+		t.Errorf("Unexpected stored profile: %+v", stored)
+	}
+}
+
+func TestUserChangePasswordMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user, _ := env.CreateTestUser("changer", "password123")
+	oldToken, _ := env.CreateTestToken(user)
+	otherToken, _ := env.CreateTestToken(user)
+
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+	claims, _ := handler.ParseToken(oldToken)
+
+	method := NewUserChangePasswordMethod(env.Storage, env.Hub, env.JWTManager)
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+	ctx = context.WithValue(ctx, "session_id", claims.ID)
+
+	params, _ := json.Marshal(UserChangePasswordParams{OldPassword: "wrong", NewPassword: "newpassword"})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Should fail with a wrong old password")
+	}
+
+	params, _ = json.Marshal(UserChangePasswordParams{OldPassword: "password123", NewPassword: "newpassword"})
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Change password failed: %v", err)
+	}
+	newToken := result.(map[string]interface{})["token"].(string)
+
+	if _, err := handler.ParseToken(oldToken); err == nil {
+		t.Error("Old token should be revoked")
+	}
+	if _, err := handler.ParseToken(otherToken); err == nil {
+		t.Error("Tokens of other devices should be revoked")
+	}
+	if _, err := handler.ParseToken(newToken); err != nil {
+		t.Errorf("New token should be valid: %v", err)
+	}
+
+	loginMethod := NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB))
+	params, _ = json.Marshal(UserLoginParams{Username: "changer", Password: "newpassword"})
+	if _, err := loginMethod.Execute(context.Background(), params); err != nil {
+		t.Errorf("Login with new password failed: %v", err)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestUserSessionMethods_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	env.CreateTestUser("multidevice", "password123")
+	other, _ := env.CreateTestUser("intruder", "password123")
+
+	loginMethod := NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB))
+	loginCtx := context.WithValue(context.Background(), "client_ip", "10.0.0.1")
+	loginCtx = context.WithValue(loginCtx, "user_agent", "TestAgent/1.0")
+
+	params, _ := json.Marshal(UserLoginParams{Username: "multidevice", Password: "password123", Device: "Phone"})
+	result, err := loginMethod.Execute(loginCtx, params)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	phoneToken := result.(map[string]interface{})["token"].(string)
+
+	params, _ = json.Marshal(UserLoginParams{Username: "multidevice", Password: "password123"})
+	result, _ = loginMethod.Execute(loginCtx, params)
+	browserToken := result.(map[string]interface{})["token"].(string)
+
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+	phone, _ := handler.ParseToken(phoneToken)
+	browser, _ := handler.ParseToken(browserToken)
+
+	ctx := context.WithValue(context.Background(), "user_id", phone.UserID)
+	ctx = context.WithValue(ctx, "session_id", phone.ID)
+
+	result, err = NewUserSessionsMethod(env.Storage).Execute(ctx, nil)
+	if err != nil {
+		t.Fatalf("Get sessions failed: %v", err)
+	}
+
+	sessions := result.([]map[string]interface{})
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	devices := map[string]bool{}
+	for _, s := range sessions {
+		devices[s["device"].(string)] = true
+		if s["ip"] != "10.0.0.1" {
+			t.Errorf("Expected ip 10.0.0.1, got %v", s["ip"])
+		}
+		if s["current"] != (s["session_id"] == phone.ID) {
+			t.Errorf("Unexpected current flag: %v", s)
+		}
+	}
+	if !devices["Phone"] || !devices["TestAgent/1.0"] {
+		t.Errorf("Unexpected devices: %v", devices)
+	}
+
+	// Other users can't terminate the session
+	terminateMethod := NewUserTerminateSessionMethod(env.Storage, env.Hub)
+	otherCtx := context.WithValue(context.Background(), "user_id", other.ID)
+	params, _ = json.Marshal(UserTerminateSessionParams{SessionID: browser.ID})
+	if _, err := terminateMethod.Execute(otherCtx, params); err == nil {
+		t.Error("Should not terminate another user's session")
+	}
+
+	if _, err := terminateMethod.Execute(ctx, params); err != nil {
+		t.Fatalf("Terminate session failed: %v", err)
+	}
+	if _, err := handler.ParseToken(browserToken); err == nil {
+		t.Error("Terminated session token should be rejected")
+	}
+	if _, err := handler.ParseToken(phoneToken); err != nil {
+		t.Errorf("Current session should stay valid: %v", err)
+	}
+
+	if _, err := NewUserLogoutMethod(env.Storage, env.Hub).Execute(ctx, nil); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	if _, err := handler.ParseToken(phoneToken); err == nil {
+		t.Error("Token should be rejected after logout")
+	}
+}
+
+func TestUserRefreshMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	env.CreateTestUser("refresher", "password123")
+
+	params, _ := json.Marshal(UserLoginParams{Username: "refresher", Password: "password123"})
+	result, err := NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB)).Execute(context.Background(), params)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	login := result.(map[string]interface{})
+	firstRefresh := login["refresh_token"].(string)
+	if login["expires_in"] != int64(3600) {
+		t.Errorf("Expected expires_in 3600, got %v", login["expires_in"])
+	}
+
+	method := NewUserRefreshMethod(env.Storage, env.Hub, env.JWTManager)
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+
+	params, _ = json.Marshal(UserRefreshParams{RefreshToken: firstRefresh})
+	result, err = method.Execute(context.Background(), params)
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	refreshed := result.(map[string]interface{})
+	secondRefresh := refreshed["refresh_token"].(string)
+	if secondRefresh == firstRefresh {
+		t.Error("Refresh token should rotate")
+	}
+
+	claims, err := handler.ParseToken(refreshed["token"].(string))
+	if err != nil {
+		t.Fatalf("Refreshed access token should be valid: %v", err)
+	}
+	original, _ := handler.ParseToken(login["token"].(string))
+	if claims.ID != original.ID {
+		t.Error("Refreshing should keep the session")
+	}
+
+	// A forged token for the session is refused without ending it
+	sessionID, _, _ := strings.Cut(secondRefresh, ".")
+	params, _ = json.Marshal(UserRefreshParams{RefreshToken: sessionID + ".forged"})
+	if _, err := method.Execute(context.Background(), params); err == nil {
+		t.Error("Forged refresh token should be refused")
+	}
+	if _, err := handler.ParseToken(refreshed["token"].(string)); err != nil {
+		t.Error("Forged refresh token should not revoke the session")
+	}
+
+	// Reusing a rotated token revokes the whole session
+	params, _ = json.Marshal(UserRefreshParams{RefreshToken: firstRefresh})
+	if _, err := method.Execute(context.Background(), params); err == nil {
+		t.Error("Reused refresh token should be refused")
+	}
+	if _, err := handler.ParseToken(refreshed["token"].(string)); err == nil {
+		t.Error("Access token should be revoked after refresh token reuse")
+	}
+	params, _ = json.Marshal(UserRefreshParams{RefreshToken: secondRefresh})
+	if _, err := method.Execute(context.Background(), params); err == nil {
+		t.Error("Latest refresh token should be revoked after reuse")
+	}
+}
+
+func TestUserTwoFactor_EnrollAndLogin(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	// Keep the lockout out of the way of the challenge attempt limit
+	env.Config.RateLimitConfiguration.LockoutThreshold = 100
+
+	user, _ := env.CreateTestUser("secure", "password123")
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+
+	enroll := NewUserTwoFactorEnrollMethod(env.Storage, env.Config.TwoFactorConfiguration)
+	params, _ := json.Marshal(UserTwoFactorEnrollParams{Password: "wrong"})
+	if _, err := enroll.Execute(ctx, params); err == nil {
+		t.Error("Enroll should require the password")
+	}
+
+	params, _ = json.Marshal(UserTwoFactorEnrollParams{Password: "password123"})
+	result, err := enroll.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Enroll failed: %v", err)
+	}
+	enrolled := result.(map[string]interface{})
+	secret := enrolled["secret"].(string)
+	if !strings.HasPrefix(enrolled["uri"].(string), "otpauth://totp/simple_im:secure?") {
+		t.Errorf("Unexpected provisioning URI: %v", enrolled["uri"])
+	}
+
+	// Not enabled until verified, login still works with the password alone
+	login := NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB))
+	loginParams, _ := json.Marshal(UserLoginParams{Username: "secure", Password: "password123"})
+	result, _ = login.Execute(context.Background(), loginParams)
+	if _, ok := result.(map[string]interface{})["token"]; !ok {
+		t.Error("Unverified enrollment should not change login")
+	}
+
+	now := time.Now()
+	code, _ := totp.CodeAt(secret, totp.Step(now))
+	verify := NewUserTwoFactorVerifyMethod(env.Storage)
+	params, _ = json.Marshal(UserTwoFactorVerifyParams{Code: code})
+	result, err = verify.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	recoveryCodes := result.(map[string]interface{})["recovery_codes"].([]string)
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", recoveryCodeCount, len(recoveryCodes))
+	}
+
+	// Password step now only returns a challenge
+	result, err = login.Execute(context.Background(), loginParams)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	challenge := result.(map[string]interface{})
+	if challenge["two_factor_required"] != true {
+		t.Fatal("Login should require the second factor")
+	}
+	if _, ok := challenge["token"]; ok {
+		t.Error("No token should be issued before the code check")
+	}
+	challengeToken := challenge["challenge_token"].(string)
+
+	loginTwoFactor := NewUserLoginTwoFactorMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration)
+
+	// The code spent on verify cannot be replayed
+	params, _ = json.Marshal(UserLoginTwoFactorParams{ChallengeToken: challengeToken, Code: code})
+	if _, err := loginTwoFactor.Execute(context.Background(), params); err == nil {
+		t.Error("Replayed TOTP code should be refused")
+	}
+
+	next, _ := totp.CodeAt(secret, totp.Step(now)+1)
+	params, _ = json.Marshal(UserLoginTwoFactorParams{ChallengeToken: challengeToken, Code: next})
+	result, err = loginTwoFactor.Execute(context.Background(), params)
+	if err != nil {
+		t.Fatalf("Second factor failed: %v", err)
+	}
+	if _, err := env.JWTManager.ParseToken(result.(map[string]interface{})["token"].(string)); err != nil {
+		t.Errorf("Issued token should be valid: %v", err)
+	}
+
+	// Challenges are single use
+	if _, err := loginTwoFactor.Execute(context.Background(), params); err == nil {
+		t.Error("Challenge should not be usable twice")
+	}
+
+	// Recovery codes work once, in any case and without the dash
+	result, _ = login.Execute(context.Background(), loginParams)
+	challengeToken = result.(map[string]interface{})["challenge_token"].(string)
+	recovery := strings.ToLower(strings.ReplaceAll(recoveryCodes[0], "-", ""))
+	params, _ = json.Marshal(UserLoginTwoFactorParams{ChallengeToken: challengeToken, Code: recovery})
+	if _, err := loginTwoFactor.Execute(context.Background(), params); err != nil {
+		t.Fatalf("Recovery code should be accepted: %v", err)
+	}
+
+	result, _ = login.Execute(context.Background(), loginParams)
+	challengeToken = result.(map[string]interface{})["challenge_token"].(string)
+	params, _ = json.Marshal(UserLoginTwoFactorParams{ChallengeToken: challengeToken, Code: recoveryCodes[0]})
+	if _, err := loginTwoFactor.Execute(context.Background(), params); err == nil {
+		t.Error("Used recovery code should be refused")
+	}
+
+	// Too many wrong codes drop the challenge
+	for i := 1; i < loginChallengeAttempts; i++ {
+		params, _ = json.Marshal(UserLoginTwoFactorParams{ChallengeToken: challengeToken, Code: "000000"})
+		loginTwoFactor.Execute(context.Background(), params)
+	}
+	params, _ = json.Marshal(UserLoginTwoFactorParams{ChallengeToken: challengeToken, Code: recoveryCodes[1]})
+	if _, err := loginTwoFactor.Execute(context.Background(), params); err == nil {
+		t.Error("Challenge should be dropped after too many attempts")
+	}
+}
+
+func TestUserTwoFactorDisableMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	user, _ := env.CreateTestUser("secure", "password123")
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+
+	params, _ := json.Marshal(UserTwoFactorEnrollParams{Password: "password123"})
+	result, _ := NewUserTwoFactorEnrollMethod(env.Storage, env.Config.TwoFactorConfiguration).Execute(ctx, params)
+	secret := result.(map[string]interface{})["secret"].(string)
+	code, _ := totp.CodeAt(secret, totp.Step(time.Now()))
+	params, _ = json.Marshal(UserTwoFactorVerifyParams{Code: code})
+	result, err = NewUserTwoFactorVerifyMethod(env.Storage).Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	recoveryCodes := result.(map[string]interface{})["recovery_codes"].([]string)
+
+	method := NewUserTwoFactorDisableMethod(env.Storage)
+	params, _ = json.Marshal(UserTwoFactorDisableParams{Password: "password123", Code: "000000"})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Disable should require a valid code")
+	}
+
+	params, _ = json.Marshal(UserTwoFactorDisableParams{Password: "password123", Code: recoveryCodes[0]})
+	if _, err := method.Execute(ctx, params); err != nil {
+		t.Fatalf("Disable failed: %v", err)
+	}
+
+	var count int64
+	env.DB.Model(&models.RecoveryCode{}).Where("user_id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("Recovery codes should be removed, %d left", count)
+	}
+
+	params, _ = json.Marshal(UserLoginParams{Username: "secure", Password: "password123"})
+	result, _ = NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB)).Execute(context.Background(), params)
+	if _, ok := result.(map[string]interface{})["token"]; !ok {
+		t.Error("Login should not require a code after disabling")
+	}
+}
+
+func TestUserLoginMethod_Lockout(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	env.CreateTestUser("target", "password123")
+	limits := config.RateLimitConfiguration{LockoutThreshold: 2, LockoutBase: 60, LockoutMax: 300}
+	method := NewUserLoginMethod(env.Storage, env.JWTManager, limits, auth.NewLocal(env.DB))
+
+	wrong, _ := json.Marshal(UserLoginParams{Username: "target", Password: "wrong"})
+	right, _ := json.Marshal(UserLoginParams{Username: "target", Password: "password123"})
+
+	lockedFor := func() int64 {
+		_, err := method.Execute(context.Background(), right)
+		var rpcErr *resp.Error
+		if !errors.As(err, &rpcErr) || rpcErr.Code != resp.AccountLockedCode {
+			t.Fatalf("Expected account locked error, got %v", err)
+		}
+		return rpcErr.Data.(map[string]interface{})["retry_after"].(int64)
+	}
+
+	method.Execute(context.Background(), wrong)
+	if _, err := method.Execute(context.Background(), wrong); err == nil {
+		t.Fatal("Wrong password should fail")
+	}
+
+	// Even the right password is refused while locked
+	if wait := lockedFor(); wait != 60 {
+		t.Errorf("Expected first lockout of 60s, got %d", wait)
+	}
+
+	// Every further failure doubles the lockout up to the maximum
+	env.Redis.FastForward(61 * time.Second)
+	method.Execute(context.Background(), wrong)
+	if wait := lockedFor(); wait != 120 {
+		t.Errorf("Expected second lockout of 120s, got %d", wait)
+	}
+
+	env.Redis.FastForward(121 * time.Second)
+	method.Execute(context.Background(), wrong)
+	env.Redis.FastForward(241 * time.Second)
+	method.Execute(context.Background(), wrong)
+	if wait := lockedFor(); wait != 300 {
+		t.Errorf("Expected lockout capped at 300s, got %d", wait)
+	}
+
+	// A successful login resets the count
+	env.Redis.FastForward(301 * time.Second)
+	if _, err := method.Execute(context.Background(), right); err != nil {
+		t.Fatalf("Login after lockout failed: %v", err)
+	}
+	method.Execute(context.Background(), wrong)
+	if _, err := method.Execute(context.Background(), right); err != nil {
+		t.Errorf("Single failure after a reset should not lock: %v", err)
+	}
+}
+
+func TestUserLoginMethod_LockoutIgnoresCase(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	env.CreateTestUser("mixedcase", "password123")
+	limits := config.RateLimitConfiguration{LockoutThreshold: 2, LockoutBase: 60, LockoutMax: 300}
+	method := NewUserLoginMethod(env.Storage, env.JWTManager, limits, auth.NewLocal(env.DB))
+
+	for _, name := range []string{"MixedCase", " MIXEDCASE "} {
+		params, _ := json.Marshal(UserLoginParams{Username: name, Password: "wrong"})
+		method.Execute(context.Background(), params)
+	}
+
+	// Another spelling of the locked name gets no fresh counter
+	for _, name := range []string{"mixedcase", "mixedCASE"} {
+		params, _ := json.Marshal(UserLoginParams{Username: name, Password: "password123"})
+		_, err := method.Execute(context.Background(), params)
+		var rpcErr *resp.Error
+		if !errors.As(err, &rpcErr) || rpcErr.Code != resp.AccountLockedCode {
+			t.Errorf("Expected %q to be locked, got %v", name, err)
+		}
+	}
+
+	// A successful login clears the counter that was incremented
+	env.Redis.FastForward(61 * time.Second)
+	params, _ := json.Marshal(UserLoginParams{Username: "mixedcase", Password: "password123"})
+	if _, err := method.Execute(context.Background(), params); err != nil {
+		t.Fatalf("Login after lockout failed: %v", err)
+	}
+	wrong, _ := json.Marshal(UserLoginParams{Username: "MIXEDCASE", Password: "wrong"})
+	method.Execute(context.Background(), wrong)
+	if _, err := method.Execute(context.Background(), params); err != nil {
+		t.Errorf("Single failure after a reset should not lock: %v", err)
+	}
+}
+
+func TestUserLoginMethod_RateLimit(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	env.CreateTestUser("busy", "password123")
+	limits := config.RateLimitConfiguration{LoginPerUsername: 3}
+	method := NewUserLoginMethod(env.Storage, env.JWTManager, limits, auth.NewLocal(env.DB))
+	params, _ := json.Marshal(UserLoginParams{Username: "busy", Password: "password123"})
+
+	for i := 0; i < 3; i++ {
+		if _, err := method.Execute(context.Background(), params); err != nil {
+			t.Fatalf("Login %d failed: %v", i+1, err)
+		}
+	}
+
+	_, err = method.Execute(context.Background(), params)
+	var rpcErr *resp.Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != resp.RateLimitedCode {
+		t.Fatalf("Expected rate limited error, got %v", err)
+	}
+
+	// The window resets
+	env.Redis.FastForward(time.Minute)
+	if _, err := method.Execute(context.Background(), params); err != nil {
+		t.Errorf("Login in the next window failed: %v", err)
+	}
+}
+
+func TestUserRegisterMethod_RateLimit(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	method := NewUserRegisterMethod(env.Storage, env.JWTManager, config.RateLimitConfiguration{RegisterPerIP: 2})
+	ctx := context.WithValue(context.Background(), "client_ip", "10.0.0.1")
+
+	for _, name := range []string{"first", "second"} {
+		params, _ := json.Marshal(UserRegisterParams{Username: name, Password: "password123"})
+		if _, err := method.Execute(ctx, params); err != nil {
+			t.Fatalf("Register %s failed: %v", name, err)
+		}
+	}
+
+	params, _ := json.Marshal(UserRegisterParams{Username: "third", Password: "password123"})
+	_, err = method.Execute(ctx, params)
+	var rpcErr *resp.Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != resp.RateLimitedCode {
+		t.Fatalf("Expected rate limited error, got %v", err)
+	}
+
+	// Other addresses are not affected
+	otherCtx := context.WithValue(context.Background(), "client_ip", "10.0.0.2")
+	if _, err := method.Execute(otherCtx, params); err != nil {
+		t.Errorf("Register from another IP failed: %v", err)
+	}
+}
+
+func TestConfirmUser_IdentityAccounts(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.ExportConfiguration.SavePath = t.TempDir()
+
+	local, _ := env.CreateTestUser("confirmlocal", "password123")
+	sso, _ := env.CreateTestUser("confirmsso", "unknown-random")
+	env.DB.Create(&models.UserIdentity{UserID: sso.ID, Provider: "oidc", Subject: "sub-1"})
+
+	session := func(user *models.User, id string, age time.Duration) context.Context {
+		created := time.Now().Add(-age)
+		env.Storage.CreateSession(context.Background(), &storage.Session{ID: id, UserID: user.ID, CreatedAt: created, LastActiveAt: created}, time.Hour)
+		return context.WithValue(context.WithValue(context.Background(), "user_id", user.ID), "session_id", id)
+	}
+
+	enroll := NewUserTwoFactorEnrollMethod(env.Storage, env.Config.TwoFactorConfiguration)
+	noPassword, _ := json.Marshal(UserTwoFactorEnrollParams{})
+
+	if _, err := enroll.Execute(session(local, "local-fresh", 0), noPassword); err == nil {
+		t.Error("Local accounts should always need the password")
+	}
+	if _, err := enroll.Execute(session(sso, "sso-stale", time.Hour), noPassword); err == nil {
+		t.Error("An old login should not confirm an SSO account")
+	}
+	if _, err := enroll.Execute(session(sso, "sso-fresh", time.Minute), noPassword); err != nil {
+		t.Errorf("A recent login should confirm an SSO account: %v", err)
+	}
+
+	params, _ := json.Marshal(UserDeleteAccountParams{})
+	if _, err := NewUserDeleteAccountMethod(env.Storage, env.Hub, nil, nil, env.Config.ExportConfiguration).Execute(session(sso, "sso-delete", 0), params); err != nil {
+		t.Errorf("SSO accounts should be able to delete themselves: %v", err)
+	}
+}
+
+func TestUserDeleteAccountMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.ExportConfiguration.SavePath = t.TempDir()
+
+	user, _ := env.CreateTestUser("leaving", "password123")
+	admin, _ := env.CreateTestUser("deputy", "password123")
+	member, _ := env.CreateTestUser("member", "password123")
+	friend, _ := env.CreateTestUser("friend", "password123")
+
+	shared, _ := env.CreateTestGroup("shared", user.ID)
+	env.DB.Create(&models.GroupMember{GroupID: shared.ID, UserID: member.ID, Role: models.GroupRoleMember})
+	env.DB.Create(&models.GroupMember{GroupID: shared.ID, UserID: admin.ID, Role: models.GroupRoleAdmin})
+	solo, _ := env.CreateTestGroup("solo", user.ID)
+
+	env.CreateTestFriendship(user.ID, friend.ID, models.FriendStatusAccepted)
+	env.DB.Create(&models.FriendRemark{UserID: friend.ID, FriendID: user.ID, Remark: "old pal"})
+
+	upload := filepath.Join(t.TempDir(), "upload.png")
+	os.WriteFile(upload, []byte("png"), 0644)
+	env.DB.Create(&models.File{UserID: user.ID, Filename: "upload.png", Filepath: upload, Filesize: 3, Mimetype: "image/png"})
+
+	receiverID := friend.ID
+	env.DB.Create(&models.Message{SenderID: user.ID, ReceiverID: &receiverID, MsgType: models.MsgTypeText, Content: "bye"})
+
+	token, _ := env.CreateTestToken(user)
+	handler := NewRpcHandler(env.Storage, env.Hub, env.JWTManager)
+
+	method := NewUserDeleteAccountMethod(env.Storage, env.Hub, nil, nil, env.Config.ExportConfiguration)
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+
+	params, _ := json.Marshal(UserDeleteAccountParams{Password: "wrong"})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Fatal("Deletion should require the password")
+	}
+
+	params, _ = json.Marshal(UserDeleteAccountParams{Password: "password123"})
+	result, err := method.Execute(ctx, params)
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	summary := result.(map[string]interface{})
+	if summary["groups_transferred"] != 1 || summary["groups_dissolved"] != 1 {
+		t.Errorf("Unexpected summary: %v", summary)
+	}
+
+	var deleted models.User
+	env.DB.Unscoped().First(&deleted, user.ID)
+	if !deleted.DeletedAt.Valid || deleted.Nickname != deletedUserNickname || !strings.HasPrefix(deleted.Username, "deleted_") {
+		t.Errorf("Account should be anonymized and soft deleted, got %+v", deleted)
+	}
+
+	if _, err := handler.ParseToken(token); err == nil {
+		t.Error("Sessions should be revoked")
+	}
+
+	params, _ = json.Marshal(UserLoginParams{Username: "leaving", Password: "password123"})
+	if _, err := NewUserLoginMethod(env.Storage, env.JWTManager, env.Config.RateLimitConfiguration, auth.NewLocal(env.DB)).Execute(context.Background(), params); err == nil {
+		t.Error("Deleted account should not log in")
+	}
+
+	// The admin outranks the earlier member and takes over
+	var group models.Group
+	env.DB.First(&group, shared.ID)
+	if group.OwnerID != admin.ID {
+		t.Errorf("Expected admin to own the group, owner is %d", group.OwnerID)
+	}
+	var ownerRole models.GroupMember
+	env.DB.Where("group_id = ? AND user_id = ?", shared.ID, admin.ID).First(&ownerRole)
+	if ownerRole.Role != models.GroupRoleOwner {
+		t.Error("New owner should have the owner role")
+	}
+
+	var count int64
+	env.DB.Model(&models.Group{}).Where("id = ?", solo.ID).Count(&count)
+	if count != 0 {
+		t.Error("Group without other members should be dissolved")
+	}
+
+	env.DB.Model(&models.Friend{}).Where("user_id = ? OR friend_id = ?", user.ID, user.ID).Count(&count)
+	if count != 0 {
+		t.Error("Friendships should be removed")
+	}
+	env.DB.Model(&models.FriendRemark{}).Where("friend_id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Error("Remarks about the user should be removed")
+	}
+
+	if _, err := os.Stat(upload); !os.IsNotExist(err) {
+		t.Error("Uploaded files should be removed")
+	}
+
+	// Sent messages stay, attributed to the anonymized account
+	historyCtx := context.WithValue(context.Background(), "user_id", friend.ID)
+	params, _ = json.Marshal(MessageHistoryParams{ReceiverID: user.ID})
+	result, err = NewMessageHistoryMethod(env.Storage).Execute(historyCtx, params)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	messages := result.([]historyMessage)
+	if len(messages) != 1 || messages[0].Sender == nil || messages[0].Sender.Nickname != deletedUserNickname {
+		t.Errorf("Expected message from the deleted user, got %+v", messages)
+	}
+}
+
+func TestUserExportDataMethod_Execute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.ExportConfiguration.SavePath = t.TempDir()
+
+	user, _ := env.CreateTestUser("exporter", "password123")
+	friend, _ := env.CreateTestUser("friend", "password123")
+	env.CreateTestFriendship(friend.ID, user.ID, models.FriendStatusAccepted)
+	env.DB.Create(&models.FriendTag{UserID: user.ID, FriendID: friend.ID, Tag: "work"})
+	env.CreateTestGroup("mine", user.ID)
+
+	receiverID := friend.ID
+	env.DB.Create(&models.Message{SenderID: user.ID, ReceiverID: &receiverID, MsgType: models.MsgTypeText, Content: "hi"})
+	env.DB.Create(&models.Message{SenderID: friend.ID, ReceiverID: &user.ID, MsgType: models.MsgTypeText, Content: "hello"})
+
+	upload := filepath.Join(t.TempDir(), "notes.pdf")
+	os.WriteFile(upload, []byte("%PDF"), 0644)
+	env.DB.Create(&models.File{UserID: user.ID, Filename: "notes.pdf", Filepath: upload, Filesize: 4, Mimetype: "application/pdf"})
+
+	method := NewUserExportDataMethod(env.Storage, env.Config.ExportConfiguration)
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+
+	result, err := method.Execute(ctx, nil)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	exportID := strings.TrimPrefix(result.(map[string]interface{})["url"].(string), "/api/export/")
+
+	archive, err := zip.OpenReader(exportArchivePath(env.Config.ExportConfiguration, user.ID, exportID))
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	defer archive.Close()
+
+	entries := make(map[string][]byte)
+	for _, f := range archive.File {
+		r, _ := f.Open()
+		entries[f.Name], _ = io.ReadAll(r)
+		r.Close()
+	}
+
+	var friends []map[string]interface{}
+	json.Unmarshal(entries["friends.json"], &friends)
+	if len(friends) != 1 || friends[0]["username"] != "friend" || friends[0]["outgoing"] != false {
+		t.Errorf("Unexpected friends: %s", entries["friends.json"])
+	}
+
+	var groups []map[string]interface{}
+	json.Unmarshal(entries["groups.json"], &groups)
+	if len(groups) != 1 || groups[0]["name"] != "mine" {
+		t.Errorf("Unexpected groups: %s", entries["groups.json"])
+	}
+
+	var messages []models.Message
+	if err := json.Unmarshal(entries["messages.json"], &messages); err != nil || len(messages) != 2 {
+		t.Errorf("Expected 2 messages, got %s", entries["messages.json"])
+	}
+
+	if _, ok := entries["profile.json"]; !ok {
+		t.Error("Archive should contain the profile")
+	}
+	var files []map[string]interface{}
+	json.Unmarshal(entries["files.json"], &files)
+	if len(files) != 1 || string(entries[files[0]["path"].(string)]) != "%PDF" {
+		t.Errorf("Uploaded file should be in the archive: %s", entries["files.json"])
+	}
+
+	// Only the owner can download the archive
+	server := &ApiServer{storage: env.Storage, conf: env.Config}
+	download := func(userID int64) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/export/"+exportID, nil)
+		c.Params = gin.Params{{Key: "id", Value: exportID}}
+		c.Set("user_id", userID)
+		server.DownloadExport(c)
+		return w.Code
+	}
+	if code := download(user.ID); code != http.StatusOK {
+		t.Errorf("Owner download failed with status %d", code)
+	}
+	if code := download(friend.ID); code != http.StatusNotFound {
+		t.Errorf("Other users should not download the archive, got status %d", code)
+	}
+
+	// Exports are throttled
+	for i := 1; i < exportsPerHour; i++ {
+		method.Execute(ctx, nil)
+	}
+	if _, err := method.Execute(ctx, nil); err == nil {
+		t.Error("Expected export rate limit")
+	}
+}
+
+func TestUserLoginOIDCMethod_Execute(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	provider := oidctest.NewProvider("simple_im", "secret")
+	defer provider.Close()
+
+	conf := config.OIDCConfiguration{
+		Issuer:        provider.URL,
+		ClientID:      "simple_im",
+		ClientSecret:  "secret",
+		RedirectURL:   "http://localhost:3000/login/callback",
+		UsernameClaim: "email",
+	}
+	client := oidc.NewClient(conf)
+	authURLMethod := NewUserOIDCAuthURLMethod(env.Storage, client)
+	ctx := context.Background()
+
+	// login runs the whole flow for the user the provider currently has
+	var lastState string
+	login := func(method *UserLoginOIDCMethod) (map[string]interface{}, error) {
+		result, err := authURLMethod.Execute(ctx, json.RawMessage(`{"device":"browser"}`))
+		if err != nil {
+			t.Fatalf("Auth URL failed: %v", err)
+		}
+		code, state, err := provider.Authorize(result.(map[string]interface{})["url"].(string))
+		if err != nil {
+			t.Fatalf("Authorize failed: %v", err)
+		}
+		lastState = state
+		params, _ := json.Marshal(UserLoginOIDCParams{Code: code, State: state})
+		data, err := method.Execute(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		return data.(map[string]interface{}), nil
+	}
+
+	method := NewUserLoginOIDCMethod(env.Storage, env.JWTManager, client, conf)
+
+	// First login creates the account from the mapped claims
+	provider.SetUser(map[string]interface{}{"sub": "emp-1", "email": "alice@corp.example", "name": "Alice"})
+	data, err := login(method)
+	if err != nil {
+		t.Fatalf("First login failed: %v", err)
+	}
+	user := data["user"].(*fullProfile)
+	if user.Username != "alice@corp.example" || user.Nickname != "Alice" || data["token"] == "" {
+		t.Errorf("Unexpected account: %+v", user)
+	}
+
+	// The state is single use
+	params, _ := json.Marshal(UserLoginOIDCParams{Code: "any", State: lastState})
+	if _, err := method.Execute(ctx, params); err == nil {
+		t.Error("Expected replayed state to fail")
+	}
+
+	// Later logins find the account by subject even when the username claim changes
+	provider.SetUser(map[string]interface{}{"sub": "emp-1", "email": "alice.new@corp.example"})
+	data, err = login(method)
+	if err != nil {
+		t.Fatalf("Second login failed: %v", err)
+	}
+	if data["user"].(*fullProfile).ID != user.ID {
+		t.Error("Second login should use the same account")
+	}
+
+	// Local accounts are only linked when configured
+	bob, _ := env.CreateTestUser("bob@corp.example", "password123")
+	provider.SetUser(map[string]interface{}{"sub": "emp-2", "email": "bob@corp.example"})
+	if _, err := login(method); err == nil {
+		t.Error("Expected username conflict without LinkExisting")
+	}
+
+	conf.LinkExisting = true
+	linking := NewUserLoginOIDCMethod(env.Storage, env.JWTManager, client, conf)
+	data, err = login(linking)
+	if err != nil {
+		t.Fatalf("Linking login failed: %v", err)
+	}
+	if data["user"].(*fullProfile).ID != bob.ID {
+		t.Error("Expected the local account to be linked")
+	}
+
+	// An account linked to one identity cannot be taken over by another
+	provider.SetUser(map[string]interface{}{"sub": "emp-3", "email": "bob@corp.example"})
+	if _, err := login(linking); err == nil {
+		t.Error("Expected a second identity for the same account to be refused")
+	}
+
+	// Disabled accounts cannot log in through the provider either
+	env.DB.Model(&models.User{}).Where("id = ?", user.ID).Update("status", 0)
+	provider.SetUser(map[string]interface{}{"sub": "emp-1", "email": "alice@corp.example"})
+	if _, err := login(method); err == nil {
+		t.Error("Expected disabled user to be refused")
+	}
+
+	var count int64
+	env.DB.Model(&models.UserIdentity{}).Count(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 linked identities, got %d", count)
+	}
+}
+
+func TestUserOIDCMethods_NotConfigured(t *testing.T) {
+	env, _ := SetupTestEnv()
+
+	client := oidc.NewClient(env.Config.OIDCConfiguration)
+	if _, err := NewUserOIDCAuthURLMethod(env.Storage, client).Execute(context.Background(), nil); err == nil {
+		t.Error("Expected error without OIDC configuration")
+	}
+
+	method := NewUserLoginOIDCMethod(env.Storage, env.JWTManager, client, env.Config.OIDCConfiguration)
+	if _, err := method.Execute(context.Background(), json.RawMessage(`{"code":"c","state":"s"}`)); err == nil {
+		t.Error("Expected error without OIDC configuration")
+	}
+}
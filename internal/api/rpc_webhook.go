@@ -0,0 +1,468 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"simple_im/internal/models"
+	"simple_im/internal/storage"
+	"simple_im/pkg/common/config"
+	"simple_im/pkg/common/resp"
+
+	"gorm.io/gorm"
+)
+
+const defaultMaxWebhooksPerOwner = 10
+
+// checkWebhookAccess lets everyone manage user webhooks, group admins the
+// webhooks of their group and roles with PermissionWebhooksManage the global ones
+func checkWebhookAccess(db *gorm.DB, userID int64, scope models.WebhookScope, groupID *int64) error {
+	switch scope {
+	case models.WebhookScopeUser:
+		return nil
+	case models.WebhookScopeGroup:
+		if groupID == nil {
+			return errors.New("group_id is required")
+		}
+		var membership models.GroupMember
+		err := db.Where("group_id = ? AND user_id = ?", *groupID, userID).First(&membership).Error
+		if err != nil || membership.Role < models.GroupRoleAdmin {
+			return errors.New("only group owner or admin can manage its webhooks")
+		}
+		return nil
+	case models.WebhookScopeGlobal:
+		var user models.User
+		if err := db.Select("id", "role").First(&user, userID).Error; err != nil || !user.Role.HasPermission(models.PermissionWebhooksManage) {
+			return resp.NewError(resp.PermissionDeniedCode, "permission denied", nil)
+		}
+		return nil
+	}
+	return errors.New("invalid scope")
+}
+
+// loadManagedWebhook returns the webhook when the caller may manage it,
+// other webhooks look like they don't exist
+func loadManagedWebhook(ctx context.Context, db *gorm.DB, webhookID int64) (*models.Webhook, error) {
+	if webhookID == 0 {
+		return nil, errors.New("webhook_id is required")
+	}
+	userID := ctx.Value("user_id").(int64)
+
+	var hook models.Webhook
+	if err := db.First(&hook, webhookID).Error; err != nil {
+		return nil, errors.New("webhook not found")
+	}
+	if hook.Scope == models.WebhookScopeUser && hook.OwnerID != userID {
+		return nil, errors.New("webhook not found")
+	}
+	if checkWebhookAccess(db, userID, hook.Scope, hook.GroupID) != nil {
+		return nil, errors.New("webhook not found")
+	}
+	return &hook, nil
+}
+
+// parseWebhookEvents validates the events and joins them for Webhook.Events
+func parseWebhookEvents(events []string) (string, error) {
+	if len(events) == 0 {
+		return "", errors.New("events is required")
+	}
+	seen := make(map[string]bool, len(events))
+	valid := make([]string, 0, len(events))
+	for _, e := range events {
+		if !models.WebhookEvent(e).Valid() {
+			return "", fmt.Errorf("unknown event: %s", e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			valid = append(valid, e)
+		}
+	}
+	return strings.Join(valid, " "), nil
+}
+
+// ============ webhook.create ============
+
+type WebhookCreateMethod struct {
+	storage    *storage.Storage
+	dispatcher *webhookDispatcher
+	conf       config.WebhookConfiguration
+}
+
+func NewWebhookCreateMethod(s *storage.Storage, d *webhookDispatcher, c config.WebhookConfiguration) *WebhookCreateMethod {
+	return &WebhookCreateMethod{storage: s, dispatcher: d, conf: c}
+}
+
+func (m *WebhookCreateMethod) Name() string { return "webhook.create" }
+
+func (m *WebhookCreateMethod) RequireAuth() bool { return true }
+
+func (m *WebhookCreateMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "group", "group_id")
+}
+
+type WebhookCreateParams struct {
+	Scope   models.WebhookScope `json:"scope"`    // Defaults to user
+	GroupID int64               `json:"group_id"` // For group webhooks
+	URL     string              `json:"url"`
+	Events  []string            `json:"events"`
+}
+
+// Execute returns the signing secret once, it is not shown again
+func (m *WebhookCreateMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p WebhookCreateParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.Scope == "" {
+		p.Scope = models.WebhookScopeUser
+	}
+	if !p.Scope.Valid() {
+		return nil, errors.New("invalid scope")
+	}
+
+	p.URL = strings.TrimSpace(p.URL)
+	if len(p.URL) > 500 || !validWebhookURL(p.URL) {
+		return nil, errors.New("url must be an http or https URL")
+	}
+
+	events, err := parseWebhookEvents(p.Events)
+	if err != nil {
+		return nil, err
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+
+	hook := &models.Webhook{
+		OwnerID: userID,
+		Scope:   p.Scope,
+		URL:     p.URL,
+		Events:  events,
+		Active:  true,
+	}
+	if p.Scope == models.WebhookScopeGroup && p.GroupID > 0 {
+		hook.GroupID = &p.GroupID
+	}
+	if err := checkWebhookAccess(db, userID, hook.Scope, hook.GroupID); err != nil {
+		return nil, err
+	}
+
+	limit := m.conf.MaxPerOwner
+	if limit <= 0 {
+		limit = defaultMaxWebhooksPerOwner
+	}
+	var owned int64
+	db.Model(&models.Webhook{}).Where("owner_id = ?", userID).Count(&owned)
+	if owned >= int64(limit) {
+		return nil, fmt.Errorf("cannot create more than %d webhooks", limit)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	hook.Secret = hex.EncodeToString(secret)
+
+	if err := db.Create(hook).Error; err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %v", err)
+	}
+	m.dispatcher.reload()
+
+	return map[string]interface{}{
+		"webhook": hook,
+		"secret":  hook.Secret,
+	}, nil
+}
+
+// ============ webhook.list ============
+
+type WebhookListMethod struct {
+	storage *storage.Storage
+}
+
+func NewWebhookListMethod(s *storage.Storage) *WebhookListMethod {
+	return &WebhookListMethod{storage: s}
+}
+
+func (m *WebhookListMethod) Name() string { return "webhook.list" }
+
+func (m *WebhookListMethod) RequireAuth() bool { return true }
+
+type WebhookListParams struct {
+	GroupID int64 `json:"group_id"` // Webhooks of the group
+	Global  bool  `json:"global"`   // Global webhooks
+}
+
+// Execute lists the caller's own webhooks unless a group or the global
+// webhooks are asked for
+func (m *WebhookListMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p WebhookListParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
+	userID := ctx.Value("user_id").(int64)
+	db := m.storage.GetDB()
+	query := db.Order("id")
+
+	switch {
+	case p.Global:
+		if err := checkWebhookAccess(db, userID, models.WebhookScopeGlobal, nil); err != nil {
+			return nil, err
+		}
+		query = query.Where("scope = ?", models.WebhookScopeGlobal)
+	case p.GroupID > 0:
+		if err := checkWebhookAccess(db, userID, models.WebhookScopeGroup, &p.GroupID); err != nil {
+			return nil, err
+		}
+		query = query.Where("scope = ? AND group_id = ?", models.WebhookScopeGroup, p.GroupID)
+	default:
+		query = query.Where("owner_id = ?", userID)
+	}
+
+	var hooks []models.Webhook
+	if err := query.Find(&hooks).Error; err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %v", err)
+	}
+
+	return hooks, nil
+}
+
+// ============ webhook.update ============
+
+type WebhookUpdateMethod struct {
+	storage    *storage.Storage
+	dispatcher *webhookDispatcher
+}
+
+func NewWebhookUpdateMethod(s *storage.Storage, d *webhookDispatcher) *WebhookUpdateMethod {
+	return &WebhookUpdateMethod{storage: s, dispatcher: d}
+}
+
+func (m *WebhookUpdateMethod) Name() string { return "webhook.update" }
+
+func (m *WebhookUpdateMethod) RequireAuth() bool { return true }
+
+func (m *WebhookUpdateMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "webhook", "webhook_id")
+}
+
+type WebhookUpdateParams struct {
+	WebhookID int64    `json:"webhook_id"`
+	URL       *string  `json:"url"`
+	Events    []string `json:"events"`
+	Active    *bool    `json:"active"`
+}
+
+func (m *WebhookUpdateMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p WebhookUpdateParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	db := m.storage.GetDB()
+	hook, err := loadManagedWebhook(ctx, db, p.WebhookID)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{}
+	if p.URL != nil {
+		url := strings.TrimSpace(*p.URL)
+		if len(url) > 500 || !validWebhookURL(url) {
+			return nil, errors.New("url must be an http or https URL")
+		}
+		updates["url"] = url
+	}
+	if p.Events != nil {
+		events, err := parseWebhookEvents(p.Events)
+		if err != nil {
+			return nil, err
+		}
+		updates["events"] = events
+	}
+	if p.Active != nil {
+		updates["active"] = *p.Active
+	}
+
+	if len(updates) == 0 {
+		return nil, errors.New("no fields to update")
+	}
+
+	if err := db.Model(hook).Updates(updates).Error; err != nil {
+		return nil, fmt.Errorf("failed to update webhook: %v", err)
+	}
+	m.dispatcher.reload()
+
+	return hook, nil
+}
+
+// ============ webhook.delete ============
+
+type WebhookDeleteMethod struct {
+	storage    *storage.Storage
+	dispatcher *webhookDispatcher
+}
+
+func NewWebhookDeleteMethod(s *storage.Storage, d *webhookDispatcher) *WebhookDeleteMethod {
+	return &WebhookDeleteMethod{storage: s, dispatcher: d}
+}
+
+func (m *WebhookDeleteMethod) Name() string { return "webhook.delete" }
+
+func (m *WebhookDeleteMethod) RequireAuth() bool { return true }
+
+func (m *WebhookDeleteMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "webhook", "webhook_id")
+}
+
+type WebhookDeleteParams struct {
+	WebhookID int64 `json:"webhook_id"`
+}
+
+// Execute deletes the webhook together with its delivery log
+func (m *WebhookDeleteMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p WebhookDeleteParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	db := m.storage.GetDB()
+	hook, err := loadManagedWebhook(ctx, db, p.WebhookID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", hook.ID).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(hook).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete webhook: %v", err)
+	}
+	m.dispatcher.reload()
+
+	return map[string]interface{}{
+		"success": true,
+	}, nil
+}
+
+// ============ webhook.deliveries ============
+
+type WebhookDeliveriesMethod struct {
+	storage *storage.Storage
+}
+
+func NewWebhookDeliveriesMethod(s *storage.Storage) *WebhookDeliveriesMethod {
+	return &WebhookDeliveriesMethod{storage: s}
+}
+
+func (m *WebhookDeliveriesMethod) Name() string { return "webhook.deliveries" }
+
+func (m *WebhookDeliveriesMethod) RequireAuth() bool { return true }
+
+type WebhookDeliveriesParams struct {
+	WebhookID int64                         `json:"webhook_id"`
+	Status    *models.WebhookDeliveryStatus `json:"status"`
+	Offset    int                           `json:"offset"`
+	Limit     int                           `json:"limit"`
+}
+
+func (m *WebhookDeliveriesMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p WebhookDeliveriesParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.Limit <= 0 || p.Limit > 100 {
+		p.Limit = 50
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+
+	db := m.storage.GetDB()
+	hook, err := loadManagedWebhook(ctx, db, p.WebhookID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.Model(&models.WebhookDelivery{}).Where("webhook_id = ?", hook.ID)
+	if p.Status != nil {
+		query = query.Where("status = ?", *p.Status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, fmt.Errorf("failed to count deliveries: %v", err)
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("id DESC").Offset(p.Offset).Limit(p.Limit).Find(&deliveries).Error; err != nil {
+		return nil, fmt.Errorf("failed to get deliveries: %v", err)
+	}
+
+	return map[string]interface{}{
+		"deliveries": deliveries,
+		"total":      total,
+	}, nil
+}
+
+// ============ webhook.replay ============
+
+type WebhookReplayMethod struct {
+	storage    *storage.Storage
+	dispatcher *webhookDispatcher
+}
+
+func NewWebhookReplayMethod(s *storage.Storage, d *webhookDispatcher) *WebhookReplayMethod {
+	return &WebhookReplayMethod{storage: s, dispatcher: d}
+}
+
+func (m *WebhookReplayMethod) Name() string { return "webhook.replay" }
+
+func (m *WebhookReplayMethod) RequireAuth() bool { return true }
+
+func (m *WebhookReplayMethod) AuditTarget(params json.RawMessage) (string, string) {
+	return auditTarget(params, "webhook_delivery", "delivery_id")
+}
+
+type WebhookReplayParams struct {
+	DeliveryID int64 `json:"delivery_id"`
+}
+
+// Execute sends a logged delivery again, the result is the new delivery
+// which is attempted in the background
+func (m *WebhookReplayMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p WebhookReplayParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	if p.DeliveryID == 0 {
+		return nil, errors.New("delivery_id is required")
+	}
+
+	db := m.storage.GetDB()
+
+	var original models.WebhookDelivery
+	if err := db.First(&original, p.DeliveryID).Error; err != nil {
+		return nil, errors.New("delivery not found")
+	}
+	hook, err := loadManagedWebhook(ctx, db, original.WebhookID)
+	if err != nil {
+		return nil, errors.New("delivery not found")
+	}
+
+	return m.dispatcher.replay(&original, hook)
+}
@@ -0,0 +1,320 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"simple_im/internal/models"
+	"simple_im/internal/ws"
+	"simple_im/pkg/common/config"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForDelivery polls the delivery log until check accepts a delivery
+func waitForDelivery(t *testing.T, env *TestEnv, check func(d models.WebhookDelivery) bool) models.WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var deliveries []models.WebhookDelivery
+		env.DB.Order("id").Find(&deliveries)
+		for _, d := range deliveries {
+			if check(d) {
+				return d
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected delivery was not recorded")
+	return models.WebhookDelivery{}
+}
+
+func TestWebhookEventOf(t *testing.T) {
+	joined, _ := json.Marshal(models.SystemPayload{Event: models.SystemEventMemberInvited})
+	created, _ := json.Marshal(models.SystemPayload{Event: models.SystemEventGroupCreated})
+
+	tests := []struct {
+		msg  ws.Message
+		want models.WebhookEvent
+	}{
+		{ws.Message{Type: "message", MsgType: ws.MsgTypeText}, models.WebhookEventMessageCreated},
+		{ws.Message{Type: "message", MsgType: ws.MsgTypeSystem, Content: string(joined)}, models.WebhookEventMemberJoined},
+		{ws.Message{Type: "message", MsgType: ws.MsgTypeSystem, Content: string(created)}, ""},
+		{ws.Message{Type: "message_deleted"}, models.WebhookEventMessageDeleted},
+		{ws.Message{Type: "friend_accepted"}, models.WebhookEventFriendAccepted},
+		{ws.Message{Type: "friend_rejected"}, ""},
+	}
+	for _, tt := range tests {
+		if got := webhookEventOf(&tt.msg); got != tt.want {
+			t.Errorf("webhookEventOf(%s) = %q, want %q", tt.msg.Type, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookCreateMethod_Access(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	owner, _ := env.CreateTestUser("hookowner", "password123")
+	member, _ := env.CreateTestUser("hookmember", "password123")
+	admin, _ := env.CreateTestUser("hookadmin", "password123")
+	env.DB.Model(admin).Update("role", models.UserRoleAdmin)
+	group, _ := env.CreateTestGroup("Hook Group", owner.ID)
+	env.DB.Create(&models.GroupMember{GroupID: group.ID, UserID: member.ID, Role: models.GroupRoleMember})
+
+	method := NewWebhookCreateMethod(env.Storage, nil, env.Config.WebhookConfiguration)
+	call := func(user *models.User, p WebhookCreateParams) error {
+		ctx := context.WithValue(context.Background(), "user_id", user.ID)
+		params, _ := json.Marshal(p)
+		_, err := method.Execute(ctx, params)
+		return err
+	}
+
+	events := []string{"message.created"}
+	tests := []struct {
+		name   string
+		user   *models.User
+		params WebhookCreateParams
+		ok     bool
+	}{
+		{"user webhook", member, WebhookCreateParams{URL: "https://example.com/hook", Events: events}, true},
+		{"unknown event", member, WebhookCreateParams{URL: "https://example.com/hook", Events: []string{"everything"}}, false},
+		{"invalid url", member, WebhookCreateParams{URL: "ftp://example.com", Events: events}, false},
+		{"group webhook by member", member, WebhookCreateParams{Scope: models.WebhookScopeGroup, GroupID: group.ID, URL: "https://example.com/hook", Events: events}, false},
+		{"group webhook by owner", owner, WebhookCreateParams{Scope: models.WebhookScopeGroup, GroupID: group.ID, URL: "https://example.com/hook", Events: events}, true},
+		{"global webhook by user", owner, WebhookCreateParams{Scope: models.WebhookScopeGlobal, URL: "https://example.com/hook", Events: events}, false},
+		{"global webhook by admin", admin, WebhookCreateParams{Scope: models.WebhookScopeGlobal, URL: "https://example.com/hook", Events: events}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := call(tt.user, tt.params); (err == nil) != tt.ok {
+				t.Errorf("Expected ok=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+
+	// Other users don't see a user webhook
+	var hook models.Webhook
+	env.DB.Where("owner_id = ? AND scope = ?", member.ID, models.WebhookScopeUser).First(&hook)
+	ctx := context.WithValue(context.Background(), "user_id", owner.ID)
+	params, _ := json.Marshal(WebhookDeleteParams{WebhookID: hook.ID})
+	if _, err := NewWebhookDeleteMethod(env.Storage, nil).Execute(ctx, params); err == nil {
+		t.Error("Only the owner should delete a user webhook")
+	}
+}
+
+func TestWebhookDispatcher_Deliver(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	var mu sync.Mutex
+	var calls int
+	var lastBody []byte
+	var lastHeader http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		lastBody, lastHeader = body, r.Header
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	dispatcher := newWebhookDispatcher(env.DB, config.WebhookConfiguration{MaxAttempts: 3, AllowPrivateNetworks: true})
+	dispatcher.run()
+	env.Hub.OnBroadcast(dispatcher.observe)
+
+	owner, _ := env.CreateTestUser("dispatchowner", "password123")
+	outsider, _ := env.CreateTestUser("dispatchoutsider", "password123")
+	group, _ := env.CreateTestGroup("Dispatch Group", owner.ID)
+	other, _ := env.CreateTestGroup("Other Group", outsider.ID)
+	ownerCtx := context.WithValue(context.WithValue(context.Background(), "user_id", owner.ID), "username", owner.Username)
+
+	params, _ := json.Marshal(WebhookCreateParams{
+		Scope: models.WebhookScopeGroup, GroupID: group.ID,
+		URL: server.URL, Events: []string{"message.created"},
+	})
+	result, err := NewWebhookCreateMethod(env.Storage, dispatcher, env.Config.WebhookConfiguration).Execute(ownerCtx, params)
+	if err != nil {
+		t.Fatalf("Create webhook failed: %v", err)
+	}
+	hook := result.(map[string]interface{})["webhook"].(*models.Webhook)
+	secret := result.(map[string]interface{})["secret"].(string)
+
+	// Only messages of the webhook's group are delivered
+	send := NewMessageSendMethod(env.Storage, env.Hub)
+	outsiderCtx := context.WithValue(context.WithValue(context.Background(), "user_id", outsider.ID), "username", outsider.Username)
+	params, _ = json.Marshal(MessageSendParams{GroupID: other.ID, Content: "elsewhere"})
+	send.Execute(outsiderCtx, params)
+	params, _ = json.Marshal(MessageSendParams{GroupID: group.ID, Content: "hello"})
+	if _, err := send.Execute(ownerCtx, params); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	first := waitForDelivery(t, env, func(d models.WebhookDelivery) bool { return d.Attempts == 1 })
+	if first.Status != models.WebhookDeliveryPending || first.ResponseCode != http.StatusInternalServerError || first.NextAttemptAt == nil {
+		t.Errorf("Failed attempt should be scheduled for a retry: %+v", first)
+	}
+
+	// Make the retry due now
+	env.DB.Model(&first).Update("next_attempt_at", time.Now().Add(-time.Second))
+	dispatcher.retryDue()
+
+	var retried models.WebhookDelivery
+	env.DB.First(&retried, first.ID)
+	if retried.Status != models.WebhookDeliverySucceeded || retried.Attempts != 2 || retried.DeliveredAt == nil {
+		t.Errorf("Retry should succeed: %+v", retried)
+	}
+
+	mu.Lock()
+	timestamp, _ := strconv.ParseInt(lastHeader.Get(webhookTimestampHeader), 10, 64)
+	if lastHeader.Get(webhookSignatureHeader) != signWebhook(secret, timestamp, lastBody) {
+		t.Error("Signature does not match the body")
+	}
+	if lastHeader.Get(webhookEventHeader) != "message.created" || lastHeader.Get(webhookDeliveryHeader) != strconv.FormatInt(first.ID, 10) {
+		t.Errorf("Unexpected headers: %v", lastHeader)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(lastBody, &payload); err != nil || payload.Data.Content != "hello" {
+		t.Errorf("Unexpected payload: %s", lastBody)
+	}
+	mu.Unlock()
+
+	var count int64
+	env.DB.Model(&models.WebhookDelivery{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected one delivery, got %d", count)
+	}
+
+	// Replay creates a new delivery of the same payload
+	params, _ = json.Marshal(WebhookReplayParams{DeliveryID: first.ID})
+	replayResult, err := NewWebhookReplayMethod(env.Storage, dispatcher).Execute(ownerCtx, params)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	replayID := replayResult.(*models.WebhookDelivery).ID
+	replayed := waitForDelivery(t, env, func(d models.WebhookDelivery) bool {
+		return d.ID == replayID && d.Status == models.WebhookDeliverySucceeded
+	})
+	if replayed.ReplayOf == nil || *replayed.ReplayOf != first.ID || replayed.Payload != first.Payload {
+		t.Errorf("Unexpected replay: %+v", replayed)
+	}
+
+	params, _ = json.Marshal(WebhookDeliveriesParams{WebhookID: hook.ID})
+	listed, err := NewWebhookDeliveriesMethod(env.Storage).Execute(ownerCtx, params)
+	if err != nil || listed.(map[string]interface{})["total"].(int64) != 2 {
+		t.Errorf("Expected two logged deliveries, got %v, %v", listed, err)
+	}
+}
+
+func TestWebhookDispatcher_GivesUp(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	owner, _ := env.CreateTestUser("giveupowner", "password123")
+	hook := &models.Webhook{OwnerID: owner.ID, Scope: models.WebhookScopeUser, URL: server.URL, Secret: "s", Events: "friend.accepted", Active: true}
+	env.DB.Create(hook)
+
+	dispatcher := newWebhookDispatcher(env.DB, config.WebhookConfiguration{MaxAttempts: 2, AllowPrivateNetworks: true})
+	dispatcher.dispatch(webhookJob{
+		event: models.WebhookEventFriendAccepted,
+		msg:   &ws.Message{Type: "friend_accepted", ReceiverID: owner.ID},
+		hooks: []models.Webhook{*hook},
+	})
+
+	var delivery models.WebhookDelivery
+	env.DB.First(&delivery)
+	env.DB.Model(&delivery).Update("next_attempt_at", time.Now().Add(-time.Second))
+	dispatcher.retryDue()
+
+	var failed models.WebhookDelivery
+	env.DB.First(&failed, delivery.ID)
+	if failed.Status != models.WebhookDeliveryFailed || failed.Attempts != 2 || failed.NextAttemptAt != nil {
+		t.Errorf("Delivery should fail after the last attempt: %+v", failed)
+	}
+}
+
+func TestUserDeleteAccountMethod_Webhooks(t *testing.T) {
+	env, err := SetupTestEnv()
+	if err != nil {
+		t.Fatalf("Failed to setup test env: %v", err)
+	}
+	env.Config.ExportConfiguration.SavePath = t.TempDir()
+
+	user, _ := env.CreateTestUser("hookleaving", "password123")
+	solo, _ := env.CreateTestGroup("Solo Hooks", user.ID)
+	groupHook := &models.Webhook{OwnerID: user.ID, Scope: models.WebhookScopeGroup, GroupID: &solo.ID, URL: "https://example.com/g", Secret: "s", Events: "message.created", Active: true}
+	userHook := &models.Webhook{OwnerID: user.ID, Scope: models.WebhookScopeUser, URL: "https://example.com/u", Secret: "s", Events: "message.created", Active: true}
+	env.DB.Create(groupHook)
+	env.DB.Create(userHook)
+	env.DB.Create(&models.WebhookDelivery{WebhookID: groupHook.ID, Event: models.WebhookEventMessageCreated, Payload: "{}"})
+
+	dispatcher := newWebhookDispatcher(env.DB, config.WebhookConfiguration{})
+	dispatcher.reload()
+
+	ctx := context.WithValue(context.Background(), "user_id", user.ID)
+	params, _ := json.Marshal(UserDeleteAccountParams{Password: "password123"})
+	if _, err := NewUserDeleteAccountMethod(env.Storage, env.Hub, nil, dispatcher, env.Config.ExportConfiguration).Execute(ctx, params); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	// The dissolved group's webhook is gone with its deliveries
+	var count int64
+	env.DB.Model(&models.Webhook{}).Where("id = ?", groupHook.ID).Count(&count)
+	if count != 0 {
+		t.Error("Webhook of the dissolved group should be deleted")
+	}
+	env.DB.Model(&models.WebhookDelivery{}).Count(&count)
+	if count != 0 {
+		t.Error("Deliveries of the deleted webhook should be deleted")
+	}
+
+	dispatcher.mu.RLock()
+	active := len(dispatcher.hooks)
+	dispatcher.mu.RUnlock()
+	if active != 0 {
+		t.Errorf("Dispatcher should no longer hold the user's webhooks, has %d", active)
+	}
+}
+
+func TestNewWebhookClient_PrivateNetworks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	if _, err := newWebhookClient(time.Second, false).Post(server.URL, "application/json", nil); !errors.Is(err, errWebhookAddressForbidden) {
+		t.Errorf("Loopback should be refused, got %v", err)
+	}
+	res, err := newWebhookClient(time.Second, true).Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("Allowed private networks should connect: %v", err)
+	}
+	res.Body.Close()
+
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "::1", "fe80::1", "0.0.0.0"} {
+		if publicAddress(net.ParseIP(addr)) {
+			t.Errorf("%s should not be public", addr)
+		}
+	}
+	if !publicAddress(net.ParseIP("93.184.216.34")) {
+		t.Error("Public address should be allowed")
+	}
+}
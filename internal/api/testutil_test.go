@@ -1,11 +1,14 @@
 package api
 
 import (
+	"context"
+	"simple_im/internal/conf"
 	"simple_im/internal/models"
 	"simple_im/internal/storage"
 	"simple_im/internal/ws"
 	"simple_im/pkg/common/jwt"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -18,6 +21,8 @@ type TestEnv struct {
 	Storage    *storage.Storage
 	Hub        *ws.Hub
 	JWTManager *jwt.JWTManager
+	Redis      *miniredis.Miniredis
+	Config     conf.Config
 }
 
 // SetupTestEnv creates a test environment with SQLite in-memory database
@@ -34,21 +39,40 @@ func SetupTestEnv() (*TestEnv, error) {
 	err = db.AutoMigrate(
 		&models.User{},
 		&models.Friend{},
+		&models.Block{},
+		&models.TwoFactor{},
+		&models.RecoveryCode{},
+		&models.UserIdentity{},
+		&models.Bot{},
+		&models.APIToken{},
+		&models.Webhook{},
+		&models.WebhookDelivery{},
+		&models.IncomingWebhook{},
+		&models.FriendRemark{},
+		&models.FriendTag{},
 		&models.Group{},
 		&models.GroupMember{},
+		&models.GroupAnnouncement{},
+		&models.GroupTag{},
+		&models.GroupJoinRequest{},
 		&models.Message{},
 		&models.File{},
+		&models.AuditLog{},
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create mock Redis client (nil for tests that don't need Redis)
-	var redisClient *redis.Client = nil
+	// In-memory Redis server, closed when the process exits
+	mr, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
 
 	st := storage.NewStorage(redisClient, db)
 	hub := ws.NewHub()
-	jwtManager := jwt.NewJWTManager("test_secret", 3600)
+	jwtManager := jwt.NewJWTManager("test_secret", 3600, 86400)
 
 	go hub.Run()
 
@@ -57,6 +81,7 @@ func SetupTestEnv() (*TestEnv, error) {
 		Storage:    st,
 		Hub:        hub,
 		JWTManager: jwtManager,
+		Redis:      mr,
 	}, nil
 }
 
@@ -77,6 +102,15 @@ func (env *TestEnv) CreateTestUser(username, password string) (*models.User, err
 	return user, nil
 }
 
+// CreateTestToken logs the user in and returns the access token
+func (env *TestEnv) CreateTestToken(user *models.User) (string, error) {
+	tokens, err := issueToken(context.Background(), env.Storage, env.JWTManager, user, "test")
+	if err != nil {
+		return "", err
+	}
+	return tokens.AccessToken, nil
+}
+
 // CreateTestFriendship creates a friendship between two users
 func (env *TestEnv) CreateTestFriendship(userID, friendID int64, status models.FriendStatus) error {
 	friend := &models.Friend{
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"simple_im/internal/models"
+	"simple_im/pkg/common/config"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultExportPath   = "./exports"
+	defaultExportExpire = 86400 // seconds
+	exportMessageBatch  = 500
+)
+
+func exportDir(c config.ExportConfiguration) string {
+	if c.SavePath == "" {
+		return defaultExportPath
+	}
+	return c.SavePath
+}
+
+func exportExpire(c config.ExportConfiguration) time.Duration {
+	if c.Expire <= 0 {
+		return defaultExportExpire * time.Second
+	}
+	return time.Duration(c.Expire) * time.Second
+}
+
+// exportArchivePath returns the file of an export, the user id prefix lets
+// removeExports find all archives of a user
+func exportArchivePath(c config.ExportConfiguration, userID int64, exportID string) string {
+	return filepath.Join(exportDir(c), fmt.Sprintf("%d_%s.zip", userID, exportID))
+}
+
+// removeExports deletes every archive of userID and any archive that expired
+func removeExports(c config.ExportConfiguration, userID int64) {
+	entries, err := os.ReadDir(exportDir(c))
+	if err != nil {
+		return
+	}
+
+	prefix := fmt.Sprintf("%d_", userID)
+	cutoff := time.Now().Add(-exportExpire(c))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".zip" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), prefix) || info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(exportDir(c), entry.Name()))
+		}
+	}
+}
+
+// writeUserArchive writes everything stored about a user as a zip: JSON
+// files for the profile, friends, blocks, groups and messages plus the
+// uploaded files under files/
+func writeUserArchive(w io.Writer, db *gorm.DB, user *models.User) error {
+	zw := zip.NewWriter(w)
+
+	writeJSON := func(name string, v interface{}) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	var twoFactor int64
+	db.Model(&models.TwoFactor{}).Where("user_id = ? AND enabled = ?", user.ID, true).Count(&twoFactor)
+	if err := writeJSON("profile.json", map[string]interface{}{
+		"user":               newFullProfile(user),
+		"two_factor_enabled": twoFactor > 0,
+		"exported_at":        time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	var friends []models.Friend
+	db.Preload("User").Preload("Friend").
+		Where("user_id = ? OR friend_id = ?", user.ID, user.ID).
+		Order("id ASC").Find(&friends)
+	remarks, tags := loadFriendLabels(db, user.ID)
+	friendList := make([]map[string]interface{}, 0, len(friends))
+	for _, f := range friends {
+		other, outgoing := f.Friend, true
+		if f.FriendID == user.ID {
+			other, outgoing = f.User, false
+		}
+		if other == nil {
+			continue
+		}
+		friendList = append(friendList, map[string]interface{}{
+			"user_id":    other.ID,
+			"username":   other.Username,
+			"nickname":   other.Nickname,
+			"status":     f.Status,
+			"outgoing":   outgoing,
+			"message":    f.Message,
+			"remark":     remarks[other.ID],
+			"tags":       tags[other.ID],
+			"created_at": f.CreatedAt,
+			"updated_at": f.UpdatedAt,
+		})
+	}
+	if err := writeJSON("friends.json", friendList); err != nil {
+		return err
+	}
+
+	var blocks []models.Block
+	db.Preload("Blocked").Where("user_id = ?", user.ID).Order("id ASC").Find(&blocks)
+	blockList := make([]map[string]interface{}, 0, len(blocks))
+	for _, b := range blocks {
+		entry := map[string]interface{}{
+			"user_id":    b.BlockedID,
+			"created_at": b.CreatedAt,
+		}
+		if b.Blocked != nil {
+			entry["username"] = b.Blocked.Username
+		}
+		blockList = append(blockList, entry)
+	}
+	if err := writeJSON("blocks.json", blockList); err != nil {
+		return err
+	}
+
+	var memberships []models.GroupMember
+	db.Preload("Group").Where("user_id = ?", user.ID).Order("id ASC").Find(&memberships)
+	groupList := make([]map[string]interface{}, 0, len(memberships))
+	for _, m := range memberships {
+		if m.Group == nil {
+			continue
+		}
+		groupList = append(groupList, map[string]interface{}{
+			"group_id":  m.GroupID,
+			"name":      m.Group.Name,
+			"role":      m.Role,
+			"nickname":  m.Nickname,
+			"joined_at": m.JoinedAt,
+		})
+	}
+	if err := writeJSON("groups.json", groupList); err != nil {
+		return err
+	}
+
+	if err := writeArchiveMessages(zw, db, user.ID); err != nil {
+		return err
+	}
+
+	var files []models.File
+	db.Where("user_id = ?", user.ID).Order("id ASC").Find(&files)
+	fileList := make([]map[string]interface{}, 0, len(files))
+	for _, f := range files {
+		entry := map[string]interface{}{
+			"id":         f.ID,
+			"filename":   f.Filename,
+			"size":       f.Filesize,
+			"mimetype":   f.Mimetype,
+			"created_at": f.CreatedAt,
+		}
+		name := fmt.Sprintf("files/%d_%s", f.ID, filepath.Base(f.Filename))
+		if err := copyIntoArchive(zw, name, f.Filepath); err == nil {
+			entry["path"] = name
+		}
+		fileList = append(fileList, entry)
+	}
+	if err := writeJSON("files.json", fileList); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// writeArchiveMessages streams the messages the user sent or received
+// privately into messages.json, batch by batch to keep memory flat
+func writeArchiveMessages(zw *zip.Writer, db *gorm.DB, userID int64) error {
+	f, err := zw.Create("messages.json")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, "["); err != nil {
+		return err
+	}
+
+	first := true
+	var messages []models.Message
+	result := db.Where("sender_id = ? OR receiver_id = ?", userID, userID).
+		Order("id ASC").
+		FindInBatches(&messages, exportMessageBatch, func(tx *gorm.DB, batch int) error {
+			for i := range messages {
+				data, err := json.Marshal(&messages[i])
+				if err != nil {
+					return err
+				}
+				if !first {
+					if _, err := io.WriteString(f, ","); err != nil {
+						return err
+					}
+				}
+				first = false
+				if _, err := f.Write(data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	_, err = io.WriteString(f, "]\n")
+	return err
+}
+
+func copyIntoArchive(zw *zip.Writer, name, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"time"
+
+	"simple_im/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// userProfile is a user as other users see it, the avatar and last seen time
+// only when the owner's visibility settings allow
+type userProfile struct {
+	ID         int64      `json:"id"`
+	Username   string     `json:"username"`
+	Nickname   string     `json:"nickname"`
+	Avatar     string     `json:"avatar"`
+	IsBot      bool       `json:"is_bot"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// newUserProfile projects u for viewerID, isFriend tells whether the two are friends
+func newUserProfile(u *models.User, viewerID int64, isFriend bool) *userProfile {
+	profile := &userProfile{
+		ID:        u.ID,
+		Username:  u.Username,
+		Nickname:  u.Nickname,
+		Avatar:    visibleAvatar(u, viewerID, isFriend),
+		IsBot:     u.IsBot,
+		CreatedAt: u.CreatedAt,
+	}
+	if u.LastSeenVisibility.VisibleTo(u.ID == viewerID, isFriend) {
+		profile.LastSeenAt = u.LastSeenAt
+	}
+	return profile
+}
+
+// visibleAvatar returns the avatar of u if viewerID may see it, every
+// response showing other users' avatars goes through it
+func visibleAvatar(u *models.User, viewerID int64, isFriend bool) string {
+	if !u.AvatarVisibility.VisibleTo(u.ID == viewerID, isFriend) {
+		return ""
+	}
+	return u.Avatar
+}
+
+// fullProfile is the user with the privacy settings and last seen time
+// models.User keeps out of JSON, only for the user themselves and admins
+type fullProfile struct {
+	*models.User
+	Discoverable        bool                       `json:"discoverable"`
+	FriendRequestPolicy models.FriendRequestPolicy `json:"friend_request_policy"`
+	AvatarVisibility    models.Visibility          `json:"avatar_visibility"`
+	LastSeenVisibility  models.Visibility          `json:"last_seen_visibility"`
+	AllowStrangerChat   bool                       `json:"allow_stranger_chat"`
+	LastSeenAt          *time.Time                 `json:"last_seen_at"`
+}
+
+func newFullProfile(u *models.User) *fullProfile {
+	return &fullProfile{
+		User:                u,
+		Discoverable:        u.Discoverable,
+		FriendRequestPolicy: u.FriendRequestPolicy,
+		AvatarVisibility:    u.AvatarVisibility,
+		LastSeenVisibility:  u.LastSeenVisibility,
+		AllowStrangerChat:   u.AllowStrangerChat,
+		LastSeenAt:          u.LastSeenAt,
+	}
+}
+
+// friendsAmong returns which of userIDs are accepted friends of userID
+func friendsAmong(db *gorm.DB, userID int64, userIDs []int64) map[int64]bool {
+	friends := make(map[int64]bool, len(userIDs))
+	if len(userIDs) == 0 {
+		return friends
+	}
+
+	var rows []models.Friend
+	db.Where("((user_id = ? AND friend_id IN ?) OR (friend_id = ? AND user_id IN ?)) AND status = ?",
+		userID, userIDs, userID, userIDs, models.FriendStatusAccepted).Find(&rows)
+	for _, f := range rows {
+		if f.UserID == userID {
+			friends[f.FriendID] = true
+		} else {
+			friends[f.UserID] = true
+		}
+	}
+	return friends
+}
@@ -0,0 +1,316 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"simple_im/internal/models"
+	"simple_im/internal/ws"
+	"simple_im/pkg/common/config"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultWebhookMaxAttempts = 6
+	defaultWebhookRetryBase   = 30 * time.Second
+	defaultWebhookTimeout     = 10 * time.Second
+	webhookRetryInterval      = 10 * time.Second // How often due retries are looked for
+	webhookRetryBatch         = 100
+	webhookQueueSize          = 1024
+	webhookWorkers            = 4
+
+	webhookEventHeader    = "X-SimpleIM-Event"
+	webhookDeliveryHeader = "X-SimpleIM-Delivery" // Same for every attempt, receivers can drop duplicates
+)
+
+// webhookPayload is the body of a delivery, Data is what WebSocket clients
+// receive for the event
+type webhookPayload struct {
+	Event     models.WebhookEvent `json:"event"`
+	CreatedAt time.Time           `json:"created_at"`
+	Data      *ws.Message         `json:"data"`
+}
+
+// webhookEventOf maps a hub message to its webhook event, messages without
+// one are not sent to webhooks
+func webhookEventOf(msg *ws.Message) models.WebhookEvent {
+	switch msg.Type {
+	case "message":
+		if msg.MsgType != ws.MsgTypeSystem {
+			return models.WebhookEventMessageCreated
+		}
+		var payload models.SystemPayload
+		if json.Unmarshal([]byte(msg.Content), &payload) != nil {
+			return ""
+		}
+		switch payload.Event {
+		case models.SystemEventMemberJoined, models.SystemEventMemberInvited:
+			return models.WebhookEventMemberJoined
+		case models.SystemEventMemberLeft, models.SystemEventMemberRemoved:
+			return models.WebhookEventMemberLeft
+		}
+	case "message_deleted":
+		return models.WebhookEventMessageDeleted
+	case "friend_request":
+		return models.WebhookEventFriendRequested
+	case "friend_accepted":
+		return models.WebhookEventFriendAccepted
+	}
+	return ""
+}
+
+// webhookSees reports whether the event falls in the scope of the webhook
+func webhookSees(hook *models.Webhook, msg *ws.Message) bool {
+	switch hook.Scope {
+	case models.WebhookScopeGlobal:
+		return true
+	case models.WebhookScopeGroup:
+		return hook.GroupID != nil && msg.GroupID == *hook.GroupID
+	case models.WebhookScopeUser:
+		if msg.SenderID == hook.OwnerID || msg.ReceiverID == hook.OwnerID {
+			return true
+		}
+		for _, id := range msg.GroupMembers {
+			if id == hook.OwnerID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type webhookJob struct {
+	event models.WebhookEvent
+	msg   *ws.Message
+	hooks []models.Webhook
+}
+
+// webhookDispatcher sends hub events to outgoing webhooks. Every delivery is
+// stored before it is attempted, failed ones are retried with exponential
+// backoff from the database so restarts don't lose them.
+type webhookDispatcher struct {
+	db          *gorm.DB
+	client      *http.Client
+	maxAttempts int
+	retryBase   time.Duration
+	queue       chan webhookJob
+
+	mu    sync.RWMutex
+	hooks []models.Webhook // Active webhooks
+}
+
+func newWebhookDispatcher(db *gorm.DB, c config.WebhookConfiguration) *webhookDispatcher {
+	timeout := defaultWebhookTimeout
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout) * time.Second
+	}
+	d := &webhookDispatcher{
+		db:          db,
+		client:      newWebhookClient(timeout, c.AllowPrivateNetworks),
+		maxAttempts: c.MaxAttempts,
+		retryBase:   time.Duration(c.RetryBase) * time.Second,
+		queue:       make(chan webhookJob, webhookQueueSize),
+	}
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = defaultWebhookMaxAttempts
+	}
+	if d.retryBase <= 0 {
+		d.retryBase = defaultWebhookRetryBase
+	}
+	return d
+}
+
+// reload reads the active webhooks, called after every change
+func (d *webhookDispatcher) reload() error {
+	if d == nil {
+		return nil
+	}
+	var hooks []models.Webhook
+	if err := d.db.Where("active = ?", true).Find(&hooks).Error; err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.hooks = hooks
+	d.mu.Unlock()
+	return nil
+}
+
+// observe is the hub's OnBroadcast hook
+func (d *webhookDispatcher) observe(msg *ws.Message) {
+	event := webhookEventOf(msg)
+	if event == "" {
+		return
+	}
+
+	var matched []models.Webhook
+	d.mu.RLock()
+	for i := range d.hooks {
+		if d.hooks[i].Subscribes(event) && webhookSees(&d.hooks[i], msg) {
+			matched = append(matched, d.hooks[i])
+		}
+	}
+	d.mu.RUnlock()
+	if len(matched) == 0 {
+		return
+	}
+
+	select {
+	case d.queue <- webhookJob{event: event, msg: msg, hooks: matched}:
+	default:
+		log.Warn().Str("event", string(event)).Msg("webhook queue full, event dropped")
+	}
+}
+
+func (d *webhookDispatcher) run() {
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for job := range d.queue {
+				d.dispatch(job)
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(webhookRetryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			d.retryDue()
+		}
+	}()
+}
+
+func (d *webhookDispatcher) dispatch(job webhookJob) {
+	payload, err := json.Marshal(webhookPayload{Event: job.event, CreatedAt: job.msg.CreatedAt, Data: job.msg})
+	if err != nil {
+		log.Error().Err(err).Str("event", string(job.event)).Msg("failed to encode webhook payload")
+		return
+	}
+
+	for i := range job.hooks {
+		// The first retry time doubles as a lease, a delivery lost to a
+		// restart before its attempt is picked up by retryDue
+		next := time.Now().Add(d.retryBase)
+		delivery := &models.WebhookDelivery{
+			WebhookID:     job.hooks[i].ID,
+			Event:         job.event,
+			Payload:       string(payload),
+			NextAttemptAt: &next,
+		}
+		if err := d.db.Create(delivery).Error; err != nil {
+			log.Error().Err(err).Int64("webhook_id", job.hooks[i].ID).Msg("failed to record webhook delivery")
+			continue
+		}
+		d.attempt(delivery, &job.hooks[i])
+	}
+}
+
+// attempt posts the delivery once and records the outcome
+func (d *webhookDispatcher) attempt(delivery *models.WebhookDelivery, hook *models.Webhook) {
+	code, err := d.post(delivery, hook)
+
+	now := time.Now()
+	delivery.Attempts++
+	delivery.ResponseCode = code
+	delivery.Error = ""
+	switch {
+	case err == nil:
+		delivery.Status = models.WebhookDeliverySucceeded
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+	case delivery.Attempts >= d.maxAttempts:
+		delivery.Status = models.WebhookDeliveryFailed
+		delivery.Error = truncateRunes(err.Error(), 255)
+		delivery.NextAttemptAt = nil
+	default:
+		next := now.Add(d.retryBase << (delivery.Attempts - 1))
+		delivery.Error = truncateRunes(err.Error(), 255)
+		delivery.NextAttemptAt = &next
+	}
+
+	err = d.db.Model(delivery).
+		Select("status", "attempts", "response_code", "error", "delivered_at", "next_attempt_at").
+		Updates(delivery).Error
+	if err != nil {
+		log.Error().Err(err).Int64("delivery_id", delivery.ID).Msg("failed to update webhook delivery")
+	}
+}
+
+func (d *webhookDispatcher) post(delivery *models.WebhookDelivery, hook *models.Webhook) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, string(delivery.Event))
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(hook.Secret, timestamp, body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// retryDue attempts the pending deliveries whose retry time has come
+func (d *webhookDispatcher) retryDue() {
+	var due []models.WebhookDelivery
+	err := d.db.Where("status = ? AND next_attempt_at <= ?", models.WebhookDeliveryPending, time.Now()).
+		Order("next_attempt_at").Limit(webhookRetryBatch).Find(&due).Error
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find due webhook deliveries")
+		return
+	}
+
+	for i := range due {
+		var hook models.Webhook
+		if err := d.db.Where("active = ?", true).First(&hook, due[i].WebhookID).Error; err != nil {
+			// Disabled or deleted meanwhile
+			d.db.Model(&due[i]).Updates(map[string]interface{}{
+				"status":          models.WebhookDeliveryFailed,
+				"error":           "webhook disabled",
+				"next_attempt_at": nil,
+			})
+			continue
+		}
+		d.attempt(&due[i], &hook)
+	}
+}
+
+// replay sends the payload of a past delivery again as a new delivery
+func (d *webhookDispatcher) replay(original *models.WebhookDelivery, hook *models.Webhook) (*models.WebhookDelivery, error) {
+	if !hook.Active {
+		return nil, errors.New("webhook is disabled")
+	}
+
+	next := time.Now().Add(d.retryBase)
+	delivery := &models.WebhookDelivery{
+		WebhookID:     original.WebhookID,
+		Event:         original.Event,
+		Payload:       original.Payload,
+		NextAttemptAt: &next,
+		ReplayOf:      &original.ID,
+	}
+	if err := d.db.Create(delivery).Error; err != nil {
+		return nil, fmt.Errorf("failed to record delivery: %v", err)
+	}
+
+	attempted := *delivery
+	go d.attempt(&attempted, hook)
+	return delivery, nil
+}
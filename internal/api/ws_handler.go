@@ -3,8 +3,11 @@ package api
 import (
 	"net/http"
 	"strings"
+	"time"
 
+	"simple_im/internal/models"
 	"simple_im/internal/ws"
+	"simple_im/pkg/common/jwt"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -38,7 +41,7 @@ func (a *ApiServer) WebSocket(ctx *gin.Context) {
 		return
 	}
 
-	claims, err := a.jwtManager.ParseToken(token)
+	claims, err := a.parseSocketToken(token)
 	if err != nil {
 		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
 		return
@@ -50,11 +53,46 @@ func (a *ApiServer) WebSocket(ctx *gin.Context) {
 		return
 	}
 
-	client := ws.NewClient(a.hub, conn, claims.UserID, claims.Username)
+	client := ws.NewClient(a.hub, conn, claims.UserID, claims.Username, claims.ID)
+	if claims.ExpiresAt != nil {
+		client.EnableReauth(claims.ExpiresAt.Time, a.rpcHandler.ParseToken)
+	}
 	a.hub.Register(client)
+	a.touchLastSeen(claims.UserID)
 
 	go client.WritePump()
-	go client.ReadPump()
+	go func() {
+		client.ReadPump()
+		a.touchLastSeen(claims.UserID)
+	}()
 
 	log.Info().Int64("user_id", claims.UserID).Str("username", claims.Username).Msg("websocket client connected")
 }
+
+// parseSocketToken accepts access tokens and bot API tokens with the events
+// scope. Bot connections get no expiry, revoking the token closes them.
+func (a *ApiServer) parseSocketToken(token string) (*jwt.Claims, error) {
+	if !strings.HasPrefix(token, models.APITokenPrefix) {
+		return a.rpcHandler.ParseToken(token)
+	}
+
+	apiToken, err := a.rpcHandler.ParseAPIToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if !apiToken.HasScope(models.ScopeEvents) {
+		return nil, ErrAPITokenInvalid
+	}
+
+	claims := &jwt.Claims{UserID: apiToken.UserID, Username: apiToken.User.Username}
+	claims.ID = apiTokenSessionID(apiToken.ID)
+	return claims, nil
+}
+
+// touchLastSeen records when the user was last connected
+func (a *ApiServer) touchLastSeen(userID int64) {
+	err := a.storage.GetDB().Model(&models.User{}).Where("id = ?", userID).Update("last_seen_at", time.Now()).Error
+	if err != nil {
+		log.Error().Err(err).Int64("user_id", userID).Msg("failed to update last seen")
+	}
+}
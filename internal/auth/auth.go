@@ -0,0 +1,78 @@
+// Package auth checks login credentials against the local password hashes
+// and external directories.
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"simple_im/internal/models"
+	"simple_im/pkg/common/config"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidCredentials is returned when a backend does not accept the
+// username and password, whether the user is unknown or the password wrong
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// Authenticator checks a username and password and returns the local
+// account they belong to. Backends that know users the database does not
+// provision the account on the first successful login.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (*models.User, error)
+}
+
+// New returns the authenticator for the configured backends, LDAP first
+// when it is configured and local passwords after it
+func New(db *gorm.DB, c config.LDAPConfiguration) Authenticator {
+	local := NewLocal(db)
+	if directory := NewLDAP(db, c); directory != nil {
+		return Chain{directory, local}
+	}
+	return local
+}
+
+// Local checks the bcrypt hash stored by User.SetPassword
+type Local struct {
+	db *gorm.DB
+}
+
+func NewLocal(db *gorm.DB) *Local {
+	return &Local{db: db}
+}
+
+func (a *Local) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	var user models.User
+	if err := a.db.WithContext(ctx).Where("username = ?", username).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	// Bots authenticate with API tokens only
+	if user.IsBot || !user.CheckPassword(password) {
+		return nil, ErrInvalidCredentials
+	}
+	return &user, nil
+}
+
+// Chain asks each backend in turn, the first one accepting the credentials
+// wins. A failing backend is logged and skipped so an unreachable directory
+// does not block local accounts.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	for _, a := range c {
+		user, err := a.Authenticate(ctx, username, password)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, ErrInvalidCredentials) {
+			log.Warn().Err(err).Str("username", username).Msg("authentication backend failed")
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"simple_im/internal/models"
+	"simple_im/pkg/common/config"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.User{}, &models.UserIdentity{}); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	return db
+}
+
+func TestLocal_Authenticate(t *testing.T) {
+	db := setupTestDB(t)
+	user := &models.User{Username: "local", Nickname: "local"}
+	user.SetPassword("password123")
+	db.Create(user)
+
+	a := NewLocal(db)
+	ctx := context.Background()
+
+	got, err := a.Authenticate(ctx, "local", "password123")
+	if err != nil || got.ID != user.ID {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	if _, err := a.Authenticate(ctx, "local", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected invalid credentials, got %v", err)
+	}
+	if _, err := a.Authenticate(ctx, "nobody", "password123"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected invalid credentials, got %v", err)
+	}
+}
+
+func TestProvision(t *testing.T) {
+	db := setupTestDB(t)
+	identity := ExternalIdentity{Provider: "https://idp.example", Subject: "42", Username: "erin", Nickname: "Erin"}
+
+	user, err := Provision(db, identity, false)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	// The same subject maps to the same account, the username claim is ignored
+	identity.Username = "renamed"
+	again, err := Provision(db, identity, false)
+	if err != nil || again.ID != user.ID {
+		t.Errorf("Expected the linked account, got %v", err)
+	}
+
+	if _, err := Provision(db, ExternalIdentity{Provider: "x", Subject: "1", Username: "ab"}, false); err == nil {
+		t.Error("Expected short username to be refused")
+	}
+}
+
+func TestProvision_LinkExisting(t *testing.T) {
+	db := setupTestDB(t)
+	member := &models.User{Username: "member", Nickname: "member"}
+	admin := &models.User{Username: "root", Nickname: "root", Role: models.UserRoleAdmin}
+	db.Create(member)
+	db.Create(admin)
+
+	if _, err := Provision(db, ExternalIdentity{Provider: "ldap", Subject: "a", Username: "member"}, false); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("Expected taken username without linking, got %v", err)
+	}
+	linked, err := Provision(db, ExternalIdentity{Provider: "ldap", Subject: "b", Username: "member"}, true)
+	if err != nil || linked.ID != member.ID {
+		t.Errorf("Expected the local account to be linked, got %v", err)
+	}
+
+	// Whoever controls the username at the provider must not get an admin account
+	if _, err := Provision(db, ExternalIdentity{Provider: "ldap", Subject: "c", Username: "root"}, true); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("Admin accounts should not be linked, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	db := setupTestDB(t)
+	if _, ok := New(db, config.LDAPConfiguration{}).(*Local); !ok {
+		t.Error("Expected local authentication without LDAP")
+	}
+	if _, ok := New(db, config.LDAPConfiguration{URL: "ldap://localhost"}).(Chain); !ok {
+		t.Error("Expected a chain with LDAP configured")
+	}
+}
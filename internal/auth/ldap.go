@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"simple_im/internal/models"
+	"simple_im/pkg/common/config"
+
+	"github.com/go-ldap/ldap/v3"
+	"gorm.io/gorm"
+)
+
+// LDAPProvider is the UserIdentity provider of directory accounts
+const LDAPProvider = "ldap"
+
+// ErrNotInGroup means the directory knows the user but none of the required
+// groups lists them, callers see it as wrong credentials
+var ErrNotInGroup = fmt.Errorf("%w: not in a permitted group", ErrInvalidCredentials)
+
+const (
+	defaultLDAPUserFilter  = "(uid=%s)"
+	defaultLDAPGroupFilter = "(|(member=%[1]s)(uniqueMember=%[1]s)(memberUid=%[2]s))"
+	defaultLDAPTimeout     = 10 * time.Second
+)
+
+// LDAP finds the user with the service account, binds as the user to check
+// the password and, when groups are required, checks the membership
+type LDAP struct {
+	db   *gorm.DB
+	conf config.LDAPConfiguration
+}
+
+// NewLDAP returns nil when no directory is configured
+func NewLDAP(db *gorm.DB, c config.LDAPConfiguration) *LDAP {
+	if c.URL == "" {
+		return nil
+	}
+	return &LDAP{db: db, conf: c}
+}
+
+func (a *LDAP) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	// An empty password would be an unauthenticated bind, which servers accept
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := a.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	entry, err := a.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.checkGroups(conn, entry); err != nil {
+		return nil, err
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap bind failed: %v", err)
+	}
+
+	name := entry.GetAttributeValue(a.usernameAttribute())
+	if name == "" {
+		return nil, fmt.Errorf("ldap entry %s has no %s", entry.DN, a.usernameAttribute())
+	}
+	nickname := entry.GetAttributeValue(a.nicknameAttribute())
+	if nickname == "" {
+		nickname = entry.GetAttributeValue("cn")
+	}
+
+	return Provision(a.db.WithContext(ctx), ExternalIdentity{
+		Provider: LDAPProvider,
+		Subject:  strings.ToLower(name),
+		Username: name,
+		Nickname: nickname,
+	}, a.conf.LinkExisting)
+}
+
+func (a *LDAP) dial() (*ldap.Conn, error) {
+	timeout := defaultLDAPTimeout
+	if a.conf.Timeout > 0 {
+		timeout = time.Duration(a.conf.Timeout) * time.Second
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.conf.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(a.conf.URL, ldap.DialWithTLSConfig(tlsConfig), ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, fmt.Errorf("ldap dial failed: %v", err)
+	}
+	conn.SetTimeout(timeout)
+
+	if a.conf.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap starttls failed: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAP) bindService(conn *ldap.Conn) error {
+	var err error
+	if a.conf.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(a.conf.BindDN, a.conf.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("ldap service bind failed: %v", err)
+	}
+	return nil
+}
+
+// findUser returns the only entry matching the login name, unknown and
+// ambiguous names are both treated as wrong credentials
+func (a *LDAP) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := a.conf.UserFilter
+	if filter == "" {
+		filter = defaultLDAPUserFilter
+	}
+
+	req := ldap.NewSearchRequest(
+		a.conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(username)),
+		[]string{a.usernameAttribute(), a.nicknameAttribute(), "cn"},
+		nil,
+	)
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap search failed: %v", err)
+	}
+	if res == nil || len(res.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return res.Entries[0], nil
+}
+
+// checkGroups looks for the user in each required group entry
+func (a *LDAP) checkGroups(conn *ldap.Conn, entry *ldap.Entry) error {
+	if len(a.conf.RequiredGroups) == 0 {
+		return nil
+	}
+
+	filter := a.conf.GroupFilter
+	if filter == "" {
+		filter = defaultLDAPGroupFilter
+	}
+	filter = fmt.Sprintf(filter, ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(entry.GetAttributeValue(a.usernameAttribute())))
+
+	for _, group := range a.conf.RequiredGroups {
+		req := ldap.NewSearchRequest(
+			group, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+			filter, []string{"1.1"}, nil, // 1.1 asks for no attributes
+		)
+		res, err := conn.Search(req)
+		if err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				continue
+			}
+			return fmt.Errorf("ldap group search failed: %v", err)
+		}
+		if len(res.Entries) > 0 {
+			return nil
+		}
+	}
+	return ErrNotInGroup
+}
+
+func (a *LDAP) usernameAttribute() string {
+	if a.conf.UsernameAttribute == "" {
+		return "uid"
+	}
+	return a.conf.UsernameAttribute
+}
+
+func (a *LDAP) nicknameAttribute() string {
+	if a.conf.NicknameAttribute == "" {
+		return "displayName"
+	}
+	return a.conf.NicknameAttribute
+}
@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"simple_im/internal/models"
+	"simple_im/pkg/common/config"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jimlambrt/gldap"
+)
+
+const (
+	testBaseDN    = "ou=people,dc=example,dc=org"
+	testServiceDN = "cn=simple_im,ou=services,dc=example,dc=org"
+	testGroupDN   = "cn=chat,ou=groups,dc=example,dc=org"
+)
+
+// testDirectory is an in-process LDAP server with simple bind and searches
+// that evaluate equality, presence and substring filters
+type testDirectory struct {
+	entries map[string]map[string][]string // DN -> attributes
+	url     string
+}
+
+func startTestDirectory(t *testing.T) *testDirectory {
+	d := &testDirectory{entries: map[string]map[string][]string{
+		testServiceDN: {"userPassword": {"service-secret"}},
+		"uid=alice," + testBaseDN: {
+			"objectClass": {"person"}, "uid": {"alice"}, "cn": {"alice"},
+			"displayName": {"Alice Liddell"}, "userPassword": {"alice-pw"},
+		},
+		"uid=bob," + testBaseDN: {
+			"objectClass": {"person"}, "uid": {"bob"}, "cn": {"Bob B."}, "userPassword": {"bob-pw"},
+		},
+		"uid=carol," + testBaseDN: {
+			"objectClass": {"person"}, "uid": {"carol"}, "cn": {"Carol"}, "userPassword": {"carol-pw"},
+		},
+		testGroupDN: {
+			"objectClass": {"groupOfNames"},
+			"member":      {"uid=alice," + testBaseDN, "uid=carol," + testBaseDN},
+		},
+	}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server, err := gldap.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create ldap server: %v", err)
+	}
+	mux, _ := gldap.NewMux()
+	mux.Bind(d.bind)
+	mux.Search(d.search)
+	server.Router(mux)
+
+	go server.Run(addr)
+	t.Cleanup(func() { server.Stop() })
+	for deadline := time.Now().Add(5 * time.Second); !server.Ready(); {
+		if time.Now().After(deadline) {
+			t.Fatal("ldap server did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	d.url = "ldap://" + addr
+	return d
+}
+
+func (d *testDirectory) bind(w *gldap.ResponseWriter, r *gldap.Request) {
+	res := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer w.Write(res)
+
+	m, err := r.GetSimpleBindMessage()
+	if err != nil {
+		return
+	}
+	if m.UserName == "" && m.Password == "" {
+		res.SetResultCode(gldap.ResultSuccess)
+		return
+	}
+	if entry, ok := d.entries[m.UserName]; ok && len(entry["userPassword"]) > 0 && entry["userPassword"][0] == string(m.Password) {
+		res.SetResultCode(gldap.ResultSuccess)
+	}
+}
+
+func (d *testDirectory) search(w *gldap.ResponseWriter, r *gldap.Request) {
+	res := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultOperationsError))
+	defer func() { w.Write(res) }()
+
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		return
+	}
+	filter, err := ldap.CompileFilter(m.Filter)
+	if err != nil {
+		return
+	}
+
+	if _, ok := d.entries[m.BaseDN]; m.Scope == gldap.BaseObject && !ok {
+		res.SetResultCode(gldap.ResultNoSuchObject)
+		return
+	}
+	for dn, attrs := range d.entries {
+		inScope := dn == m.BaseDN
+		if m.Scope != gldap.BaseObject {
+			inScope = inScope || strings.HasSuffix(strings.ToLower(dn), ","+strings.ToLower(m.BaseDN))
+		}
+		if !inScope || !matchFilter(filter, attrs) {
+			continue
+		}
+		entry := r.NewSearchResponseEntry(dn)
+		for name, values := range attrs {
+			if name != "userPassword" {
+				entry.AddAttribute(name, values)
+			}
+		}
+		w.Write(entry)
+	}
+	res.SetResultCode(gldap.ResultSuccess)
+}
+
+func matchFilter(f *ber.Packet, attrs map[string][]string) bool {
+	values := func(name string) []string {
+		for k, v := range attrs {
+			if strings.EqualFold(k, name) {
+				return v
+			}
+		}
+		return nil
+	}
+
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, child := range f.Children {
+			if !matchFilter(child, attrs) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range f.Children {
+			if matchFilter(child, attrs) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !matchFilter(f.Children[0], attrs)
+	case ldap.FilterPresent:
+		return len(values(f.Value.(string))) > 0
+	case ldap.FilterEqualityMatch:
+		want := f.Children[1].Value.(string)
+		for _, v := range values(f.Children[0].Value.(string)) {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newTestLDAP(t *testing.T, d *testDirectory, modify func(*config.LDAPConfiguration)) *LDAP {
+	c := config.LDAPConfiguration{
+		URL:          d.url,
+		BindDN:       testServiceDN,
+		BindPassword: "service-secret",
+		BaseDN:       testBaseDN,
+		UserFilter:   "(&(objectClass=person)(uid=%s))",
+	}
+	if modify != nil {
+		modify(&c)
+	}
+	return NewLDAP(setupTestDB(t), c)
+}
+
+func TestNewLDAP_Disabled(t *testing.T) {
+	if NewLDAP(nil, config.LDAPConfiguration{}) != nil {
+		t.Error("Expected no LDAP authenticator without URL")
+	}
+}
+
+func TestLDAP_Authenticate(t *testing.T) {
+	d := startTestDirectory(t)
+	a := newTestLDAP(t, d, nil)
+	ctx := context.Background()
+
+	user, err := a.Authenticate(ctx, "alice", "alice-pw")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if user.Username != "alice" || user.Nickname != "Alice Liddell" {
+		t.Errorf("Unexpected provisioned user: %+v", user)
+	}
+
+	again, err := a.Authenticate(ctx, "ALICE", "alice-pw")
+	if err != nil || again.ID != user.ID {
+		t.Errorf("Second login should return the same account, got %v", err)
+	}
+
+	// Without displayName the nickname falls back to cn
+	bob, err := a.Authenticate(ctx, "bob", "bob-pw")
+	if err != nil || bob.Nickname != "Bob B." {
+		t.Errorf("Expected nickname from cn, got %+v, %v", bob, err)
+	}
+
+	tests := []struct{ name, username, password string }{
+		{"wrong password", "alice", "wrong"},
+		{"unknown user", "mallory", "alice-pw"},
+		{"empty password", "alice", ""},
+		{"wildcard username", "*", "alice-pw"},
+		{"filter injection", "alice)(uid=*", "alice-pw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := a.Authenticate(ctx, tt.username, tt.password); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Expected invalid credentials, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLDAP_RequiredGroups(t *testing.T) {
+	d := startTestDirectory(t)
+	a := newTestLDAP(t, d, func(c *config.LDAPConfiguration) {
+		c.RequiredGroups = []string{"cn=missing,ou=groups,dc=example,dc=org", testGroupDN}
+	})
+	ctx := context.Background()
+
+	if _, err := a.Authenticate(ctx, "alice", "alice-pw"); err != nil {
+		t.Errorf("Group member should log in: %v", err)
+	}
+
+	_, err := a.Authenticate(ctx, "bob", "bob-pw")
+	if !errors.Is(err, ErrNotInGroup) || !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected not in group, got %v", err)
+	}
+}
+
+func TestLDAP_ExistingLocalAccount(t *testing.T) {
+	d := startTestDirectory(t)
+	a := newTestLDAP(t, d, nil)
+	ctx := context.Background()
+
+	local := &models.User{Username: "carol", Nickname: "Local Carol"}
+	local.SetPassword("local-pw")
+	a.db.Create(local)
+
+	if _, err := a.Authenticate(ctx, "carol", "carol-pw"); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("Expected username conflict, got %v", err)
+	}
+
+	a.conf.LinkExisting = true
+	user, err := a.Authenticate(ctx, "carol", "carol-pw")
+	if err != nil || user.ID != local.ID || user.Nickname != "Local Carol" {
+		t.Errorf("Expected the local account to be linked, got %+v, %v", user, err)
+	}
+}
+
+func TestChain_Authenticate(t *testing.T) {
+	d := startTestDirectory(t)
+	directory := newTestLDAP(t, d, nil)
+	local := NewLocal(directory.db)
+	ctx := context.Background()
+
+	dave := &models.User{Username: "dave", Nickname: "dave"}
+	dave.SetPassword("dave-pw")
+	directory.db.Create(dave)
+
+	chain := Chain{directory, local}
+	if user, err := chain.Authenticate(ctx, "alice", "alice-pw"); err != nil || user.Username != "alice" {
+		t.Errorf("Directory user should log in, got %v", err)
+	}
+	if user, err := chain.Authenticate(ctx, "dave", "dave-pw"); err != nil || user.ID != dave.ID {
+		t.Errorf("Local user should log in, got %v", err)
+	}
+	if _, err := chain.Authenticate(ctx, "dave", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected invalid credentials, got %v", err)
+	}
+
+	// An unreachable directory does not lock out local accounts
+	down := NewLDAP(directory.db, config.LDAPConfiguration{URL: fmt.Sprintf("ldap://127.0.0.1:%d", 1), Timeout: 1})
+	if _, err := (Chain{down, local}).Authenticate(ctx, "dave", "dave-pw"); err != nil {
+		t.Errorf("Local login should survive a directory outage: %v", err)
+	}
+}
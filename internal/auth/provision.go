@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"simple_im/internal/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrUsernameTaken = errors.New("username already exists")
+
+// ExternalIdentity is a user as an external provider describes it
+type ExternalIdentity struct {
+	Provider string // OIDC issuer, or "ldap"
+	Subject  string // stable id of the user at the provider
+	Username string // used when the account is created
+	Nickname string
+}
+
+// Provision returns the account linked to the identity. On its first login
+// it creates one, or links the local account of the same username when
+// linkExisting is set and that account has no identity of this provider yet.
+// Usernames are only as trustworthy as the provider, so admin and moderator
+// accounts are never linked this way.
+func Provision(db *gorm.DB, identity ExternalIdentity, linkExisting bool) (*models.User, error) {
+	var link models.UserIdentity
+	err := db.Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).First(&link).Error
+	if err == nil {
+		var user models.User
+		if err := db.First(&user, link.UserID).Error; err != nil {
+			return nil, errors.New("user not found")
+		}
+		return &user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to find identity: %v", err)
+	}
+
+	username := strings.TrimSpace(identity.Username)
+	if len(username) < 3 || len(username) > 50 {
+		return nil, errors.New("identity provider sent no usable username")
+	}
+	nickname := strings.TrimSpace(identity.Nickname)
+	if nickname == "" {
+		nickname = username
+	}
+	if utf8.RuneCountInString(nickname) > 100 {
+		nickname = string([]rune(nickname)[:100])
+	}
+
+	var user models.User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("username = ?", username).First(&user).Error
+		switch {
+		case err == nil:
+			if !linkExisting || user.IsBot || user.Role != models.UserRoleUser {
+				return ErrUsernameTaken
+			}
+			// The account may already belong to another identity of this provider
+			var linked int64
+			tx.Model(&models.UserIdentity{}).Where("user_id = ? AND provider = ?", user.ID, identity.Provider).Count(&linked)
+			if linked > 0 {
+				return ErrUsernameTaken
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			user = models.User{Username: username, Nickname: nickname}
+			// Provisioned accounts get a random password nobody knows, they log in through the provider
+			password := make([]byte, 32)
+			if _, err := rand.Read(password); err != nil {
+				return err
+			}
+			if err := user.SetPassword(hex.EncodeToString(password)); err != nil {
+				return err
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return fmt.Errorf("failed to create user: %v", err)
+			}
+		default:
+			return err
+		}
+
+		return tx.Create(&models.UserIdentity{
+			UserID:   user.ID,
+			Provider: identity.Provider,
+			Subject:  identity.Subject,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -3,10 +3,19 @@ package conf
 import "simple_im/pkg/common/config"
 
 type Config struct {
-	ServiceConfiguration  config.ServiceConfiguration
-	PostgresConfiguration config.PostgresConfiguration
-	RedisConfiguration    config.RedisConfiguration
-	LoggerConfiguration   config.LoggerConfig
-	JWTConfiguration      config.JWTConfiguration
-	UploadConfiguration   config.UploadConfiguration
+	ServiceConfiguration   config.ServiceConfiguration
+	PostgresConfiguration  config.PostgresConfiguration
+	RedisConfiguration     config.RedisConfiguration
+	LoggerConfiguration    config.LoggerConfig
+	JWTConfiguration       config.JWTConfiguration
+	UploadConfiguration    config.UploadConfiguration
+	GroupConfiguration     config.GroupConfiguration
+	FriendConfiguration    config.FriendConfiguration
+	TwoFactorConfiguration config.TwoFactorConfiguration
+	RateLimitConfiguration config.RateLimitConfiguration
+	ExportConfiguration    config.ExportConfiguration
+	OIDCConfiguration      config.OIDCConfiguration
+	LDAPConfiguration      config.LDAPConfiguration
+	BotConfiguration       config.BotConfiguration
+	WebhookConfiguration   config.WebhookConfiguration
 }
@@ -15,7 +15,10 @@ const (
 	ContextKeyUsername = "username"
 )
 
-func JWTAuth(jwtManager *jwt.JWTManager) gin.HandlerFunc {
+// TokenParser validates a bearer token and returns its claims
+type TokenParser func(token string) (*jwt.Claims, error)
+
+func JWTAuth(parseToken TokenParser) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		authHeader := ctx.GetHeader("Authorization")
 		if authHeader == "" {
@@ -31,7 +34,7 @@ func JWTAuth(jwtManager *jwt.JWTManager) gin.HandlerFunc {
 			return
 		}
 
-		claims, err := jwtManager.ParseToken(parts[1])
+		claims, err := parseToken(parts[1])
 		if err != nil {
 			resp.Return(ctx, 200, "", nil, fmt.Errorf("invalid token: %v", err))
 			ctx.Abort()
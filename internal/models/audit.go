@@ -0,0 +1,39 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrAuditLogImmutable = errors.New("audit log entries cannot be changed")
+
+// AuditLog records one call of a security relevant RPC method. Entries are
+// append-only, the hooks below refuse updates and deletes through gorm and
+// migration 012 does the same in the database.
+type AuditLog struct {
+	ID         int64     `gorm:"primaryKey" json:"id"`
+	ActorID    *int64    `gorm:"index" json:"actor_id"`                             // nil when no user could be identified
+	Action     string    `gorm:"size:100;not null;index" json:"action"`             // RPC method name
+	TargetType string    `gorm:"size:30;index:idx_audit_target" json:"target_type"` // e.g. user, group, message
+	TargetID   string    `gorm:"size:64;index:idx_audit_target" json:"target_id"`
+	Success    bool      `json:"success"`
+	Error      string    `gorm:"size:255" json:"error,omitempty"`
+	IP         string    `gorm:"size:64" json:"ip"`
+	UserAgent  string    `gorm:"size:255" json:"user_agent"`
+	Params     string    `gorm:"type:text" json:"params"` // JSON with secrets redacted
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+}
+
+func (AuditLog) TableName() string {
+	return "audit_logs"
+}
+
+func (AuditLog) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditLogImmutable
+}
+
+func (AuditLog) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditLogImmutable
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Block stops BlockedID from sending friend requests or private messages to UserID
+type Block struct {
+	ID        int64     `gorm:"primaryKey" json:"id"`
+	UserID    int64     `gorm:"not null;uniqueIndex:idx_block_user" json:"user_id"`
+	BlockedID int64     `gorm:"not null;uniqueIndex:idx_block_user" json:"blocked_id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Blocked *User `gorm:"foreignKey:BlockedID" json:"blocked,omitempty"`
+}
+
+func (Block) TableName() string {
+	return "blocks"
+}
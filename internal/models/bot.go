@@ -0,0 +1,84 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// APITokenPrefix starts every bot API token, it tells them apart from JWTs
+const APITokenPrefix = "sim_"
+
+// TokenScope limits what an API token may do, RPC methods name the scope
+// they need and refuse tokens without it
+type TokenScope string
+
+const (
+	ScopeMessagesSend TokenScope = "messages:send"
+	ScopeMessagesRead TokenScope = "messages:read"
+	ScopeGroupsRead   TokenScope = "groups:read"
+	ScopeUsersRead    TokenScope = "users:read"
+	ScopeEvents       TokenScope = "events" // WebSocket connections
+)
+
+var tokenScopes = map[TokenScope]bool{
+	ScopeMessagesSend: true,
+	ScopeMessagesRead: true,
+	ScopeGroupsRead:   true,
+	ScopeUsersRead:    true,
+	ScopeEvents:       true,
+}
+
+func (s TokenScope) Valid() bool {
+	return tokenScopes[s]
+}
+
+// Bot is the bot part of a user with IsBot set, owned by the user who
+// created it
+type Bot struct {
+	UserID        int64     `gorm:"primaryKey" json:"user_id"`
+	OwnerID       int64     `gorm:"not null;index" json:"owner_id"`
+	Description   string    `gorm:"size:255" json:"description"`
+	WebhookURL    string    `gorm:"size:500" json:"webhook_url"` // Receives the bot's events, empty disables
+	WebhookSecret string    `gorm:"size:64" json:"-"`            // HMAC key of the deliveries
+	User          *User     `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func (Bot) TableName() string {
+	return "bots"
+}
+
+// APIToken is a long-lived credential of a bot. Only the sha256 of the token
+// is stored, the token itself is shown once when it is created.
+type APIToken struct {
+	ID         int64      `gorm:"primaryKey" json:"id"`
+	UserID     int64      `gorm:"not null;index" json:"user_id"` // The bot
+	Name       string     `gorm:"size:100" json:"name"`
+	TokenHash  string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Prefix     string     `gorm:"size:16" json:"prefix"`  // Start of the token, to tell tokens apart
+	Scopes     string     `gorm:"size:255" json:"scopes"` // Space separated
+	ExpiresAt  *time.Time `json:"expires_at"`             // nil never expires
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	User       *User      `gorm:"foreignKey:UserID" json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (APIToken) TableName() string {
+	return "api_tokens"
+}
+
+func (t *APIToken) HasScope(scope TokenScope) bool {
+	for _, s := range strings.Fields(t.Scopes) {
+		if TokenScope(s) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the token can still be used
+func (t *APIToken) Active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
@@ -1,20 +1,31 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type FriendStatus int
 
 const (
-	FriendStatusPending  FriendStatus = 0
-	FriendStatusAccepted FriendStatus = 1
-	FriendStatusRejected FriendStatus = 2
+	FriendStatusPending   FriendStatus = 0
+	FriendStatusAccepted  FriendStatus = 1
+	FriendStatusRejected  FriendStatus = 2
+	FriendStatusCancelled FriendStatus = 3
 )
 
+// Friend is the single row describing the relationship between two users,
+// UserID is whoever sent the latest request. PairKey keeps it unique in
+// both directions.
 type Friend struct {
 	ID        int64        `gorm:"primaryKey" json:"id"`
 	UserID    int64        `gorm:"not null;index:idx_friend_user" json:"user_id"`
 	FriendID  int64        `gorm:"not null;index:idx_friend_user" json:"friend_id"`
-	Status    FriendStatus `gorm:"default:0" json:"status"` // 0:pending 1:accepted 2:rejected
+	PairKey   string       `gorm:"size:50;uniqueIndex:idx_friends_pair_key" json:"-"`
+	Status    FriendStatus `gorm:"default:0" json:"status"` // 0:pending 1:accepted 2:rejected 3:cancelled
+	Message   string       `gorm:"size:255" json:"message"` // Greeting sent with the latest request
 	CreatedAt time.Time    `json:"created_at"`
 	UpdatedAt time.Time    `json:"updated_at"`
 
@@ -25,3 +36,41 @@ type Friend struct {
 func (Friend) TableName() string {
 	return "friends"
 }
+
+func (f *Friend) BeforeSave(tx *gorm.DB) error {
+	f.PairKey = FriendPairKey(f.UserID, f.FriendID)
+	return nil
+}
+
+// FriendPairKey returns the same key for (a, b) and (b, a)
+func FriendPairKey(a, b int64) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d:%d", a, b)
+}
+
+// FriendRemark is a private alias UserID gave to FriendID, only UserID sees it
+type FriendRemark struct {
+	ID        int64     `gorm:"primaryKey" json:"id"`
+	UserID    int64     `gorm:"not null;uniqueIndex:idx_friend_remark" json:"user_id"`
+	FriendID  int64     `gorm:"not null;uniqueIndex:idx_friend_remark" json:"friend_id"`
+	Remark    string    `gorm:"size:100;not null" json:"remark"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (FriendRemark) TableName() string {
+	return "friend_remarks"
+}
+
+// FriendTag puts FriendID into one of UserID's friend groups
+type FriendTag struct {
+	ID       int64  `gorm:"primaryKey" json:"-"`
+	UserID   int64  `gorm:"not null;uniqueIndex:idx_friend_tag;index:idx_friend_tag_user" json:"-"`
+	FriendID int64  `gorm:"not null;uniqueIndex:idx_friend_tag" json:"-"`
+	Tag      string `gorm:"size:30;not null;uniqueIndex:idx_friend_tag;index:idx_friend_tag_user" json:"tag"`
+}
+
+func (FriendTag) TableName() string {
+	return "friend_tags"
+}
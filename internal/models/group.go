@@ -10,15 +10,28 @@ const (
 	GroupRoleOwner  GroupRole = 2
 )
 
+type GroupJoinPolicy int
+
+const (
+	GroupJoinOpen       GroupJoinPolicy = 0 // Anyone with the group id can join
+	GroupJoinApproval   GroupJoinPolicy = 1 // Join requests are reviewed by admins
+	GroupJoinInviteOnly GroupJoinPolicy = 2 // Members can only be invited
+)
+
 type Group struct {
-	ID        int64     `gorm:"primaryKey" json:"id"`
-	Name      string    `gorm:"size:100;not null" json:"name"`
-	OwnerID   int64     `gorm:"not null" json:"owner_id"`
-	Avatar    string    `gorm:"size:500" json:"avatar"`
-	CreatedAt time.Time `json:"created_at"`
+	ID           int64           `gorm:"primaryKey" json:"id"`
+	Name         string          `gorm:"size:100;not null" json:"name"`
+	OwnerID      int64           `gorm:"not null" json:"owner_id"`
+	Avatar       string          `gorm:"size:500" json:"avatar"`
+	Description  string          `gorm:"size:500" json:"description"`
+	Announcement string          `gorm:"size:2000" json:"announcement"`
+	IsPublic     bool            `gorm:"default:false;index" json:"is_public"` // Listed in group.search
+	JoinPolicy   GroupJoinPolicy `gorm:"default:0" json:"join_policy"`         // 0:open 1:approval 2:invite only
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
 
-	Owner   *User          `gorm:"foreignKey:OwnerID" json:"owner,omitempty"`
-	Members []GroupMember  `gorm:"foreignKey:GroupID" json:"members,omitempty"`
+	Owner   *User         `gorm:"foreignKey:OwnerID" json:"owner,omitempty"`
+	Members []GroupMember `gorm:"foreignKey:GroupID" json:"members,omitempty"`
 }
 
 func (Group) TableName() string {
@@ -29,7 +42,8 @@ type GroupMember struct {
 	ID       int64     `gorm:"primaryKey" json:"id"`
 	GroupID  int64     `gorm:"not null;uniqueIndex:idx_group_member" json:"group_id"`
 	UserID   int64     `gorm:"not null;uniqueIndex:idx_group_member" json:"user_id"`
-	Role     GroupRole `gorm:"default:0" json:"role"` // 0:member 1:admin 2:owner
+	Role     GroupRole `gorm:"default:0" json:"role"`    // 0:member 1:admin 2:owner
+	Nickname string    `gorm:"size:100" json:"nickname"` // Group specific display name
 	JoinedAt time.Time `json:"joined_at"`
 
 	Group *Group `gorm:"foreignKey:GroupID" json:"group,omitempty"`
@@ -39,3 +53,72 @@ type GroupMember struct {
 func (GroupMember) TableName() string {
 	return "group_members"
 }
+
+// DisplayName returns the name shown for the member inside the group, falling
+// back to the global nickname and then the username. User must be loaded.
+func (m *GroupMember) DisplayName() string {
+	if m.Nickname != "" {
+		return m.Nickname
+	}
+	if m.User == nil {
+		return ""
+	}
+	if m.User.Nickname != "" {
+		return m.User.Nickname
+	}
+	return m.User.Username
+}
+
+// GroupAnnouncement keeps every announcement ever pinned to a group,
+// the current one is mirrored in Group.Announcement.
+type GroupAnnouncement struct {
+	ID        int64     `gorm:"primaryKey" json:"id"`
+	GroupID   int64     `gorm:"not null;index" json:"group_id"`
+	AuthorID  int64     `gorm:"not null" json:"author_id"`
+	Content   string    `gorm:"size:2000" json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Author *User `gorm:"foreignKey:AuthorID" json:"author,omitempty"`
+}
+
+func (GroupAnnouncement) TableName() string {
+	return "group_announcements"
+}
+
+// GroupTag is a lower-cased keyword used to find public groups
+type GroupTag struct {
+	ID      int64  `gorm:"primaryKey" json:"-"`
+	GroupID int64  `gorm:"not null;uniqueIndex:idx_group_tag" json:"-"`
+	Tag     string `gorm:"size:30;not null;uniqueIndex:idx_group_tag;index" json:"tag"`
+}
+
+func (GroupTag) TableName() string {
+	return "group_tags"
+}
+
+type GroupJoinRequestStatus int
+
+const (
+	GroupJoinRequestPending  GroupJoinRequestStatus = 0
+	GroupJoinRequestApproved GroupJoinRequestStatus = 1
+	GroupJoinRequestRejected GroupJoinRequestStatus = 2
+)
+
+// GroupJoinRequest is created by group.join for groups using GroupJoinApproval
+type GroupJoinRequest struct {
+	ID         int64                  `gorm:"primaryKey" json:"id"`
+	GroupID    int64                  `gorm:"not null;index" json:"group_id"`
+	UserID     int64                  `gorm:"not null;index" json:"user_id"`
+	Message    string                 `gorm:"size:255" json:"message"`
+	Status     GroupJoinRequestStatus `gorm:"default:0" json:"status"` // 0:pending 1:approved 2:rejected
+	ReviewerID *int64                 `json:"reviewer_id,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+
+	Group *Group `gorm:"foreignKey:GroupID" json:"group,omitempty"`
+	User  *User  `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (GroupJoinRequest) TableName() string {
+	return "group_join_requests"
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// UserIdentity links an account to an external identity provider. Provider
+// is the OIDC issuer, Subject the provider's stable id of the user.
+type UserIdentity struct {
+	ID        int64     `gorm:"primaryKey" json:"id"`
+	UserID    int64     `gorm:"not null;index" json:"user_id"`
+	Provider  string    `gorm:"size:255;not null;uniqueIndex:idx_identity_subject" json:"provider"`
+	Subject   string    `gorm:"size:255;not null;uniqueIndex:idx_identity_subject" json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (UserIdentity) TableName() string {
+	return "user_identities"
+}
@@ -5,9 +5,10 @@ import "time"
 type MessageType int
 
 const (
-	MsgTypeText  MessageType = 1
-	MsgTypeImage MessageType = 2
-	MsgTypeFile  MessageType = 3
+	MsgTypeText   MessageType = 1
+	MsgTypeImage  MessageType = 2
+	MsgTypeFile   MessageType = 3
+	MsgTypeSystem MessageType = 4 // Server generated event, Content holds a JSON payload
 )
 
 type Message struct {
@@ -15,7 +16,7 @@ type Message struct {
 	SenderID   int64       `gorm:"not null;index" json:"sender_id"`
 	ReceiverID *int64      `gorm:"index" json:"receiver_id,omitempty"` // Private chat (nullable)
 	GroupID    *int64      `gorm:"index" json:"group_id,omitempty"`    // Group chat (nullable)
-	MsgType    MessageType `gorm:"not null" json:"msg_type"`           // 1:text 2:image 3:file
+	MsgType    MessageType `gorm:"not null" json:"msg_type"`           // 1:text 2:image 3:file 4:system
 	Content    string      `gorm:"type:text" json:"content,omitempty"`
 	FileURL    string      `gorm:"size:500" json:"file_url,omitempty"`
 	FileName   string      `gorm:"size:255" json:"file_name,omitempty"`
@@ -30,3 +31,32 @@ type Message struct {
 func (Message) TableName() string {
 	return "messages"
 }
+
+type SystemEvent string
+
+const (
+	SystemEventGroupCreated  SystemEvent = "group_created"
+	SystemEventGroupUpdated  SystemEvent = "group_updated"
+	SystemEventMemberJoined  SystemEvent = "member_joined"
+	SystemEventMemberInvited SystemEvent = "member_invited"
+	SystemEventMemberLeft    SystemEvent = "member_left"
+	SystemEventMemberRemoved SystemEvent = "member_removed"
+)
+
+// SystemTarget is a user affected by a system event, the name is captured at
+// event time so history still reads well after renames.
+type SystemTarget struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// SystemPayload is stored as JSON in the Content of MsgTypeSystem messages,
+// e.g. "X invited Y" is {"event":"member_invited","actor_id":X,"actor_name":"X",
+// "targets":[{"user_id":Y,"name":"Y"}]}
+type SystemPayload struct {
+	Event     SystemEvent            `json:"event"`
+	ActorID   int64                  `json:"actor_id"`
+	ActorName string                 `json:"actor_name"`
+	Targets   []SystemTarget         `json:"targets,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
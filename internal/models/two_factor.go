@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// TwoFactor holds a user's TOTP secret. It is created by user.2fa_enroll and
+// only guards logins once user.2fa_verify has confirmed a code and set Enabled.
+type TwoFactor struct {
+	UserID       int64      `gorm:"primaryKey" json:"user_id"`
+	Secret       string     `gorm:"size:64;not null" json:"-"` // base32
+	Enabled      bool       `gorm:"default:false" json:"enabled"`
+	LastUsedStep int64      `gorm:"default:0" json:"-"` // Codes of this time step or older are refused
+	EnabledAt    *time.Time `json:"enabled_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+func (TwoFactor) TableName() string {
+	return "user_two_factors"
+}
+
+// RecoveryCode replaces a TOTP code once when the authenticator is lost
+type RecoveryCode struct {
+	ID        int64      `gorm:"primaryKey" json:"id"`
+	UserID    int64      `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"size:64;not null" json:"-"` // sha256 hex of the normalized code
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (RecoveryCode) TableName() string {
+	return "user_recovery_codes"
+}
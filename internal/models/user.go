@@ -7,16 +7,103 @@ import (
 	"gorm.io/gorm"
 )
 
+// FriendRequestPolicy decides who may send a user friend requests
+type FriendRequestPolicy int
+
+const (
+	FriendRequestEveryone     FriendRequestPolicy = 0
+	FriendRequestGroupMembers FriendRequestPolicy = 1 // Only people sharing a group
+	FriendRequestNobody       FriendRequestPolicy = 2
+)
+
+// Visibility decides who may see a part of a user's profile
+type Visibility int
+
+const (
+	VisibilityEveryone Visibility = 0
+	VisibilityFriends  Visibility = 1
+	VisibilityNobody   Visibility = 2
+)
+
+// VisibleTo reports whether a viewer may see the field, owners always see their own profile
+func (v Visibility) VisibleTo(isSelf, isFriend bool) bool {
+	switch {
+	case isSelf:
+		return true
+	case v == VisibilityEveryone:
+		return true
+	case v == VisibilityFriends:
+		return isFriend
+	default:
+		return false
+	}
+}
+
+// UserRole is the global role of an account, unrelated to roles inside groups
+type UserRole int
+
+const (
+	UserRoleUser      UserRole = 0
+	UserRoleAdmin     UserRole = 1
+	UserRoleModerator UserRole = 2
+)
+
+// Permission allows acting on data of other users, it is granted by UserRole
+type Permission string
+
+const (
+	PermissionUsersView      Permission = "users.view"
+	PermissionUsersManage    Permission = "users.manage" // Disable accounts, reset passwords and 2FA
+	PermissionRolesManage    Permission = "roles.manage"
+	PermissionGroupsView     Permission = "groups.view"
+	PermissionMessagesDelete Permission = "messages.delete"
+	PermissionAuditView      Permission = "audit.view"
+	PermissionWebhooksManage Permission = "webhooks.manage" // Global webhooks that see every event
+)
+
+var rolePermissions = map[UserRole][]Permission{
+	UserRoleModerator: {PermissionUsersView, PermissionGroupsView, PermissionMessagesDelete},
+	UserRoleAdmin: {
+		PermissionUsersView, PermissionUsersManage, PermissionRolesManage,
+		PermissionGroupsView, PermissionMessagesDelete, PermissionAuditView,
+		PermissionWebhooksManage,
+	},
+}
+
+func (r UserRole) Valid() bool {
+	return r == UserRoleUser || r == UserRoleAdmin || r == UserRoleModerator
+}
+
+// HasPermission reports whether the role grants p
+func (r UserRole) HasPermission(p Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// User keeps the privacy settings and last seen time out of JSON, responses
+// show other users through a projection applying the visibility settings
 type User struct {
-	ID        int64          `gorm:"primaryKey" json:"id"`
-	Username  string         `gorm:"uniqueIndex;size:50;not null" json:"username"`
-	Password  string         `gorm:"size:255;not null" json:"-"`
-	Nickname  string         `gorm:"size:100" json:"nickname"`
-	Avatar    string         `gorm:"size:500" json:"avatar"`
-	Status    int            `gorm:"default:1" json:"status"` // 1:normal 0:disabled
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                  int64               `gorm:"primaryKey" json:"id"`
+	Username            string              `gorm:"uniqueIndex;size:50;not null" json:"username"`
+	Password            string              `gorm:"size:255;not null" json:"-"`
+	Nickname            string              `gorm:"size:100" json:"nickname"`
+	Avatar              string              `gorm:"size:500" json:"avatar"`
+	Status              int                 `gorm:"default:1" json:"status"` // 1:normal 0:disabled
+	Role                UserRole            `gorm:"default:0" json:"role"`   // 0:user 1:admin 2:moderator
+	Discoverable        bool                `gorm:"default:true" json:"-"`   // Shown in user.search
+	FriendRequestPolicy FriendRequestPolicy `gorm:"default:0" json:"-"`
+	AvatarVisibility    Visibility          `gorm:"default:0" json:"-"`
+	LastSeenVisibility  Visibility          `gorm:"default:0" json:"-"`
+	AllowStrangerChat   bool                `gorm:"default:false" json:"-"`      // Members of a shared group may send private messages
+	IsBot               bool                `gorm:"default:false" json:"is_bot"` // Bots use API tokens and cannot log in
+	LastSeenAt          *time.Time          `json:"-"`
+	CreatedAt           time.Time           `json:"created_at"`
+	UpdatedAt           time.Time           `json:"updated_at"`
+	DeletedAt           gorm.DeletedAt      `gorm:"index" json:"-"`
 }
 
 func (User) TableName() string {
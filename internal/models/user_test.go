@@ -2,6 +2,7 @@ package models
 
 import (
 	"testing"
+	"time"
 )
 
 func TestUser_SetPassword(t *testing.T) {
@@ -83,3 +84,198 @@ func TestFile_TableName(t *testing.T) {
 		t.Errorf("Expected table name 'files', got '%s'", file.TableName())
 	}
 }
+
+func TestGroupAnnouncement_TableName(t *testing.T) {
+	announcement := GroupAnnouncement{}
+	if announcement.TableName() != "group_announcements" {
+		t.Errorf("Expected table name 'group_announcements', got '%s'", announcement.TableName())
+	}
+}
+
+func TestGroupMember_DisplayName(t *testing.T) {
+	member := GroupMember{User: &User{Username: "alice", Nickname: "Alice"}}
+	if member.DisplayName() != "Alice" {
+		t.Errorf("Expected global nickname 'Alice', got '%s'", member.DisplayName())
+	}
+
+	member.Nickname = "Alice (QA)"
+	if member.DisplayName() != "Alice (QA)" {
+		t.Errorf("Expected group nickname 'Alice (QA)', got '%s'", member.DisplayName())
+	}
+
+	member = GroupMember{User: &User{Username: "bob"}}
+	if member.DisplayName() != "bob" {
+		t.Errorf("Expected username 'bob', got '%s'", member.DisplayName())
+	}
+}
+
+func TestGroupTag_TableName(t *testing.T) {
+	tag := GroupTag{}
+	if tag.TableName() != "group_tags" {
+		t.Errorf("Expected table name 'group_tags', got '%s'", tag.TableName())
+	}
+}
+
+func TestGroupJoinRequest_TableName(t *testing.T) {
+	request := GroupJoinRequest{}
+	if request.TableName() != "group_join_requests" {
+		t.Errorf("Expected table name 'group_join_requests', got '%s'", request.TableName())
+	}
+}
+
+func TestBlock_TableName(t *testing.T) {
+	block := Block{}
+	if block.TableName() != "blocks" {
+		t.Errorf("Expected table name 'blocks', got '%s'", block.TableName())
+	}
+}
+
+func TestFriendRemark_TableName(t *testing.T) {
+	remark := FriendRemark{}
+	if remark.TableName() != "friend_remarks" {
+		t.Errorf("Expected table name 'friend_remarks', got '%s'", remark.TableName())
+	}
+}
+
+func TestFriendTag_TableName(t *testing.T) {
+	tag := FriendTag{}
+	if tag.TableName() != "friend_tags" {
+		t.Errorf("Expected table name 'friend_tags', got '%s'", tag.TableName())
+	}
+}
+
+func TestTwoFactor_TableName(t *testing.T) {
+	tf := TwoFactor{}
+	if tf.TableName() != "user_two_factors" {
+		t.Errorf("Expected table name 'user_two_factors', got '%s'", tf.TableName())
+	}
+}
+
+func TestRecoveryCode_TableName(t *testing.T) {
+	code := RecoveryCode{}
+	if code.TableName() != "user_recovery_codes" {
+		t.Errorf("Expected table name 'user_recovery_codes', got '%s'", code.TableName())
+	}
+}
+
+func TestUserIdentity_TableName(t *testing.T) {
+	identity := UserIdentity{}
+	if identity.TableName() != "user_identities" {
+		t.Errorf("Expected table name 'user_identities', got '%s'", identity.TableName())
+	}
+}
+
+func TestAuditLog_TableName(t *testing.T) {
+	entry := AuditLog{}
+	if entry.TableName() != "audit_logs" {
+		t.Errorf("Expected table name 'audit_logs', got '%s'", entry.TableName())
+	}
+}
+
+func TestBot_TableName(t *testing.T) {
+	bot := Bot{}
+	if bot.TableName() != "bots" {
+		t.Errorf("Expected table name 'bots', got '%s'", bot.TableName())
+	}
+}
+
+func TestAPIToken_TableName(t *testing.T) {
+	token := APIToken{}
+	if token.TableName() != "api_tokens" {
+		t.Errorf("Expected table name 'api_tokens', got '%s'", token.TableName())
+	}
+}
+
+func TestWebhook_TableName(t *testing.T) {
+	hook := Webhook{}
+	if hook.TableName() != "webhooks" {
+		t.Errorf("Expected table name 'webhooks', got '%s'", hook.TableName())
+	}
+}
+
+func TestWebhookDelivery_TableName(t *testing.T) {
+	delivery := WebhookDelivery{}
+	if delivery.TableName() != "webhook_deliveries" {
+		t.Errorf("Expected table name 'webhook_deliveries', got '%s'", delivery.TableName())
+	}
+}
+
+func TestIncomingWebhook_TableName(t *testing.T) {
+	hook := IncomingWebhook{}
+	if hook.TableName() != "incoming_webhooks" {
+		t.Errorf("Expected table name 'incoming_webhooks', got '%s'", hook.TableName())
+	}
+}
+
+func TestAPIToken_Scopes(t *testing.T) {
+	token := APIToken{Scopes: "messages:send events"}
+	if !token.HasScope(ScopeMessagesSend) || !token.HasScope(ScopeEvents) {
+		t.Error("Expected granted scopes")
+	}
+	if token.HasScope(ScopeGroupsRead) {
+		t.Error("Unexpected scope")
+	}
+
+	now := time.Now()
+	if !token.Active(now) {
+		t.Error("Token without expiry should be active")
+	}
+	past := now.Add(-time.Minute)
+	token.ExpiresAt = &past
+	if token.Active(now) {
+		t.Error("Expired token should not be active")
+	}
+	token.ExpiresAt = nil
+	token.RevokedAt = &past
+	if token.Active(now) {
+		t.Error("Revoked token should not be active")
+	}
+}
+
+func TestFriendPairKey(t *testing.T) {
+	if FriendPairKey(1, 2) != FriendPairKey(2, 1) {
+		t.Error("Pair key should not depend on direction")
+	}
+	if FriendPairKey(1, 2) != "1:2" {
+		t.Errorf("Expected pair key '1:2', got '%s'", FriendPairKey(1, 2))
+	}
+}
+
+func TestVisibility_VisibleTo(t *testing.T) {
+	tests := []struct {
+		visibility Visibility
+		isSelf     bool
+		isFriend   bool
+		want       bool
+	}{
+		{VisibilityEveryone, false, false, true},
+		{VisibilityFriends, false, false, false},
+		{VisibilityFriends, false, true, true},
+		{VisibilityNobody, false, true, false},
+		{VisibilityNobody, true, false, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.visibility.VisibleTo(tt.isSelf, tt.isFriend); got != tt.want {
+			t.Errorf("Visibility(%d).VisibleTo(%v, %v) = %v, want %v", tt.visibility, tt.isSelf, tt.isFriend, got, tt.want)
+		}
+	}
+}
+
+func TestUserRole_HasPermission(t *testing.T) {
+	if UserRoleUser.HasPermission(PermissionUsersView) {
+		t.Error("Regular users should have no permissions")
+	}
+	if !UserRoleModerator.HasPermission(PermissionMessagesDelete) {
+		t.Error("Moderators should delete messages")
+	}
+	if UserRoleModerator.HasPermission(PermissionUsersManage) {
+		t.Error("Moderators should not manage users")
+	}
+	if !UserRoleAdmin.HasPermission(PermissionRolesManage) {
+		t.Error("Admins should manage roles")
+	}
+	if UserRole(9).Valid() || UserRole(9).HasPermission(PermissionUsersView) {
+		t.Error("Unknown roles should be invalid and grant nothing")
+	}
+}
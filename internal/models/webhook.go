@@ -0,0 +1,118 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// WebhookEvent names an event sent to outgoing webhooks
+type WebhookEvent string
+
+const (
+	WebhookEventMessageCreated  WebhookEvent = "message.created"
+	WebhookEventMessageDeleted  WebhookEvent = "message.deleted"
+	WebhookEventMemberJoined    WebhookEvent = "member.joined" // Joined, approved or invited
+	WebhookEventMemberLeft      WebhookEvent = "member.left"   // Left or removed
+	WebhookEventFriendRequested WebhookEvent = "friend.requested"
+	WebhookEventFriendAccepted  WebhookEvent = "friend.accepted"
+)
+
+var webhookEvents = map[WebhookEvent]bool{
+	WebhookEventMessageCreated:  true,
+	WebhookEventMessageDeleted:  true,
+	WebhookEventMemberJoined:    true,
+	WebhookEventMemberLeft:      true,
+	WebhookEventFriendRequested: true,
+	WebhookEventFriendAccepted:  true,
+}
+
+func (e WebhookEvent) Valid() bool {
+	return webhookEvents[e]
+}
+
+// WebhookScope decides which events a webhook sees
+type WebhookScope string
+
+const (
+	WebhookScopeUser   WebhookScope = "user"   // Events the owner sends or receives
+	WebhookScopeGroup  WebhookScope = "group"  // Events of one group, managed by its admins
+	WebhookScopeGlobal WebhookScope = "global" // Every event, managed by admins
+)
+
+func (s WebhookScope) Valid() bool {
+	return s == WebhookScopeUser || s == WebhookScopeGroup || s == WebhookScopeGlobal
+}
+
+// Webhook is an outgoing webhook, deliveries are signed with Secret
+type Webhook struct {
+	ID        int64        `gorm:"primaryKey" json:"id"`
+	OwnerID   int64        `gorm:"not null;index" json:"owner_id"` // Creator, the subscriber of user webhooks
+	Scope     WebhookScope `gorm:"size:10;not null" json:"scope"`
+	GroupID   *int64       `gorm:"index" json:"group_id"` // Set for group webhooks
+	URL       string       `gorm:"size:500;not null" json:"url"`
+	Secret    string       `gorm:"size:64;not null" json:"-"`
+	Events    string       `gorm:"size:255" json:"events"` // Space separated
+	Active    bool         `gorm:"default:true" json:"active"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+func (Webhook) TableName() string {
+	return "webhooks"
+}
+
+func (w *Webhook) Subscribes(event WebhookEvent) bool {
+	for _, e := range strings.Fields(w.Events) {
+		if WebhookEvent(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDeliveryStatus int
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = 0 // Waiting for its first or next attempt
+	WebhookDeliverySucceeded WebhookDeliveryStatus = 1
+	WebhookDeliveryFailed    WebhookDeliveryStatus = 2 // Out of attempts
+)
+
+// WebhookDelivery is one event sent to one webhook, kept as the delivery log
+type WebhookDelivery struct {
+	ID            int64                 `gorm:"primaryKey" json:"id"`
+	WebhookID     int64                 `gorm:"not null;index" json:"webhook_id"`
+	Event         WebhookEvent          `gorm:"size:50;not null" json:"event"`
+	Payload       string                `gorm:"type:text" json:"payload"`
+	Status        WebhookDeliveryStatus `gorm:"default:0;index:idx_webhook_delivery_due" json:"status"`
+	Attempts      int                   `json:"attempts"`
+	ResponseCode  int                   `json:"response_code"` // Of the last attempt, 0 when no response came
+	Error         string                `gorm:"size:255" json:"error,omitempty"`
+	NextAttemptAt *time.Time            `gorm:"index:idx_webhook_delivery_due" json:"next_attempt_at"`
+	DeliveredAt   *time.Time            `json:"delivered_at"`
+	ReplayOf      *int64                `json:"replay_of,omitempty"` // Delivery this one replays
+	CreatedAt     time.Time             `gorm:"index" json:"created_at"`
+}
+
+func (WebhookDelivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+// IncomingWebhook lets scripts post into a group without logging in. The
+// messages are sent by a bot user created for the webhook, only the sha256
+// of the token in its URL is stored.
+type IncomingWebhook struct {
+	ID         int64      `gorm:"primaryKey" json:"id"`
+	GroupID    int64      `gorm:"not null;index" json:"group_id"`
+	CreatorID  int64      `gorm:"not null" json:"creator_id"`
+	BotID      int64      `gorm:"not null" json:"bot_id"` // Sender of the messages, a member of the group
+	Name       string     `gorm:"size:100" json:"name"`
+	TokenHash  string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Prefix     string     `gorm:"size:16" json:"prefix"` // Start of the token, to tell webhooks apart
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (IncomingWebhook) TableName() string {
+	return "incoming_webhooks"
+}
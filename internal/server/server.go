@@ -17,17 +17,20 @@ type Server struct {
 	conf      conf.Config
 }
 
-func NewServer(db *gorm.DB, redisClient *redis.Client, config conf.Config) *Server {
+func NewServer(db *gorm.DB, redisClient *redis.Client, config conf.Config) (*Server, error) {
 	st := storage.NewStorage(redisClient, db)
 	hub := ws.NewHub()
-	apiServer := api.NewApiServer(st, hub, config)
+	apiServer, err := api.NewApiServer(st, hub, config)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Server{
 		storage:   st,
 		apiServer: apiServer,
 		wsHub:     hub,
 		conf:      config,
-	}
+	}, nil
 }
 
 func (s *Server) Run() error {
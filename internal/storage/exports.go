@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrExportNotFound = errors.New("export not found")
+
+func exportKey(exportID string) string {
+	return fmt.Sprintf("export:%s", exportID)
+}
+
+// CreateExport makes a data export archive downloadable by its owner for ttl
+func (s *Storage) CreateExport(ctx context.Context, exportID string, userID int64, ttl time.Duration) error {
+	return s.redis.Set(ctx, exportKey(exportID), userID, ttl).Err()
+}
+
+// GetExportOwner returns the user an unexpired export belongs to
+func (s *Storage) GetExportOwner(ctx context.Context, exportID string) (int64, error) {
+	userID, err := s.redis.Get(ctx, exportKey(exportID)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrExportNotFound
+	}
+	return userID, err
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"simple_im/internal/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const groupMembersCacheTTL = time.Hour
+
+func groupMembersKey(groupID int64) string {
+	return fmt.Sprintf("group:members:%d", groupID)
+}
+
+// groupMembersVersionKey is bumped by every invalidation
+func groupMembersVersionKey(groupID int64) string {
+	return fmt.Sprintf("group:members:%d:version", groupID)
+}
+
+// fillGroupMembersScript caches the ids ARGV[3..] for ARGV[2] seconds unless
+// the version moved on from ARGV[1], a fill that read the database before an
+// invalidation would cache a stale member set
+var fillGroupMembersScript = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '0') ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+for i = 3, #ARGV do
+	redis.call('SADD', KEYS[1], ARGV[i])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// GetGroupMemberIDs returns the user ids of all members of a group. The ids are
+// cached in a Redis set, callers changing membership must call
+// InvalidateGroupMembers.
+func (s *Storage) GetGroupMemberIDs(ctx context.Context, groupID int64) ([]int64, error) {
+	key := groupMembersKey(groupID)
+
+	cached, err := s.redis.SMembers(ctx, key).Result()
+	if err == nil && len(cached) > 0 {
+		ids := make([]int64, 0, len(cached))
+		for _, v := range cached {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+
+	// Read before the database so an invalidation during the query is noticed
+	versionKey := groupMembersVersionKey(groupID)
+	version, err := s.redis.Get(ctx, versionKey).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		version = "0"
+	case err != nil:
+		version = "" // Not cached without a version
+	}
+
+	var ids []int64
+	if err := s.db.Model(&models.GroupMember{}).Where("group_id = ?", groupID).Pluck("user_id", &ids).Error; err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 && version != "" {
+		args := make([]interface{}, 0, len(ids)+2)
+		args = append(args, version, int(groupMembersCacheTTL.Seconds()))
+		for _, id := range ids {
+			args = append(args, id)
+		}
+		fillGroupMembersScript.Run(ctx, s.redis, []string{key, versionKey}, args...)
+	}
+
+	return ids, nil
+}
+
+// InvalidateGroupMembers drops the cached member ids of a group, call it after
+// the membership change is committed
+func (s *Storage) InvalidateGroupMembers(ctx context.Context, groupID int64) {
+	versionKey := groupMembersVersionKey(groupID)
+	pipe := s.redis.TxPipeline()
+	pipe.Incr(ctx, versionKey)
+	// Outlives any fill that could still be running
+	pipe.Expire(ctx, versionKey, 2*groupMembersCacheTTL)
+	pipe.Del(ctx, groupMembersKey(groupID))
+	pipe.Exec(ctx)
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrChallengeNotFound = errors.New("login challenge not found")
+
+// LoginChallenge is the first half of a two-factor login, the password was
+// correct and the client still has to send a code before getting tokens
+type LoginChallenge struct {
+	ID     string
+	UserID int64
+	Device string
+}
+
+func loginChallengeKey(challengeID string) string {
+	return fmt.Sprintf("login:challenge:%s", challengeID)
+}
+
+func (s *Storage) CreateLoginChallenge(ctx context.Context, challenge *LoginChallenge, ttl time.Duration) error {
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, loginChallengeKey(challenge.ID), map[string]interface{}{
+		"user_id":  challenge.UserID,
+		"device":   challenge.Device,
+		"attempts": 0,
+	})
+	pipe.Expire(ctx, loginChallengeKey(challenge.ID), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *Storage) GetLoginChallenge(ctx context.Context, challengeID string) (*LoginChallenge, error) {
+	fields, err := s.redis.HGetAll(ctx, loginChallengeKey(challengeID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if fields["user_id"] == "" {
+		return nil, ErrChallengeNotFound
+	}
+
+	userID, _ := strconv.ParseInt(fields["user_id"], 10, 64)
+	return &LoginChallenge{
+		ID:     challengeID,
+		UserID: userID,
+		Device: fields["device"],
+	}, nil
+}
+
+// failChallengeScript counts a failed attempt on an existing challenge and
+// deletes it once ARGV[1] attempts are reached
+var failChallengeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+if redis.call('HINCRBY', KEYS[1], 'attempts', 1) >= tonumber(ARGV[1]) then
+	redis.call('DEL', KEYS[1])
+end
+return 1
+`)
+
+// FailLoginChallenge counts a wrong code and drops the challenge after
+// maxAttempts, so a stolen password alone cannot brute force the code
+func (s *Storage) FailLoginChallenge(ctx context.Context, challengeID string, maxAttempts int64) error {
+	return failChallengeScript.Run(ctx, s.redis, []string{loginChallengeKey(challengeID)}, maxAttempts).Err()
+}
+
+// ConsumeLoginChallenge deletes the challenge, false means another request used it first
+func (s *Storage) ConsumeLoginChallenge(ctx context.Context, challengeID string) (bool, error) {
+	deleted, err := s.redis.Del(ctx, loginChallengeKey(challengeID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return deleted == 1, nil
+}
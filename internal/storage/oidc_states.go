@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrOIDCStateNotFound = errors.New("oidc state not found")
+
+// OIDCState remembers an authorization request until the provider sends the
+// user back, it can be used only once
+type OIDCState struct {
+	ID       string
+	Nonce    string
+	Verifier string // PKCE code verifier
+	Device   string
+}
+
+func oidcStateKey(state string) string {
+	return fmt.Sprintf("oidc:state:%s", state)
+}
+
+func (s *Storage) CreateOIDCState(ctx context.Context, state *OIDCState, ttl time.Duration) error {
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, oidcStateKey(state.ID), map[string]interface{}{
+		"nonce":    state.Nonce,
+		"verifier": state.Verifier,
+		"device":   state.Device,
+	})
+	pipe.Expire(ctx, oidcStateKey(state.ID), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TakeOIDCState returns and deletes the state, a replayed callback finds nothing
+func (s *Storage) TakeOIDCState(ctx context.Context, state string) (*OIDCState, error) {
+	pipe := s.redis.TxPipeline()
+	get := pipe.HGetAll(ctx, oidcStateKey(state))
+	pipe.Del(ctx, oidcStateKey(state))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	fields := get.Val()
+	if fields["nonce"] == "" {
+		return nil, ErrOIDCStateNotFound
+	}
+	return &OIDCState{
+		ID:       state,
+		Nonce:    fields["nonce"],
+		Verifier: fields["verifier"],
+		Device:   fields["device"],
+	}, nil
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// loginFailureTTL is how long failed logins are remembered without new attempts
+const loginFailureTTL = 24 * time.Hour
+
+func rateLimitKey(key string) string {
+	return fmt.Sprintf("rate:%s", key)
+}
+
+func loginFailuresKey(username string) string {
+	return fmt.Sprintf("login:failures:%s", username)
+}
+
+func loginLockKey(username string) string {
+	return fmt.Sprintf("login:lock:%s", username)
+}
+
+// hitRateLimitScript counts a request in a fixed window of ARGV[2] ms and
+// returns the ms left in the window once more than ARGV[1] requests were made
+var hitRateLimitScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	ttl = tonumber(ARGV[2])
+end
+if count > tonumber(ARGV[1]) then
+	return ttl
+end
+return 0
+`)
+
+// loginFailureScript counts a failed login and locks the account once
+// ARGV[1] failures are reached. The lock starts at ARGV[2] seconds and
+// doubles with every further failure up to ARGV[3]. Returns the lock seconds.
+var loginFailureScript = redis.NewScript(`
+local failures = redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+local over = failures - tonumber(ARGV[1])
+if over < 0 then
+	return 0
+end
+local lock = tonumber(ARGV[3])
+if over < 30 then
+	lock = math.min(tonumber(ARGV[2]) * 2 ^ over, lock)
+end
+lock = math.floor(lock)
+redis.call('SET', KEYS[2], failures, 'EX', lock)
+return lock
+`)
+
+// HitRateLimit counts a request against key and returns how long the caller
+// has to wait, zero while the limit of the current window is not exceeded
+func (s *Storage) HitRateLimit(ctx context.Context, key string, limit int64, window time.Duration) (time.Duration, error) {
+	wait, err := hitRateLimitScript.Run(ctx, s.redis, []string{rateLimitKey(key)}, limit, window.Milliseconds()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// RecordLoginFailure counts a failed login for username and returns the
+// lockout it caused, zero while below threshold
+func (s *Storage) RecordLoginFailure(ctx context.Context, username string, threshold int64, base, max time.Duration) (time.Duration, error) {
+	keys := []string{loginFailuresKey(username), loginLockKey(username)}
+	lock, err := loginFailureScript.Run(ctx, s.redis, keys, threshold, int64(base/time.Second), int64(max/time.Second), int64(loginFailureTTL/time.Second)).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(lock) * time.Second, nil
+}
+
+// LoginLockout returns how long username stays locked, zero if it is not
+func (s *Storage) LoginLockout(ctx context.Context, username string) (time.Duration, error) {
+	ttl, err := s.redis.PTTL(ctx, loginLockKey(username)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// ClearLoginFailures resets the failure count after a successful login
+func (s *Storage) ClearLoginFailures(ctx context.Context, username string) error {
+	return s.redis.Del(ctx, loginFailuresKey(username), loginLockKey(username)).Err()
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrRefreshInvalid  = errors.New("refresh token is invalid")
+	ErrRefreshReused   = errors.New("refresh token was already used")
+)
+
+// sessionTouchInterval limits how often LastActiveAt is written back
+const sessionTouchInterval = time.Minute
+
+// Session is a logged in device, access tokens carry its ID as jti and stop
+// working once it is deleted. The session lives as long as its refresh token.
+type Session struct {
+	ID           string    `json:"id"`
+	UserID       int64     `json:"user_id"`
+	Device       string    `json:"device"`
+	IP           string    `json:"ip"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActiveAt time.Time `json:"last_active_at"`
+	RefreshHash  string    `json:"-"` // Hash of the current refresh token
+}
+
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+// sessionUsedRefreshKey holds the hashes of refresh tokens already rotated out
+func sessionUsedRefreshKey(sessionID string) string {
+	return fmt.Sprintf("session:%s:used_refresh", sessionID)
+}
+
+func userSessionsKey(userID int64) string {
+	return fmt.Sprintf("user:sessions:%d", userID)
+}
+
+// touchSessionScript only updates sessions that still exist, a plain HSET
+// would bring a deleted session back without a TTL
+var touchSessionScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return redis.call('HSET', KEYS[1], 'last_active_at', ARGV[1])
+end
+return 0
+`)
+
+// rotateRefreshScript swaps the refresh token hash ARGV[1] for ARGV[2] and
+// extends the session by ARGV[3] seconds. Returns 1 on success, 2 if ARGV[1]
+// was rotated out before, 0 if it is unknown and -1 if the session is gone.
+var rotateRefreshScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'refresh_hash')
+if not current then
+	return -1
+end
+if current == ARGV[1] then
+	redis.call('HSET', KEYS[1], 'refresh_hash', ARGV[2])
+	redis.call('SADD', KEYS[2], ARGV[1])
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+	redis.call('EXPIRE', KEYS[2], ARGV[3])
+	redis.call('EXPIRE', KEYS[3], ARGV[3])
+	return 1
+end
+if redis.call('SISMEMBER', KEYS[2], ARGV[1]) == 1 then
+	return 2
+end
+return 0
+`)
+
+// CreateSession stores a session for ttl, which should match the refresh token lifetime
+func (s *Storage) CreateSession(ctx context.Context, session *Session, ttl time.Duration) error {
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, sessionKey(session.ID), map[string]interface{}{
+		"user_id":        session.UserID,
+		"device":         session.Device,
+		"ip":             session.IP,
+		"created_at":     session.CreatedAt.Unix(),
+		"last_active_at": session.LastActiveAt.Unix(),
+		"refresh_hash":   session.RefreshHash,
+	})
+	pipe.Expire(ctx, sessionKey(session.ID), ttl)
+	pipe.SAdd(ctx, userSessionsKey(session.UserID), session.ID)
+	pipe.Expire(ctx, userSessionsKey(session.UserID), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *Storage) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	fields, err := s.redis.HGetAll(ctx, sessionKey(sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 || fields["user_id"] == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	userID, _ := strconv.ParseInt(fields["user_id"], 10, 64)
+	createdAt, _ := strconv.ParseInt(fields["created_at"], 10, 64)
+	lastActiveAt, _ := strconv.ParseInt(fields["last_active_at"], 10, 64)
+
+	return &Session{
+		ID:           sessionID,
+		UserID:       userID,
+		Device:       fields["device"],
+		IP:           fields["ip"],
+		CreatedAt:    time.Unix(createdAt, 0),
+		LastActiveAt: time.Unix(lastActiveAt, 0),
+		RefreshHash:  fields["refresh_hash"],
+	}, nil
+}
+
+// TouchSession records activity on the session, at most once per sessionTouchInterval
+func (s *Storage) TouchSession(ctx context.Context, session *Session) {
+	if time.Since(session.LastActiveAt) < sessionTouchInterval {
+		return
+	}
+	session.LastActiveAt = time.Now()
+	touchSessionScript.Run(ctx, s.redis, []string{sessionKey(session.ID)}, session.LastActiveAt.Unix())
+}
+
+// RotateRefreshToken replaces the session's refresh token hash and extends the
+// session by ttl. Presenting a hash that was already rotated out returns
+// ErrRefreshReused, the caller should then revoke the session.
+func (s *Storage) RotateRefreshToken(ctx context.Context, session *Session, oldHash, newHash string, ttl time.Duration) error {
+	keys := []string{sessionKey(session.ID), sessionUsedRefreshKey(session.ID), userSessionsKey(session.UserID)}
+	result, err := rotateRefreshScript.Run(ctx, s.redis, keys, oldHash, newHash, int64(ttl/time.Second)).Int()
+	if err != nil {
+		return err
+	}
+
+	switch result {
+	case 1:
+		session.RefreshHash = newHash
+		return nil
+	case 2:
+		return ErrRefreshReused
+	case -1:
+		return ErrSessionNotFound
+	default:
+		return ErrRefreshInvalid
+	}
+}
+
+// ListSessions returns the live sessions of a user, most recently active first
+func (s *Storage) ListSessions(ctx context.Context, userID int64) ([]*Session, error) {
+	ids, err := s.redis.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		session, err := s.GetSession(ctx, id)
+		if errors.Is(err, ErrSessionNotFound) {
+			// Expired, drop it from the index
+			s.redis.SRem(ctx, userSessionsKey(userID), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastActiveAt.After(sessions[j].LastActiveAt)
+	})
+	return sessions, nil
+}
+
+func (s *Storage) DeleteSession(ctx context.Context, userID int64, sessionID string) error {
+	pipe := s.redis.TxPipeline()
+	pipe.Del(ctx, sessionKey(sessionID), sessionUsedRefreshKey(sessionID))
+	pipe.SRem(ctx, userSessionsKey(userID), sessionID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// DeleteUserSessions logs the user out everywhere and returns the deleted session ids
+func (s *Storage) DeleteUserSessions(ctx context.Context, userID int64) ([]string, error) {
+	ids, err := s.redis.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.redis.TxPipeline()
+	for _, id := range ids {
+		pipe.Del(ctx, sessionKey(id), sessionUsedRefreshKey(id))
+	}
+	pipe.Del(ctx, userSessionsKey(userID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -2,8 +2,11 @@ package ws
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 
+	"simple_im/pkg/common/jwt"
+
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
@@ -13,24 +16,88 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 512 * 1024
+
+	// closeSessionEnded tells the client its session was logged out or terminated
+	closeSessionEnded = 4001
+	// closeTokenExpired tells the client to reconnect with a fresh access token
+	closeTokenExpired = 4002
 )
 
+// TokenValidator checks an access token sent to re-authenticate a connection
+type TokenValidator func(token string) (*jwt.Claims, error)
+
 type Client struct {
-	hub      *Hub
-	conn     *websocket.Conn
-	send     chan *Message
-	UserID   int64
-	Username string
+	hub       *Hub
+	conn      *websocket.Conn
+	send      chan *Message
+	UserID    int64
+	Username  string
+	SessionID string
+
+	mu        sync.Mutex
+	expiresAt time.Time
+	validate  TokenValidator
 }
 
-func NewClient(hub *Hub, conn *websocket.Conn, userID int64, username string) *Client {
+func NewClient(hub *Hub, conn *websocket.Conn, userID int64, username, sessionID string) *Client {
 	return &Client{
-		hub:      hub,
-		conn:     conn,
-		send:     make(chan *Message, 256),
-		UserID:   userID,
-		Username: username,
+		hub:       hub,
+		conn:      conn,
+		send:      make(chan *Message, 256),
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
+	}
+}
+
+// EnableReauth closes the connection once expiresAt passes unless the client
+// sends a new access token with an "auth" message first
+func (c *Client) EnableReauth(expiresAt time.Time, validate TokenValidator) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expiresAt = expiresAt
+	c.validate = validate
+}
+
+func (c *Client) expired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.expiresAt.IsZero() && time.Now().After(c.expiresAt)
+}
+
+// reauth accepts a new access token for the same session
+func (c *Client) reauth(token string) {
+	c.mu.Lock()
+	validate := c.validate
+	c.mu.Unlock()
+
+	reply := &Message{Type: "auth_ok", CreatedAt: time.Now()}
+	if validate == nil {
+		reply = &Message{Type: "auth_failed", Content: "re-authentication not supported", CreatedAt: time.Now()}
+	} else if claims, err := validate(token); err != nil {
+		reply = &Message{Type: "auth_failed", Content: err.Error(), CreatedAt: time.Now()}
+	} else if claims.UserID != c.UserID || claims.ID != c.SessionID || claims.ExpiresAt == nil {
+		reply = &Message{Type: "auth_failed", Content: "token belongs to another session", CreatedAt: time.Now()}
+	} else {
+		c.mu.Lock()
+		c.expiresAt = claims.ExpiresAt.Time
+		c.mu.Unlock()
+	}
+
+	select {
+	case c.send <- reply:
+	default:
+	}
+}
+
+// Close ends the connection, ReadPump then unregisters the client
+func (c *Client) Close() {
+	if c.conn == nil {
+		return
 	}
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(closeSessionEnded, "session ended"), time.Now().Add(writeWait))
+	c.conn.Close()
 }
 
 func (c *Client) ReadPump() {
@@ -47,7 +114,7 @@ func (c *Client) ReadPump() {
 	})
 
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Error().Err(err).Int64("user_id", c.UserID).Msg("websocket read error")
@@ -55,7 +122,11 @@ func (c *Client) ReadPump() {
 			break
 		}
 		// Client messages are handled via JSON-RPC, not WebSocket
-		// WebSocket is only for receiving push notifications
+		// WebSocket is only for receiving push notifications and re-authentication
+		var msg ClientMessage
+		if json.Unmarshal(data, &msg) == nil && msg.Type == "auth" {
+			c.reauth(msg.Token)
+		}
 	}
 }
 
@@ -87,6 +158,11 @@ func (c *Client) WritePump() {
 			}
 
 		case <-ticker.C:
+			if c.expired() {
+				c.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(closeTokenExpired, "token expired"), time.Now().Add(writeWait))
+				return
+			}
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
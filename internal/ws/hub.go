@@ -4,17 +4,20 @@ import (
 	"sync"
 )
 
+// Hub keeps every connection of a user, one per logged in device
 type Hub struct {
-	clients    map[int64]*Client
+	clients    map[int64]map[*Client]bool
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan *Message
 	mu         sync.RWMutex
+	deliver    func(userID int64, msg *Message) // Sees every recipient, connected or not
+	observe    func(msg *Message)               // Sees every broadcast message once
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		clients:    make(map[int64]*Client),
+		clients:    make(map[int64]map[*Client]bool),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		broadcast:  make(chan *Message, 256),
@@ -26,13 +29,19 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
-			h.clients[client.UserID] = client
+			if h.clients[client.UserID] == nil {
+				h.clients[client.UserID] = make(map[*Client]bool)
+			}
+			h.clients[client.UserID][client] = true
 			h.mu.Unlock()
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client.UserID]; ok {
-				delete(h.clients, client.UserID)
+			if clients, ok := h.clients[client.UserID]; ok && clients[client] {
+				delete(clients, client)
+				if len(clients) == 0 {
+					delete(h.clients, client.UserID)
+				}
 				close(client.send)
 			}
 			h.mu.Unlock()
@@ -47,15 +56,13 @@ func (h *Hub) handleMessage(msg *Message) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
+	if h.observe != nil {
+		h.observe(msg)
+	}
+
 	// Send to specific user (private message)
 	if msg.ReceiverID > 0 {
-		if client, ok := h.clients[msg.ReceiverID]; ok {
-			select {
-			case client.send <- msg:
-			default:
-				// Client buffer full, skip
-			}
-		}
+		h.sendToUser(msg.ReceiverID, msg)
 		return
 	}
 
@@ -65,12 +72,21 @@ func (h *Hub) handleMessage(msg *Message) {
 			if memberID == msg.SenderID {
 				continue // Don't send to sender
 			}
-			if client, ok := h.clients[memberID]; ok {
-				select {
-				case client.send <- msg:
-				default:
-				}
-			}
+			h.sendToUser(memberID, msg)
+		}
+	}
+}
+
+// sendToUser delivers to all connections of the user, callers hold h.mu
+func (h *Hub) sendToUser(userID int64, msg *Message) {
+	if h.deliver != nil {
+		h.deliver(userID, msg)
+	}
+	for client := range h.clients[userID] {
+		select {
+		case client.send <- msg:
+		default:
+			// Client buffer full, skip
 		}
 	}
 }
@@ -87,9 +103,37 @@ func (h *Hub) Broadcast(msg *Message) {
 	h.broadcast <- msg
 }
 
+// OnDeliver sets a function called for each recipient of a broadcast
+// message, it runs on the hub goroutine and must not block
+func (h *Hub) OnDeliver(fn func(userID int64, msg *Message)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deliver = fn
+}
+
+// OnBroadcast sets a function called once for each broadcast message, it
+// runs on the hub goroutine and must not block
+func (h *Hub) OnBroadcast(fn func(msg *Message)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.observe = fn
+}
+
 func (h *Hub) IsOnline(userID int64) bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	_, ok := h.clients[userID]
-	return ok
+	return len(h.clients[userID]) > 0
+}
+
+// DisconnectSession closes the connections opened with the given session,
+// an empty sessionID closes every connection of the user
+func (h *Hub) DisconnectSession(userID int64, sessionID string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients[userID] {
+		if sessionID == "" || client.SessionID == sessionID {
+			client.Close()
+		}
+	}
 }
@@ -1,8 +1,17 @@
 package ws
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"simple_im/pkg/common/jwt"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
 )
 
 func TestNewHub(t *testing.T) {
@@ -40,7 +49,7 @@ func TestHub_IsOnline(t *testing.T) {
 
 	// Manually add a client to test
 	hub.mu.Lock()
-	hub.clients[1] = &Client{UserID: 1}
+	hub.clients[1] = map[*Client]bool{{UserID: 1}: true}
 	hub.mu.Unlock()
 
 	if !hub.IsOnline(1) {
@@ -176,4 +185,142 @@ func TestMessage_Types(t *testing.T) {
 	if MsgTypeFile != 3 {
 		t.Errorf("MsgTypeFile should be 3, got %d", MsgTypeFile)
 	}
+	if MsgTypeSystem != 4 {
+		t.Errorf("MsgTypeSystem should be 4, got %d", MsgTypeSystem)
+	}
+}
+
+func TestHub_MultipleDevices(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	phone := &Client{UserID: 3, SessionID: "phone", send: make(chan *Message, 10)}
+	laptop := &Client{UserID: 3, SessionID: "laptop", send: make(chan *Message, 10)}
+	hub.Register(phone)
+	hub.Register(laptop)
+	time.Sleep(50 * time.Millisecond)
+
+	hub.Broadcast(&Message{Type: "message", SenderID: 1, ReceiverID: 3, Content: "Hi"})
+	time.Sleep(50 * time.Millisecond)
+
+	if len(phone.send) != 1 || len(laptop.send) != 1 {
+		t.Error("Every device of the receiver should get the message")
+	}
+
+	// One device going away keeps the user online
+	hub.Unregister(phone)
+	time.Sleep(50 * time.Millisecond)
+
+	if !hub.IsOnline(3) {
+		t.Error("User should stay online while another device is connected")
+	}
+}
+
+func TestHub_DisconnectSession(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(hub, conn, 4, "user", r.URL.Query().Get("session"))
+		hub.Register(client)
+		go client.WritePump()
+		go client.ReadPump()
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	kept, _, err := websocket.DefaultDialer.Dial(url+"?session=kept", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer kept.Close()
+	ended, _, err := websocket.DefaultDialer.Dial(url+"?session=ended", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ended.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	hub.DisconnectSession(4, "ended")
+
+	ended.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = ended.ReadMessage()
+	if !websocket.IsCloseError(err, closeSessionEnded) {
+		t.Errorf("Expected close code %d, got %v", closeSessionEnded, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if !hub.IsOnline(4) {
+		t.Error("The other session should stay connected")
+	}
+}
+
+func TestClient_Reauth(t *testing.T) {
+	client := &Client{UserID: 5, SessionID: "s1", send: make(chan *Message, 10)}
+
+	validate := func(token string) (*jwt.Claims, error) {
+		claims := &jwt.Claims{UserID: 5}
+		claims.ID = token
+		claims.ExpiresAt = gojwt.NewNumericDate(time.Now().Add(time.Hour))
+		return claims, nil
+	}
+	client.EnableReauth(time.Now().Add(-time.Second), validate)
+
+	if !client.expired() {
+		t.Fatal("Client should be expired")
+	}
+
+	// A token for another session is refused
+	client.reauth("s2")
+	if reply := <-client.send; reply.Type != "auth_failed" {
+		t.Errorf("Expected auth_failed, got %s", reply.Type)
+	}
+	if !client.expired() {
+		t.Error("Failed re-authentication should not extend the connection")
+	}
+
+	client.reauth("s1")
+	if reply := <-client.send; reply.Type != "auth_ok" {
+		t.Errorf("Expected auth_ok, got %s", reply.Type)
+	}
+	if client.expired() {
+		t.Error("Re-authentication should extend the connection")
+	}
+}
+
+func TestHub_Hooks(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	var mu sync.Mutex
+	var observed int
+	var delivered []int64
+	hub.OnBroadcast(func(msg *Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		observed++
+	})
+	hub.OnDeliver(func(userID int64, msg *Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, userID)
+	})
+
+	// Recipients see the hook whether or not they are connected
+	hub.Broadcast(&Message{Type: "message", SenderID: 1, GroupID: 100, GroupMembers: []int64{1, 2, 3}})
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if observed != 1 {
+		t.Errorf("Expected the broadcast to be observed once, got %d", observed)
+	}
+	if len(delivered) != 2 || delivered[0] != 2 || delivered[1] != 3 {
+		t.Errorf("Expected deliveries to 2 and 3, got %v", delivered)
+	}
 }
@@ -5,9 +5,10 @@ import "time"
 type MessageType int
 
 const (
-	MsgTypeText  MessageType = 1
-	MsgTypeImage MessageType = 2
-	MsgTypeFile  MessageType = 3
+	MsgTypeText   MessageType = 1
+	MsgTypeImage  MessageType = 2
+	MsgTypeFile   MessageType = 3
+	MsgTypeSystem MessageType = 4
 )
 
 type Message struct {
@@ -26,3 +27,10 @@ type Message struct {
 	CreatedAt    time.Time   `json:"created_at"`
 	GroupMembers []int64     `json:"-"` // Internal use for broadcasting
 }
+
+// ClientMessage is sent by clients over the socket, "auth" carries a fresh
+// access token to keep the connection open past the expiry of the old one
+type ClientMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token,omitempty"`
+}
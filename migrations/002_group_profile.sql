@@ -0,0 +1,16 @@
+-- Group profile and announcements
+
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS description VARCHAR(500);
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS announcement TEXT;
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT NOW();
+
+-- Announcement history
+CREATE TABLE IF NOT EXISTS group_announcements (
+    id BIGSERIAL PRIMARY KEY,
+    group_id BIGINT NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    author_id BIGINT NOT NULL REFERENCES users(id),
+    content TEXT,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_announcements_group ON group_announcements(group_id);
@@ -0,0 +1,3 @@
+-- Group specific member nicknames
+
+ALTER TABLE group_members ADD COLUMN IF NOT EXISTS nickname VARCHAR(100);
@@ -0,0 +1,31 @@
+-- Public group directory and join policies
+
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS is_public BOOLEAN DEFAULT FALSE;
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS join_policy SMALLINT DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_groups_is_public ON groups(is_public);
+
+-- Group tags
+CREATE TABLE IF NOT EXISTS group_tags (
+    id BIGSERIAL PRIMARY KEY,
+    group_id BIGINT NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    tag VARCHAR(30) NOT NULL,
+    UNIQUE(group_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_tags_tag ON group_tags(tag);
+
+-- Join requests for groups that require approval
+CREATE TABLE IF NOT EXISTS group_join_requests (
+    id BIGSERIAL PRIMARY KEY,
+    group_id BIGINT NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    message VARCHAR(255),
+    status SMALLINT DEFAULT 0,
+    reviewer_id BIGINT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_join_requests_group ON group_join_requests(group_id);
+CREATE INDEX IF NOT EXISTS idx_group_join_requests_user ON group_join_requests(user_id);
@@ -0,0 +1,19 @@
+-- One canonical friends row per pair of users
+
+ALTER TABLE friends ADD COLUMN IF NOT EXISTS pair_key VARCHAR(50);
+
+UPDATE friends SET pair_key = LEAST(user_id, friend_id) || ':' || GREATEST(user_id, friend_id);
+
+-- Keep the accepted row if any, then pending, then the most recent one
+DELETE FROM friends WHERE id IN (
+    SELECT id FROM (
+        SELECT id, ROW_NUMBER() OVER (
+            PARTITION BY pair_key
+            ORDER BY CASE status WHEN 1 THEN 0 WHEN 0 THEN 1 ELSE 2 END, updated_at DESC, id DESC
+        ) AS rn
+        FROM friends
+    ) ranked
+    WHERE rn > 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_friends_pair_key ON friends(pair_key);
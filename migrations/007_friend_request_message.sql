@@ -0,0 +1,3 @@
+-- Greeting sent with a friend request
+
+ALTER TABLE friends ADD COLUMN IF NOT EXISTS message VARCHAR(255);
@@ -0,0 +1,20 @@
+-- Private remarks and tags on friends
+
+CREATE TABLE IF NOT EXISTS friend_remarks (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    friend_id BIGINT NOT NULL REFERENCES users(id),
+    remark VARCHAR(100) NOT NULL,
+    updated_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE(user_id, friend_id)
+);
+
+CREATE TABLE IF NOT EXISTS friend_tags (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    friend_id BIGINT NOT NULL REFERENCES users(id),
+    tag VARCHAR(30) NOT NULL,
+    UNIQUE(user_id, friend_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS idx_friend_tag_user ON friend_tags(user_id, tag);
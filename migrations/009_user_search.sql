@@ -0,0 +1,6 @@
+-- User directory search
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS discoverable BOOLEAN DEFAULT TRUE;
+
+CREATE INDEX IF NOT EXISTS idx_users_username_lower ON users(LOWER(username) varchar_pattern_ops);
+CREATE INDEX IF NOT EXISTS idx_users_nickname_lower ON users(LOWER(nickname) varchar_pattern_ops);
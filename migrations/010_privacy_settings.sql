@@ -0,0 +1,7 @@
+-- Privacy settings and last seen time
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS friend_request_policy SMALLINT DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_visibility SMALLINT DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_visibility SMALLINT DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS allow_stranger_chat BOOLEAN DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP;
@@ -0,0 +1,12 @@
+-- Accounts linked to external identity providers (OIDC single sign-on)
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    provider VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_identity_subject ON user_identities(provider, subject);
@@ -0,0 +1,31 @@
+-- Bot accounts and their API tokens
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS bots (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id),
+    owner_id BIGINT NOT NULL REFERENCES users(id),
+    description VARCHAR(255),
+    webhook_url VARCHAR(500),
+    webhook_secret VARCHAR(64),
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_bots_owner_id ON bots(owner_id);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    name VARCHAR(100),
+    token_hash VARCHAR(64) NOT NULL,
+    prefix VARCHAR(16),
+    scopes VARCHAR(255),
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_tokens_token_hash ON api_tokens(token_hash);
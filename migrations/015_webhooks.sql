@@ -0,0 +1,36 @@
+-- Outgoing webhooks and their delivery log
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id BIGSERIAL PRIMARY KEY,
+    owner_id BIGINT NOT NULL REFERENCES users(id),
+    scope VARCHAR(10) NOT NULL,
+    group_id BIGINT REFERENCES groups(id),
+    url VARCHAR(500) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    events VARCHAR(255),
+    active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhooks_owner_id ON webhooks(owner_id);
+CREATE INDEX IF NOT EXISTS idx_webhooks_group_id ON webhooks(group_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id BIGINT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event VARCHAR(50) NOT NULL,
+    payload TEXT,
+    status SMALLINT DEFAULT 0,
+    attempts INT DEFAULT 0,
+    response_code INT DEFAULT 0,
+    error VARCHAR(255),
+    next_attempt_at TIMESTAMP,
+    delivered_at TIMESTAMP,
+    replay_of BIGINT,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_created_at ON webhook_deliveries(created_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_delivery_due ON webhook_deliveries(status, next_attempt_at);
@@ -0,0 +1,16 @@
+-- Incoming webhooks that post into a group as a bot
+
+CREATE TABLE IF NOT EXISTS incoming_webhooks (
+    id BIGSERIAL PRIMARY KEY,
+    group_id BIGINT NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    creator_id BIGINT NOT NULL REFERENCES users(id),
+    bot_id BIGINT NOT NULL REFERENCES users(id),
+    name VARCHAR(100),
+    token_hash VARCHAR(64) NOT NULL,
+    prefix VARCHAR(16),
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_incoming_webhooks_group_id ON incoming_webhooks(group_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_incoming_webhooks_token_hash ON incoming_webhooks(token_hash);
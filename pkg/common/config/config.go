@@ -31,8 +31,101 @@ type LoggerConfig struct {
 }
 
 type JWTConfiguration struct {
-	Secret string
-	Expire int64 // seconds
+	Secret        string
+	Expire        int64  // seconds, lifetime of access tokens
+	RefreshExpire int64  // seconds, lifetime of refresh tokens
+	SigningKey    string // kid of the key in Keys used for signing, empty signs HS256 with Secret
+	Issuer        string // iss of issued tokens, defaults to simple_im
+	Keys          []JWTKeyConfiguration
+}
+
+// JWTKeyConfiguration is an RS256 or EdDSA key, retired keys keep only the
+// public key so their tokens verify until they expire
+type JWTKeyConfiguration struct {
+	ID             string // kid
+	Algorithm      string // RS256 or EdDSA
+	PrivateKeyFile string // PEM, required for the signing key
+	PublicKeyFile  string // PEM, derived from the private key when empty
+}
+
+type GroupConfiguration struct {
+	MaxMembers int // 0 means the built-in default
+}
+
+type FriendConfiguration struct {
+	RequestCooldown int64 // seconds before a rejected or cancelled request can be sent again, 0 disables it
+}
+
+// BotConfiguration limits bot accounts and their webhooks
+type BotConfiguration struct {
+	MaxPerOwner    int   // bots a user may own, 0 means the built-in default
+	WebhookTimeout int64 // seconds to wait for a webhook response, 0 means 10
+}
+
+// WebhookConfiguration controls outgoing webhooks, 0 means the built-in default
+type WebhookConfiguration struct {
+	MaxPerOwner int   // webhooks a user may create
+	MaxAttempts int   // deliveries are given up after this many failed attempts
+	RetryBase   int64 // seconds before the first retry, doubled for every further one
+	Timeout     int64 // seconds to wait for a response
+
+	// Lets outgoing and bot webhooks reach loopback, private and link-local
+	// addresses, only for servers whose users are all trusted
+	AllowPrivateNetworks bool
+}
+
+// RateLimitConfiguration throttles the unauthenticated user methods, 0 means the built-in default
+type RateLimitConfiguration struct {
+	LoginPerIP       int64 // login attempts per IP and minute
+	LoginPerUsername int64 // login attempts per username and minute
+	RegisterPerIP    int64 // registrations per IP and hour
+	LockoutThreshold int64 // failed logins before the account is locked
+	LockoutBase      int64 // seconds of the first lockout, doubled for every further failure
+	LockoutMax       int64 // seconds
+}
+
+type TwoFactorConfiguration struct {
+	Issuer string // shown by authenticator apps, defaults to simple_im
+}
+
+// OIDCConfiguration enables single sign-on with an OpenID Connect provider,
+// an empty Issuer disables it
+type OIDCConfiguration struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string   // client page that receives code and state and calls user.login_oidc
+	Scopes        []string // defaults to openid, profile and email
+	UsernameClaim string   // claim holding the username of new accounts, defaults to preferred_username
+	NicknameClaim string   // defaults to name
+	// Link a local account with the same username on its first SSO login
+	// instead of refusing it. Only for providers where users can't choose the
+	// username claim, admin and moderator accounts are never linked.
+	LinkExisting bool
+}
+
+// LDAPConfiguration lets user.login check passwords against a directory,
+// an empty URL disables it. Local passwords keep working next to it.
+type LDAPConfiguration struct {
+	URL                string // ldap:// or ldaps://
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string // service account used for searches, empty binds anonymously
+	BindPassword       string
+	BaseDN             string   // where users are searched
+	UserFilter         string   // %s is the escaped login name, defaults to (uid=%s)
+	UsernameAttribute  string   // username of provisioned accounts, defaults to uid
+	NicknameAttribute  string   // defaults to displayName, falling back to cn
+	RequiredGroups     []string // group DNs, users must be in one of them, empty allows everyone
+	GroupFilter        string   // matches a member in a group entry, %[1]s is the user DN and %[2]s the username, defaults to (|(member=%[1]s)(uniqueMember=%[1]s)(memberUid=%[2]s))
+	LinkExisting       bool     // link a local account with the same username on its first LDAP login instead of refusing it, never admins or moderators
+	Timeout            int64    // seconds, 0 means 10
+}
+
+// ExportConfiguration controls user.export_data archives
+type ExportConfiguration struct {
+	SavePath string // directory of the archives, must not be served under /files
+	Expire   int64  // seconds an archive stays downloadable, 0 means one day
 }
 
 type UploadConfiguration struct {
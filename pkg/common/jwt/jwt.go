@@ -2,16 +2,24 @@ package jwt
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"time"
 
+	"simple_im/pkg/common/config"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
 var (
 	ErrTokenExpired = errors.New("token has expired")
 	ErrTokenInvalid = errors.New("token is invalid")
+	ErrTokenRevoked = errors.New("token has been revoked")
 )
 
+// DefaultIssuer is the iss of issued tokens when none is configured
+const DefaultIssuer = "simple_im"
+
 type Claims struct {
 	UserID   int64  `json:"user_id"`
 	Username string `json:"username"`
@@ -19,37 +27,152 @@ type Claims struct {
 }
 
 type JWTManager struct {
-	secret []byte
-	expire time.Duration
+	keys          map[string]*Key
+	signing       *Key
+	issuer        string
+	expire        time.Duration
+	refreshExpire time.Duration
+}
+
+// NewJWTManager creates a manager signing HS256 with the shared secret,
+// refreshExpireSeconds is how long a session can be kept alive with refresh
+// tokens and never shorter than the access token
+func NewJWTManager(secret string, expireSeconds, refreshExpireSeconds int64) *JWTManager {
+	if refreshExpireSeconds < expireSeconds {
+		refreshExpireSeconds = expireSeconds
+	}
+	m := &JWTManager{
+		keys:          make(map[string]*Key),
+		issuer:        DefaultIssuer,
+		expire:        time.Duration(expireSeconds) * time.Second,
+		refreshExpire: time.Duration(refreshExpireSeconds) * time.Second,
+	}
+	if secret != "" {
+		m.signing = NewHMACKey("", []byte(secret))
+		m.keys[""] = m.signing
+	}
+	return m
+}
+
+// NewJWTManagerFromConfig loads the configured keys. Without a SigningKey
+// tokens are signed HS256 with Secret, with one Secret is no longer accepted.
+func NewJWTManagerFromConfig(c config.JWTConfiguration) (*JWTManager, error) {
+	m := NewJWTManager(c.Secret, c.Expire, c.RefreshExpire)
+	if c.Issuer != "" {
+		m.issuer = c.Issuer
+	}
+
+	keys := make([]*Key, 0, len(c.Keys))
+	for _, kc := range c.Keys {
+		key, err := LoadKey(kc.ID, kc.Algorithm, kc.PrivateKeyFile, kc.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err := m.SetKeys(c.SigningKey, keys...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetKeys adds verification keys and switches signing to signingKeyID, an
+// empty id keeps the current signing key. Once a key from the ring signs,
+// HS256 tokens of the shared secret are rejected, sessions carry on through
+// their refresh tokens.
+func (m *JWTManager) SetKeys(signingKeyID string, keys ...*Key) error {
+	for _, key := range keys {
+		if key.ID == "" {
+			return errors.New("key id is required")
+		}
+		if _, ok := m.keys[key.ID]; ok {
+			return fmt.Errorf("duplicate key id %s", key.ID)
+		}
+		m.keys[key.ID] = key
+	}
+
+	if signingKeyID != "" {
+		key, ok := m.keys[signingKeyID]
+		if !ok {
+			return fmt.Errorf("signing key %s not found", signingKeyID)
+		}
+		if key.signKey == nil {
+			return fmt.Errorf("signing key %s has no private key", signingKeyID)
+		}
+		m.signing = key
+		delete(m.keys, "")
+	}
+
+	if m.signing == nil {
+		return errors.New("no signing key configured")
+	}
+	return nil
 }
 
-func NewJWTManager(secret string, expireSeconds int64) *JWTManager {
-	return &JWTManager{
-		secret: []byte(secret),
-		expire: time.Duration(expireSeconds) * time.Second,
+// JWKS returns the public keys other services use to verify tokens
+func (m *JWTManager) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range m.keys {
+		if jwk, ok := key.jwk(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
 	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
 }
 
-func (m *JWTManager) GenerateToken(userID int64, username string) (string, error) {
+// Expire returns how long issued access tokens stay valid
+func (m *JWTManager) Expire() time.Duration {
+	return m.expire
+}
+
+// RefreshExpire returns how long a refresh token stays valid
+func (m *JWTManager) RefreshExpire() time.Duration {
+	return m.refreshExpire
+}
+
+// GenerateToken issues a token for the session, sessionID is stored as jti
+func (m *JWTManager) GenerateToken(userID int64, username, sessionID string) (string, error) {
+	if m.signing == nil {
+		return "", errors.New("no signing key configured")
+	}
+
 	now := time.Now()
 	claims := Claims{
 		UserID:   userID,
 		Username: username,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
+			Issuer:    m.issuer,
 			ExpiresAt: jwt.NewNumericDate(now.Add(m.expire)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(m.secret)
+	token := jwt.NewWithClaims(m.signing.Method, claims)
+	if m.signing.ID != "" {
+		token.Header["kid"] = m.signing.ID
+	}
+	return token.SignedString(m.signing.signKey)
 }
 
+// ParseToken verifies the token with the key named by its kid header, the
+// alg header has to match that key so a public key can't be used as an HMAC
+// secret, and iss has to be ours
 func (m *JWTManager) ParseToken(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return m.secret, nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		key, ok := m.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return key.verifyKey, nil
+	}, jwt.WithIssuer(m.issuer))
 
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
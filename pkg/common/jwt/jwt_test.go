@@ -1,18 +1,27 @@
 package jwt
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"testing"
 	"time"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
 )
 
 func TestJWTManager_GenerateAndParseToken(t *testing.T) {
-	manager := NewJWTManager("test_secret_key", 3600)
+	manager := NewJWTManager("test_secret_key", 3600, 3600)
 
 	userID := int64(123)
 	username := "testuser"
 
 	// Generate token
-	token, err := manager.GenerateToken(userID, username)
+	token, err := manager.GenerateToken(userID, username, "session1")
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -34,13 +43,17 @@ func TestJWTManager_GenerateAndParseToken(t *testing.T) {
 	if claims.Username != username {
 		t.Errorf("Username mismatch: expected %s, got %s", username, claims.Username)
 	}
+
+	if claims.ID != "session1" {
+		t.Errorf("Session ID mismatch: expected session1, got %s", claims.ID)
+	}
 }
 
 func TestJWTManager_ExpiredToken(t *testing.T) {
 	// Create manager with 1 second expiry
-	manager := NewJWTManager("test_secret_key", 1)
+	manager := NewJWTManager("test_secret_key", 1, 1)
 
-	token, err := manager.GenerateToken(1, "testuser")
+	token, err := manager.GenerateToken(1, "testuser", "session1")
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -59,7 +72,7 @@ func TestJWTManager_ExpiredToken(t *testing.T) {
 }
 
 func TestJWTManager_InvalidToken(t *testing.T) {
-	manager := NewJWTManager("test_secret_key", 3600)
+	manager := NewJWTManager("test_secret_key", 3600, 3600)
 
 	// Test with invalid token
 	_, err := manager.ParseToken("invalid.token.here")
@@ -73,13 +86,187 @@ func TestJWTManager_InvalidToken(t *testing.T) {
 }
 
 func TestJWTManager_WrongSecret(t *testing.T) {
-	manager1 := NewJWTManager("secret1", 3600)
-	manager2 := NewJWTManager("secret2", 3600)
+	manager1 := NewJWTManager("secret1", 3600, 3600)
+	manager2 := NewJWTManager("secret2", 3600, 3600)
 
-	token, _ := manager1.GenerateToken(1, "user")
+	token, _ := manager1.GenerateToken(1, "user", "session1")
 
 	_, err := manager2.ParseToken(token)
 	if err == nil {
 		t.Fatal("Expected error when parsing with wrong secret")
 	}
 }
+
+func encodePrivateKey(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func encodePublicKey(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestJWTManager_AsymmetricKeys(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	rsaPEM := encodePrivateKey(t, rsaKey)
+	edPEM := encodePrivateKey(t, edKey)
+
+	for _, tt := range []struct {
+		alg string
+		pem []byte
+	}{
+		{"RS256", rsaPEM},
+		{"EdDSA", edPEM},
+	} {
+		t.Run(tt.alg, func(t *testing.T) {
+			key, err := ParseKey("k1", tt.alg, tt.pem, nil)
+			if err != nil {
+				t.Fatalf("Failed to parse key: %v", err)
+			}
+
+			manager := NewJWTManager("", 3600, 3600)
+			if err := manager.SetKeys("k1", key); err != nil {
+				t.Fatalf("Failed to set keys: %v", err)
+			}
+
+			token, err := manager.GenerateToken(1, "user", "session1")
+			if err != nil {
+				t.Fatalf("Failed to generate token: %v", err)
+			}
+
+			parsed, _ := gojwt.Parse(token, nil)
+			if parsed.Header["kid"] != "k1" || parsed.Header["alg"] != tt.alg {
+				t.Errorf("Unexpected header: %v", parsed.Header)
+			}
+
+			claims, err := manager.ParseToken(token)
+			if err != nil {
+				t.Fatalf("Failed to parse token: %v", err)
+			}
+			if claims.UserID != 1 {
+				t.Errorf("Expected user 1, got %d", claims.UserID)
+			}
+		})
+	}
+}
+
+func TestJWTManager_KeyRotation(t *testing.T) {
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	before := NewJWTManager("", 3600, 3600)
+	k1, _ := ParseKey("k1", "EdDSA", encodePrivateKey(t, oldKey), nil)
+	before.SetKeys("k1", k1)
+	oldToken, _ := before.GenerateToken(1, "user", "session1")
+
+	// After rotation k1 is only kept for verification
+	after := NewJWTManager("", 3600, 3600)
+	k1Public, err := ParseKey("k1", "EdDSA", nil, encodePublicKey(t, oldKey.Public()))
+	if err != nil {
+		t.Fatalf("Failed to parse public key: %v", err)
+	}
+	k2, _ := ParseKey("k2", "EdDSA", encodePrivateKey(t, newKey), nil)
+	if err := after.SetKeys("k2", k1Public, k2); err != nil {
+		t.Fatalf("Failed to set keys: %v", err)
+	}
+
+	if _, err := after.ParseToken(oldToken); err != nil {
+		t.Errorf("Tokens of the retired key should still verify: %v", err)
+	}
+
+	newToken, _ := after.GenerateToken(1, "user", "session1")
+	if _, err := before.ParseToken(newToken); err == nil {
+		t.Error("Tokens of an unknown kid should be rejected")
+	}
+
+	// Switching from the shared secret to the key ring retires HS256
+	shared := NewJWTManager("secret", 3600, 3600)
+	hsToken, _ := shared.GenerateToken(1, "user", "session1")
+	if _, err := shared.ParseToken(hsToken); err != nil {
+		t.Fatalf("Failed to parse HS256 token: %v", err)
+	}
+	if err := shared.SetKeys("k2", k2); err != nil {
+		t.Fatalf("Failed to set keys: %v", err)
+	}
+	if _, err := shared.ParseToken(hsToken); err == nil {
+		t.Error("HS256 tokens should be rejected once the key ring signs")
+	}
+
+	if err := NewJWTManager("", 3600, 3600).SetKeys("k1", k1Public); err == nil {
+		t.Error("A verification-only key can't be the signing key")
+	}
+
+	jwks := after.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != "k1" || jwks.Keys[1].Kid != "k2" {
+		t.Fatalf("Unexpected JWKS: %+v", jwks)
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	if jwks.Keys[0].Kty != "OKP" || jwks.Keys[0].Crv != "Ed25519" || !bytes.Equal(x, oldKey.Public().(ed25519.PublicKey)) {
+		t.Errorf("Unexpected JWK: %+v", jwks.Keys[0])
+	}
+}
+
+func TestJWTManager_RejectsAlgorithmMismatch(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	publicPEM := encodePublicKey(t, &rsaKey.PublicKey)
+	key, _ := ParseKey("k1", "RS256", encodePrivateKey(t, rsaKey), nil)
+
+	manager := NewJWTManager("secret", 3600, 3600)
+	manager.SetKeys("k1", key)
+
+	claims := Claims{UserID: 1, RegisteredClaims: gojwt.RegisteredClaims{
+		ExpiresAt: gojwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}
+
+	// HS256 signed with the public key, the classic key confusion attack
+	forged := gojwt.NewWithClaims(gojwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = "k1"
+	token, _ := forged.SignedString(publicPEM)
+	if _, err := manager.ParseToken(token); err == nil {
+		t.Error("HS256 token for an RS256 key should be rejected")
+	}
+
+	unsigned := gojwt.NewWithClaims(gojwt.SigningMethodNone, claims)
+	unsigned.Header["kid"] = "k1"
+	token, _ = unsigned.SignedString(gojwt.UnsafeAllowNoneSignatureType)
+	if _, err := manager.ParseToken(token); err == nil {
+		t.Error("Unsigned token should be rejected")
+	}
+
+	if len(manager.JWKS().Keys) != 1 {
+		t.Error("The shared secret must not be published")
+	}
+}
+
+func TestJWTManager_Issuer(t *testing.T) {
+	manager := NewJWTManager("secret", 3600, 3600)
+
+	token, _ := manager.GenerateToken(1, "user", "session1")
+	claims, err := manager.ParseToken(token)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	if claims.Issuer != DefaultIssuer {
+		t.Errorf("Expected iss %s, got %q", DefaultIssuer, claims.Issuer)
+	}
+
+	for _, iss := range []string{"", "other"} {
+		forged := gojwt.NewWithClaims(gojwt.SigningMethodHS256, Claims{UserID: 1, RegisteredClaims: gojwt.RegisteredClaims{
+			Issuer:    iss,
+			ExpiresAt: gojwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}})
+		token, _ := forged.SignedString([]byte("secret"))
+		if _, err := manager.ParseToken(token); err == nil {
+			t.Errorf("Token with iss %q should be rejected", iss)
+		}
+	}
+}
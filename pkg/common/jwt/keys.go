@@ -0,0 +1,139 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is one signing or verification key. Keys without a private part can
+// only verify, which is how retired keys stay usable until their tokens expire.
+type Key struct {
+	ID        string // kid header
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// NewHMACKey returns a shared secret key, it is never published in the JWKS
+func NewHMACKey(id string, secret []byte) *Key {
+	return &Key{ID: id, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+// ParseKey builds an RS256 or EdDSA key from PEM data. privatePEM may be nil
+// for verification-only keys, publicPEM may be nil when privatePEM is set.
+func ParseKey(id, algorithm string, privatePEM, publicPEM []byte) (*Key, error) {
+	if id == "" {
+		return nil, errors.New("key id is required")
+	}
+
+	key := &Key{ID: id}
+	switch algorithm {
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+		if len(privatePEM) > 0 {
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", id, err)
+			}
+			key.signKey = private
+			key.verifyKey = &private.PublicKey
+		}
+		if len(publicPEM) > 0 {
+			public, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", id, err)
+			}
+			key.verifyKey = public
+		}
+	case "EdDSA":
+		key.Method = jwt.SigningMethodEdDSA
+		if len(privatePEM) > 0 {
+			private, err := jwt.ParseEdPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", id, err)
+			}
+			key.signKey = private
+			key.verifyKey = private.(ed25519.PrivateKey).Public()
+		}
+		if len(publicPEM) > 0 {
+			public, err := jwt.ParseEdPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", id, err)
+			}
+			key.verifyKey = public
+		}
+	default:
+		return nil, fmt.Errorf("key %s: unsupported algorithm %q", id, algorithm)
+	}
+
+	if key.verifyKey == nil {
+		return nil, fmt.Errorf("key %s: a private or public key is required", id)
+	}
+	return key, nil
+}
+
+// LoadKey reads the PEM files of a key, either path may be empty
+func LoadKey(id, algorithm, privateKeyFile, publicKeyFile string) (*Key, error) {
+	var privatePEM, publicPEM []byte
+	var err error
+	if privateKeyFile != "" {
+		if privatePEM, err = os.ReadFile(privateKeyFile); err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+	}
+	if publicKeyFile != "" {
+		if publicPEM, err = os.ReadFile(publicKeyFile); err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+	}
+	return ParseKey(id, algorithm, privatePEM, publicPEM)
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // OKP curve
+	X   string `json:"x,omitempty"`   // OKP public key
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// jwk returns the public JWK of the key, false for shared secrets
+func (k *Key) jwk() (JWK, bool) {
+	b64 := base64.RawURLEncoding
+	switch public := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: k.ID,
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			N:   b64.EncodeToString(public.N.Bytes()),
+			E:   b64.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Kid: k.ID,
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			Crv: "Ed25519",
+			X:   b64.EncodeToString(public),
+		}, true
+	}
+	return JWK{}, false
+}
@@ -0,0 +1,324 @@
+// Package oidc is a minimal OpenID Connect relying party for the
+// authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"simple_im/pkg/common/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+
+	// keysRefreshInterval limits how often an unknown kid refetches the JWKS
+	keysRefreshInterval = time.Minute
+)
+
+var defaultScopes = []string{"openid", "profile", "email"}
+
+// Provider is the part of the discovery document the client needs
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Token is the response of the token endpoint
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Claims are the verified claims of an ID token
+type Claims map[string]interface{}
+
+// String returns a string claim, empty when it is missing or not a string
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+func (c Claims) Subject() string {
+	return c.String("sub")
+}
+
+// Client talks to one provider. Discovery and the signing keys are fetched
+// on first use, so the server starts even while the provider is down.
+type Client struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	httpClient   *http.Client
+
+	mu          sync.Mutex
+	provider    *Provider
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// NewClient returns nil when no issuer is configured
+func NewClient(c config.OIDCConfiguration) *Client {
+	if c.Issuer == "" {
+		return nil
+	}
+
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+	return &Client{
+		issuer:       strings.TrimSuffix(c.Issuer, "/"),
+		clientID:     c.ClientID,
+		clientSecret: c.ClientSecret,
+		redirectURL:  c.RedirectURL,
+		scopes:       scopes,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Issuer is the issuer identifier, identities are unique per issuer and subject
+func (c *Client) Issuer() string {
+	return c.issuer
+}
+
+// Discover fetches the discovery document once and caches it
+func (c *Client) Discover(ctx context.Context) (*Provider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.provider != nil {
+		return c.provider, nil
+	}
+
+	var provider Provider
+	if err := c.getJSON(ctx, c.issuer+discoveryPath, &provider); err != nil {
+		return nil, fmt.Errorf("discovery failed: %v", err)
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != c.issuer {
+		return nil, fmt.Errorf("discovery failed: issuer %q does not match %q", provider.Issuer, c.issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovery failed: incomplete provider metadata")
+	}
+
+	c.provider = &provider
+	return c.provider, nil
+}
+
+// AuthCodeURL returns the provider page the user has to visit. state and
+// nonce are checked again on the way back, challenge is the PKCE S256
+// challenge of the verifier passed to Exchange.
+func (c *Client) AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	provider, err := c.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.clientID},
+		"redirect_uri":          {c.redirectURL},
+		"scope":                 {strings.Join(c.scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return provider.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens
+func (c *Client) Exchange(ctx context.Context, code, verifier string) (*Token, error) {
+	provider, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.redirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.Unmarshal(body, &e)
+		if e.Error == "" {
+			e.Error = res.Status
+		}
+		return nil, fmt.Errorf("token request failed: %s %s", e.Error, e.Description)
+	}
+
+	var token Token
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	return &token, nil
+}
+
+// VerifyIDToken checks signature, issuer, audience, expiry and nonce of an
+// ID token and returns its claims
+func (c *Client) VerifyIDToken(ctx context.Context, raw, nonce string) (Claims, error) {
+	provider, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.verificationKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(c.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %v", err)
+	}
+
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, errors.New("invalid id_token: nonce mismatch")
+	}
+	// With several audiences the token must have been issued to us
+	if azp, ok := claims["azp"].(string); ok && azp != c.clientID {
+		return nil, errors.New("invalid id_token: azp mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("invalid id_token: missing sub")
+	}
+
+	return Claims(claims), nil
+}
+
+// verificationKey looks the kid up in the cached JWKS, an unknown kid
+// refetches it since the provider may have rotated its keys
+func (c *Client) verificationKey(ctx context.Context, kid string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(c.keysFetched) < keysRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set JWKSet
+	if err := c.getJSON(ctx, c.provider.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %v", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if public, err := k.PublicKey(); err == nil {
+			keys[k.Kid] = public
+		}
+	}
+	c.keys = keys
+	c.keysFetched = time.Now()
+
+	if key, ok := c.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey accepts a missing kid only while the provider publishes a single key
+func (c *Client) lookupKey(kid string) (interface{}, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+func (c *Client) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// RandomString returns a URL safe random value for state, nonce and the PKCE verifier
+func RandomString() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// CodeChallenge is the S256 PKCE challenge of verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
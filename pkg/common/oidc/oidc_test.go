@@ -0,0 +1,144 @@
+package oidc_test
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"simple_im/pkg/common/config"
+	"simple_im/pkg/common/oidc"
+	"simple_im/pkg/common/oidc/oidctest"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestClient(t *testing.T) (*oidctest.Provider, *oidc.Client) {
+	provider := oidctest.NewProvider("simple_im", "secret")
+	t.Cleanup(provider.Close)
+
+	client := oidc.NewClient(config.OIDCConfiguration{
+		Issuer:       provider.URL,
+		ClientID:     "simple_im",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:3000/callback",
+	})
+	return provider, client
+}
+
+func TestNewClient_Disabled(t *testing.T) {
+	if oidc.NewClient(config.OIDCConfiguration{}) != nil {
+		t.Error("Expected no client without issuer")
+	}
+}
+
+func TestClient_AuthorizationCodeFlow(t *testing.T) {
+	provider, client := newTestClient(t)
+	provider.SetUser(map[string]interface{}{"sub": "u-1", "preferred_username": "alice"})
+	ctx := context.Background()
+
+	verifier, _ := oidc.RandomString()
+	authURL, err := client.AuthCodeURL(ctx, "state-1", "nonce-1", oidc.CodeChallenge(verifier))
+	if err != nil {
+		t.Fatalf("AuthCodeURL failed: %v", err)
+	}
+
+	parsed, _ := url.Parse(authURL)
+	if parsed.Query().Get("scope") != "openid profile email" || parsed.Query().Get("code_challenge_method") != "S256" {
+		t.Errorf("Unexpected authorization URL: %s", authURL)
+	}
+
+	code, state, err := provider.Authorize(authURL)
+	if err != nil || state != "state-1" {
+		t.Fatalf("Authorize failed: %v, state %q", err, state)
+	}
+
+	if _, err := client.Exchange(ctx, code, "wrong-verifier"); err == nil {
+		t.Error("Expected exchange with wrong verifier to fail")
+	}
+
+	code, _, _ = provider.Authorize(authURL)
+	token, err := client.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+
+	if _, err := client.VerifyIDToken(ctx, token.IDToken, "other-nonce"); err == nil {
+		t.Error("Expected nonce mismatch")
+	}
+
+	claims, err := client.VerifyIDToken(ctx, token.IDToken, "nonce-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken failed: %v", err)
+	}
+	if claims.Subject() != "u-1" || claims.String("preferred_username") != "alice" {
+		t.Errorf("Unexpected claims: %v", claims)
+	}
+}
+
+func TestClient_VerifyIDToken_Rejects(t *testing.T) {
+	provider, client := newTestClient(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   provider.URL,
+			"aud":   "simple_im",
+			"sub":   "u-1",
+			"nonce": "n",
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Minute).Unix(),
+		}
+	}
+	if _, err := client.VerifyIDToken(ctx, provider.SignIDToken(valid()), "n"); err != nil {
+		t.Fatalf("Valid token rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(jwt.MapClaims)
+	}{
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }},
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "other-app" }},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Hour).Unix() }},
+		{"no expiry", func(c jwt.MapClaims) { delete(c, "exp") }},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }},
+		{"other authorized party", func(c jwt.MapClaims) { c["azp"] = "other-app" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			tt.modify(claims)
+			if _, err := client.VerifyIDToken(ctx, provider.SignIDToken(claims), "n"); err == nil {
+				t.Error("Expected token to be rejected")
+			}
+		})
+	}
+
+	// Tokens signed by someone else
+	forged := oidctest.NewProvider("simple_im", "secret")
+	defer forged.Close()
+	claims := valid()
+	if _, err := client.VerifyIDToken(ctx, forged.SignIDToken(claims), "n"); err == nil {
+		t.Error("Expected token with foreign signature to be rejected")
+	}
+
+	// HS256 with the public key as secret is the classic algorithm confusion
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, valid())
+	raw, _ := hs.SignedString([]byte("secret"))
+	if _, err := client.VerifyIDToken(ctx, raw, "n"); err == nil || !strings.Contains(err.Error(), "invalid id_token") {
+		t.Errorf("Expected HS256 token to be rejected, got %v", err)
+	}
+}
+
+func TestClient_DiscoveryIssuerMismatch(t *testing.T) {
+	provider := oidctest.NewProvider("simple_im", "secret")
+	defer provider.Close()
+
+	client := oidc.NewClient(config.OIDCConfiguration{Issuer: provider.URL + "/tenant", ClientID: "simple_im"})
+	if _, err := client.Discover(context.Background()); err == nil {
+		t.Error("Expected discovery to fail")
+	}
+}
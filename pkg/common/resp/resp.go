@@ -2,14 +2,18 @@ package resp
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
 const (
-	JsonRPCVersion = "2.0"
-	ErrorCode      = -32000
+	JsonRPCVersion       = "2.0"
+	ErrorCode            = -32000
+	RateLimitedCode      = -32001 // Too many requests, data.retry_after holds the seconds to wait
+	AccountLockedCode    = -32002 // Locked after failed logins, data.retry_after holds the seconds to wait
+	PermissionDeniedCode = -32003 // The caller's role lacks a permission the method requires
 )
 
 type RpcRequest struct {
@@ -32,6 +36,21 @@ type RpcError struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
+// Error is returned by methods that need a code other than ErrorCode
+type Error struct {
+	Code    int
+	Message string
+	Data    interface{}
+}
+
+func NewError(code int, message string, data interface{}) *Error {
+	return &Error{Code: code, Message: message, Data: data}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
 func SuccessReturn(ctx *gin.Context, id string, result interface{}) {
 	Return(ctx, http.StatusOK, id, result, nil)
 }
@@ -46,7 +65,14 @@ func Return(ctx *gin.Context, httpCode int, id string, result interface{}, err e
 		Id:      id,
 	}
 
-	if err != nil {
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		resp.Error = &RpcError{
+			Code:    rpcErr.Code,
+			Message: rpcErr.Message,
+			Data:    rpcErr.Data,
+		}
+	} else if err != nil {
 		resp.Error = &RpcError{
 			Code:    ErrorCode,
 			Message: err.Error(),
@@ -0,0 +1,66 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1 with the ASCII secret "12345678901234567890"
+func TestCodeAt_RFC6238(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		unix int64
+		want string // Last 6 digits of the 8 digit reference values
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := CodeAt(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("CodeAt failed: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("CodeAt(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret failed: %v", err)
+	}
+
+	now := time.Now()
+	previous, _ := CodeAt(secret, Step(now)-1)
+	old, _ := CodeAt(secret, Step(now)-3)
+
+	step, ok := Validate(secret, previous, now, 1)
+	if !ok || step != Step(now)-1 {
+		t.Errorf("Code of the previous step should be accepted with skew 1")
+	}
+
+	if _, ok := Validate(secret, old, now, 1); ok {
+		t.Error("Code outside the skew window should be rejected")
+	}
+
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Error("Short code should be rejected")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("simple_im", "alice", "ABCDEF")
+	if !strings.HasPrefix(uri, "otpauth://totp/simple_im:alice?") || !strings.Contains(uri, "secret=ABCDEF") {
+		t.Errorf("Unexpected URI: %s", uri)
+	}
+}